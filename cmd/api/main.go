@@ -1,15 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/harliandi/go-heif/internal/cache"
 	"github.com/harliandi/go-heif/internal/config"
 	"github.com/harliandi/go-heif/internal/converter"
 	"github.com/harliandi/go-heif/internal/handler"
+	"github.com/harliandi/go-heif/internal/logging"
 	"github.com/harliandi/go-heif/internal/middleware"
 	"github.com/harliandi/go-heif/internal/storage"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -18,8 +24,38 @@ import (
 func main() {
 	cfg := config.Load()
 
+	// Structured logs; the standard log package writes through them too
+	level, err := logging.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		fatal("invalid LOG_LEVEL", err)
+	}
+	logger, err := logging.New(os.Stderr, cfg.LogFormat, level)
+	if err != nil {
+		fatal("invalid LOG_FORMAT", err)
+	}
+	slog.SetDefault(logger)
+
+	// Select the JPEG encoder backend
+	converter.UseTurboJPEG = cfg.JPEGEncoder == converter.JPEGEncoderTurbo
+	if converter.UseTurboJPEG && converter.JPEGEncoder() != converter.JPEGEncoderTurbo {
+		slog.Warn("JPEG_ENCODER=turbo but libjpeg-turbo is not compiled in, using image/jpeg")
+	}
+
 	// Initialize global worker pool for conversion jobs
 	converter.InitGlobalWorkerPool(cfg.WorkerCount, cfg.TargetSizeKB)
+	pool := converter.GlobalWorkerPool()
+	for class, depth := range cfg.QueueDepth {
+		if depth > 0 {
+			pool.SetQueueLimit(converter.Priority(class), depth)
+		}
+	}
+	for tenant, weight := range cfg.TenantWeights {
+		pool.SetTenantWeight(tenant, weight)
+	}
+	pool.SetJobTimeout(time.Duration(cfg.JobTimeoutSec) * time.Second)
+	pool.SetMemoryBudget(int64(cfg.MemoryBudgetMB) << 20)
+	queueWait := time.Duration(cfg.QueueMaxWaitMs) * time.Millisecond
+	pool.SetMaxQueueWait(queueWait)
 
 	h := handler.New(cfg.TargetSizeKB, cfg.MaxUploadMB)
 
@@ -27,35 +63,187 @@ func main() {
 	if os.Getenv("SUPABASE_URL") != "" && os.Getenv("SUPABASE_KEY") != "" && os.Getenv("SUPABASE_BUCKET") != "" {
 		storageClient, err := storage.NewClient(storage.Config{})
 		if err != nil {
-			log.Printf("Failed to initialize storage client: %v", err)
+			slog.Error("failed to initialize storage client", "error", err)
 		} else {
 			uploader := storage.NewUploader(storageClient)
 			h.WithUploader(uploader)
-			log.Printf("Storage enabled: bucket=%s", os.Getenv("SUPABASE_BUCKET"))
+			slog.Info("storage enabled", "bucket", os.Getenv("SUPABASE_BUCKET"))
 		}
 	}
 
+	// Conversion result cache: memory first, then the optional directory
+	var cacheBackends []cache.Backend
+	var diskCache *cache.Disk
+	if cfg.CacheMemoryMB > 0 {
+		cacheBackends = append(cacheBackends, cache.NewMemory(int64(cfg.CacheMemoryMB)<<20))
+	}
+	if cfg.CacheDir != "" {
+		disk, err := cache.NewDisk(cfg.CacheDir, int64(cfg.CacheDiskMB)<<20)
+		if err != nil {
+			slog.Error("failed to open cache directory", "error", err)
+		} else {
+			diskCache = disk
+			cacheBackends = append(cacheBackends, disk)
+		}
+	}
+	if len(cacheBackends) > 0 {
+		h.WithCache(cache.New(cacheBackends...))
+		slog.Info("result cache enabled", "memory_mb", cfg.CacheMemoryMB, "dir", cfg.CacheDir, "disk_mb", cfg.CacheDiskMB)
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/convert", h.Convert)
 	mux.HandleFunc("/convert/store", h.ConvertAndStore)
+	mux.HandleFunc("/info", h.Info)
 	mux.HandleFunc("/health", h.Health)
+	mux.HandleFunc("/ready", h.Ready)
 	mux.Handle("/metrics", promhttp.Handler())
 
-	// Apply middlewares in order (outermost first):
-	// 1. Security headers (always applied)
-	// 2. Rate limiting (per IP)
-	// 3. Concurrency limit (global)
-	// 4. Recovery (catches panics)
-	// 5. Logger (logs requests)
-	handler := middleware.Security(
-		middleware.RateLimit(cfg.RateLimitPerSec, cfg.RateLimitBurst)(
-			middleware.ConcurrencyLimit(cfg.MaxConcurrent)(
-				middleware.Recovery(
-					middleware.Logger(mux),
-				),
-			),
+	// Share rate limits between replicas through Redis, falling back to
+	// per-process limits while it is unreachable
+	newLimiter := func(rate, burst int) middleware.Limiter {
+		local := middleware.NewRateLimiter(rate, burst)
+		if cfg.RedisURL == "" {
+			return local
+		}
+		rl, err := middleware.NewRedisLimiter(cfg.RedisURL, rate, burst, local)
+		if err != nil {
+			fatal("failed to configure Redis rate limiting", err)
+		}
+		return rl
+	}
+	if cfg.RedisURL != "" {
+		slog.Info("distributed rate limiting enabled")
+	}
+
+	// Ban clients that keep sending invalid requests, sharing bans between
+	// replicas through Redis if configured
+	public := []string{"/health", "/ready", "/metrics"}
+	var guard *middleware.AbuseGuard
+	if cfg.AbuseThreshold > 0 {
+		var store middleware.BanStore = middleware.NewMemoryBanStore()
+		if cfg.RedisURL != "" {
+			rs, err := middleware.NewRedisBanStore(cfg.RedisURL, store)
+			if err != nil {
+				fatal("failed to configure Redis ban store", err)
+			}
+			store = rs
+		}
+		guard = middleware.NewAbuseGuard(store, cfg.AbuseThreshold,
+			time.Duration(cfg.AbuseWindowSec)*time.Second,
+			time.Duration(cfg.AbuseBanSec)*time.Second)
+		if cfg.AdminToken != "" {
+			// The admin token stands in for API keys
+			mux.Handle("/admin/bans", middleware.AdminAuth(cfg.AdminToken)(middleware.BanAdmin(guard)))
+			public = append(public, "/admin/bans")
+		}
+	}
+
+	// Per-route limits; probes and metrics are exempt by default
+	policies := middleware.DefaultRoutePolicies()
+	if cfg.RoutePoliciesFile != "" {
+		custom, err := middleware.LoadRoutePolicies(cfg.RoutePoliciesFile)
+		if err != nil {
+			fatal("failed to load route policies", err)
+		}
+		policies = append(policies, custom...)
+		slog.Info("route policies loaded", "routes", len(custom))
+	}
+	routes, err := middleware.NewRoutePolicies(policies, newLimiter)
+	if err != nil {
+		fatal("failed to load route policies", err)
+	}
+
+	// Shed expensive requests while the conversion queue stays backed up
+	var admitted http.Handler = routes.ConcurrencyLimit(middleware.NewConcurrencyLimiter(cfg.MaxConcurrent), queueWait)(
+		middleware.Recovery(
+			middleware.Logger(mux),
 		),
 	)
+	if cfg.AdmissionTargetMs > 0 {
+		ac := middleware.NewAdmissionController(pool.QueueDelay,
+			time.Duration(cfg.AdmissionTargetMs)*time.Millisecond,
+			time.Duration(cfg.AdmissionIntervalMs)*time.Millisecond)
+		admitted = middleware.AdaptiveAdmission(ac, nil)(admitted)
+	}
+
+	// Charge conversions by input size and decoded megapixels, per tenant
+	// for API keys whose tier sets a cost budget
+	if cfg.CostLimitRate > 0 {
+		cl := middleware.NewCostLimiter(middleware.TierBudget(middleware.CostBudget{
+			Rate:  cfg.CostLimitRate,
+			Burst: cfg.CostLimitBurst,
+		}))
+		admitted = middleware.CostLimit(cl)(admitted)
+	}
+
+	// Require API keys or JWTs for everything but probes and metrics
+	var auth middleware.Authenticator
+	if cfg.APIKeysFile != "" {
+		keys, err := middleware.LoadKeyStore(cfg.APIKeysFile)
+		if err != nil {
+			fatal("failed to load API keys", err)
+		}
+		slog.Info("API key authentication enabled", "keys", keys.Len())
+		auth.Keys = keys
+	}
+	if cfg.JWTJWKS != "" {
+		jwtCfg := middleware.JWTConfig{
+			Issuer:      cfg.JWTIssuer,
+			Audience:    cfg.JWTAudience,
+			TenantClaim: cfg.JWTTenantClaim,
+			TierClaim:   cfg.JWTTierClaim,
+			DefaultTier: cfg.JWTDefaultTier,
+			Leeway:      30 * time.Second,
+		}
+		if auth.Keys != nil {
+			jwtCfg.Tiers = auth.Keys.Tiers()
+		}
+		auth.JWT = middleware.NewJWTValidator(middleware.NewJWKS(cfg.JWTJWKS, 0), jwtCfg)
+		slog.Info("JWT authentication enabled", "jwks", cfg.JWTJWKS)
+	}
+	if auth.Keys != nil || auth.JWT != nil {
+		admitted = middleware.Auth(auth, public...)(admitted)
+	}
+
+	// Believe forwarding headers only from the configured proxies
+	proxies, err := middleware.ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		fatal("failed to parse TRUSTED_PROXIES", err)
+	}
+	if proxies.Len() > 0 {
+		slog.Info("trusting forwarding headers", "proxy_ranges", proxies.Len())
+	}
+	allow, err := middleware.ParseCIDRs(cfg.IPAllowlist)
+	if err != nil {
+		fatal("failed to parse IP_ALLOWLIST", err)
+	}
+	deny, err := middleware.ParseCIDRs(cfg.IPDenylist)
+	if err != nil {
+		fatal("failed to parse IP_DENYLIST", err)
+	}
+
+	// Apply middlewares in order (outermost first):
+	// 0. Request ID (X-Request-ID, carried in every log record of the request)
+	// 1. Client IP resolution through trusted proxies
+	// 2. Security headers (always applied)
+	// 3. IP allowlist and denylist (if set; probes pass)
+	// 4. Abuse bans (if enabled)
+	// 5. Rate limiting (per IP and route policy, shared through Redis if configured)
+	// 6. API key or JWT authentication and tier rate limits (if enabled)
+	// 7. Cost limit (if enabled; charged by the handlers)
+	// 8. Adaptive load shedding (if enabled)
+	// 9. Concurrency limit (global or per route policy)
+	// 10. Recovery (catches panics)
+	// 11. Logger (logs requests)
+	handler := routes.RateLimit(newLimiter(cfg.RateLimitPerSec, cfg.RateLimitBurst))(admitted)
+	if guard != nil {
+		handler = middleware.AbuseBan(guard)(handler)
+	}
+	if len(allow) > 0 || len(deny) > 0 {
+		handler = middleware.IPFilter(allow, deny, "/health", "/ready")(handler)
+	}
+	handler = middleware.RequestID(middleware.RealIP(proxies)(middleware.Security(handler)))
 
 	// Configure server with timeouts to prevent slowloris and hanging connections
 	server := &http.Server{
@@ -64,14 +252,66 @@ func main() {
 		ReadTimeout:  30 * time.Second,
 		WriteTimeout: 60 * time.Second,
 		IdleTimeout:  120 * time.Second,
+		ErrorLog:     slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
 	}
 
-	log.Printf("Starting HEIF to JPEG conversion API on %s", server.Addr)
-	log.Printf("Target size: %dKB, Max upload: %dMB, Max concurrent: %d, Rate limit: %d/sec, Workers: %d",
-		cfg.TargetSizeKB, cfg.MaxUploadMB, cfg.MaxConcurrent, cfg.RateLimitPerSec, cfg.WorkerCount)
+	slog.Info("starting HEIF to JPEG conversion API",
+		"addr", server.Addr,
+		"target_size_kb", cfg.TargetSizeKB,
+		"max_upload_mb", cfg.MaxUploadMB,
+		"max_concurrent", cfg.MaxConcurrent,
+		"rate_limit", cfg.RateLimitPerSec,
+		"workers", cfg.WorkerCount,
+		"jpeg_encoder", converter.JPEGEncoder(),
+	)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	if cfg.Autoscale {
+		go pool.Autoscale(ctx, converter.AutoscaleConfig{
+			Min:        cfg.WorkerMin,
+			Max:        cfg.WorkerMax,
+			TargetWait: time.Duration(cfg.AutoscaleWaitMs) * time.Millisecond,
+		})
+	}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
 
-	if err := server.ListenAndServe(); err != nil {
-		log.Printf("Server error: %v", err)
-		os.Exit(1)
+	select {
+	case err := <-serverErr:
+		fatal("server error", err)
+	case <-ctx.Done():
+		stop() // a second signal kills the process
 	}
+
+	// Fail readiness and keep serving until load balancers have noticed,
+	// then finish in-flight requests and queued jobs within the grace period
+	slog.Info("shutting down", "drain_delay_sec", cfg.DrainDelaySec, "grace_sec", cfg.ShutdownGraceSec)
+	h.SetDraining()
+	time.Sleep(time.Duration(cfg.DrainDelaySec) * time.Second)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownGraceSec)*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("HTTP shutdown", "error", err)
+	}
+	// Past the grace period this fails whatever is left, which unblocks
+	// the remaining handlers
+	if err := pool.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("worker pool shutdown", "error", err)
+	}
+	if err := server.Close(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Warn("HTTP close", "error", err)
+	}
+	if diskCache != nil {
+		diskCache.Close() // write the results still queued
+	}
+	slog.Info("server stopped")
+}
+
+// fatal logs err and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
@@ -0,0 +1,62 @@
+// Package cache stores conversion results keyed by a hash of the input file
+// and the settings it was converted with, so re-uploads of the same image
+// skip decoding and encoding.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/harliandi/go-heif/pkg/metrics"
+)
+
+// Backend stores cached results. Implementations must be safe for
+// concurrent use; values are shared and must not be modified.
+type Backend interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte)
+}
+
+// Key returns the cache key of converting data with the given settings.
+// params must be a normalized description of every setting that affects
+// the output.
+func Key(data []byte, params string) string {
+	h := sha256.New()
+	h.Write(data)
+	h.Write([]byte{0})
+	h.Write([]byte(params))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Cache looks results up in a chain of backends, fastest first
+type Cache struct {
+	backends []Backend
+}
+
+// New creates a cache over the given backends, fastest first
+func New(backends ...Backend) *Cache {
+	return &Cache{backends: backends}
+}
+
+// Get returns the cached result for key. A hit in a slower backend is
+// copied into the faster ones.
+func (c *Cache) Get(key string) ([]byte, bool) {
+	for i, b := range c.backends {
+		if value, ok := b.Get(key); ok {
+			for _, faster := range c.backends[:i] {
+				faster.Set(key, value)
+			}
+			metrics.RecordCacheLookup(true)
+			return value, true
+		}
+	}
+	metrics.RecordCacheLookup(false)
+	return nil, false
+}
+
+// Set stores a result in every backend
+func (c *Cache) Set(key string, value []byte) {
+	for _, b := range c.backends {
+		b.Set(key, value)
+	}
+}
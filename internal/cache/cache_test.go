@@ -0,0 +1,203 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKey(t *testing.T) {
+	a := Key([]byte("image"), "q=80")
+	if a != Key([]byte("image"), "q=80") {
+		t.Error("Key is not deterministic")
+	}
+	if len(a) != 64 {
+		t.Errorf("Key length %d, want 64 hex digits", len(a))
+	}
+	for _, other := range []string{
+		Key([]byte("image"), "q=81"),
+		Key([]byte("imag"), "q=80"),
+		Key([]byte("image\x00q"), "=80"), // separator keeps data and params apart
+	} {
+		if other == a {
+			t.Error("different inputs share a key")
+		}
+	}
+}
+
+func TestMemory_LRU(t *testing.T) {
+	// Room for two 10-byte values with 1-byte keys
+	m := NewMemory(22)
+	m.Set("a", make([]byte, 10))
+	m.Set("b", make([]byte, 10))
+	if _, ok := m.Get("a"); !ok { // a is now the most recent
+		t.Fatal("a missing")
+	}
+	m.Set("c", make([]byte, 10))
+	if _, ok := m.Get("b"); ok {
+		t.Error("least recently used entry b not evicted")
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, ok := m.Get(k); !ok {
+			t.Errorf("%s evicted", k)
+		}
+	}
+	if m.Len() != 2 || m.Size() != 22 {
+		t.Errorf("Len=%d Size=%d, want 2 and 22", m.Len(), m.Size())
+	}
+
+	// Replacing a value updates the size; oversized values are skipped
+	m.Set("a", make([]byte, 4))
+	if m.Size() != 16 {
+		t.Errorf("Size=%d after replace, want 16", m.Size())
+	}
+	m.Set("big", make([]byte, 100))
+	if _, ok := m.Get("big"); ok || m.Len() != 2 {
+		t.Error("value larger than the cache was stored")
+	}
+}
+
+func TestMemory_Concurrent(t *testing.T) {
+	m := NewMemory(1 << 10)
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 200 {
+				k := fmt.Sprint(g, i%20)
+				m.Set(k, make([]byte, 32))
+				m.Get(k)
+			}
+		}()
+	}
+	wg.Wait()
+	if m.Size() > 1<<10 {
+		t.Errorf("size %d over the limit", m.Size())
+	}
+}
+
+func TestDisk(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDisk(filepath.Join(dir, "cache"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	key := Key([]byte("image"), "")
+	if _, ok := d.Get(key); ok {
+		t.Fatal("unexpected hit")
+	}
+	d.Set(key, []byte("jpeg"))
+	d.Flush()
+
+	// A new instance on the same directory sees the result
+	d2, err := NewDisk(filepath.Join(dir, "cache"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d2.Close()
+	if v, ok := d2.Get(key); !ok || string(v) != "jpeg" {
+		t.Errorf("Get = %q, %v", v, ok)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cache", key[:2], key)); err != nil {
+		t.Errorf("result not sharded by key prefix: %v", err)
+	}
+
+	for _, bad := range []string{"", "ab", "../../etc", "a/b/c", ".hidden"} {
+		d.Set(bad, []byte("x"))
+		d.Flush()
+		if _, ok := d.Get(bad); ok {
+			t.Errorf("key %q accepted", bad)
+		}
+	}
+}
+
+func TestDisk_Eviction(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDisk(dir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b, c := Key([]byte("a"), ""), Key([]byte("b"), ""), Key([]byte("c"), "")
+	d.Set(a, []byte("aaaa"))
+	d.Set(b, []byte("bbbb"))
+	d.Flush()
+	d.Get(a) // b is now the least recently used
+	d.Set(c, []byte("cccc"))
+	d.Set(Key([]byte("big"), ""), make([]byte, 11))
+	d.Flush()
+
+	if _, ok := d.Get(b); ok {
+		t.Error("least recently used result not evicted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, b[:2], b)); !os.IsNotExist(err) {
+		t.Errorf("evicted file still on disk: %v", err)
+	}
+	for _, key := range []string{a, c} {
+		if _, ok := d.Get(key); !ok {
+			t.Errorf("recent result %s evicted", key[:8])
+		}
+	}
+	if d.Size() != 8 {
+		t.Errorf("size %d, want 8", d.Size())
+	}
+	d.Close()
+
+	// A restart indexes the existing files and applies a smaller limit,
+	// oldest first
+	time.Sleep(10 * time.Millisecond)
+	now := time.Now()
+	os.Chtimes(filepath.Join(dir, c[:2], c), now, now)
+	d2, err := NewDisk(dir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d2.Close()
+	if _, ok := d2.Get(a); ok {
+		t.Error("oldest file kept over the limit")
+	}
+	if _, ok := d2.Get(c); !ok || d2.Size() != 4 {
+		t.Errorf("newest file dropped, size %d", d2.Size())
+	}
+
+	// Set after Close is ignored
+	d.Set(a, []byte("aaaa"))
+}
+
+func TestCache_Tiers(t *testing.T) {
+	mem := NewMemory(1 << 20)
+	disk, err := NewDisk(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+	key := Key([]byte("image"), "")
+	disk.Set(key, []byte("webp"))
+	disk.Flush()
+
+	c := New(mem, disk)
+	if v, ok := c.Get(key); !ok || !bytes.Equal(v, []byte("webp")) {
+		t.Fatalf("Get = %q, %v", v, ok)
+	}
+	if _, ok := mem.Get(key); !ok {
+		t.Error("disk hit not promoted to memory")
+	}
+
+	other := Key([]byte("other"), "")
+	if _, ok := c.Get(other); ok {
+		t.Error("unexpected hit")
+	}
+	c.Set(other, []byte("jpeg"))
+	disk.Flush()
+	if _, ok := mem.Get(other); !ok {
+		t.Error("Set did not reach memory")
+	}
+	if _, ok := disk.Get(other); !ok {
+		t.Error("Set did not reach disk")
+	}
+}
@@ -0,0 +1,267 @@
+package cache
+
+import (
+	"container/list"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harliandi/go-heif/pkg/metrics"
+)
+
+// diskWriteQueue is the number of results waiting to be written; results
+// set while the queue is full are not cached on disk
+const diskWriteQueue = 64
+
+// Disk stores results as files in a directory, sharded by the first two
+// characters of the key. It survives restarts and can be shared by
+// processes on the same host. The files are bounded by size: the least
+// recently used ones are deleted first, ordered by modification time
+// across restarts. Each process only accounts for the files it has seen.
+//
+// Set returns immediately; files are written by a background goroutine,
+// so a result is visible to Get once its write completes.
+type Disk struct {
+	dir      string
+	maxBytes int64 // 0 for unbounded
+
+	mu     sync.Mutex
+	size   int64
+	order  *list.List // front is most recently used
+	items  map[string]*list.Element
+	closed bool
+
+	writes  chan diskEntry
+	pending sync.WaitGroup // queued writes
+	done    chan struct{}  // closed when the writer exits
+}
+
+type diskEntry struct {
+	key   string
+	value []byte
+	size  int64 // bytes on disk, used by the index
+}
+
+// NewDisk creates a disk cache in dir holding up to maxBytes, 0 for
+// unbounded, creating the directory if needed. Files already in dir are
+// indexed and count against the limit.
+func NewDisk(dir string, maxBytes int64) (*Disk, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	d := &Disk{
+		dir:      dir,
+		maxBytes: maxBytes,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+		writes:   make(chan diskEntry, diskWriteQueue),
+		done:     make(chan struct{}),
+	}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.evict()
+	d.mu.Unlock()
+	go d.writer()
+	return d, nil
+}
+
+// Get reads the value for key
+func (d *Disk) Get(key string) ([]byte, bool) {
+	path, ok := d.path(key)
+	if !ok {
+		return nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("cache read failed", "error", err)
+		}
+		d.mu.Lock()
+		if el, ok := d.items[key]; ok {
+			d.remove(el)
+		}
+		d.mu.Unlock()
+		return nil, false
+	}
+
+	// Record the access, in the file too so the order survives restarts
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	d.mu.Lock()
+	if el, ok := d.items[key]; ok {
+		d.order.MoveToFront(el)
+	} else {
+		d.add(key, int64(len(data)))
+	}
+	d.mu.Unlock()
+	return data, true
+}
+
+// Set queues the value for key to be written. The file is written under a
+// temporary name and renamed, so readers never see partial results.
+func (d *Disk) Set(key string, value []byte) {
+	if _, ok := d.path(key); !ok {
+		return
+	}
+	if d.maxBytes > 0 && int64(len(value)) > d.maxBytes {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	d.pending.Add(1)
+	select {
+	case d.writes <- diskEntry{key: key, value: value}:
+	default:
+		d.pending.Done()
+	}
+}
+
+// Flush waits for queued writes to complete
+func (d *Disk) Flush() {
+	d.pending.Wait()
+}
+
+// Close writes the queued results and stops the writer. Later calls to
+// Set are ignored.
+func (d *Disk) Close() {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.writes)
+	}
+	d.mu.Unlock()
+	<-d.done
+}
+
+// Size returns the bytes of the files in the index
+func (d *Disk) Size() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.size
+}
+
+// writer writes queued results and evicts old ones until Close
+func (d *Disk) writer() {
+	defer close(d.done)
+	for e := range d.writes {
+		path, _ := d.path(e.key)
+		if err := writeFileAtomic(path, e.value); err != nil {
+			slog.Warn("cache write failed", "error", err)
+		} else {
+			d.mu.Lock()
+			if el, ok := d.items[e.key]; ok {
+				d.remove(el)
+			}
+			d.add(e.key, int64(len(e.value)))
+			d.evict()
+			d.mu.Unlock()
+		}
+		d.pending.Done()
+	}
+}
+
+// load indexes the files already in the directory, oldest last
+func (d *Disk) load() error {
+	var entries []diskEntry
+	var mtimes []time.Time
+	err := filepath.WalkDir(d.dir, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		key := de.Name()
+		if de.IsDir() || strings.HasPrefix(key, ".") {
+			return nil
+		}
+		if p, ok := d.path(key); !ok || p != path {
+			return nil
+		}
+		info, err := de.Info()
+		if err != nil {
+			return nil // removed by another process
+		}
+		entries = append(entries, diskEntry{key: key, size: info.Size()})
+		mtimes = append(mtimes, info.ModTime())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	idx := make([]int, len(entries))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(a, b int) bool { return mtimes[idx[a]].Before(mtimes[idx[b]]) })
+	for _, i := range idx {
+		d.add(entries[i].key, entries[i].size)
+	}
+	return nil
+}
+
+// add indexes a file as the most recently used; d.mu must be held
+func (d *Disk) add(key string, size int64) {
+	d.items[key] = d.order.PushFront(&diskEntry{key: key, size: size})
+	d.size += size
+	metrics.UpdateCacheSize("disk", d.size)
+}
+
+// remove drops a file from the index; d.mu must be held
+func (d *Disk) remove(el *list.Element) {
+	e := d.order.Remove(el).(*diskEntry)
+	delete(d.items, e.key)
+	d.size -= e.size
+	metrics.UpdateCacheSize("disk", d.size)
+}
+
+// evict deletes the least recently used files until the cache fits in its
+// limit; d.mu must be held
+func (d *Disk) evict() {
+	for d.maxBytes > 0 && d.size > d.maxBytes {
+		el := d.order.Back()
+		path, _ := d.path(el.Value.(*diskEntry).key)
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("cache eviction failed", "error", err)
+		}
+		d.remove(el)
+	}
+}
+
+// path returns the file of key, rejecting keys that are not plain names
+func (d *Disk) path(key string) (string, bool) {
+	if len(key) < 3 || filepath.Base(key) != key || key[0] == '.' {
+		return "", false
+	}
+	return filepath.Join(d.dir, key[:2], key), true
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/harliandi/go-heif/pkg/metrics"
+)
+
+// Memory is an in-memory LRU cache bounded by the total size of its
+// keys and values
+type Memory struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	order    *list.List // front is most recently used
+	items    map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key   string
+	value []byte
+}
+
+// NewMemory creates an LRU cache holding up to maxBytes
+func NewMemory(maxBytes int64) *Memory {
+	return &Memory{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns the value for key and marks it as recently used
+func (m *Memory) Get(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	m.order.MoveToFront(el)
+	return el.Value.(*memoryEntry).value, true
+}
+
+// Set stores a value, evicting the least recently used entries to stay
+// within the size limit. Values larger than the limit are not stored.
+func (m *Memory) Set(key string, value []byte) {
+	n := entrySize(key, value)
+	if n > m.maxBytes {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.items[key]; ok {
+		m.remove(el)
+	}
+	m.items[key] = m.order.PushFront(&memoryEntry{key: key, value: value})
+	m.size += n
+	for m.size > m.maxBytes {
+		m.remove(m.order.Back())
+	}
+	metrics.UpdateCacheSize("memory", m.size)
+}
+
+// Len returns the number of cached entries
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.order.Len()
+}
+
+// Size returns the bytes held by the cache
+func (m *Memory) Size() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.size
+}
+
+func (m *Memory) remove(el *list.Element) {
+	e := m.order.Remove(el).(*memoryEntry)
+	delete(m.items, e.key)
+	m.size -= entrySize(e.key, e.value)
+}
+
+func entrySize(key string, value []byte) int64 {
+	return int64(len(key) + len(value))
+}
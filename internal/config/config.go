@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 )
 
 // Config holds application configuration
@@ -13,7 +14,44 @@ type Config struct {
 	MaxConcurrent      int
 	RateLimitPerSec    int
 	RateLimitBurst     int
+	RoutePoliciesFile  string  // JSON rate and concurrency limits per route
+	TrustedProxies     string  // CIDRs of reverse proxies whose forwarding headers are believed
+	IPAllowlist        string  // CIDRs allowed to use the API, empty for all
+	IPDenylist         string  // CIDRs refused
+	AbuseThreshold     int     // invalid requests (400/415) within AbuseWindowSec that ban a client, 0 disables bans
+	AbuseWindowSec     int
+	AbuseBanSec        int     // ban duration
+	AdminToken         string  // bearer token of the /admin endpoints, empty disables them
+	RedisURL           string  // Redis server holding rate limit buckets shared by all replicas, empty for per-process limits
+	APIKeysFile        string  // JSON key store; when set, conversions require an API key
+	JWTJWKS            string  // JWKS file or URL of the identity provider; when set, conversions accept its JWTs
+	JWTIssuer          string  // required token issuer
+	JWTAudience        string  // required token audience
+	JWTTenantClaim     string  // claim naming the tenant
+	JWTTierClaim       string  // claim naming the tier, defined in APIKeysFile
+	JWTDefaultTier     string  // tier of tokens without a tier claim
+	CostLimitRate      float64 // cost tokens (input MB plus decoded megapixels) per second per client, 0 disables the cost limit
+	CostLimitBurst     float64 // cost tokens a client may spend at once
 	WorkerCount        int
+	Autoscale          bool   // resize the worker pool between WorkerMin and WorkerMax
+	WorkerMin          int    // fewest workers when autoscaling
+	WorkerMax          int    // most workers when autoscaling, 0 for twice the CPU limit
+	AutoscaleWaitMs    int    // queue wait above which workers are added
+	JPEGEncoder        string // "turbo" (libjpeg-turbo, if compiled in) or "std" (image/jpeg)
+	CacheMemoryMB      int    // in-memory result cache size, 0 disables it
+	CacheDir           string // on-disk result cache directory, empty disables it
+	CacheDiskMB        int    // on-disk result cache size, 0 for unbounded
+	QueueMaxWaitMs     int    // time a request waits for a full queue or concurrency limit before a 503, 0 rejects right away
+	AdmissionTargetMs  int    // queueing delay above which expensive requests are shed, 0 disables shedding
+	AdmissionIntervalMs int   // time the delay must stay above target before shedding starts
+	QueueDepth         [3]int // worker pool queue limit per priority class (interactive, batch, background), 0 for the default
+	TenantWeights      map[string]int // fair-share weight per tenant (client IP, or IPv6 /64), 1 when unset
+	JobTimeoutSec      int    // max conversion time per job, 0 for none
+	MemoryBudgetMB     int    // estimated memory of running conversions, 0 for unlimited; defaults to half the cgroup memory limit
+	ShutdownGraceSec   int    // time to finish in-flight requests and queued jobs on SIGTERM
+	DrainDelaySec      int    // time /ready fails before the listener closes on SIGTERM
+	LogLevel           string // debug, info, warn or error
+	LogFormat          string // "json" or "text"
 }
 
 // Load loads configuration from environment variables with defaults
@@ -25,11 +63,59 @@ func Load() *Config {
 		MaxConcurrent:   getEnvInt("MAX_CONCURRENT", 50),
 		RateLimitPerSec: getEnvInt("RATE_LIMIT", 10),
 		RateLimitBurst:  getEnvInt("RATE_LIMIT_BURST", 20),
+		RedisURL:        getEnv("REDIS_URL", ""),
+		IPAllowlist:     getEnv("IP_ALLOWLIST", ""),
+		IPDenylist:      getEnv("IP_DENYLIST", ""),
+		AbuseThreshold:  getEnvInt("ABUSE_THRESHOLD", 20),
+		AbuseWindowSec:  getEnvInt("ABUSE_WINDOW_SEC", 60),
+		AbuseBanSec:     getEnvInt("ABUSE_BAN_SEC", 900),
+		AdminToken:      getEnv("ADMIN_TOKEN", ""),
+		TrustedProxies:  getEnv("TRUSTED_PROXIES", ""),
+		RoutePoliciesFile: getEnv("ROUTE_POLICIES_FILE", ""),
+		APIKeysFile:     getEnv("API_KEYS_FILE", ""),
+		JWTJWKS:         getEnv("JWT_JWKS", ""),
+		JWTIssuer:       getEnv("JWT_ISSUER", ""),
+		JWTAudience:     getEnv("JWT_AUDIENCE", ""),
+		JWTTenantClaim:  getEnv("JWT_TENANT_CLAIM", "sub"),
+		JWTTierClaim:    getEnv("JWT_TIER_CLAIM", "tier"),
+		JWTDefaultTier:  getEnv("JWT_DEFAULT_TIER", ""),
+		CostLimitRate:   getEnvFloat("COST_LIMIT_RATE", 50),
+		CostLimitBurst:  getEnvFloat("COST_LIMIT_BURST", 500),
 		WorkerCount:     getEnvInt("WORKER_COUNT", 10),
+		Autoscale:       getEnv("AUTOSCALE", "") == "true",
+		WorkerMin:       getEnvInt("WORKER_MIN", 1),
+		WorkerMax:       getEnvInt("WORKER_MAX", 0),
+		AutoscaleWaitMs: getEnvInt("AUTOSCALE_TARGET_WAIT_MS", 200),
+		JPEGEncoder:     getEnv("JPEG_ENCODER", "turbo"),
+		CacheMemoryMB:   getEnvInt("CACHE_MEMORY_MB", 64),
+		CacheDir:        getEnv("CACHE_DIR", ""),
+		CacheDiskMB:     getEnvInt("CACHE_DISK_MB", 1024),
+		QueueMaxWaitMs:  getEnvInt("QUEUE_MAX_WAIT_MS", 1000),
+		AdmissionTargetMs:   getEnvInt("ADMISSION_TARGET_MS", 500),
+		AdmissionIntervalMs: getEnvInt("ADMISSION_INTERVAL_MS", 2000),
+		QueueDepth: [3]int{
+			getEnvInt("QUEUE_DEPTH_INTERACTIVE", 0),
+			getEnvInt("QUEUE_DEPTH_BATCH", 0),
+			getEnvInt("QUEUE_DEPTH_BACKGROUND", 0),
+		},
+		TenantWeights:    getEnvWeights("TENANT_WEIGHTS"),
+		JobTimeoutSec:    getEnvInt("JOB_TIMEOUT_SEC", 30),
+		MemoryBudgetMB:   getEnvInt("MEMORY_BUDGET_MB", defaultMemoryBudgetMB()),
+		ShutdownGraceSec: getEnvInt("SHUTDOWN_GRACE_SEC", 30),
+		DrainDelaySec:    getEnvInt("DRAIN_DELAY_SEC", 5),
+		LogLevel:         getEnv("LOG_LEVEL", "info"),
+		LogFormat:        getEnv("LOG_FORMAT", "json"),
 	}
 	return cfg
 }
 
+func getEnv(key, defaultValue string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return defaultValue
+}
+
 func getEnvInt(key string, defaultValue int) int {
 	if val := os.Getenv(key); val != "" {
 		if intVal, err := strconv.Atoi(val); err == nil {
@@ -38,3 +124,55 @@ func getEnvInt(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if val := os.Getenv(key); val != "" {
+		if floatVal, err := strconv.ParseFloat(val, 64); err == nil {
+			return floatVal
+		}
+	}
+	return defaultValue
+}
+
+// getEnvWeights parses a "name=weight,name=weight" list, skipping invalid
+// entries
+func getEnvWeights(key string) map[string]int {
+	weights := make(map[string]int)
+	for _, entry := range strings.Split(os.Getenv(key), ",") {
+		name, val, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || name == "" {
+			continue
+		}
+		if w, err := strconv.Atoi(val); err == nil && w > 0 {
+			weights[name] = w
+		}
+	}
+	return weights
+}
+
+// defaultMemoryBudgetMB returns half the cgroup memory limit, leaving the
+// rest for uploads, responses and the result cache, or 2048 without a limit
+func defaultMemoryBudgetMB() int {
+	if limit := cgroupMemoryLimit(); limit > 0 {
+		return max(int(limit>>20)/2, 1)
+	}
+	return 2048
+}
+
+// cgroupMemoryLimit returns the memory limit of the container in bytes
+// (cgroup v2 or v1), or 0 if it has none
+func cgroupMemoryLimit() int64 {
+	for _, path := range []string{"/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory/memory.limit_in_bytes"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		// "max" (v2) or a huge page-aligned value (v1) means no limit
+		if err != nil || n <= 0 || n >= 1<<62 {
+			return 0
+		}
+		return n
+	}
+	return 0
+}
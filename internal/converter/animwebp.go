@@ -0,0 +1,120 @@
+package converter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// defaultFrameDurationMs is used for frames whose track has no timing info
+const defaultFrameDurationMs = 100
+
+// webpFrame is a still WebP image plus its display duration
+type webpFrame struct {
+	data       []byte // complete RIFF WebP file of the frame
+	width      int
+	height     int
+	durationMs int
+}
+
+// muxAnimatedWebP assembles still WebP frames into an animated WebP file
+// (VP8X + ANIM + one ANMF chunk per frame). loopCount 0 loops forever.
+func muxAnimatedWebP(frames []webpFrame, loopCount int) ([]byte, error) {
+	if len(frames) == 0 {
+		return nil, errors.New("no frames to mux")
+	}
+
+	var canvasW, canvasH int
+	for _, fr := range frames {
+		canvasW = max(canvasW, fr.width)
+		canvasH = max(canvasH, fr.height)
+	}
+
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+
+	// VP8X: animation flag, canvas size
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x02
+	putUint24(vp8x[4:], canvasW-1)
+	putUint24(vp8x[7:], canvasH-1)
+	writeChunk(&body, "VP8X", vp8x)
+
+	// ANIM: background color (BGRA) and loop count
+	anim := make([]byte, 6)
+	binary.LittleEndian.PutUint16(anim[4:], uint16(loopCount))
+	writeChunk(&body, "ANIM", anim)
+
+	for i, fr := range frames {
+		payload, err := webpFramePayload(fr.data)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %w", i, err)
+		}
+		duration := fr.durationMs
+		if duration <= 0 {
+			duration = defaultFrameDurationMs
+		}
+		hdr := make([]byte, 16)
+		// X and Y offsets (stored /2) stay zero: frames cover the canvas origin
+		putUint24(hdr[6:], fr.width-1)
+		putUint24(hdr[9:], fr.height-1)
+		putUint24(hdr[12:], min(duration, 1<<24-1))
+		hdr[15] = 0x02 // do not blend, no disposal
+		writeChunk(&body, "ANMF", append(hdr, payload...))
+	}
+
+	out := make([]byte, 8, 8+body.Len())
+	copy(out, "RIFF")
+	binary.LittleEndian.PutUint32(out[4:], uint32(body.Len()))
+	return append(out, body.Bytes()...), nil
+}
+
+// webpFramePayload extracts the ALPH and VP8/VP8L chunks of a still WebP
+func webpFramePayload(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("not a WebP file")
+	}
+	var payload []byte
+	for b := data[12:]; len(b) >= 8; {
+		typ := string(b[0:4])
+		size := int(binary.LittleEndian.Uint32(b[4:8]))
+		padded := size + size&1
+		if size < 0 || 8+size > len(b) {
+			return nil, errors.New("truncated WebP chunk")
+		}
+		switch typ {
+		case "ALPH", "VP8 ", "VP8L":
+			payload = append(payload, b[:8+size]...)
+			if size&1 == 1 {
+				payload = append(payload, 0)
+			}
+		}
+		if 8+padded > len(b) {
+			break
+		}
+		b = b[8+padded:]
+	}
+	if len(payload) == 0 {
+		return nil, errors.New("WebP has no image data")
+	}
+	return payload, nil
+}
+
+// writeChunk writes a RIFF chunk, padding the payload to an even size
+func writeChunk(w *bytes.Buffer, typ string, payload []byte) {
+	var hdr [8]byte
+	copy(hdr[:4], typ)
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(len(payload)))
+	w.Write(hdr[:])
+	w.Write(payload)
+	if len(payload)&1 == 1 {
+		w.WriteByte(0)
+	}
+}
+
+func putUint24(b []byte, v int) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
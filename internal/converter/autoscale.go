@@ -0,0 +1,137 @@
+package converter
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Autoscale defaults
+const (
+	defaultAutoscaleInterval = 5 * time.Second
+	defaultTargetWait        = 200 * time.Millisecond
+	// autoscaleIdleRounds is the number of quiet intervals before a
+	// worker is removed, so short lulls don't shrink the pool
+	autoscaleIdleRounds = 3
+)
+
+// AutoscaleConfig bounds and tunes Autoscale
+type AutoscaleConfig struct {
+	Min        int           // fewest workers, at least 1
+	Max        int           // most workers, 0 for twice the CPU limit
+	TargetWait time.Duration // average queue wait above which workers are added
+	Interval   time.Duration // time between adjustments
+}
+
+// withDefaults fills in unset fields
+func (c AutoscaleConfig) withDefaults() AutoscaleConfig {
+	c.Min = max(c.Min, 1)
+	if c.Max <= 0 {
+		// Conversions are CPU bound; a second worker per CPU keeps it
+		// busy while the other decodes input or waits for memory
+		c.Max = 2 * cpuLimit()
+	}
+	c.Max = max(c.Max, c.Min)
+	if c.TargetWait <= 0 {
+		c.TargetWait = defaultTargetWait
+	}
+	if c.Interval <= 0 {
+		c.Interval = defaultAutoscaleInterval
+	}
+	return c
+}
+
+// Autoscale adjusts the number of workers within cfg's bounds until ctx is
+// done. Workers are added (a quarter more, at least one) when jobs waited
+// longer than TargetWait on average, or when jobs stayed queued without
+// any starting. One is removed after a few intervals with an empty queue
+// and fewer than half the workers busy.
+func (p *WorkerPool) Autoscale(ctx context.Context, cfg AutoscaleConfig) {
+	cfg = cfg.withDefaults()
+	p.Resize(min(max(p.Workers(), cfg.Min), cfg.Max))
+	slog.Info("autoscaling worker pool", "min", cfg.Min, "max", cfg.Max)
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	idle := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		workers := p.Workers()
+		if n := p.scaleStep(cfg, workers, &idle); n != workers {
+			slog.Info("resizing worker pool", "from", workers, "to", n)
+			p.Resize(n)
+		}
+	}
+}
+
+// scaleStep returns the number of workers for the next interval. idle
+// counts the consecutive quiet intervals.
+func (p *WorkerPool) scaleStep(cfg AutoscaleConfig, workers int, idle *int) int {
+	wait, started := p.takeWaitStats()
+	active, queued := p.Stats()
+	switch {
+	case queued > 0 && (wait > cfg.TargetWait || started == 0):
+		*idle = 0
+		return min(workers+max(workers/4, 1), cfg.Max)
+	case queued == 0 && active < (workers+1)/2:
+		*idle++
+		if *idle >= autoscaleIdleRounds {
+			*idle = 0
+			return max(workers-1, cfg.Min)
+		}
+	default:
+		*idle = 0
+	}
+	return workers
+}
+
+// cpuLimit returns the number of CPUs the process may use: GOMAXPROCS,
+// capped by the container's cgroup CPU quota rounded up
+func cpuLimit() int {
+	n := runtime.GOMAXPROCS(0)
+	if quota := cgroupCPUQuota(); quota > 0 {
+		n = min(n, max(int(math.Ceil(quota)), 1))
+	}
+	return n
+}
+
+// cgroupCPUQuota returns the CPU quota of the container in CPUs (cgroup v2
+// or v1), or 0 if it has none
+func cgroupCPUQuota() float64 {
+	if data, err := os.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		// "<quota> <period>", quota "max" for no limit
+		quota, period, _ := strings.Cut(strings.TrimSpace(string(data)), " ")
+		return quotaCPUs(quota, period)
+	}
+	quota, err := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	if err != nil {
+		return 0
+	}
+	period, err := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if err != nil {
+		return 0
+	}
+	return quotaCPUs(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+}
+
+// quotaCPUs divides a CFS quota by its period, 0 for no or invalid limits
+func quotaCPUs(quota, period string) float64 {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0
+	}
+	return q / p
+}
@@ -0,0 +1,132 @@
+package converter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/harliandi/go-heif/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// runningWorkers returns the number of live worker goroutines
+func runningWorkers(p *WorkerPool) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.running
+}
+
+func TestWorkerPool_Resize(t *testing.T) {
+	p := NewWorkerPool(1)
+	p.SetQueueLimit(PriorityBackground, 7)
+	p.Resize(3) // before Start only sets the count
+	if runningWorkers(p) != 0 {
+		t.Fatal("Resize started workers before Start")
+	}
+	p.Start()
+	defer p.Stop()
+	if n := runningWorkers(p); n != 3 {
+		t.Errorf("%d workers running, want 3", n)
+	}
+	if got := testutil.ToFloat64(metrics.WorkerPoolWorkers); got != 3 {
+		t.Errorf("worker gauge = %v, want 3", got)
+	}
+	if p.classes[PriorityInteractive].limit != 6 || p.classes[PriorityBackground].limit != 7 {
+		t.Errorf("queue limits %d and %d, want 6 and the explicit 7",
+			p.classes[PriorityInteractive].limit, p.classes[PriorityBackground].limit)
+	}
+
+	// Idle workers over the count exit
+	p.Resize(1)
+	deadline := time.Now().Add(time.Second)
+	for runningWorkers(p) != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runningWorkers(p); n != 1 || p.Workers() != 1 {
+		t.Errorf("%d workers running, %d wanted, want 1", n, p.Workers())
+	}
+	p.Resize(0)
+	if p.Workers() != 1 {
+		t.Error("pool resized below one worker")
+	}
+}
+
+func TestWorkerPool_ScaleStep(t *testing.T) {
+	// Workers are not started, so queued jobs never start on their own
+	p := NewWorkerPool(4)
+	cfg := AutoscaleConfig{Min: 2, Max: 6, TargetWait: 50 * time.Millisecond}.withDefaults()
+	idle := 0
+
+	// Queued jobs that don't start add a quarter of the workers
+	for range 3 {
+		p.enqueue(Job{Data: []byte("x")}, PriorityInteractive, "")
+	}
+	if n := p.scaleStep(cfg, 4, &idle); n != 5 {
+		t.Errorf("stuck queue: %d workers, want 5", n)
+	}
+	if n := p.scaleStep(cfg, 6, &idle); n != 6 {
+		t.Errorf("at the maximum: %d workers, want 6", n)
+	}
+
+	// Jobs that start quickly keep the count
+	for range 3 {
+		job, _ := p.next()
+		p.finish(job)
+	}
+	p.enqueue(Job{Data: []byte("x")}, PriorityInteractive, "")
+	p.waitSum, p.waitJobs = time.Millisecond, 1
+	if n := p.scaleStep(cfg, 4, &idle); n != 4 {
+		t.Errorf("short waits: %d workers, want 4", n)
+	}
+	// Long waits add workers
+	p.waitSum, p.waitJobs = time.Second, 1
+	if n := p.scaleStep(cfg, 4, &idle); n != 5 {
+		t.Errorf("long waits: %d workers, want 5", n)
+	}
+
+	// An idle pool shrinks after a few quiet intervals, down to Min
+	job, _ := p.next()
+	p.finish(job)
+	for i := 1; i < autoscaleIdleRounds; i++ {
+		if n := p.scaleStep(cfg, 3, &idle); n != 3 {
+			t.Fatalf("quiet interval %d: %d workers, want 3", i, n)
+		}
+	}
+	if n := p.scaleStep(cfg, 3, &idle); n != 2 {
+		t.Errorf("idle pool: %d workers, want 2", n)
+	}
+	for range autoscaleIdleRounds {
+		if n := p.scaleStep(cfg, 2, &idle); n != 2 {
+			t.Errorf("at the minimum: %d workers, want 2", n)
+		}
+	}
+}
+
+func TestAutoscaleConfig_Defaults(t *testing.T) {
+	cfg := AutoscaleConfig{}.withDefaults()
+	if cfg.Min != 1 || cfg.Max != 2*cpuLimit() || cfg.TargetWait != defaultTargetWait || cfg.Interval != defaultAutoscaleInterval {
+		t.Errorf("defaults = %+v", cfg)
+	}
+	if cfg := (AutoscaleConfig{Min: 8, Max: 4}).withDefaults(); cfg.Max != 8 {
+		t.Errorf("Max %d below Min 8", cfg.Max)
+	}
+}
+
+func TestQuotaCPUs(t *testing.T) {
+	for _, tt := range []struct {
+		quota, period string
+		want          float64
+	}{
+		{"200000", "100000", 2},
+		{"150000", "100000", 1.5},
+		{"max", "100000", 0},
+		{"-1", "100000", 0}, // cgroup v1 without a quota
+		{"100000", "0", 0},
+	} {
+		if got := quotaCPUs(tt.quota, tt.period); got != tt.want {
+			t.Errorf("quotaCPUs(%q, %q) = %v, want %v", tt.quota, tt.period, got, tt.want)
+		}
+	}
+	if n := cpuLimit(); n < 1 {
+		t.Errorf("cpuLimit() = %d", n)
+	}
+}
@@ -3,6 +3,8 @@ package converter
 import (
 	"bytes"
 	"sync"
+
+	"github.com/harliandi/go-heif/pkg/metrics"
 )
 
 // BufferPool manages reusable byte buffers to reduce GC pressure
@@ -13,46 +15,42 @@ type BufferPool struct {
 	xlarge  sync.Pool // ~10MB buffers (HEIF input)
 }
 
-// Global buffer pool
-var globalBufferPool = &BufferPool{
-	small: sync.Pool{
-		New: func() interface{} {
-			b := make([]byte, 0, 64*1024)
-			return &b
-		},
-	},
-	medium: sync.Pool{
-		New: func() interface{} {
-			b := make([]byte, 0, 512*1024)
-			return &b
-		},
-	},
-	large: sync.Pool{
-		New: func() interface{} {
-			b := make([]byte, 0, 5*1024*1024)
-			return &b
-		},
-	},
-	xlarge: sync.Pool{
-		New: func() interface{} {
-			b := make([]byte, 0, 10*1024*1024)
-			return &b
-		},
-	},
-}
+// Buffer size classes
+const (
+	smallBufferSize  = 64 * 1024
+	mediumBufferSize = 512 * 1024
+	largeBufferSize  = 5 * 1024 * 1024
+	xlargeBufferSize = 10 * 1024 * 1024
+)
+
+// Global buffer pool. The pools have no New function so that misses can
+// be counted.
+var globalBufferPool = &BufferPool{}
 
 // GetBuffer returns a buffer with at least the specified capacity
 func GetBuffer(size int) *[]byte {
 	switch {
-	case size <= 64*1024:
-		return globalBufferPool.small.Get().(*[]byte)
-	case size <= 512*1024:
-		return globalBufferPool.medium.Get().(*[]byte)
-	case size <= 5*1024*1024:
-		return globalBufferPool.large.Get().(*[]byte)
+	case size <= smallBufferSize:
+		return getPooled(&globalBufferPool.small, "small", smallBufferSize)
+	case size <= mediumBufferSize:
+		return getPooled(&globalBufferPool.medium, "medium", mediumBufferSize)
+	case size <= largeBufferSize:
+		return getPooled(&globalBufferPool.large, "large", largeBufferSize)
 	default:
-		return globalBufferPool.xlarge.Get().(*[]byte)
+		return getPooled(&globalBufferPool.xlarge, "xlarge", xlargeBufferSize)
+	}
+}
+
+// getPooled takes a buffer from pool, allocating one of the given capacity
+// on a miss
+func getPooled(pool *sync.Pool, size string, capacity int) *[]byte {
+	if b, ok := pool.Get().(*[]byte); ok {
+		metrics.RecordPoolHit(size)
+		return b
 	}
+	metrics.RecordPoolMiss(size)
+	b := make([]byte, 0, capacity)
+	return &b
 }
 
 // PutBuffer returns a buffer to the pool
@@ -63,13 +61,13 @@ func PutBuffer(b *[]byte) {
 	// Return to appropriate pool based on capacity
 	capacity := cap(*b)
 	switch {
-	case capacity == 64*1024:
+	case capacity == smallBufferSize:
 		globalBufferPool.small.Put(b)
-	case capacity == 512*1024:
+	case capacity == mediumBufferSize:
 		globalBufferPool.medium.Put(b)
-	case capacity == 5*1024*1024:
+	case capacity == largeBufferSize:
 		globalBufferPool.large.Put(b)
-	case capacity == 10*1024*1024:
+	case capacity == xlargeBufferSize:
 		globalBufferPool.xlarge.Put(b)
 	// Don't pool buffers with unexpected sizes - let GC handle them
 	}
@@ -0,0 +1,790 @@
+package converter
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrItemNotFound is returned when a requested image index does not exist
+	ErrItemNotFound = errors.New("image item not found")
+	// ErrUnsupportedItem is returned when an image item uses a coding we cannot decode
+	ErrUnsupportedItem = errors.New("unsupported image item type")
+)
+
+// Container parsing limits (protect against malformed or hostile files)
+const (
+	maxBoxDepth       = 8
+	maxContainerItems = 4096
+	maxItemExtents    = 1 << 16 // across all items of an iloc box
+	maxTrackSamples   = 100_000
+)
+
+// box is a raw ISOBMFF box. body excludes the box header.
+type box struct {
+	typ  string
+	body []byte
+}
+
+// extent is a byte range inside the file (or inside idat)
+type extent struct {
+	offset uint64
+	length uint64
+}
+
+// heifItem is an item from the meta box (image, tile, Exif, ...)
+type heifItem struct {
+	id           uint32
+	typ          string
+	hidden       bool
+	construction uint8
+	baseOffset   uint64
+	extents      []extent
+	refs         map[string][]uint32 // outgoing iref entries by reference type
+	props        []box               // associated item properties in ipma order
+}
+
+// property returns the first associated property of the given box type
+func (it *heifItem) property(typ string) (box, bool) {
+	for _, p := range it.props {
+		if p.typ == typ {
+			return p, true
+		}
+	}
+	return box{}, false
+}
+
+// size returns the ispe dimensions of the item
+func (it *heifItem) size() (width, height int, ok bool) {
+	p, ok := it.property("ispe")
+	if !ok || len(p.body) < 12 {
+		return 0, 0, false
+	}
+	return int(binary.BigEndian.Uint32(p.body[4:8])), int(binary.BigEndian.Uint32(p.body[8:12])), true
+}
+
+// sample is a single coded picture of an image sequence track
+type sample struct {
+	offset   uint64
+	size     uint64
+	duration uint32 // in track timescale units
+	sync     bool
+}
+
+// heifTrack is a picture track ('pict' or 'vide' handler) of an image sequence
+type heifTrack struct {
+	id        uint32
+	handler   string
+	timescale uint32
+	width     int
+	height    int
+	codec     string
+	hvcC      []byte
+	props     []box // sample entry child boxes (hvcC, colr, clli, ...)
+	samples   []sample
+}
+
+// heifFile is a parsed HEIF container. Only the boxes needed to locate
+// image items, image sequences and their properties are read.
+type heifFile struct {
+	data      []byte
+	brand     string
+	brands    []string
+	primaryID uint32
+	items     []*heifItem
+	byID      map[uint32]*heifItem
+	idat      []byte
+	tracks    []*heifTrack
+}
+
+// readBoxes splits b into consecutive boxes
+func readBoxes(b []byte) ([]box, error) {
+	var boxes []box
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return nil, fmt.Errorf("%w: truncated box header", ErrInvalidHEIF)
+		}
+		size := uint64(binary.BigEndian.Uint32(b[0:4]))
+		typ := string(b[4:8])
+		hdr := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(b))
+		case 1:
+			if len(b) < 16 {
+				return nil, fmt.Errorf("%w: truncated large box header", ErrInvalidHEIF)
+			}
+			size = binary.BigEndian.Uint64(b[8:16])
+			hdr = 16
+		}
+		if size < hdr || size > uint64(len(b)) {
+			return nil, fmt.Errorf("%w: box %q has invalid size %d", ErrInvalidHEIF, typ, size)
+		}
+		boxes = append(boxes, box{typ: typ, body: b[hdr:size]})
+		b = b[size:]
+	}
+	return boxes, nil
+}
+
+// findBox returns the first box of the given type
+func findBox(boxes []box, typ string) (box, bool) {
+	for _, bx := range boxes {
+		if bx.typ == typ {
+			return bx, true
+		}
+	}
+	return box{}, false
+}
+
+// childBoxes parses the children of a container box, skipping skip header bytes
+func childBoxes(bx box, skip int) ([]box, error) {
+	if len(bx.body) < skip {
+		return nil, fmt.Errorf("%w: truncated %q box", ErrInvalidHEIF, bx.typ)
+	}
+	return readBoxes(bx.body[skip:])
+}
+
+// byteReader reads big-endian fields and records the first out-of-bounds error
+type byteReader struct {
+	b   []byte
+	err error
+}
+
+func (r *byteReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.b) {
+		r.err = fmt.Errorf("%w: truncated box", ErrInvalidHEIF)
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *byteReader) u8() uint8 {
+	if v := r.take(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (r *byteReader) u16() uint16 {
+	if v := r.take(2); v != nil {
+		return binary.BigEndian.Uint16(v)
+	}
+	return 0
+}
+
+func (r *byteReader) u32() uint32 {
+	if v := r.take(4); v != nil {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (r *byteReader) u64() uint64 {
+	if v := r.take(8); v != nil {
+		return binary.BigEndian.Uint64(v)
+	}
+	return 0
+}
+
+// uintN reads an unsigned integer of n bytes (0, 4 or 8 as used by iloc)
+func (r *byteReader) uintN(n int) uint64 {
+	switch n {
+	case 0:
+		return 0
+	case 2:
+		return uint64(r.u16())
+	case 4:
+		return uint64(r.u32())
+	case 8:
+		return r.u64()
+	}
+	r.err = fmt.Errorf("%w: unsupported field size %d", ErrInvalidHEIF, n)
+	return 0
+}
+
+// fullBox reads the version and flags of a FullBox
+func (r *byteReader) fullBox() (version uint8, flags uint32) {
+	v := r.u32()
+	return uint8(v >> 24), v & 0xFFFFFF
+}
+
+// parseContainer parses the top-level boxes of a HEIF file
+func parseContainer(data []byte) (*heifFile, error) {
+	top, err := readBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &heifFile{data: data, byID: make(map[uint32]*heifItem)}
+
+	ftyp, ok := findBox(top, "ftyp")
+	if !ok || len(ftyp.body) < 8 {
+		return nil, fmt.Errorf("%w: missing ftyp", ErrInvalidHEIF)
+	}
+	f.brand = string(ftyp.body[0:4])
+	for b := ftyp.body[8:]; len(b) >= 4; b = b[4:] {
+		f.brands = append(f.brands, string(b[0:4]))
+	}
+
+	if meta, ok := findBox(top, "meta"); ok {
+		if err := f.parseMeta(meta); err != nil {
+			return nil, err
+		}
+	}
+	if moov, ok := findBox(top, "moov"); ok {
+		if err := f.parseMoov(moov); err != nil {
+			return nil, err
+		}
+	}
+	if len(f.items) == 0 && len(f.tracks) == 0 {
+		return nil, fmt.Errorf("%w: no images or sequences", ErrInvalidHEIF)
+	}
+	return f, nil
+}
+
+// parseMeta reads item info, locations, references and properties
+func (f *heifFile) parseMeta(meta box) error {
+	children, err := childBoxes(meta, 4)
+	if err != nil {
+		return err
+	}
+
+	if pitm, ok := findBox(children, "pitm"); ok {
+		r := &byteReader{b: pitm.body}
+		if v, _ := r.fullBox(); v == 0 {
+			f.primaryID = uint32(r.u16())
+		} else {
+			f.primaryID = r.u32()
+		}
+		if r.err != nil {
+			return r.err
+		}
+	}
+
+	if iinf, ok := findBox(children, "iinf"); ok {
+		if err := f.parseItemInfo(iinf); err != nil {
+			return err
+		}
+	}
+	if iloc, ok := findBox(children, "iloc"); ok {
+		if err := f.parseItemLocations(iloc); err != nil {
+			return err
+		}
+	}
+	if iref, ok := findBox(children, "iref"); ok {
+		if err := f.parseItemReferences(iref); err != nil {
+			return err
+		}
+	}
+	if iprp, ok := findBox(children, "iprp"); ok {
+		if err := f.parseItemProperties(iprp); err != nil {
+			return err
+		}
+	}
+	if idat, ok := findBox(children, "idat"); ok {
+		f.idat = idat.body
+	}
+	return nil
+}
+
+func (f *heifFile) parseItemInfo(iinf box) error {
+	r := &byteReader{b: iinf.body}
+	version, _ := r.fullBox()
+	if version == 0 {
+		r.u16()
+	} else {
+		r.u32()
+	}
+	if r.err != nil {
+		return r.err
+	}
+	entries, err := readBoxes(r.b)
+	if err != nil {
+		return err
+	}
+	for _, infe := range entries {
+		if infe.typ != "infe" {
+			continue
+		}
+		if len(f.items) >= maxContainerItems {
+			return fmt.Errorf("%w: too many items", ErrInvalidHEIF)
+		}
+		er := &byteReader{b: infe.body}
+		v, flags := er.fullBox()
+		if v < 2 {
+			// Version 0/1 entries carry no item type; nothing we can decode
+			continue
+		}
+		it := &heifItem{hidden: flags&1 != 0, refs: make(map[string][]uint32)}
+		if v == 2 {
+			it.id = uint32(er.u16())
+		} else {
+			it.id = er.u32()
+		}
+		er.u16() // protection index
+		it.typ = string(er.take(4))
+		if er.err != nil {
+			return er.err
+		}
+		f.items = append(f.items, it)
+		f.byID[it.id] = it
+	}
+	return nil
+}
+
+func (f *heifFile) parseItemLocations(iloc box) error {
+	r := &byteReader{b: iloc.body}
+	version, _ := r.fullBox()
+	sizes := r.u16()
+	offsetSize := int(sizes >> 12)
+	lengthSize := int(sizes>>8) & 0xF
+	baseOffsetSize := int(sizes>>4) & 0xF
+	indexSize := 0
+	if version == 1 || version == 2 {
+		indexSize = int(sizes) & 0xF
+	}
+	var count uint32
+	if version < 2 {
+		count = uint32(r.u16())
+	} else {
+		count = r.u32()
+	}
+	extentSize := indexSize + offsetSize + lengthSize
+	totalExtents := 0
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		var id uint32
+		if version < 2 {
+			id = uint32(r.u16())
+		} else {
+			id = r.u32()
+		}
+		var construction uint8
+		if version == 1 || version == 2 {
+			construction = uint8(r.u16() & 0xF)
+		}
+		r.u16() // data reference index
+		base := r.uintN(baseOffsetSize)
+		extentCount := int(r.u16())
+		// Zero-size fields make extents free to declare, so bound them by
+		// the bytes left and by a total count
+		totalExtents += extentCount
+		if extentCount*extentSize > len(r.b) || totalExtents > maxItemExtents {
+			return fmt.Errorf("%w: too many item extents", ErrInvalidHEIF)
+		}
+		extents := make([]extent, 0, min(extentCount, 64))
+		for j := 0; j < extentCount && r.err == nil; j++ {
+			if indexSize > 0 {
+				r.uintN(indexSize)
+			}
+			off := r.uintN(offsetSize)
+			length := r.uintN(lengthSize)
+			extents = append(extents, extent{offset: off, length: length})
+		}
+		if it, ok := f.byID[id]; ok {
+			it.construction = construction
+			it.baseOffset = base
+			it.extents = extents
+		}
+	}
+	return r.err
+}
+
+func (f *heifFile) parseItemReferences(iref box) error {
+	r := &byteReader{b: iref.body}
+	version, _ := r.fullBox()
+	if r.err != nil {
+		return r.err
+	}
+	refs, err := readBoxes(r.b)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		rr := &byteReader{b: ref.body}
+		readID := func() uint32 {
+			if version == 0 {
+				return uint32(rr.u16())
+			}
+			return rr.u32()
+		}
+		from := readID()
+		n := int(rr.u16())
+		to := make([]uint32, 0, min(n, maxContainerItems))
+		for i := 0; i < n && rr.err == nil; i++ {
+			to = append(to, readID())
+		}
+		if rr.err != nil {
+			return rr.err
+		}
+		if it, ok := f.byID[from]; ok {
+			it.refs[ref.typ] = append(it.refs[ref.typ], to...)
+		}
+	}
+	return nil
+}
+
+func (f *heifFile) parseItemProperties(iprp box) error {
+	children, err := childBoxes(iprp, 0)
+	if err != nil {
+		return err
+	}
+	ipco, ok := findBox(children, "ipco")
+	if !ok {
+		return nil
+	}
+	props, err := childBoxes(ipco, 0)
+	if err != nil {
+		return err
+	}
+	for _, ipma := range children {
+		if ipma.typ != "ipma" {
+			continue
+		}
+		r := &byteReader{b: ipma.body}
+		version, flags := r.fullBox()
+		count := r.u32()
+		for i := uint32(0); i < count && r.err == nil; i++ {
+			var id uint32
+			if version < 1 {
+				id = uint32(r.u16())
+			} else {
+				id = r.u32()
+			}
+			n := int(r.u8())
+			it := f.byID[id]
+			for j := 0; j < n && r.err == nil; j++ {
+				var index int
+				if flags&1 != 0 {
+					index = int(r.u16() & 0x7FFF)
+				} else {
+					index = int(r.u8() & 0x7F)
+				}
+				if it != nil && index > 0 && index <= len(props) {
+					it.props = append(it.props, props[index-1])
+				}
+			}
+		}
+		if r.err != nil {
+			return r.err
+		}
+	}
+	return nil
+}
+
+// parseMoov reads picture tracks of an image sequence (msf1)
+func (f *heifFile) parseMoov(moov box) error {
+	children, err := childBoxes(moov, 0)
+	if err != nil {
+		return err
+	}
+	for _, trak := range children {
+		if trak.typ != "trak" {
+			continue
+		}
+		t, err := parseTrack(trak)
+		if err != nil {
+			return err
+		}
+		if t != nil {
+			f.tracks = append(f.tracks, t)
+		}
+	}
+	return nil
+}
+
+// parseTrack returns nil for tracks that are not HEVC picture tracks
+func parseTrack(trak box) (*heifTrack, error) {
+	children, err := childBoxes(trak, 0)
+	if err != nil {
+		return nil, err
+	}
+	t := &heifTrack{}
+	if tkhd, ok := findBox(children, "tkhd"); ok {
+		r := &byteReader{b: tkhd.body}
+		version, _ := r.fullBox()
+		if version == 1 {
+			r.take(16)
+			t.id = r.u32()
+		} else {
+			r.take(8)
+			t.id = r.u32()
+		}
+	}
+	mdia, ok := findBox(children, "mdia")
+	if !ok {
+		return nil, nil
+	}
+	mdiaChildren, err := childBoxes(mdia, 0)
+	if err != nil {
+		return nil, err
+	}
+	if hdlr, ok := findBox(mdiaChildren, "hdlr"); ok && len(hdlr.body) >= 12 {
+		t.handler = string(hdlr.body[8:12])
+	}
+	if t.handler != "pict" && t.handler != "vide" {
+		return nil, nil
+	}
+	if mdhd, ok := findBox(mdiaChildren, "mdhd"); ok {
+		r := &byteReader{b: mdhd.body}
+		version, _ := r.fullBox()
+		if version == 1 {
+			r.take(16)
+		} else {
+			r.take(8)
+		}
+		t.timescale = r.u32()
+	}
+
+	minf, ok := findBox(mdiaChildren, "minf")
+	if !ok {
+		return nil, nil
+	}
+	minfChildren, err := childBoxes(minf, 0)
+	if err != nil {
+		return nil, err
+	}
+	stbl, ok := findBox(minfChildren, "stbl")
+	if !ok {
+		return nil, nil
+	}
+	stblChildren, err := childBoxes(stbl, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if stsd, ok := findBox(stblChildren, "stsd"); ok {
+		if err := t.parseSampleDescription(stsd); err != nil {
+			return nil, err
+		}
+	}
+	if t.codec != "hvc1" && t.codec != "hev1" {
+		return nil, nil
+	}
+	if err := t.parseSampleTable(stblChildren); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *heifTrack) parseSampleDescription(stsd box) error {
+	r := &byteReader{b: stsd.body}
+	r.fullBox()
+	r.u32() // entry count
+	if r.err != nil {
+		return r.err
+	}
+	entries, err := readBoxes(r.b)
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+	entry := entries[0]
+	t.codec = entry.typ
+	// SampleEntry (8 bytes) + VisualSampleEntry fields (70 bytes)
+	const visualSampleEntrySize = 78
+	if len(entry.body) < visualSampleEntrySize {
+		return fmt.Errorf("%w: truncated sample entry", ErrInvalidHEIF)
+	}
+	t.width = int(binary.BigEndian.Uint16(entry.body[24:26]))
+	t.height = int(binary.BigEndian.Uint16(entry.body[26:28]))
+	sub, err := readBoxes(entry.body[visualSampleEntrySize:])
+	if err != nil {
+		return err
+	}
+	t.props = sub
+	if hvcC, ok := findBox(sub, "hvcC"); ok {
+		t.hvcC = hvcC.body
+	}
+	return nil
+}
+
+func (t *heifTrack) parseSampleTable(stbl []box) error {
+	// Sample sizes
+	stsz, ok := findBox(stbl, "stsz")
+	if !ok {
+		return fmt.Errorf("%w: missing stsz", ErrInvalidHEIF)
+	}
+	r := &byteReader{b: stsz.body}
+	r.fullBox()
+	fixedSize := r.u32()
+	count := r.u32()
+	if count > maxTrackSamples {
+		return fmt.Errorf("%w: too many samples", ErrInvalidHEIF)
+	}
+	t.samples = make([]sample, count)
+	for i := range t.samples {
+		if fixedSize != 0 {
+			t.samples[i].size = uint64(fixedSize)
+		} else {
+			t.samples[i].size = uint64(r.u32())
+		}
+		t.samples[i].sync = true
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	// Sample durations
+	if stts, ok := findBox(stbl, "stts"); ok {
+		r := &byteReader{b: stts.body}
+		r.fullBox()
+		n := r.u32()
+		idx := 0
+		for i := uint32(0); i < n && r.err == nil; i++ {
+			sampleCount := r.u32()
+			delta := r.u32()
+			for j := uint32(0); j < sampleCount && idx < len(t.samples); j++ {
+				t.samples[idx].duration = delta
+				idx++
+			}
+		}
+		if r.err != nil {
+			return r.err
+		}
+	}
+
+	// Sync samples (absent stss means every sample is a sync sample)
+	if stss, ok := findBox(stbl, "stss"); ok {
+		for i := range t.samples {
+			t.samples[i].sync = false
+		}
+		r := &byteReader{b: stss.body}
+		r.fullBox()
+		n := r.u32()
+		for i := uint32(0); i < n && r.err == nil; i++ {
+			if num := r.u32(); num >= 1 && int(num) <= len(t.samples) {
+				t.samples[num-1].sync = true
+			}
+		}
+		if r.err != nil {
+			return r.err
+		}
+	}
+
+	// Chunk offsets
+	var chunkOffsets []uint64
+	if stco, ok := findBox(stbl, "stco"); ok {
+		r := &byteReader{b: stco.body}
+		r.fullBox()
+		n := r.u32()
+		for i := uint32(0); i < n && r.err == nil && i < maxTrackSamples; i++ {
+			chunkOffsets = append(chunkOffsets, uint64(r.u32()))
+		}
+		if r.err != nil {
+			return r.err
+		}
+	} else if co64, ok := findBox(stbl, "co64"); ok {
+		r := &byteReader{b: co64.body}
+		r.fullBox()
+		n := r.u32()
+		for i := uint32(0); i < n && r.err == nil && i < maxTrackSamples; i++ {
+			chunkOffsets = append(chunkOffsets, r.u64())
+		}
+		if r.err != nil {
+			return r.err
+		}
+	}
+
+	// Sample-to-chunk mapping
+	type stscEntry struct{ firstChunk, samplesPerChunk uint32 }
+	var stsc []stscEntry
+	if box, ok := findBox(stbl, "stsc"); ok {
+		r := &byteReader{b: box.body}
+		r.fullBox()
+		n := r.u32()
+		for i := uint32(0); i < n && r.err == nil && i < maxTrackSamples; i++ {
+			e := stscEntry{firstChunk: r.u32(), samplesPerChunk: r.u32()}
+			r.u32() // sample description index
+			// Chunk runs must be ordered, or the mapping below revisits chunks
+			if r.err == nil && (e.firstChunk < 1 || len(stsc) > 0 && e.firstChunk <= stsc[len(stsc)-1].firstChunk) {
+				return fmt.Errorf("%w: unordered stsc entries", ErrInvalidHEIF)
+			}
+			stsc = append(stsc, e)
+		}
+		if r.err != nil {
+			return r.err
+		}
+	}
+
+	idx := 0
+	for i, e := range stsc {
+		if idx == len(t.samples) {
+			break
+		}
+		last := uint32(len(chunkOffsets))
+		if i+1 < len(stsc) {
+			last = stsc[i+1].firstChunk - 1
+		}
+		for chunk := e.firstChunk; chunk <= last && int(chunk) <= len(chunkOffsets) && idx < len(t.samples); chunk++ {
+			off := chunkOffsets[chunk-1]
+			for s := uint32(0); s < e.samplesPerChunk && idx < len(t.samples); s++ {
+				t.samples[idx].offset = off
+				off += t.samples[idx].size
+				idx++
+			}
+		}
+	}
+	if idx != len(t.samples) {
+		return fmt.Errorf("%w: sample table does not cover all samples", ErrInvalidHEIF)
+	}
+	return nil
+}
+
+// itemData returns the payload of an item, concatenating its extents
+func (f *heifFile) itemData(it *heifItem) ([]byte, error) {
+	if len(it.extents) == 0 {
+		return nil, fmt.Errorf("%w: item %d has no location", ErrInvalidHEIF, it.id)
+	}
+	src := f.data
+	if it.construction == 1 {
+		src = f.idat
+	} else if it.construction != 0 {
+		return nil, fmt.Errorf("%w: construction method %d", ErrUnsupportedItem, it.construction)
+	}
+
+	var out []byte
+	for _, e := range it.extents {
+		start := it.baseOffset + e.offset
+		length := e.length
+		if length == 0 && len(it.extents) == 1 {
+			// A zero length means "to the end of the source"
+			if start > uint64(len(src)) {
+				return nil, fmt.Errorf("%w: item %d out of bounds", ErrInvalidHEIF, it.id)
+			}
+			length = uint64(len(src)) - start
+		}
+		if start > uint64(len(src)) || length > uint64(len(src))-start {
+			return nil, fmt.Errorf("%w: item %d out of bounds", ErrInvalidHEIF, it.id)
+		}
+		if len(it.extents) == 1 {
+			return src[start : start+length], nil
+		}
+		out = append(out, src[start:start+length]...)
+	}
+	return out, nil
+}
+
+// sampleData returns the payload of a sequence sample
+func (f *heifFile) sampleData(s sample) ([]byte, error) {
+	if s.offset > uint64(len(f.data)) || s.size > uint64(len(f.data))-s.offset {
+		return nil, fmt.Errorf("%w: sample out of bounds", ErrInvalidHEIF)
+	}
+	return f.data[s.offset : s.offset+s.size], nil
+}
+
+// isReferenced reports whether any item references id with the given type
+func (f *heifFile) isReferenced(id uint32, refType string) bool {
+	for _, it := range f.items {
+		for _, to := range it.refs[refType] {
+			if to == id {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -2,28 +2,100 @@ package converter
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"image"
 	"io"
-	"log"
+	"log/slog"
+	"time"
 
-	"github.com/adrium/goheif"
+	turbojpeg "github.com/harliandi/go-heif/pkg/jpeg"
+	"github.com/harliandi/go-heif/pkg/metrics"
 	"github.com/harliandi/go-heif/pkg/quality"
+	"github.com/harliandi/go-heif/pkg/webp"
 	"image/jpeg"
-
-	webp "github.com/chai2010/webp"
 )
 
 var (
 	ErrInvalidHEIF = errors.New("invalid HEIF file")
-	// UseTurboJPEG is kept for backward compatibility but currently unused
-	UseTurboJPEG = false
+	// UseTurboJPEG selects the libjpeg-turbo encoder (pkg/jpeg) for JPEG output.
+	// It has no effect in builds without it (purego tag or CGO_ENABLED=0).
+	UseTurboJPEG = turbojpeg.Available
+)
+
+// JPEG encoder backends
+const (
+	JPEGEncoderTurbo = "turbo" // libjpeg-turbo via cgo
+	JPEGEncoderStd   = "std"   // image/jpeg
 )
 
+// encodeTurboJPEG is the libjpeg-turbo backend (replaced in tests)
+var encodeTurboJPEG = turbojpeg.EncodeYCbCrWithOptions
+
+// JPEGEncoder returns the JPEG encoder backend in use
+func JPEGEncoder() string {
+	if UseTurboJPEG && turbojpeg.Available {
+		return JPEGEncoderTurbo
+	}
+	return JPEGEncoderStd
+}
+
 // Converter handles HEIF to JPEG/WebP conversion
 type Converter struct {
 	targetSizeKB int
 	outputFormat string // "jpeg" or "webp"
+	toneMap      string // HDR tone mapping operator ("none", "reinhard" or "hable")
+	jpegOpts     turbojpeg.Options
+	webpOpts     webp.Options
+	ctx          context.Context // stops the conversion between stages, nil for none
+}
+
+// Options are the per-conversion settings of a Converter
+type Options struct {
+	Format  string            // "jpeg" or "webp"
+	ToneMap string            // HDR tone mapping operator, empty keeps the default
+	JPEG    turbojpeg.Options // JPEG encoder settings; Quality is set per conversion
+	WebP    webp.Options      // WebP encoder settings; the zero value keeps the default
+
+	TargetSizeKB int // output size for adaptive quality, 0 keeps the converter's
+}
+
+// WithOptions returns a copy of the converter using the given options,
+// leaving c untouched so it can be shared between requests
+func (c *Converter) WithOptions(opts Options) *Converter {
+	cp := *c
+	if opts.Format != "" {
+		cp.outputFormat = opts.Format
+	}
+	if opts.ToneMap != "" {
+		cp.toneMap = opts.ToneMap
+	}
+	cp.jpegOpts = opts.JPEG
+	if opts.WebP != (webp.Options{}) {
+		cp.webpOpts = opts.WebP
+	}
+	if opts.TargetSizeKB > 0 {
+		cp.targetSizeKB = opts.TargetSizeKB
+	}
+	return &cp
+}
+
+// WithContext returns a copy of the converter whose conversions stop with
+// ctx's error once ctx is done. Cancellation is checked between the decode,
+// scale and encode stages and between grid tiles.
+func (c *Converter) WithContext(ctx context.Context) *Converter {
+	cp := *c
+	cp.ctx = ctx
+	return &cp
+}
+
+// jobContext returns the converter's context, or context.Background
+func (c *Converter) jobContext() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
 }
 
 // SetOutputFormat sets the output format ("jpeg" or "webp")
@@ -31,25 +103,95 @@ func (c *Converter) SetOutputFormat(format string) {
 	c.outputFormat = format
 }
 
+// SetToneMapping sets the operator used to map HDR (PQ/HLG) images to SDR
+func (c *Converter) SetToneMapping(op string) {
+	c.toneMap = op
+}
+
+// decode decodes the primary image of a HEIF file into an 8-bit image.
+// High bit depth images are down-converted and HDR images tone mapped.
+func (c *Converter) decode(data []byte) (image.Image, error) {
+	ctx := c.jobContext()
+	img, err := decodeAt(ctx, data, 0, c.toneMap)
+	if err != nil {
+		if errors.Is(err, ErrImageTooLarge) || ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidHEIF
+	}
+	return img, nil
+}
+
+// SetJPEGOptions sets the JPEG encoder settings (quality is set per conversion)
+func (c *Converter) SetJPEGOptions(opts turbojpeg.Options) {
+	c.jpegOpts = opts
+}
+
+// SetWebPOptions sets the WebP encoder settings (quality is set per conversion)
+func (c *Converter) SetWebPOptions(opts webp.Options) {
+	c.webpOpts = opts
+}
+
+// findQuality estimates the quality that reaches targetSizeKB with the
+// converter's output format and JPEG settings
+func (c *Converter) findQuality(img image.Image, targetSizeKB int) int {
+	ratio := 1.0
+	if c.outputFormat != "webp" {
+		ratio = c.jpegOpts.SizeRatio()
+	}
+	q, err := quality.FindOptimalQualityWithRatio(img, targetSizeKB, ratio)
+	if err != nil {
+		return 85 // Fallback
+	}
+	return q
+}
+
+// observeStage records the duration of a conversion stage (decode, scale
+// or encode) begun at start
+func observeStage(stage string, start time.Time) {
+	metrics.RecordConversionStage(stage, time.Since(start).Seconds())
+}
+
 // encodeImage encodes an image to JPEG or WebP based on outputFormat
-func encodeImage(img image.Image, quality int, format string, out *bytes.Buffer) error {
+func encodeImage(img image.Image, quality int, format string, jpegOpts turbojpeg.Options, webpOpts webp.Options, out *bytes.Buffer) error {
+	defer observeStage("encode", time.Now())
 	if format == "webp" {
-		// Convert to RGBA first for WebP encoding
-		var rgba *image.RGBA
-		if src, ok := img.(*image.RGBA); ok {
-			rgba = src
-		} else {
-			rgba = image.NewRGBA(img.Bounds())
-			for y := rgba.Rect.Min.Y; y < rgba.Rect.Max.Y; y++ {
-				for x := rgba.Rect.Min.X; x < rgba.Rect.Max.X; x++ {
-					rgba.Set(x, y, img.At(x, y))
-				}
-			}
+		// YCbCr images go to libwebp as planes, without an RGBA copy,
+		// unless the settings need RGB input
+		if ycc, ok := img.(*image.YCbCr); ok && webpOpts.NeedsRGB() {
+			img = ycbcrToRGBA(ycc)
 		}
-		return webp.Encode(out, rgba, &webp.Options{Quality: float32(quality)})
+		webpOpts.Quality = float32(quality)
+		return webp.Encode(out, img, &webpOpts)
 	}
 	// Default to JPEG
-	return jpeg.Encode(out, img, &jpeg.Options{Quality: quality})
+	jpegOpts.Quality = quality
+	if ycc, ok := img.(*image.YCbCr); ok && JPEGEncoder() == JPEGEncoderTurbo {
+		data, err := encodeTurboJPEG(ycc, &jpegOpts)
+		if err == nil {
+			out.Write(data)
+			return nil
+		}
+		slog.Warn("libjpeg-turbo encode failed, falling back to pure Go", "error", err)
+	}
+	// image/jpeg covers the default settings; the pure Go encoder in
+	// pkg/jpeg handles the rest (progressive, subsampling, ...)
+	if jpegOpts.Standard() {
+		return jpeg.Encode(out, img, &jpeg.Options{Quality: quality})
+	}
+	return turbojpeg.EncodeGo(out, img, &jpegOpts)
+}
+
+// encodeToBytes encodes img into a pooled buffer and returns a copy of the
+// output sized to fit, so the buffer can be reused by the next job
+func encodeToBytes(img image.Image, quality int, format string, jpegOpts turbojpeg.Options, webpOpts webp.Options) ([]byte, error) {
+	buf := GetBuffer(mediumBufferSize) // typical output size
+	defer PutBuffer(buf)
+	out := bytes.NewBuffer(*buf)
+	if err := encodeImage(img, quality, format, jpegOpts, webpOpts, out); err != nil {
+		return nil, err
+	}
+	return bytes.Clone(out.Bytes()), nil
 }
 
 // New creates a new Converter with the specified target output size in KB
@@ -57,6 +199,8 @@ func New(targetSizeKB int) *Converter {
 	return &Converter{
 		targetSizeKB: targetSizeKB,
 		outputFormat: "jpeg", // default to JPEG
+		toneMap:      DefaultToneMap,
+		webpOpts:     webp.Options{Method: webp.DefaultMethod},
 	}
 }
 
@@ -67,9 +211,9 @@ func (c *Converter) ConvertBytes(data []byte) ([]byte, error) {
 	}
 
 	// Decode HEIF
-	img, err := goheif.Decode(bytes.NewReader(data))
+	img, err := c.decode(data)
 	if err != nil {
-		return nil, ErrInvalidHEIF
+		return nil, err
 	}
 
 	// Validate image dimensions (protect against decompression bombs)
@@ -77,20 +221,16 @@ func (c *Converter) ConvertBytes(data []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	// Find optimal quality for target size (now just math, super fast)
-	q, err := quality.FindOptimalQuality(img, c.targetSizeKB)
-	if err != nil {
-		q = 85 // Fallback
-	}
-
-	// Encode as JPEG with optimized settings
-	var out bytes.Buffer
-	out.Grow(512 * 1024) // Pre-allocate for ~500KB
-	if err := encodeImage(img, q, c.outputFormat, &out); err != nil {
+	// Stop if the caller has given up
+	if err := c.jobContext().Err(); err != nil {
 		return nil, err
 	}
 
-	return out.Bytes(), nil
+	// Find optimal quality for target size (now just math, super fast)
+	q := c.findQuality(img, c.targetSizeKB)
+
+	// Encode as JPEG with optimized settings
+	return encodeToBytes(img, q, c.outputFormat, c.jpegOpts, c.webpOpts)
 }
 
 // Convert converts a HEIF image reader to JPEG bytes
@@ -137,9 +277,9 @@ func (c *Converter) ConvertBytesWithQuality(data []byte, q int) ([]byte, error)
 	}
 
 	// Decode HEIF
-	img, err := goheif.Decode(bytes.NewReader(data))
+	img, err := c.decode(data)
 	if err != nil {
-		return nil, ErrInvalidHEIF
+		return nil, err
 	}
 
 	// Validate image dimensions (protect against decompression bombs)
@@ -147,14 +287,13 @@ func (c *Converter) ConvertBytesWithQuality(data []byte, q int) ([]byte, error)
 		return nil, err
 	}
 
-	// Encode as JPEG
-	var out bytes.Buffer
-	out.Grow(512 * 1024)
-	if err := encodeImage(img, q, c.outputFormat, &out); err != nil {
+	// Stop if the caller has given up
+	if err := c.jobContext().Err(); err != nil {
 		return nil, err
 	}
 
-	return out.Bytes(), nil
+	// Encode as JPEG
+	return encodeToBytes(img, q, c.outputFormat, c.jpegOpts, c.webpOpts)
 }
 
 // Validate checks if the reader contains a valid HEIF file
@@ -166,7 +305,7 @@ func Validate(source io.Reader) error {
 	if _, err := io.Copy(&buf, source); err != nil {
 		return err
 	}
-	_, err := goheif.Decode(bytes.NewReader(buf.Bytes()))
+	_, err := decodeAt(context.Background(), buf.Bytes(), 0, DefaultToneMap)
 	if err != nil {
 		return ErrInvalidHEIF
 	}
@@ -182,9 +321,9 @@ func (c *Converter) ConvertBytesFast(data []byte, scale float64) ([]byte, error)
 	}
 
 	// Decode HEIF
-	img, err := goheif.Decode(bytes.NewReader(data))
+	img, err := c.decode(data)
 	if err != nil {
-		return nil, ErrInvalidHEIF
+		return nil, err
 	}
 
 	// Validate image dimensions (protect against decompression bombs)
@@ -192,20 +331,22 @@ func (c *Converter) ConvertBytesFast(data []byte, scale float64) ([]byte, error)
 		return nil, err
 	}
 
+	// Stop if the caller has given up
+	if err := c.jobContext().Err(); err != nil {
+		return nil, err
+	}
+
 	// Downsample image for faster encoding
 	scaled := scaleImage(img, scale)
+	if err := c.jobContext().Err(); err != nil {
+		return nil, err
+	}
 
 	// Use fixed quality 85 for fast mode - good balance of quality and size
 	const fastModeQuality = 85
 
 	// Encode as JPEG
-	var out bytes.Buffer
-	out.Grow(512 * 1024)
-	if err := encodeImage(scaled, fastModeQuality, c.outputFormat, &out); err != nil {
-		return nil, err
-	}
-
-	return out.Bytes(), nil
+	return encodeToBytes(scaled, fastModeQuality, c.outputFormat, c.jpegOpts, c.webpOpts)
 }
 
 // ConvertBytesFastWithQuality converts HEIF bytes with reduced resolution and fixed quality.
@@ -218,9 +359,9 @@ func (c *Converter) ConvertBytesFastWithQuality(data []byte, scale float64, q in
 	}
 
 	// Decode HEIF
-	img, err := goheif.Decode(bytes.NewReader(data))
+	img, err := c.decode(data)
 	if err != nil {
-		return nil, ErrInvalidHEIF
+		return nil, err
 	}
 
 	// Validate image dimensions (protect against decompression bombs)
@@ -228,31 +369,34 @@ func (c *Converter) ConvertBytesFastWithQuality(data []byte, scale float64, q in
 		return nil, err
 	}
 
+	// Stop if the caller has given up
+	if err := c.jobContext().Err(); err != nil {
+		return nil, err
+	}
+
 	// Downsample image for faster encoding
 	scaled := scaleImage(img, scale)
-
-	// Encode as JPEG
-	var out bytes.Buffer
-	out.Grow(512 * 1024)
-	if err := encodeImage(scaled, q, c.outputFormat, &out); err != nil {
+	if err := c.jobContext().Err(); err != nil {
 		return nil, err
 	}
 
-	return out.Bytes(), nil
+	// Encode as JPEG
+	return encodeToBytes(scaled, q, c.outputFormat, c.jpegOpts, c.webpOpts)
 }
 
 // scaleImage downscales an image by the given factor (e.g., 0.5 for half size).
-// Uses fast nearest-neighbor sampling for maximum speed.
+// Uses fast nearest-neighbor sampling, split into bands across CPU cores.
 func scaleImage(img image.Image, scale float64) image.Image {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("scaleImage panic recovered: %v", r)
+			slog.Error("scaleImage panic recovered", "error", fmt.Sprint(r))
 		}
 	}()
 
 	if scale >= 1.0 {
 		return img // No scaling needed
 	}
+	defer observeStage("scale", time.Now())
 
 	bounds := img.Bounds()
 	srcW := bounds.Dx()
@@ -260,7 +404,7 @@ func scaleImage(img image.Image, scale float64) image.Image {
 
 	// Validate image dimensions
 	if srcW <= 0 || srcH <= 0 {
-		log.Printf("Invalid image dimensions: %dx%d", srcW, srcH)
+		slog.Debug("invalid image dimensions", "width", srcW, "height", srcH)
 		return img
 	}
 
@@ -281,111 +425,11 @@ func scaleImage(img image.Image, scale float64) image.Image {
 	// Fast nearest-neighbor scaling
 	srcYCbCr, ok := img.(*image.YCbCr)
 	if ok {
-		scaleYCbCrNearest(srcYCbCr, yimg, srcW, srcH, dstW, dstH)
+		scaleYCbCrNearest(srcYCbCr, yimg)
 		return yimg
 	}
 
 	// Fallback for other image types
-	scaleGenericNearest(img, yimg, srcW, srcH, dstW, dstH)
+	scaleGenericNearest(img, yimg)
 	return yimg
 }
-
-// scaleYCbCrNearest scales YCbCr images using nearest-neighbor (fastest)
-func scaleYCbCrNearest(src, dst *image.YCbCr, srcW, srcH, dstW, dstH int) {
-	xRatio := (srcW << 16) / dstW
-	yRatio := (srcH << 16) / dstH
-
-	for y := 0; y < dstH; y++ {
-		srcY := (y * yRatio) >> 16
-		dstYOffset := y * dst.YStride
-		srcYOffset := srcY * src.YStride
-
-		for x := 0; x < dstW; x++ {
-			srcX := (x * xRatio) >> 16
-			dst.Y[dstYOffset+x] = src.Y[srcYOffset+srcX]
-		}
-	}
-
-	// IMPORTANT: YCbCr images with 4:2:0 subsampling already have Cb/Cr planes at half resolution!
-	// We must use the actual chroma dimensions from the image structures, not recalculate them.
-	// Scale chroma (Cb and Cr) at half resolution
-	cSrcW := src.Rect.Dx() / 2
-	cSrcH := src.Rect.Dy() / 2
-	cDstW := dst.Rect.Dx() / 2
-	cDstH := dst.Rect.Dy() / 2
-	cxRatio := (cSrcW << 16) / cDstW
-	cyRatio := (cSrcH << 16) / cDstH
-
-	for y := 0; y < cDstH; y++ {
-		srcY := (y * cyRatio) >> 16
-		dstCOffset := y * dst.CStride
-		srcCOffset := srcY * src.CStride
-
-		for x := 0; x < cDstW; x++ {
-			srcX := (x * cxRatio) >> 16
-			dst.Cb[dstCOffset+x] = src.Cb[srcCOffset+srcX]
-			dst.Cr[dstCOffset+x] = src.Cr[srcCOffset+srcX]
-		}
-	}
-}
-
-// scaleGenericNearest scales any image type using nearest-neighbor
-// Properly converts RGB to YCbCr to preserve colors
-func scaleGenericNearest(src image.Image, dst *image.YCbCr, srcW, srcH, dstW, dstH int) {
-	xRatio := (srcW << 16) / dstW
-	yRatio := (srcH << 16) / dstH
-
-	// First, collect all RGB samples for chroma calculation
-	type rgbSample struct {
-		r, g, b uint32
-	}
-	// We'll compute chroma at 2x2 blocks (420 subsampling)
-	cDstW := dstW / 2
-	cDstH := dstH / 2
-
-	for y := 0; y < dstH; y++ {
-		srcY := (y * yRatio) >> 16
-		dstYOffset := y * dst.YStride
-
-		for x := 0; x < dstW; x++ {
-			srcX := (x * xRatio) >> 16
-			r, g, b, _ := src.At(srcX, srcY).RGBA()
-			// RGBA returns pre-multiplied values in range [0, 65535]
-			// Convert RGB to YCbCr using standard JPEG conversion formulas
-			// Y = 0.299*R + 0.587*G + 0.114*B
-			// Cb = -0.1687*R - 0.3313*G + 0.5*B + 128
-			// Cr = 0.5*R - 0.4187*G - 0.0813*B + 128
-
-			// Use fixed-point arithmetic for performance
-			// Y: (19595*R + 38470*G + 7471*B + 1<<15) >> 24 (but RGBA is 16-bit, not 8-bit)
-			// For 16-bit input: (19595*R + 38470*G + 7471*B + 1<<23) >> 24
-			r8 := r >> 8
-			g8 := g >> 8
-			b8 := b >> 8
-
-			yVal := (19595*r8 + 38470*g8 + 7471*b8 + 1<<15) >> 16
-			dst.Y[dstYOffset+x] = uint8(yVal)
-		}
-	}
-
-	// Compute chroma (Cb, Cr) for each 2x2 block
-	for cy := 0; cy < cDstH; cy++ {
-		for cx := 0; cx < cDstW; cx++ {
-			// Sample the center of the 2x2 block in the source
-			srcX := ((cx * 2) * xRatio) >> 16
-			srcY := ((cy * 2) * yRatio) >> 16
-			r, g, b, _ := src.At(srcX, srcY).RGBA()
-			r8 := r >> 8
-			g8 := g >> 8
-			b8 := b >> 8
-
-			// Cb = -0.1687*R - 0.3313*G + 0.5*B + 128
-			cbVal := (int32(32768*b8) - int32(11056*r8) - int32(21712*g8))>>16 + 128
-			// Cr = 0.5*R - 0.4187*G - 0.0813*B + 128
-			crVal := (int32(32768*r8) - int32(27440*g8) - int32(5328*b8))>>16 + 128
-
-			dst.Cb[cy*dst.CStride+cx] = uint8(cbVal)
-			dst.Cr[cy*dst.CStride+cx] = uint8(crVal)
-		}
-	}
-}
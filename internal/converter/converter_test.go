@@ -11,6 +11,9 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/harliandi/go-heif/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestNew(t *testing.T) {
@@ -836,6 +839,132 @@ func TestWorkerPool_DoubleStart(t *testing.T) {
 	pool.Stop()
 }
 
+// TestWorkerPool_Stats tests active and queued job counts
+func TestWorkerPool_Stats(t *testing.T) {
+	// Workers are not started; next and finish stand in for one
+	pool := NewWorkerPool(2)
+	pool.enqueue(Job{Data: []byte("a")}, PriorityInteractive, "")
+	pool.enqueue(Job{Data: []byte("b")}, PriorityBatch, "")
+	if active, queued := pool.Stats(); active != 0 || queued != 2 {
+		t.Errorf("Stats() = %d, %d, want 0, 2", active, queued)
+	}
+	job, _ := pool.next()
+	if active, queued := pool.Stats(); active != 1 || queued != 1 {
+		t.Errorf("Stats() = %d, %d, want 1, 1", active, queued)
+	}
+	if got := testutil.ToFloat64(metrics.WorkerPoolActiveJobs); got != 1 {
+		t.Errorf("active jobs gauge = %v, want 1", got)
+	}
+	pool.finish(job)
+	if active, queued := pool.Stats(); active != 0 || queued != 1 {
+		t.Errorf("Stats() = %d, %d, want 0, 1", active, queued)
+	}
+}
+
+// TestWorkerPool_ConversionMetrics tests that finished jobs are recorded
+func TestWorkerPool_ConversionMetrics(t *testing.T) {
+	failed := metrics.ConversionsTotal.WithLabelValues("error")
+	before := testutil.ToFloat64(failed)
+
+	pool := NewWorkerPool(1)
+	defer pool.Stop()
+	if _, err := pool.Submit(context.Background(), []byte("invalid heif data"), 0.5, 80); err == nil {
+		t.Fatal("expected conversion error")
+	}
+	if got := testutil.ToFloat64(failed); got != before+1 {
+		t.Errorf("error conversions = %v, want %v", got, before+1)
+	}
+	if active, _ := pool.Stats(); active != 0 {
+		t.Errorf("%d jobs still active", active)
+	}
+}
+
+// TestWorkerPool_SkipsCancelledJobs tests that abandoned jobs are not converted
+func TestWorkerPool_SkipsCancelledJobs(t *testing.T) {
+	cancelled := metrics.ConversionsTotal.WithLabelValues("cancelled")
+	before := testutil.ToFloat64(cancelled)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pool := NewWorkerPool(1)
+	result := make(chan Result, 1)
+	if err := pool.enqueue(Job{Ctx: ctx, Data: loadTestHEIF(t), Scale: 1, Result: result}, PriorityInteractive, ""); err != nil {
+		t.Fatal(err)
+	}
+	pool.Start()
+	defer pool.Stop()
+
+	select {
+	case r := <-result:
+		if !errors.Is(r.Err, context.Canceled) || r.Data != nil {
+			t.Errorf("cancelled job returned %d bytes, %v", len(r.Data), r.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no result for cancelled job")
+	}
+	if got := testutil.ToFloat64(cancelled); got != before+1 {
+		t.Errorf("cancelled conversions = %v, want %v", got, before+1)
+	}
+}
+
+// TestConverter_WithContext tests that conversions stop once the context is done
+func TestConverter_WithContext(t *testing.T) {
+	data := loadTestHEIF(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	c := New(500)
+	conv := c.WithContext(ctx)
+	if conv == c || c.ctx != nil {
+		t.Fatal("WithContext modified the shared converter")
+	}
+
+	cancel()
+	for name, convert := range map[string]func() ([]byte, error){
+		"adaptive":     func() ([]byte, error) { return conv.ConvertBytes(data) },
+		"quality":      func() ([]byte, error) { return conv.ConvertBytesWithQuality(data, 80) },
+		"fast":         func() ([]byte, error) { return conv.ConvertBytesFast(data, 0.5) },
+		"fast quality": func() ([]byte, error) { return conv.ConvertBytesFastWithQuality(data, 0.5, 80) },
+		"item":         func() ([]byte, error) { return conv.ConvertItem(data, 0, 0.5, 80) },
+	} {
+		if out, err := convert(); !errors.Is(err, context.Canceled) || out != nil {
+			t.Errorf("%s: got %d bytes, %v, want context.Canceled", name, len(out), err)
+		}
+	}
+}
+
+func TestJobMode(t *testing.T) {
+	for _, tt := range []struct {
+		scale   float64
+		quality int
+		want    string
+	}{
+		{1, -1, "adaptive"},
+		{1, 80, "fixed_quality"},
+		{0.5, -1, "fast"},
+		{0.5, 80, "fast_quality"},
+	} {
+		if got := jobMode(tt.scale, tt.quality); got != tt.want {
+			t.Errorf("jobMode(%v, %d) = %q, want %q", tt.scale, tt.quality, got, tt.want)
+		}
+	}
+}
+
+// TestGetBuffer_Metrics tests buffer pool hit and miss counting
+func TestGetBuffer_Metrics(t *testing.T) {
+	hits := metrics.MemoryPoolHits.WithLabelValues("medium")
+	misses := metrics.MemoryPoolMisses.WithLabelValues("medium")
+	h0, m0 := testutil.ToFloat64(hits), testutil.ToFloat64(misses)
+
+	buf := GetBuffer(100 * 1024)
+	if cap(*buf) != mediumBufferSize {
+		t.Errorf("capacity %d, want %d", cap(*buf), mediumBufferSize)
+	}
+	PutBuffer(buf)
+	GetBuffer(100 * 1024)
+	if got := testutil.ToFloat64(hits) + testutil.ToFloat64(misses) - h0 - m0; got != 2 {
+		t.Errorf("recorded %v lookups, want 2", got)
+	}
+}
+
 // TestUseTurboJPEG_Disable tests encoding with turbo disabled
 func TestUseTurboJPEG_Disable(t *testing.T) {
 	// Save original value
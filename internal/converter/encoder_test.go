@@ -0,0 +1,240 @@
+package converter
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"os"
+	"testing"
+
+	turbojpeg "github.com/harliandi/go-heif/pkg/jpeg"
+	"github.com/harliandi/go-heif/pkg/metrics"
+	"github.com/harliandi/go-heif/pkg/webp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func testYCbCr(w, h int) *image.YCbCr {
+	img := image.NewYCbCr(image.Rect(0, 0, w, h), image.YCbCrSubsampleRatio420)
+	for i := range img.Y {
+		img.Y[i] = uint8(i % 251)
+	}
+	for i := range img.Cb {
+		img.Cb[i] = uint8(96 + i%64)
+		img.Cr[i] = uint8(160 - i%64)
+	}
+	return img
+}
+
+func TestEncodeImage_JPEGBackends(t *testing.T) {
+	original := UseTurboJPEG
+	defer func() { UseTurboJPEG = original }()
+
+	img := testYCbCr(320, 240)
+	for _, useTurbo := range []bool{false, true} {
+		UseTurboJPEG = useTurbo
+		want := JPEGEncoderStd
+		if useTurbo && turbojpeg.Available {
+			want = JPEGEncoderTurbo
+		}
+		if got := JPEGEncoder(); got != want {
+			t.Errorf("UseTurboJPEG=%v: JPEGEncoder() = %q, want %q", useTurbo, got, want)
+		}
+
+		var out bytes.Buffer
+		if err := encodeImage(img, 85, "jpeg", turbojpeg.Options{}, webp.Options{}, &out); err != nil {
+			t.Fatalf("%s: encodeImage failed: %v", want, err)
+		}
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: output is not valid JPEG: %v", want, err)
+		}
+		if cfg.Width != 320 || cfg.Height != 240 {
+			t.Errorf("%s: wrong dimensions %dx%d", want, cfg.Width, cfg.Height)
+		}
+	}
+}
+
+func TestEncodeImage_TurboFallback(t *testing.T) {
+	if !turbojpeg.Available {
+		t.Skip("libjpeg-turbo not compiled in")
+	}
+	originalUse, originalEnc := UseTurboJPEG, encodeTurboJPEG
+	defer func() { UseTurboJPEG, encodeTurboJPEG = originalUse, originalEnc }()
+
+	calls := 0
+	UseTurboJPEG = true
+	encodeTurboJPEG = func(*image.YCbCr, *turbojpeg.Options) ([]byte, error) {
+		calls++
+		return nil, errors.New("simulated encoder failure")
+	}
+
+	var out bytes.Buffer
+	if err := encodeImage(testYCbCr(64, 64), 85, "jpeg", turbojpeg.Options{}, webp.Options{}, &out); err != nil {
+		t.Fatalf("encodeImage should fall back to image/jpeg: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("turbo encoder called %d times, want 1", calls)
+	}
+	if _, err := jpeg.DecodeConfig(bytes.NewReader(out.Bytes())); err != nil {
+		t.Errorf("fallback output is not valid JPEG: %v", err)
+	}
+}
+
+// TestEncodeImage_JPEGOptions checks that encoder options are honored by
+// every backend, including the pure Go fallback
+func TestEncodeImage_JPEGOptions(t *testing.T) {
+	original := UseTurboJPEG
+	defer func() { UseTurboJPEG = original }()
+
+	img := testYCbCr(160, 120)
+	opts := turbojpeg.Options{Progressive: true, Subsampling: turbojpeg.Subsampling444, RestartInterval: 4}
+	for _, useTurbo := range []bool{false, true} {
+		UseTurboJPEG = useTurbo
+		var out bytes.Buffer
+		if err := encodeImage(img, 85, "jpeg", opts, webp.Options{}, &out); err != nil {
+			t.Fatalf("%s: encodeImage failed: %v", JPEGEncoder(), err)
+		}
+		data := out.Bytes()
+		if !bytes.Contains(data, []byte{0xFF, 0xC2}) {
+			t.Errorf("%s: output is not progressive", JPEGEncoder())
+		}
+		if !bytes.Contains(data, []byte{0xFF, 0xDD}) {
+			t.Errorf("%s: no restart interval", JPEGEncoder())
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+			t.Errorf("%s: output is not valid JPEG: %v", JPEGEncoder(), err)
+		}
+	}
+}
+
+func TestEncodeImage_MaxCompression(t *testing.T) {
+	original := UseTurboJPEG
+	defer func() { UseTurboJPEG = original }()
+
+	img := testYCbCr(320, 240)
+	for _, useTurbo := range []bool{false, true} {
+		UseTurboJPEG = useTurbo
+		var plain, small bytes.Buffer
+		if err := encodeImage(img, 80, "jpeg", turbojpeg.Options{}, webp.Options{}, &plain); err != nil {
+			t.Fatal(err)
+		}
+		if err := encodeImage(img, 80, "jpeg", turbojpeg.MaxCompression(0), webp.Options{}, &small); err != nil {
+			t.Fatalf("%s: encodeImage failed: %v", JPEGEncoder(), err)
+		}
+		if small.Len() >= plain.Len() {
+			t.Errorf("%s: max compression output %d bytes, default %d", JPEGEncoder(), small.Len(), plain.Len())
+		}
+		if _, err := jpeg.Decode(&small); err != nil {
+			t.Errorf("%s: output is not valid JPEG: %v", JPEGEncoder(), err)
+		}
+	}
+
+	// The target-size estimate accounts for the smaller output
+	c := New(200)
+	maxC := c.WithOptions(Options{JPEG: turbojpeg.MaxCompression(0)})
+	webpConv := c.WithOptions(Options{Format: "webp", JPEG: turbojpeg.MaxCompression(0)})
+	big := testYCbCr(1600, 1200)
+	if q, qMax := c.findQuality(big, 200), maxC.findQuality(big, 200); qMax <= q {
+		t.Errorf("max compression quality %d should exceed default %d", qMax, q)
+	}
+	if q, qWebP := c.findQuality(big, 200), webpConv.findQuality(big, 200); qWebP != q {
+		t.Errorf("JPEG settings should not affect WebP quality: %d != %d", qWebP, q)
+	}
+}
+
+// TestEncodeImage_WebP checks both the direct YCbCr path and RGBA input
+func TestEncodeImage_WebP(t *testing.T) {
+	ycc := testYCbCr(64, 48)
+	inputs := map[string]image.Image{"ycbcr": ycc, "rgba": webp.ToRGBA(ycc)}
+	for name, img := range inputs {
+		for _, opts := range []webp.Options{{Method: webp.DefaultMethod}, {Method: 0, SharpYUV: true}, {NearLossless: 60}} {
+			var out bytes.Buffer
+			if err := encodeImage(img, 80, "webp", turbojpeg.Options{}, opts, &out); err != nil {
+				t.Fatalf("%s %+v: encodeImage failed: %v", name, opts, err)
+			}
+			if data := out.Bytes(); len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+				t.Errorf("%s %+v: output is not WebP", name, opts)
+			}
+		}
+	}
+	if err := encodeImage(ycc, 80, "webp", turbojpeg.Options{}, webp.Options{Method: 9}, &bytes.Buffer{}); err == nil {
+		t.Error("expected error for invalid WebP options")
+	}
+}
+
+func TestWithOptions(t *testing.T) {
+	base := New(300)
+	c := base.WithOptions(Options{
+		Format:  "webp",
+		ToneMap: ToneMapReinhard,
+		JPEG:    turbojpeg.Options{Progressive: true},
+		WebP:    webp.Options{Method: 6, SharpYUV: true},
+	})
+	if c.outputFormat != "webp" || c.toneMap != ToneMapReinhard || !c.jpegOpts.Progressive || c.targetSizeKB != 300 {
+		t.Errorf("options not applied: %+v", c)
+	}
+	if c.webpOpts.Method != 6 || !c.webpOpts.SharpYUV {
+		t.Errorf("WebP options not applied: %+v", c.webpOpts)
+	}
+	if base.outputFormat != "jpeg" || base.toneMap != DefaultToneMap || base.jpegOpts.Progressive {
+		t.Errorf("WithOptions modified the original converter: %+v", base)
+	}
+	if d := base.WithOptions(Options{}); d.outputFormat != "jpeg" || d.toneMap != DefaultToneMap || d.webpOpts.Method != webp.DefaultMethod {
+		t.Errorf("empty options should keep the defaults: %+v", d)
+	}
+}
+
+// BenchmarkConvertBytes_JPEGEncoder measures a full-resolution conversion
+// with each JPEG backend
+func BenchmarkConvertBytes_JPEGEncoder(b *testing.B) {
+	data, err := os.ReadFile("../../testdata/test.heic")
+	if err != nil {
+		b.Skip("no test file")
+	}
+	original := UseTurboJPEG
+	defer func() { UseTurboJPEG = original }()
+
+	c := New(500)
+	for _, backend := range []string{JPEGEncoderStd, JPEGEncoderTurbo} {
+		UseTurboJPEG = backend == JPEGEncoderTurbo
+		if JPEGEncoder() != backend {
+			continue
+		}
+		b.Run(backend, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := c.ConvertBytesWithQuality(data, 85); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeToBytes_PooledBuffer(t *testing.T) {
+	misses := metrics.MemoryPoolMisses.WithLabelValues("medium")
+	hits := metrics.MemoryPoolHits.WithLabelValues("medium")
+	m0, h0 := testutil.ToFloat64(misses), testutil.ToFloat64(hits)
+
+	img := testYCbCr(64, 64)
+	var want bytes.Buffer
+	if err := encodeImage(img, 85, "jpeg", turbojpeg.Options{}, webp.Options{}, &want); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		got, err := encodeToBytes(img, 85, "jpeg", turbojpeg.Options{}, webp.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want.Bytes()) {
+			t.Error("output differs from encodeImage")
+		}
+		// The result must not share the pooled buffer
+		if cap(got) == mediumBufferSize {
+			t.Error("result aliases the pooled buffer")
+		}
+	}
+	if got := testutil.ToFloat64(hits) + testutil.ToFloat64(misses) - h0 - m0; got != 2 {
+		t.Errorf("recorded %v buffer pool lookups, want 2", got)
+	}
+}
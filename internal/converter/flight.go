@@ -0,0 +1,95 @@
+package converter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+// flightGroup coalesces identical concurrent conversions: the first caller
+// starts the job and callers arriving while it runs wait for the same
+// result. Each caller stops waiting when its own context is done; the job
+// itself is only cancelled once every caller has given up.
+//
+// The job runs with the first caller's context values, so it keeps that
+// caller's priority class and tenant: an interactive request joining a
+// queued background job waits at background priority, and the job is
+// charged to the first tenant's fair share.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// flightCall is one in-flight job and the callers waiting for it
+type flightCall struct {
+	done    chan struct{} // closed when data and err are set
+	data    []byte
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// do runs fn once for all concurrent callers with the same key. The result
+// is shared, so callers must not modify the returned data. shared reports
+// whether the caller joined a job started by another one.
+func (g *flightGroup) do(ctx context.Context, key string, fn func(ctx context.Context) ([]byte, error)) (data []byte, err error, shared bool) {
+	if err := ctx.Err(); err != nil {
+		return nil, err, false
+	}
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	c, shared := g.calls[key]
+	if !shared {
+		// The job outlives the first caller if others are still waiting,
+		// and keeps its priority and tenant (see flightGroup)
+		jobCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		c = &flightCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = c
+		go func() {
+			data, err := fn(jobCtx)
+			g.mu.Lock()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+			g.mu.Unlock()
+			c.data, c.err = data, err
+			cancel()
+			close(c.done)
+		}()
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.data, c.err, shared
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			// Nobody wants the result any more; later callers start afresh
+			c.cancel()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+		}
+		g.mu.Unlock()
+		return nil, ctx.Err(), shared
+	}
+}
+
+// jobKey identifies a conversion by its input and every setting that
+// affects the output
+func jobKey(data []byte, sel Selection, scale float64, quality int, opts Options) string {
+	if scale <= 0 || scale >= 1.0 {
+		scale = 1.0
+	}
+	h := sha256.New()
+	h.Write(data)
+	fmt.Fprintf(h, "\x00select=%+v|scale=%g|quality=%d|%+v", sel, scale, quality, opts)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,160 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	turbojpeg "github.com/harliandi/go-heif/pkg/jpeg"
+)
+
+// waitForWaiters blocks until n callers wait on key
+func waitForWaiters(t *testing.T, g *flightGroup, key string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		g.mu.Lock()
+		c := g.calls[key]
+		got := 0
+		if c != nil {
+			got = c.waiters
+		}
+		g.mu.Unlock()
+		if got == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d callers", n)
+}
+
+func TestFlightGroup_Coalesces(t *testing.T) {
+	var g flightGroup
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context) ([]byte, error) {
+		calls.Add(1)
+		<-release
+		return []byte("result"), nil
+	}
+
+	const n = 8
+	var wg sync.WaitGroup
+	var sharedCount atomic.Int32
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err, shared := g.do(context.Background(), "k", fn)
+			if err != nil || string(data) != "result" {
+				t.Errorf("do = %q, %v", data, err)
+			}
+			if shared {
+				sharedCount.Add(1)
+			}
+		}()
+	}
+	waitForWaiters(t, &g, "k", n)
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Errorf("fn ran %d times, want 1", calls.Load())
+	}
+	if sharedCount.Load() != n-1 {
+		t.Errorf("%d callers shared the result, want %d", sharedCount.Load(), n-1)
+	}
+
+	// Once finished, the same key runs again
+	if _, _, shared := g.do(context.Background(), "k", func(context.Context) ([]byte, error) { return nil, nil }); shared {
+		t.Error("finished call was reused")
+	}
+}
+
+func TestFlightGroup_Cancellation(t *testing.T) {
+	var g flightGroup
+	release := make(chan struct{})
+	jobCancelled := make(chan struct{})
+	fn := func(ctx context.Context) ([]byte, error) {
+		select {
+		case <-release:
+			return []byte("result"), nil
+		case <-ctx.Done():
+			close(jobCancelled)
+			return nil, ctx.Err()
+		}
+	}
+
+	// The first caller leaves; the job keeps running for the second
+	ctxA, cancelA := context.WithCancel(context.Background())
+	errA := make(chan error)
+	go func() {
+		_, err, _ := g.do(ctxA, "k", fn)
+		errA <- err
+	}()
+	waitForWaiters(t, &g, "k", 1)
+	resB := make(chan []byte)
+	go func() {
+		data, _, _ := g.do(context.Background(), "k", fn)
+		resB <- data
+	}()
+	waitForWaiters(t, &g, "k", 2)
+
+	cancelA()
+	if err := <-errA; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled caller got %v", err)
+	}
+	select {
+	case <-jobCancelled:
+		t.Fatal("job cancelled while a caller still waits")
+	default:
+	}
+	close(release)
+	if data := <-resB; string(data) != "result" {
+		t.Errorf("remaining caller got %q", data)
+	}
+
+	// When every caller leaves, the job is cancelled
+	ctxC, cancelC := context.WithCancel(context.Background())
+	release = make(chan struct{})
+	errC := make(chan error)
+	go func() {
+		_, err, _ := g.do(ctxC, "k2", fn)
+		errC <- err
+	}()
+	waitForWaiters(t, &g, "k2", 1)
+	cancelC()
+	<-errC
+	select {
+	case <-jobCancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("abandoned job not cancelled")
+	}
+}
+
+func TestJobKey(t *testing.T) {
+	data := []byte("heif")
+	base := jobKey(data, Selection{}, 0.5, 80, Options{Format: "jpeg"})
+	if base != jobKey(data, Selection{}, 0.5, 80, Options{Format: "jpeg"}) {
+		t.Error("jobKey is not deterministic")
+	}
+	if jobKey(data, Selection{}, 1, -1, Options{}) != jobKey(data, Selection{}, 2, -1, Options{}) {
+		t.Error("full resolution scales should share a key")
+	}
+	for name, other := range map[string]string{
+		"data":    jobKey([]byte("heic"), Selection{}, 0.5, 80, Options{Format: "jpeg"}),
+		"scale":   jobKey(data, Selection{}, 0.25, 80, Options{Format: "jpeg"}),
+		"quality": jobKey(data, Selection{}, 0.5, 81, Options{Format: "jpeg"}),
+		"format":  jobKey(data, Selection{}, 0.5, 80, Options{Format: "webp"}),
+		"jpeg":    jobKey(data, Selection{}, 0.5, 80, Options{Format: "jpeg", JPEG: turbojpeg.Options{Progressive: true}}),
+		"item":    jobKey(data, Selection{Kind: SelectItem, Index: 1}, 0.5, 80, Options{Format: "jpeg"}),
+		"target":  jobKey(data, Selection{}, 0.5, 80, Options{Format: "jpeg", TargetSizeKB: 200}),
+	} {
+		if other == base {
+			t.Errorf("different %s shares a key", name)
+		}
+	}
+}
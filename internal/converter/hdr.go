@@ -0,0 +1,372 @@
+package converter
+
+import (
+	"encoding/binary"
+	"image"
+	"math"
+)
+
+// Tone mapping operators for HDR (PQ/HLG) images
+const (
+	ToneMapNone     = "none"     // clip at SDR reference white
+	ToneMapReinhard = "reinhard" // extended Reinhard
+	ToneMapHable    = "hable"    // Hable/Uncharted 2 filmic curve
+)
+
+// DefaultToneMap is used when no tone mapping operator is set
+const DefaultToneMap = ToneMapHable
+
+// IsValidToneMap reports whether op is a supported tone mapping operator
+func IsValidToneMap(op string) bool {
+	switch op {
+	case ToneMapNone, ToneMapReinhard, ToneMapHable:
+		return true
+	}
+	return false
+}
+
+// nclx code points (ITU-T H.273) used by the conversion
+const (
+	primariesBT709  = 1
+	primariesBT2020 = 9
+
+	transferPQ  = 16
+	transferHLG = 18
+
+	matrixBT709    = 1
+	matrixBT470BG  = 5
+	matrixSMPTE170 = 6
+	matrixBT2020   = 9
+)
+
+const (
+	// sdrWhiteNits is the reference white of HDR content (ITU-R BT.2408)
+	sdrWhiteNits = 203.0
+	// defaultPeakNits is assumed when the file carries no content light level
+	defaultPeakNits = 1000.0
+	// lutSize is the resolution of the transfer function lookup tables
+	lutSize = 4096
+)
+
+// colorInfo is the colour description of a coded image, taken from its
+// colr (nclx) and clli properties. Zero values mean "unspecified".
+type colorInfo struct {
+	primaries uint16
+	transfer  uint16
+	matrix    uint16
+	fullRange bool
+	maxCLL    int // maximum content light level in cd/m²
+}
+
+// parseColorInfo reads the nclx colour description and content light level
+// from item properties or sample entry boxes. ICC profiles are ignored.
+func parseColorInfo(props []box) (colorInfo, bool) {
+	var ci colorInfo
+	found := false
+	for _, p := range props {
+		switch p.typ {
+		case "colr":
+			if found || len(p.body) < 11 || string(p.body[0:4]) != "nclx" {
+				continue
+			}
+			ci.primaries = binary.BigEndian.Uint16(p.body[4:6])
+			ci.transfer = binary.BigEndian.Uint16(p.body[6:8])
+			ci.matrix = binary.BigEndian.Uint16(p.body[8:10])
+			ci.fullRange = p.body[10]&0x80 != 0
+			found = true
+		case "clli":
+			if len(p.body) >= 2 {
+				ci.maxCLL = int(binary.BigEndian.Uint16(p.body[0:2]))
+			}
+		}
+	}
+	return ci, found
+}
+
+// isHDR reports whether the transfer characteristics are PQ or HLG
+func (ci colorInfo) isHDR() bool {
+	return ci.transfer == transferPQ || ci.transfer == transferHLG
+}
+
+// lumaCoefficients returns Kr and Kb of the YCbCr matrix
+func (ci colorInfo) lumaCoefficients() (kr, kb float64) {
+	switch ci.matrix {
+	case matrixBT709:
+		return 0.2126, 0.0722
+	case matrixBT470BG, matrixSMPTE170:
+		return 0.299, 0.114
+	case matrixBT2020:
+		return 0.2627, 0.0593
+	}
+	// Unspecified: follow the primaries
+	if ci.primaries == primariesBT2020 {
+		return 0.2627, 0.0593
+	}
+	return 0.2126, 0.0722
+}
+
+// hevcBitDepth returns the luma and chroma bit depths from an hvcC record
+func hevcBitDepth(hvcC []byte) (luma, chroma int) {
+	if len(hvcC) < 19 {
+		return 8, 8
+	}
+	return int(hvcC[17]&7) + 8, int(hvcC[18]&7) + 8
+}
+
+// toSDR converts a decoded picture into an 8-bit image suitable for JPEG or
+// WebP encoding. libde265 returns pictures deeper than 8 bits as 16-bit
+// little-endian samples; those are down-converted, and PQ/HLG content is
+// tone mapped to SDR with the given operator. 8-bit SDR pictures are
+// returned unchanged.
+func toSDR(img *image.YCbCr, lumaDepth, chromaDepth int, ci colorInfo, toneMap string) *image.YCbCr {
+	if ci.isHDR() {
+		return toneMapYCbCr(img, lumaDepth, chromaDepth, ci, toneMap)
+	}
+	if lumaDepth <= 8 && chromaDepth <= 8 {
+		return img
+	}
+	return reduceBitDepth(img, lumaDepth, chromaDepth)
+}
+
+// sampleReader returns a function reading the sample at byte offset i of a
+// plane with the given bit depth
+func sampleReader(depth int) func(plane []byte, i int) int {
+	if depth <= 8 {
+		return func(plane []byte, i int) int { return int(plane[i]) }
+	}
+	return func(plane []byte, i int) int { return int(plane[i]) | int(plane[i+1])<<8 }
+}
+
+// chromaShift returns the horizontal and vertical chroma subsampling shifts
+func chromaShift(r image.YCbCrSubsampleRatio) (sx, sy int) {
+	switch r {
+	case image.YCbCrSubsampleRatio420:
+		return 1, 1
+	case image.YCbCrSubsampleRatio422:
+		return 1, 0
+	}
+	return 0, 0
+}
+
+// reduceBitDepth rounds high bit depth samples to 8 bits, keeping the
+// subsampling and range of the source
+func reduceBitDepth(src *image.YCbCr, lumaDepth, chromaDepth int) *image.YCbCr {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewYCbCr(image.Rect(0, 0, w, h), src.SubsampleRatio)
+
+	reduce := func(dstPlane, srcPlane []byte, dstStride, srcStride, pw, ph, depth int) {
+		read := sampleReader(depth)
+		bytesPer := (depth + 7) / 8
+		shift := depth - 8
+		round := 0
+		if shift > 0 {
+			round = 1 << (shift - 1)
+		}
+		parallelRows(ph, func(y0, y1 int) {
+			for y := y0; y < y1; y++ {
+				for x := 0; x < pw; x++ {
+					v := (read(srcPlane, y*srcStride+x*bytesPer) + round) >> shift
+					dstPlane[y*dstStride+x] = uint8(min(v, 255))
+				}
+			}
+		})
+	}
+
+	reduce(dst.Y, src.Y, dst.YStride, src.YStride, w, h, lumaDepth)
+	sx, sy := chromaShift(src.SubsampleRatio)
+	cw, ch := (w+(1<<sx)-1)>>sx, (h+(1<<sy)-1)>>sy
+	reduce(dst.Cb, src.Cb, dst.CStride, src.CStride, cw, ch, chromaDepth)
+	reduce(dst.Cr, src.Cr, dst.CStride, src.CStride, cw, ch, chromaDepth)
+	return dst
+}
+
+// toneMapper holds the precomputed tables of one HDR to SDR conversion
+type toneMapper struct {
+	ci       colorInfo
+	toneMap  string
+	kr, kb   float64
+	eotf     []float64 // non-linear signal -> linear (PQ: relative to SDR white, HLG: scene light)
+	hlgGamma []float64 // HLG OOTF luminance gain Ys^(gamma-1)
+	oetf     []uint8   // linear [0,1] -> 8-bit sRGB
+	peak     float64   // content peak relative to SDR white
+	hableW   float64   // Hable curve value at the peak
+}
+
+func newToneMapper(ci colorInfo, toneMap string) *toneMapper {
+	if !IsValidToneMap(toneMap) {
+		toneMap = DefaultToneMap
+	}
+	t := &toneMapper{
+		ci:       ci,
+		toneMap:  toneMap,
+		eotf:     make([]float64, lutSize),
+		hlgGamma: make([]float64, lutSize),
+		oetf:     make([]uint8, lutSize),
+	}
+	t.kr, t.kb = ci.lumaCoefficients()
+
+	peakNits := defaultPeakNits
+	if ci.transfer == transferPQ && ci.maxCLL > 0 {
+		peakNits = float64(ci.maxCLL)
+	}
+	t.peak = max(peakNits/sdrWhiteNits, 1)
+	t.hableW = hable(t.peak * hableExposure)
+
+	for i := range lutSize {
+		e := float64(i) / (lutSize - 1)
+		if ci.transfer == transferPQ {
+			t.eotf[i] = pqEOTF(e) / sdrWhiteNits
+		} else {
+			t.eotf[i] = hlgInverseOETF(e)
+		}
+		// BT.2100 HLG OOTF system gamma 1.2 for a 1000 cd/m² display
+		t.hlgGamma[i] = math.Pow(e, 0.2)
+		t.oetf[i] = uint8(math.Round(srgbOETF(e) * 255))
+	}
+	return t
+}
+
+// lut looks up v in [0,1] in a transfer table
+func lut[T any](table []T, v float64) T {
+	if v <= 0 {
+		return table[0]
+	}
+	if v >= 1 {
+		return table[lutSize-1]
+	}
+	return table[int(v*(lutSize-1)+0.5)]
+}
+
+// pixel converts one normalized non-linear Y'CbCr sample to 8-bit sRGB
+func (t *toneMapper) pixel(y, cb, cr float64) (uint8, uint8, uint8) {
+	kr, kb := t.kr, t.kb
+	kg := 1 - kr - kb
+	r := y + 2*(1-kr)*cr
+	b := y + 2*(1-kb)*cb
+	g := (y - kr*r - kb*b) / kg
+
+	r, g, b = lut(t.eotf, r), lut(t.eotf, g), lut(t.eotf, b)
+	if t.ci.transfer == transferHLG {
+		// OOTF: scene light to display light, 1000 cd/m² nominal peak
+		ys := 0.2627*r + 0.6780*g + 0.0593*b
+		gain := lut(t.hlgGamma, ys) * defaultPeakNits / sdrWhiteNits
+		r, g, b = r*gain, g*gain, b*gain
+	}
+
+	if t.ci.primaries == primariesBT2020 {
+		r, g, b = 1.6605*r-0.5876*g-0.0728*b,
+			-0.1246*r+1.1329*g-0.0083*b,
+			-0.0182*r-0.1006*g+1.1187*b
+		r, g, b = max(r, 0), max(g, 0), max(b, 0)
+	}
+
+	// Tone map the brightest channel and scale the others along to keep hue
+	if m := max(r, g, b); m > 0 {
+		var mapped float64
+		switch t.toneMap {
+		case ToneMapReinhard:
+			mapped = reinhard(m, t.peak)
+		case ToneMapHable:
+			mapped = min(hable(m*hableExposure)/t.hableW, 1)
+		default:
+			mapped = min(m, 1)
+		}
+		s := mapped / m
+		r, g, b = r*s, g*s, b*s
+	}
+	return lut(t.oetf, r), lut(t.oetf, g), lut(t.oetf, b)
+}
+
+// toneMapYCbCr converts an HDR picture to full-range 8-bit 4:2:0 YCbCr (the
+// JPEG colour space) through linear light
+func toneMapYCbCr(src *image.YCbCr, lumaDepth, chromaDepth int, ci colorInfo, toneMap string) *image.YCbCr {
+	t := newToneMapper(ci, toneMap)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewYCbCr(image.Rect(0, 0, w, h), image.YCbCrSubsampleRatio420)
+
+	readY, readC := sampleReader(lumaDepth), sampleReader(chromaDepth)
+	yBytes, cBytes := (lumaDepth+7)/8, (chromaDepth+7)/8
+	sx, sy := chromaShift(src.SubsampleRatio)
+
+	// Normalization to [0,1] luma and [-0.5,0.5] chroma
+	lumaMax, chromaMax := 1<<lumaDepth-1, 1<<chromaDepth-1
+	yOff, yScale := 0.0, float64(lumaMax)
+	cOff, cScale := float64(chromaMax/2+1), float64(chromaMax)
+	if !ci.fullRange {
+		// Limited range: luma 16..235, chroma 16..240 at 8 bits
+		yOff, yScale = float64(lumaMax+1)/16, float64(lumaMax+1)*219/256
+		cScale = float64(chromaMax+1) * 224 / 256
+	}
+
+	// Bands of whole 2x2 blocks, one output chroma row each
+	parallelRows((h+1)/2, func(c0, c1 int) {
+		for y0 := 2 * c0; y0 < min(2*c1, h); y0 += 2 {
+			for x0 := 0; x0 < w; x0 += 2 {
+				var sumR, sumG, sumB, n int
+				for y := y0; y < min(y0+2, h); y++ {
+					for x := x0; x < min(x0+2, w); x++ {
+						co := (y>>sy)*src.CStride + (x>>sx)*cBytes
+						yv := (float64(readY(src.Y, y*src.YStride+x*yBytes)) - yOff) / yScale
+						cb := (float64(readC(src.Cb, co)) - cOff) / cScale
+						cr := (float64(readC(src.Cr, co)) - cOff) / cScale
+						r, g, b := t.pixel(yv, cb, cr)
+						dst.Y[y*dst.YStride+x] = rgbToY(r, g, b)
+						sumR, sumG, sumB, n = sumR+int(r), sumG+int(g), sumB+int(b), n+1
+					}
+				}
+				cb, cr := rgbToCbCr(uint8(sumR/n), uint8(sumG/n), uint8(sumB/n))
+				off := (y0/2)*dst.CStride + x0/2
+				dst.Cb[off], dst.Cr[off] = cb, cr
+			}
+		}
+	})
+	return dst
+}
+
+// pqEOTF maps a PQ signal (SMPTE ST 2084) to display light in cd/m²
+func pqEOTF(e float64) float64 {
+	const (
+		m1 = 2610.0 / 16384
+		m2 = 2523.0 / 4096 * 128
+		c1 = 3424.0 / 4096
+		c2 = 2413.0 / 4096 * 32
+		c3 = 2392.0 / 4096 * 32
+	)
+	p := math.Pow(e, 1/m2)
+	return 10000 * math.Pow(max(p-c1, 0)/(c2-c3*p), 1/m1)
+}
+
+// hlgInverseOETF maps an HLG signal (ARIB STD-B67) to normalized scene light
+func hlgInverseOETF(e float64) float64 {
+	const (
+		a = 0.17883277
+		b = 1 - 4*a
+		c = 0.55991073
+	)
+	if e <= 0.5 {
+		return e * e / 3
+	}
+	return (math.Exp((e-c)/a) + b) / 12
+}
+
+// srgbOETF maps linear light in [0,1] to the sRGB signal
+func srgbOETF(l float64) float64 {
+	if l <= 0.0031308 {
+		return 12.92 * l
+	}
+	return 1.055*math.Pow(l, 1/2.4) - 0.055
+}
+
+// reinhard is the extended Reinhard operator mapping peak to 1
+func reinhard(l, peak float64) float64 {
+	return min(l*(1+l/(peak*peak))/(1+l), 1)
+}
+
+// hableExposure is the exposure bias applied before the Hable curve
+const hableExposure = 2.0
+
+// hable is John Hable's filmic curve (Uncharted 2)
+func hable(x float64) float64 {
+	const a, b, c, d, e, f = 0.15, 0.50, 0.10, 0.20, 0.02, 0.30
+	return (x*(a*x+c*b)+d*e)/(x*(a*x+b)+d*f) - e/f
+}
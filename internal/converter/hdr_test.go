@@ -0,0 +1,195 @@
+package converter
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+// newDeepYCbCr builds a flat 4:2:0 picture laid out like libde265 output for
+// bit depths above 8: 16-bit little-endian samples
+func newDeepYCbCr(w, h, y, cb, cr int) *image.YCbCr {
+	cw, ch := (w+1)/2, (h+1)/2
+	img := &image.YCbCr{
+		Y:              make([]byte, 2*w*h),
+		Cb:             make([]byte, 2*cw*ch),
+		Cr:             make([]byte, 2*cw*ch),
+		YStride:        2 * w,
+		CStride:        2 * cw,
+		SubsampleRatio: image.YCbCrSubsampleRatio420,
+		Rect:           image.Rect(0, 0, w, h),
+	}
+	fill := func(plane []byte, v int) {
+		for i := 0; i < len(plane); i += 2 {
+			plane[i], plane[i+1] = byte(v), byte(v>>8)
+		}
+	}
+	fill(img.Y, y)
+	fill(img.Cb, cb)
+	fill(img.Cr, cr)
+	return img
+}
+
+// pqCode returns the 10-bit limited range PQ luma code for the given luminance
+func pqCode(nits float64) int {
+	// Inverse of pqEOTF by bisection
+	lo, hi := 0.0, 1.0
+	for range 50 {
+		mid := (lo + hi) / 2
+		if pqEOTF(mid) < nits {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return 64 + int(math.Round(lo*876))
+}
+
+func TestParseColorInfo(t *testing.T) {
+	nclx := box{typ: "colr", body: []byte{'n', 'c', 'l', 'x', 0, 9, 0, 16, 0, 9, 0x80}}
+	clli := box{typ: "clli", body: []byte{0x03, 0xE8, 0x01, 0x90}}
+	icc := box{typ: "colr", body: []byte{'p', 'r', 'o', 'f', 0, 0, 0, 0}}
+
+	ci, ok := parseColorInfo([]box{icc, nclx, clli})
+	if !ok {
+		t.Fatal("expected nclx colour information")
+	}
+	want := colorInfo{primaries: 9, transfer: 16, matrix: 9, fullRange: true, maxCLL: 1000}
+	if ci != want {
+		t.Errorf("got %+v, want %+v", ci, want)
+	}
+	if !ci.isHDR() {
+		t.Error("PQ transfer should be HDR")
+	}
+
+	if _, ok := parseColorInfo([]box{icc}); ok {
+		t.Error("ICC-only colr should not yield nclx information")
+	}
+}
+
+func TestHevcBitDepth(t *testing.T) {
+	hvcC := make([]byte, 23)
+	hvcC[17], hvcC[18] = 0xFA, 0xFA // reserved bits set, depth minus 8 = 2
+	if luma, chroma := hevcBitDepth(hvcC); luma != 10 || chroma != 10 {
+		t.Errorf("got %d/%d, want 10/10", luma, chroma)
+	}
+	if luma, chroma := hevcBitDepth(nil); luma != 8 || chroma != 8 {
+		t.Errorf("truncated hvcC: got %d/%d, want 8/8", luma, chroma)
+	}
+}
+
+func TestTransferFunctions(t *testing.T) {
+	tests := []struct {
+		name string
+		got  float64
+		want float64
+		tol  float64
+	}{
+		{"PQ black", pqEOTF(0), 0, 1e-9},
+		{"PQ peak", pqEOTF(1), 10000, 1e-6},
+		{"PQ 100 nits", pqEOTF(0.5081), 100, 0.5},
+		{"PQ 1000 nits", pqEOTF(0.7518), 1000, 2},
+		{"HLG knee", hlgInverseOETF(0.5), 1.0 / 12, 1e-9},
+		{"HLG peak", hlgInverseOETF(1), 1, 1e-6},
+		{"sRGB white", srgbOETF(1), 1, 1e-9},
+		{"Reinhard peak", reinhard(4.9, 4.9), 1, 1e-9},
+	}
+	for _, tt := range tests {
+		if math.Abs(tt.got-tt.want) > tt.tol {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+
+	// Curves must be monotonic
+	for x := 0.0; x < 5; x += 0.01 {
+		if reinhard(x+0.01, 5) < reinhard(x, 5) || hable(x+0.01) < hable(x) {
+			t.Fatalf("tone curve not monotonic at %v", x)
+		}
+	}
+}
+
+func TestToSDR_8BitPassthrough(t *testing.T) {
+	img := image.NewYCbCr(image.Rect(0, 0, 4, 4), image.YCbCrSubsampleRatio420)
+	if got := toSDR(img, 8, 8, colorInfo{primaries: 1, transfer: 1}, DefaultToneMap); got != img {
+		t.Error("8-bit SDR image should be returned unchanged")
+	}
+}
+
+func TestToSDR_10BitSDR(t *testing.T) {
+	tests := []struct {
+		in, want int
+	}{
+		{0, 0},
+		{4, 1},
+		{512, 128},
+		{1023, 255},
+	}
+	for _, tt := range tests {
+		img := toSDR(newDeepYCbCr(5, 3, tt.in, tt.in, tt.in), 10, 10, colorInfo{}, DefaultToneMap)
+		if img.Rect.Dx() != 5 || img.Rect.Dy() != 3 {
+			t.Fatalf("unexpected size %v", img.Rect)
+		}
+		for _, plane := range [][]byte{img.Y[:5], img.Cb[:3], img.Cr[:3]} {
+			for _, v := range plane {
+				if int(v) != tt.want {
+					t.Fatalf("sample %d: got %d, want %d", tt.in, v, tt.want)
+				}
+			}
+		}
+	}
+}
+
+func TestToSDR_PQToneMapping(t *testing.T) {
+	ci := colorInfo{primaries: primariesBT2020, transfer: transferPQ, matrix: matrixBT2020}
+	luma := func(nits float64, op string) int {
+		img := toSDR(newDeepYCbCr(4, 4, pqCode(nits), 512, 512), 10, 10, ci, op)
+		if img.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+			t.Fatalf("expected 4:2:0 output, got %v", img.SubsampleRatio)
+		}
+		// Neutral input must stay neutral
+		if d := int(img.Cb[0]) - 128; d < -1 || d > 1 {
+			t.Errorf("%s %v nits: Cb = %d, want 128", op, nits, img.Cb[0])
+		}
+		if d := int(img.Cr[0]) - 128; d < -1 || d > 1 {
+			t.Errorf("%s %v nits: Cr = %d, want 128", op, nits, img.Cr[0])
+		}
+		return int(img.Y[0])
+	}
+
+	if y := luma(0, ToneMapHable); y != 0 {
+		t.Errorf("black: got %d, want 0", y)
+	}
+	// Without tone mapping reference white and highlights clip to white
+	if y := luma(sdrWhiteNits, ToneMapNone); y != 255 {
+		t.Errorf("none: reference white got %d, want 255", y)
+	}
+	if y := luma(1000, ToneMapNone); y != 255 {
+		t.Errorf("none: highlight got %d, want 255", y)
+	}
+
+	for _, op := range []string{ToneMapReinhard, ToneMapHable} {
+		white, highlight := luma(sdrWhiteNits, op), luma(1000, op)
+		if white < 128 || white >= highlight {
+			t.Errorf("%s: reference white %d, highlight %d", op, white, highlight)
+		}
+		if highlight < 250 {
+			t.Errorf("%s: 1000 nit peak got %d, want ~255", op, highlight)
+		}
+	}
+}
+
+func TestToSDR_HLG(t *testing.T) {
+	ci := colorInfo{primaries: primariesBT2020, transfer: transferHLG, matrix: matrixBT2020, fullRange: true}
+	prev := -1
+	for _, code := range []int{0, 256, 512, 768, 1023} {
+		img := toSDR(newDeepYCbCr(2, 2, code, 512, 512), 10, 10, ci, ToneMapHable)
+		y := int(img.Y[0])
+		if y < prev {
+			t.Errorf("HLG code %d: luma %d below previous %d", code, y, prev)
+		}
+		prev = y
+	}
+	if prev < 250 {
+		t.Errorf("HLG peak got %d, want ~255", prev)
+	}
+}
@@ -0,0 +1,343 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"time"
+
+	"github.com/adrium/goheif/libde265"
+)
+
+// Image kinds reported by ListImages
+const (
+	ImageKindItem  = "item"  // top-level image item in the meta box
+	ImageKindFrame = "frame" // sync sample of an image sequence track
+)
+
+// ImageInfo describes one decodable image in a HEIF container
+type ImageInfo struct {
+	Index      int    `json:"index"`
+	Kind       string `json:"kind"`
+	ItemID     uint32 `json:"item_id,omitempty"`
+	TrackID    uint32 `json:"track_id,omitempty"`
+	Frame      int    `json:"frame,omitempty"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	Primary    bool   `json:"primary,omitempty"`
+	DurationMs int    `json:"duration_ms,omitempty"`
+}
+
+// imageRef points at the container entity behind an ImageInfo
+type imageRef struct {
+	info  ImageInfo
+	item  *heifItem
+	track *heifTrack
+	// samples are the indexes of the track samples covered by this frame;
+	// the first one is the sync sample that gets decoded
+	samples []int
+}
+
+// ListImages lists the top-level image items and image sequence frames
+// of a HEIF file. The primary item, if any, is always index 0.
+func ListImages(data []byte) ([]ImageInfo, error) {
+	f, err := parseContainer(data)
+	if err != nil {
+		return nil, err
+	}
+	refs := f.images()
+	infos := make([]ImageInfo, len(refs))
+	for i, r := range refs {
+		infos[i] = r.info
+	}
+	return infos, nil
+}
+
+// images enumerates decodable images in a stable order
+func (f *heifFile) images() []imageRef {
+	var refs []imageRef
+
+	add := func(it *heifItem) {
+		w, h, _ := it.size()
+		refs = append(refs, imageRef{
+			info: ImageInfo{
+				Kind:    ImageKindItem,
+				ItemID:  it.id,
+				Width:   w,
+				Height:  h,
+				Primary: it.id == f.primaryID,
+			},
+			item: it,
+		})
+	}
+
+	if primary, ok := f.byID[f.primaryID]; ok && isImageItem(primary.typ) {
+		add(primary)
+	}
+	for _, it := range f.items {
+		if it.id == f.primaryID || !isImageItem(it.typ) || it.hidden {
+			continue
+		}
+		// Skip grid tiles, thumbnails and auxiliary images (alpha, depth)
+		if f.isReferenced(it.id, "dimg") || len(it.refs["thmb"]) > 0 || len(it.refs["auxl"]) > 0 {
+			continue
+		}
+		add(it)
+	}
+
+	for _, t := range f.tracks {
+		frame := 0
+		for i, s := range t.samples {
+			// Inter-coded samples cannot be decoded on their own; their
+			// display time is folded into the preceding sync sample, so
+			// only keyframes are listed and can be extracted.
+			if !s.sync {
+				if n := len(refs); n > 0 && refs[n-1].track == t {
+					refs[n-1].samples = append(refs[n-1].samples, i)
+					refs[n-1].info.DurationMs += durationMs(s.duration, t.timescale)
+				}
+				continue
+			}
+			refs = append(refs, imageRef{
+				info: ImageInfo{
+					Kind:       ImageKindFrame,
+					TrackID:    t.id,
+					Frame:      frame,
+					Width:      t.width,
+					Height:     t.height,
+					DurationMs: durationMs(s.duration, t.timescale),
+				},
+				track:   t,
+				samples: []int{i},
+			})
+			frame++
+		}
+	}
+
+	for i := range refs {
+		refs[i].info.Index = i
+	}
+	return refs
+}
+
+// isImageItem reports whether the item type is a coded image we can decode
+func isImageItem(typ string) bool {
+	return typ == "hvc1" || typ == "grid"
+}
+
+func durationMs(duration, timescale uint32) int {
+	if timescale == 0 {
+		return 0
+	}
+	return int(uint64(duration) * 1000 / uint64(timescale))
+}
+
+// hevcHeader converts an hvcC configuration record into length-prefixed
+// parameter set NAL units (VPS/SPS/PPS) ready to be pushed to the decoder
+func hevcHeader(hvcC []byte) ([]byte, error) {
+	// 22 bytes of fixed configuration fields, then numOfArrays
+	if len(hvcC) < 23 {
+		return nil, fmt.Errorf("%w: truncated hvcC", ErrInvalidHEIF)
+	}
+	r := &byteReader{b: hvcC[22:]}
+	numArrays := int(r.u8())
+	var out []byte
+	for i := 0; i < numArrays && r.err == nil; i++ {
+		r.u8() // completeness + NAL unit type
+		numNalus := int(r.u16())
+		for j := 0; j < numNalus && r.err == nil; j++ {
+			n := int(r.u16())
+			nal := r.take(n)
+			if n == 0 || nal == nil {
+				continue
+			}
+			out = append(out, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+			out = append(out, nal...)
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return out, nil
+}
+
+// decodeHEVC decodes one HEVC coded picture with its hvcC configuration
+func decodeHEVC(dec *libde265.Decoder, hvcC, data []byte) (*image.YCbCr, error) {
+	hdr, err := hevcHeader(hvcC)
+	if err != nil {
+		return nil, err
+	}
+	dec.Reset()
+	if err := dec.Push(hdr); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidHEIF, err)
+	}
+	img, err := dec.DecodeImage(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidHEIF, err)
+	}
+	ycc, ok := img.(*image.YCbCr)
+	if !ok {
+		return nil, fmt.Errorf("%w: decoded picture is not YCbCr", ErrInvalidHEIF)
+	}
+	return ycc, nil
+}
+
+// newDecoder creates a libde265 decoder that copies decoded planes into Go
+// memory, so returned images stay valid after the decoder is freed
+func newDecoder() (*libde265.Decoder, error) {
+	return libde265.NewDecoder(libde265.WithSafeEncoding(true))
+}
+
+// decodeImageRef decodes the image behind ref into an 8-bit image, tone
+// mapping HDR content with the given operator. Grid images stop between
+// tiles once ctx is done.
+func (f *heifFile) decodeImageRef(ctx context.Context, ref imageRef, toneMap string) (*image.YCbCr, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer observeStage("decode", time.Now())
+	dec, err := newDecoder()
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Free()
+
+	if ref.track != nil {
+		data, err := f.sampleData(ref.track.samples[ref.samples[0]])
+		if err != nil {
+			return nil, err
+		}
+		img, err := decodeHEVC(dec, ref.track.hvcC, data)
+		if err != nil {
+			return nil, err
+		}
+		ci, _ := parseColorInfo(ref.track.props)
+		lumaDepth, chromaDepth := hevcBitDepth(ref.track.hvcC)
+		return toSDR(img, lumaDepth, chromaDepth, ci, toneMap), nil
+	}
+	return f.decodeItem(ctx, dec, ref.item, colorInfo{}, toneMap)
+}
+
+// decodeItem decodes an hvc1 or grid image item. ci is the colour
+// description inherited from a parent grid, overridden by the item's own.
+func (f *heifFile) decodeItem(ctx context.Context, dec *libde265.Decoder, it *heifItem, ci colorInfo, toneMap string) (*image.YCbCr, error) {
+	if own, ok := parseColorInfo(it.props); ok {
+		ci = own
+	}
+	switch it.typ {
+	case "hvc1":
+		hvcC, ok := it.property("hvcC")
+		if !ok {
+			return nil, fmt.Errorf("%w: item %d has no hvcC", ErrInvalidHEIF, it.id)
+		}
+		data, err := f.itemData(it)
+		if err != nil {
+			return nil, err
+		}
+		img, err := decodeHEVC(dec, hvcC.body, data)
+		if err != nil {
+			return nil, err
+		}
+		lumaDepth, chromaDepth := hevcBitDepth(hvcC.body)
+		return toSDR(img, lumaDepth, chromaDepth, ci, toneMap), nil
+	case "grid":
+		return f.decodeGrid(ctx, dec, it, ci, toneMap)
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedItem, it.typ)
+}
+
+// decodeGrid decodes all tiles of a grid item and stitches them together
+func (f *heifFile) decodeGrid(ctx context.Context, dec *libde265.Decoder, it *heifItem, ci colorInfo, toneMap string) (*image.YCbCr, error) {
+	desc, err := f.itemData(it)
+	if err != nil {
+		return nil, err
+	}
+	r := &byteReader{b: desc}
+	r.u8() // version
+	flags := r.u8()
+	rows := int(r.u8()) + 1
+	columns := int(r.u8()) + 1
+	var width, height int
+	if flags&1 != 0 {
+		width, height = int(r.u32()), int(r.u32())
+	} else {
+		width, height = int(r.u16()), int(r.u16())
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	tiles := it.refs["dimg"]
+	if len(tiles) != rows*columns {
+		return nil, fmt.Errorf("%w: grid expects %d tiles, found %d", ErrInvalidHEIF, rows*columns, len(tiles))
+	}
+
+	var out *image.YCbCr
+	var tileW, tileH int
+	for i, id := range tiles {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		tileItem, ok := f.byID[id]
+		if !ok || tileItem.typ != "hvc1" {
+			return nil, fmt.Errorf("%w: invalid grid tile %d", ErrInvalidHEIF, id)
+		}
+		tile, err := f.decodeItem(ctx, dec, tileItem, ci, toneMap)
+		if err != nil {
+			return nil, err
+		}
+		if out == nil {
+			tileW, tileH = tile.Rect.Dx(), tile.Rect.Dy()
+			if int64(tileW)*int64(columns)*int64(tileH)*int64(rows) > MaxImagePixels {
+				return nil, ErrImageTooLarge
+			}
+			out = image.NewYCbCr(image.Rect(0, 0, tileW*columns, tileH*rows), tile.SubsampleRatio)
+		}
+		if tile.Rect.Dx() != tileW || tile.Rect.Dy() != tileH || tile.SubsampleRatio != out.SubsampleRatio {
+			return nil, fmt.Errorf("%w: inconsistent grid tiles", ErrInvalidHEIF)
+		}
+		copyTile(out, tile, (i%columns)*tileW, (i/columns)*tileH)
+	}
+
+	// Crop to the declared output size
+	if width > 0 && height > 0 && width <= out.Rect.Dx() && height <= out.Rect.Dy() {
+		out = out.SubImage(image.Rect(0, 0, width, height)).(*image.YCbCr)
+	}
+	return out, nil
+}
+
+// copyTile copies a decoded tile into dst at the given luma offset
+func copyTile(dst, tile *image.YCbCr, x0, y0 int) {
+	w, h := tile.Rect.Dx(), tile.Rect.Dy()
+	for y := 0; y < h; y++ {
+		copy(dst.Y[(y0+y)*dst.YStride+x0:], tile.Y[y*tile.YStride:y*tile.YStride+w])
+	}
+
+	cw, ch := w, h
+	cx0, cy0 := x0, y0
+	switch tile.SubsampleRatio {
+	case image.YCbCrSubsampleRatio420:
+		cw, ch, cx0, cy0 = (w+1)/2, (h+1)/2, x0/2, y0/2
+	case image.YCbCrSubsampleRatio422:
+		cw, cx0 = (w+1)/2, x0/2
+	}
+	for y := 0; y < ch; y++ {
+		src := y * tile.CStride
+		off := (cy0+y)*dst.CStride + cx0
+		copy(dst.Cb[off:], tile.Cb[src:src+cw])
+		copy(dst.Cr[off:], tile.Cr[src:src+cw])
+	}
+}
+
+// decodeAt parses data and decodes the image at the given ListImages index
+func decodeAt(ctx context.Context, data []byte, index int, toneMap string) (*image.YCbCr, error) {
+	f, err := parseContainer(data)
+	if err != nil {
+		return nil, err
+	}
+	refs := f.images()
+	if index < 0 || index >= len(refs) {
+		return nil, ErrItemNotFound
+	}
+	return f.decodeImageRef(ctx, refs[index], toneMap)
+}
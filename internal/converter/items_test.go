@@ -0,0 +1,390 @@
+package converter
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/adrium/goheif"
+)
+
+// loadTestHEIF returns the repository test image or skips the test
+func loadTestHEIF(t testing.TB) []byte {
+	t.Helper()
+	for _, f := range []string{"testdata/test.heic", "../testdata/test.heic", "../../testdata/test.heic"} {
+		if data, err := os.ReadFile(f); err == nil {
+			return data
+		}
+	}
+	t.Skip("No test HEIF file found")
+	return nil
+}
+
+func testBox(typ string, payloads ...[]byte) []byte {
+	var body []byte
+	for _, p := range payloads {
+		body = append(body, p...)
+	}
+	out := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	out = append(out, typ...)
+	return append(out, body...)
+}
+
+func testFullBox(typ string, version byte, flags uint32, payloads ...[]byte) []byte {
+	hdr := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags)
+	return testBox(typ, append([][]byte{hdr}, payloads...)...)
+}
+
+func u16(v int) []byte { return binary.BigEndian.AppendUint16(nil, uint16(v)) }
+func u32(v int) []byte { return binary.BigEndian.AppendUint32(nil, uint32(v)) }
+
+// buildMultiImageHEIF builds a HEIF file with one hvc1 item per tile and an
+// image sequence track with one sync sample per tile. All tiles must share
+// the same hvcC configuration. Extra boxes are appended to the track's stbl.
+func buildMultiImageHEIF(t *testing.T, hvcC []byte, tiles [][]byte, width, height int, stblExtra ...[]byte) []byte {
+	t.Helper()
+	ftyp := testBox("ftyp", []byte("heic"), u32(0), []byte("mif1heicmsf1"))
+
+	var mdatBody []byte
+	var offsets []int
+	start := len(ftyp) + 8
+	for _, tile := range tiles {
+		offsets = append(offsets, start+len(mdatBody))
+		mdatBody = append(mdatBody, tile...)
+	}
+	mdat := testBox("mdat", mdatBody)
+
+	// meta: items 1..n, item 1 primary
+	var infes, ilocEntries, ipmaEntries []byte
+	for i, tile := range tiles {
+		id := i + 1
+		infes = append(infes, testFullBox("infe", 2, 0, u16(id), u16(0), []byte("hvc1"), []byte{0})...)
+		ilocEntries = append(ilocEntries, append(append(append(u16(id), u16(0)...), u16(1)...), append(u32(offsets[i]), u32(len(tile))...)...)...)
+		ipmaEntries = append(ipmaEntries, append(u16(id), 2, 0x81, 0x02)...)
+	}
+	ispe := testFullBox("ispe", 0, 0, u32(width), u32(height))
+	meta := testFullBox("meta", 0, 0,
+		testFullBox("hdlr", 0, 0, u32(0), []byte("pict"), make([]byte, 13)),
+		testFullBox("pitm", 0, 0, u16(1)),
+		testFullBox("iinf", 0, 0, u16(len(tiles)), infes),
+		testFullBox("iloc", 0, 0, []byte{0x44, 0x00}, u16(len(tiles)), ilocEntries),
+		testBox("iprp",
+			testBox("ipco", testBox("hvcC", hvcC), ispe),
+			testFullBox("ipma", 0, 0, u32(len(tiles)), ipmaEntries),
+		),
+	)
+
+	// moov: one picture track, 40ms per sample, one chunk per sample
+	sampleEntry := append(make([]byte, 6), u16(1)...)
+	sampleEntry = append(sampleEntry, make([]byte, 16)...)
+	sampleEntry = append(sampleEntry, u16(width)...)
+	sampleEntry = append(sampleEntry, u16(height)...)
+	sampleEntry = append(sampleEntry, make([]byte, 50)...)
+	var sizes, chunkOffsets []byte
+	for i, tile := range tiles {
+		sizes = append(sizes, u32(len(tile))...)
+		chunkOffsets = append(chunkOffsets, u32(offsets[i])...)
+	}
+	stbl := testBox("stbl",
+		testFullBox("stsd", 0, 0, u32(1), testBox("hvc1", sampleEntry, testBox("hvcC", hvcC))),
+		testFullBox("stts", 0, 0, u32(1), u32(len(tiles)), u32(40)),
+		testFullBox("stsz", 0, 0, u32(0), u32(len(tiles)), sizes),
+		testFullBox("stsc", 0, 0, u32(1), u32(1), u32(1), u32(1)),
+		testFullBox("stco", 0, 0, u32(len(tiles)), chunkOffsets),
+		bytes.Join(stblExtra, nil),
+	)
+	moov := testBox("moov", testBox("trak",
+		testFullBox("tkhd", 0, 3, u32(0), u32(0), u32(7), make([]byte, 68)),
+		testBox("mdia",
+			testFullBox("mdhd", 0, 0, u32(0), u32(0), u32(1000), u32(0), u32(0)),
+			testFullBox("hdlr", 0, 0, u32(0), []byte("pict"), make([]byte, 13)),
+			testBox("minf", stbl),
+		),
+	))
+
+	return bytes.Join([][]byte{ftyp, mdat, meta, moov}, nil)
+}
+
+// testTiles extracts the first n grid tiles of the test image
+func testTiles(t *testing.T, n int) (hvcC []byte, tiles [][]byte, width, height int) {
+	t.Helper()
+	f, err := parseContainer(loadTestHEIF(t))
+	if err != nil {
+		t.Fatalf("parseContainer failed: %v", err)
+	}
+	grid := f.byID[f.primaryID]
+	if grid == nil || grid.typ != "grid" || len(grid.refs["dimg"]) < n {
+		t.Skip("test image is not a grid with enough tiles")
+	}
+	for _, id := range grid.refs["dimg"][:n] {
+		tile := f.byID[id]
+		p, ok := tile.property("hvcC")
+		if !ok {
+			t.Fatal("tile has no hvcC")
+		}
+		data, err := f.itemData(tile)
+		if err != nil {
+			t.Fatalf("itemData failed: %v", err)
+		}
+		hvcC = p.body
+		tiles = append(tiles, data)
+		width, height, _ = tile.size()
+	}
+	return hvcC, tiles, width, height
+}
+
+func TestListImages_SingleImage(t *testing.T) {
+	data := loadTestHEIF(t)
+
+	images, err := ListImages(data)
+	if err != nil {
+		t.Fatalf("ListImages failed: %v", err)
+	}
+	if len(images) != 1 {
+		t.Fatalf("Expected 1 image (tiles are not top-level), got %d", len(images))
+	}
+	if !images[0].Primary || images[0].Kind != ImageKindItem {
+		t.Errorf("Expected primary item at index 0, got %+v", images[0])
+	}
+
+	cfg, err := goheif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("DecodeConfig failed: %v", err)
+	}
+	if images[0].Width != cfg.Width || images[0].Height != cfg.Height {
+		t.Errorf("Dimensions = %dx%d, want %dx%d", images[0].Width, images[0].Height, cfg.Width, cfg.Height)
+	}
+}
+
+func TestDecodeAt_MatchesGoheif(t *testing.T) {
+	data := loadTestHEIF(t)
+
+	img, err := decodeAt(context.Background(), data, 0, DefaultToneMap)
+	if err != nil {
+		t.Fatalf("decodeAt failed: %v", err)
+	}
+	want, err := goheif.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("goheif.Decode failed: %v", err)
+	}
+	if img.Bounds() != want.Bounds() {
+		t.Fatalf("Bounds = %v, want %v", img.Bounds(), want.Bounds())
+	}
+	b := img.Bounds()
+	for _, p := range [][2]int{{0, 0}, {b.Dx() / 2, b.Dy() / 2}, {b.Dx() - 1, b.Dy() - 1}, {517, 1029}} {
+		if img.At(p[0], p[1]) != want.At(p[0], p[1]) {
+			t.Errorf("Pixel %v = %v, want %v", p, img.At(p[0], p[1]), want.At(p[0], p[1]))
+		}
+	}
+
+	if _, err := decodeAt(context.Background(), data, 1, DefaultToneMap); !errors.Is(err, ErrItemNotFound) {
+		t.Errorf("Expected ErrItemNotFound for index 1, got %v", err)
+	}
+}
+
+// countdownContext reports cancellation from its n-th Err call on
+type countdownContext struct {
+	context.Context
+	n int
+}
+
+func (c *countdownContext) Err() error {
+	if c.n--; c.n <= 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestDecodeAt_CancelledBetweenTiles(t *testing.T) {
+	data := loadTestHEIF(t)
+	testTiles(t, 3) // skips unless the primary image is a grid
+
+	// One check before decoding, then one per tile: cancel at the third tile
+	ctx := &countdownContext{Context: context.Background(), n: 4}
+	if _, err := decodeAt(ctx, data, 0, DefaultToneMap); !errors.Is(err, context.Canceled) {
+		t.Fatalf("decodeAt = %v, want context.Canceled", err)
+	}
+	if ctx.n != 0 {
+		t.Errorf("decoding continued after cancellation (%d checks)", 4-ctx.n)
+	}
+}
+
+func TestListImages_MultiImageAndSequence(t *testing.T) {
+	hvcC, tiles, w, h := testTiles(t, 3)
+	data := buildMultiImageHEIF(t, hvcC, tiles, w, h)
+
+	images, err := ListImages(data)
+	if err != nil {
+		t.Fatalf("ListImages failed: %v", err)
+	}
+	if len(images) != 6 {
+		t.Fatalf("Expected 3 items + 3 frames, got %d: %+v", len(images), images)
+	}
+	for i, img := range images {
+		if img.Index != i {
+			t.Errorf("Image %d has index %d", i, img.Index)
+		}
+		wantKind := ImageKindItem
+		if i >= 3 {
+			wantKind = ImageKindFrame
+		}
+		if img.Kind != wantKind {
+			t.Errorf("Image %d kind = %s, want %s", i, img.Kind, wantKind)
+		}
+		if img.Width != w || img.Height != h {
+			t.Errorf("Image %d size = %dx%d, want %dx%d", i, img.Width, img.Height, w, h)
+		}
+	}
+	if !images[0].Primary {
+		t.Error("Item 0 should be primary")
+	}
+	if images[3].DurationMs != 40 || images[3].TrackID != 7 {
+		t.Errorf("Frame 0 = %+v, want 40ms on track 7", images[3])
+	}
+}
+
+func TestConvertItem(t *testing.T) {
+	hvcC, tiles, w, h := testTiles(t, 2)
+	data := buildMultiImageHEIF(t, hvcC, tiles, w, h)
+	c := New(500)
+
+	for _, index := range []int{1, 3} {
+		out, err := c.ConvertItem(data, index, 1.0, 85)
+		if err != nil {
+			t.Fatalf("ConvertItem(%d) failed: %v", index, err)
+		}
+		if len(out) < 2 || out[0] != 0xFF || out[1] != 0xD8 {
+			t.Errorf("ConvertItem(%d) did not return a JPEG", index)
+		}
+	}
+
+	if _, err := c.ConvertItem(data, 4, 1.0, 85); !errors.Is(err, ErrItemNotFound) {
+		t.Errorf("Expected ErrItemNotFound, got %v", err)
+	}
+}
+
+func TestConvertAllToZip(t *testing.T) {
+	hvcC, tiles, w, h := testTiles(t, 2)
+	data := buildMultiImageHEIF(t, hvcC, tiles, w, h)
+	c := New(500)
+
+	out, err := c.ConvertAllToZip(data, 0.5, -1)
+	if err != nil {
+		t.Fatalf("ConvertAllToZip failed: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	if err != nil {
+		t.Fatalf("Output is not a ZIP: %v", err)
+	}
+	if len(zr.File) != 4 {
+		t.Fatalf("Expected 4 entries, got %d", len(zr.File))
+	}
+	if zr.File[0].Name != "image_000.jpg" {
+		t.Errorf("First entry = %s, want image_000.jpg", zr.File[0].Name)
+	}
+}
+
+func TestConvertSequenceToWebP(t *testing.T) {
+	hvcC, tiles, w, h := testTiles(t, 3)
+	data := buildMultiImageHEIF(t, hvcC, tiles, w, h)
+	c := New(500)
+
+	out, err := c.ConvertSequenceToWebP(data, 1.0, 75)
+	if err != nil {
+		t.Fatalf("ConvertSequenceToWebP failed: %v", err)
+	}
+	if string(out[0:4]) != "RIFF" || string(out[8:12]) != "WEBP" || string(out[12:16]) != "VP8X" {
+		t.Fatalf("Output is not an extended WebP: % x", out[:16])
+	}
+	if int(binary.LittleEndian.Uint32(out[4:8])) != len(out)-8 {
+		t.Errorf("RIFF size mismatch")
+	}
+	if out[20]&0x02 == 0 {
+		t.Error("VP8X animation flag not set")
+	}
+	if frames := bytes.Count(out, []byte("ANMF")); frames != 3 {
+		t.Errorf("Expected 3 ANMF chunks, got %d", frames)
+	}
+
+	// A still image has no sequence
+	if _, err := c.ConvertSequenceToWebP(loadTestHEIF(t), 1.0, 75); !errors.Is(err, ErrNoSequence) {
+		t.Errorf("Expected ErrNoSequence, got %v", err)
+	}
+
+	// Inter-coded samples can't be decoded, so the animation is rejected
+	// rather than emitting only the keyframes
+	gop := buildMultiImageHEIF(t, hvcC, tiles, w, h, testFullBox("stss", 0, 0, u32(1), u32(1)))
+	if _, err := c.ConvertSequenceToWebP(gop, 1.0, 75); !errors.Is(err, ErrUnsupportedItem) {
+		t.Errorf("Expected ErrUnsupportedItem, got %v", err)
+	}
+}
+
+func TestParseContainer_Malformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"Empty", nil},
+		{"Truncated header", []byte{0, 0, 0}},
+		{"Oversized box", append(u32(1000), []byte("ftypheic")...)},
+		{"No meta or moov", testBox("ftyp", []byte("heic"), u32(0))},
+		{"Truncated iloc", append(testBox("ftyp", []byte("heic"), u32(0)), testFullBox("meta", 0, 0, testFullBox("iloc", 0, 0, []byte{0x44}))...)},
+		// Extents declared beyond the end of the box
+		{"Truncated iloc extents", append(testBox("ftyp", []byte("heic"), u32(0)), testFullBox("meta", 0, 0,
+			testFullBox("iloc", 0, 0, []byte{0x44, 0x00}, u16(1), u16(1), u16(0), u16(1000)))...)},
+		// Zero-size fields make extents free; their total is capped
+		{"Zero-size iloc extents", append(testBox("ftyp", []byte("heic"), u32(0)), testFullBox("meta", 0, 0,
+			testFullBox("iloc", 0, 0, []byte{0x00, 0x00}, u16(2), u16(1), u16(0), u16(0xFFFF), u16(2), u16(0), u16(0xFFFF)))...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseContainer(tt.data); !errors.Is(err, ErrInvalidHEIF) {
+				t.Errorf("Expected ErrInvalidHEIF, got %v", err)
+			}
+		})
+	}
+}
+
+func TestParseSampleTable_Stsc(t *testing.T) {
+	stbl := func(stsc ...int) []box {
+		entries := []byte{}
+		for _, v := range stsc {
+			entries = append(entries, u32(v)...)
+		}
+		boxes, err := readBoxes(bytes.Join([][]byte{
+			testFullBox("stsz", 0, 0, u32(1), u32(3)),
+			testFullBox("stco", 0, 0, u32(3), u32(0), u32(1), u32(2)),
+			testFullBox("stsc", 0, 0, u32(len(stsc)/3), entries),
+		}, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return boxes
+	}
+
+	tr := &heifTrack{}
+	if err := tr.parseSampleTable(stbl(1, 1, 1)); err != nil {
+		t.Fatalf("valid stsc: %v", err)
+	}
+	for i, s := range tr.samples {
+		if s.offset != uint64(i) {
+			t.Errorf("sample %d at offset %d", i, s.offset)
+		}
+	}
+
+	// A zero or repeated first chunk used to make the mapping loop revisit
+	// every chunk for each entry
+	for name, stsc := range map[string][]int{
+		"zero first chunk": {0, 1, 1},
+		"decreasing":       {1, 1, 1, 3, 1, 1, 2, 1, 1},
+		"repeated":         {1, 1, 1, 1, 1, 1},
+	} {
+		if err := (&heifTrack{}).parseSampleTable(stbl(stsc...)); !errors.Is(err, ErrInvalidHEIF) {
+			t.Errorf("%s: got %v, want ErrInvalidHEIF", name, err)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package converter
+
+import (
+	"sync"
+
+	"github.com/harliandi/go-heif/pkg/metrics"
+)
+
+// Memory estimate per pixel of the decoded image
+const (
+	// decodeBytesPerPixel covers the decoder's frame and the 8-bit copy
+	// handed to the encoder (up to 4:4:4, or high bit depth at 4:2:0)
+	decodeBytesPerPixel = 6
+	// rgbaBytesPerPixel is the RGBA copy made for WebP settings that need
+	// RGB input
+	rgbaBytesPerPixel = 4
+)
+
+// estimateMemory estimates the peak memory of converting the images sel
+// picks from data. Images of archives and animations are converted one at
+// a time, so they are charged for the largest one. Files whose size can't
+// be read are charged their input size only; they fail in the decoder
+// anyway.
+func estimateMemory(data []byte, opts Options, sel Selection) int64 {
+	n := int64(len(data))
+	pixels := MaxPixels(data, sel)
+	bpp := int64(decodeBytesPerPixel)
+	if opts.Format == "webp" && opts.WebP.NeedsRGB() {
+		bpp += rgbaBytesPerPixel
+	}
+	return n + pixels*bpp
+}
+
+// Pixels returns the number of pixels decoded to convert the images sel
+// picks from data, read from the container without decoding. It is 0 for
+// files whose size can't be read.
+func Pixels(data []byte, sel Selection) int64 {
+	var pixels int64
+	for _, ref := range selectedImages(data, sel) {
+		pixels += int64(ref.info.Width) * int64(ref.info.Height)
+	}
+	return pixels
+}
+
+// MaxPixels returns the pixels of the largest image sel picks from data,
+// like Pixels
+func MaxPixels(data []byte, sel Selection) int64 {
+	var pixels int64
+	for _, ref := range selectedImages(data, sel) {
+		pixels = max(pixels, int64(ref.info.Width)*int64(ref.info.Height))
+	}
+	return pixels
+}
+
+// selectedImages returns the images sel picks from data, none if the
+// container can't be parsed or the item doesn't exist
+func selectedImages(data []byte, sel Selection) []imageRef {
+	f, err := parseContainer(data)
+	if err != nil {
+		return nil
+	}
+	refs := f.images()
+	switch sel.Kind {
+	case SelectItem:
+		if sel.Index < 0 || sel.Index >= len(refs) {
+			return nil
+		}
+		return refs[sel.Index : sel.Index+1]
+	case SelectAll, SelectAnimation:
+		return refs
+	}
+	return refs[:min(len(refs), 1)]
+}
+
+// memoryBudget bounds the memory reserved by running jobs. The pool
+// reserves a job's memory before a worker starts it; see WorkerPool.next.
+type memoryBudget struct {
+	mu    sync.Mutex
+	limit int64 // 0 for unlimited
+	used  int64 // bytes reserved by running jobs
+}
+
+// setLimit sets the budget in bytes, 0 for unlimited
+func (b *memoryBudget) setLimit(limit int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limit = limit
+}
+
+// fits reports whether n bytes fit in the budget at all
+func (b *memoryBudget) fits(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limit <= 0 || n <= b.limit
+}
+
+// tryAcquire reserves n bytes if they fit in what is left of the budget
+func (b *memoryBudget) tryAcquire(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit > 0 && b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	metrics.UpdateMemoryReserved(b.used)
+	return true
+}
+
+// release returns n bytes reserved by tryAcquire
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	metrics.UpdateMemoryReserved(b.used)
+}
@@ -0,0 +1,183 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/harliandi/go-heif/pkg/webp"
+)
+
+func TestEstimateMemory(t *testing.T) {
+	data := loadTestHEIF(t)
+	infos, err := ListImages(data)
+	if err != nil || len(infos) == 0 {
+		t.Fatalf("ListImages: %v", err)
+	}
+	pixels := int64(infos[0].Width) * int64(infos[0].Height)
+
+	jpeg := estimateMemory(data, Options{}, Selection{})
+	if want := int64(len(data)) + pixels*decodeBytesPerPixel; jpeg != want {
+		t.Errorf("estimate %d, want %d", jpeg, want)
+	}
+	rgb := estimateMemory(data, Options{Format: "webp", WebP: webp.Options{Lossless: true}}, Selection{})
+	if rgb != jpeg+pixels*rgbaBytesPerPixel {
+		t.Errorf("lossless WebP estimate %d, want the RGBA copy on top of %d", rgb, jpeg)
+	}
+	if got := estimateMemory([]byte("garbage"), Options{}, Selection{}); got != 7 {
+		t.Errorf("unparseable file estimate %d, want its size", got)
+	}
+	if got := estimateMemory(data, Options{}, Selection{Kind: SelectItem, Index: len(infos)}); got != int64(len(data)) {
+		t.Errorf("missing item estimate %d, want the file size", got)
+	}
+	if got := estimateMemory(data, Options{}, Selection{Kind: SelectAll}); got < jpeg {
+		t.Errorf("archive estimate %d below the primary image's %d", got, jpeg)
+	}
+}
+
+func TestPixels(t *testing.T) {
+	data := loadTestHEIF(t)
+	infos, err := ListImages(data)
+	if err != nil || len(infos) == 0 {
+		t.Fatalf("ListImages: %v", err)
+	}
+	var all int64
+	for _, info := range infos {
+		all += int64(info.Width) * int64(info.Height)
+	}
+	if got, want := Pixels(data, Selection{}), int64(infos[0].Width)*int64(infos[0].Height); got != want {
+		t.Errorf("primary image: %d pixels, want %d", got, want)
+	}
+	if got := Pixels(data, Selection{Kind: SelectAll}); got != all {
+		t.Errorf("all images: %d pixels, want %d", got, all)
+	}
+	if got := MaxPixels(data, Selection{Kind: SelectAll}); got > all || got < all/int64(len(infos)) {
+		t.Errorf("largest image: %d pixels of %d in %d images", got, all, len(infos))
+	}
+	if got := Pixels(data, Selection{Kind: SelectItem, Index: len(infos)}); got != 0 {
+		t.Errorf("missing item: %d pixels, want 0", got)
+	}
+	if got := Pixels([]byte("garbage"), Selection{}); got != 0 {
+		t.Errorf("unparseable file: %d pixels, want 0", got)
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	var b memoryBudget
+	if !b.fits(1<<40) || !b.tryAcquire(1<<40) {
+		t.Error("unlimited budget rejected a job")
+	}
+	b.release(1 << 40)
+	b.setLimit(100)
+	if b.fits(101) || !b.fits(100) {
+		t.Error("fits ignores the limit")
+	}
+	if !b.tryAcquire(60) {
+		t.Fatal("reservation within the budget failed")
+	}
+	if b.tryAcquire(60) {
+		t.Error("reserved memory over the budget")
+	}
+	b.release(60)
+	if !b.tryAcquire(60) {
+		t.Error("released memory not reusable")
+	}
+	b.release(60)
+	if b.used != 0 {
+		t.Errorf("%d bytes still reserved", b.used)
+	}
+}
+
+func TestWorkerPool_MemoryOrder(t *testing.T) {
+	// Workers are not started; next and finish stand in for them
+	p := NewWorkerPool(4)
+	p.SetMemoryBudget(100)
+	for _, job := range []Job{
+		{Scale: 1, memory: 60},
+		{Scale: 2, memory: 60}, // waits for the first one
+		{Scale: 3, memory: 10}, // fits, but must not overtake the second
+	} {
+		if err := p.enqueue(job, PriorityInteractive, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, _ := p.next()
+
+	taken := make(chan Job, 2)
+	go func() {
+		for range 2 {
+			job, _ := p.next()
+			taken <- job
+		}
+	}()
+	select {
+	case job := <-taken:
+		t.Fatalf("job %v started without memory or out of order", job.Scale)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if active, queued := p.Stats(); active != 1 || queued != 2 {
+		t.Errorf("Stats() = %d, %d, want 1, 2", active, queued)
+	}
+
+	// Releasing memory starts the waiting jobs in order
+	p.finish(first)
+	for _, want := range []float64{2, 3} {
+		if job := <-taken; job.Scale != want {
+			t.Errorf("started job %v, want %v", job.Scale, want)
+		}
+	}
+}
+
+func TestWorkerPool_MemoryWaitCancelled(t *testing.T) {
+	p := NewWorkerPool(2)
+	p.SetMemoryBudget(100)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := p.enqueue(Job{Scale: 1, memory: 100}, PriorityInteractive, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.enqueue(Job{Ctx: ctx, Scale: 2, memory: 100}, PriorityInteractive, ""); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := p.next()
+
+	// A job whose submitter gives up stops waiting, without memory
+	taken := make(chan Job)
+	go func() {
+		job, _ := p.next()
+		taken <- job
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if job := <-taken; job.Scale != 2 || job.memory != 0 {
+		t.Errorf("got job %v with %d bytes, want the cancelled job without memory", job.Scale, job.memory)
+	}
+	p.finish(first)
+	if p.memory.used != 0 {
+		t.Errorf("%d bytes still reserved", p.memory.used)
+	}
+}
+
+func TestWorkerPool_Limits(t *testing.T) {
+	InitGlobalWorkerPool(1, 500) // workers convert with the default converter
+	data := loadTestHEIF(t)
+	pool := NewWorkerPool(1)
+	defer pool.Stop()
+	ctx := context.Background()
+
+	pool.SetMemoryBudget(1 << 20)
+	if _, err := pool.Submit(ctx, data, 0.5, 80); !errors.Is(err, ErrMemoryBudget) {
+		t.Errorf("over budget: got %v, want ErrMemoryBudget", err)
+	}
+
+	pool.SetMemoryBudget(0)
+	pool.SetJobTimeout(time.Nanosecond)
+	if _, err := pool.Submit(ctx, data, 0.5, 80); !errors.Is(err, ErrJobTimeout) {
+		t.Errorf("over time: got %v, want ErrJobTimeout", err)
+	}
+
+	pool.SetJobTimeout(0)
+	if _, err := pool.Submit(ctx, data, 0.5, 80); err != nil {
+		t.Errorf("without limits: %v", err)
+	}
+}
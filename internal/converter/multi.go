@@ -0,0 +1,197 @@
+package converter
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+)
+
+var (
+	// ErrNoSequence is returned when an animation is requested for a file without an image sequence
+	ErrNoSequence = errors.New("file has no image sequence")
+	// ErrTooManyImages is returned when a file has more images than an archive or animation allows
+	ErrTooManyImages = errors.New("too many images in file")
+)
+
+// Multi-image limits
+const (
+	MaxArchiveImages   = 64  // max images converted into one ZIP
+	MaxAnimationFrames = 120 // max frames converted into one animated WebP
+)
+
+// Selection kinds
+const (
+	SelectItem      = "item"      // the image at Selection.Index
+	SelectAll       = "all"       // every image into a ZIP archive
+	SelectAnimation = "animation" // the image sequence into an animated WebP
+)
+
+// Selection picks the images of a file a conversion covers. The zero value
+// converts the primary image.
+type Selection struct {
+	Kind  string // one of the Select kinds, empty for the primary image
+	Index int    // ListImages index for SelectItem
+}
+
+// ConvertSelection converts the images sel picks with a fixed quality, or
+// the adaptive target-size quality when q <= 0
+func (c *Converter) ConvertSelection(data []byte, sel Selection, scale float64, q int) ([]byte, error) {
+	switch sel.Kind {
+	case SelectItem:
+		return c.ConvertItem(data, sel.Index, scale, q)
+	case SelectAll:
+		return c.ConvertAllToZip(data, scale, q)
+	case SelectAnimation:
+		return c.ConvertSequenceToWebP(data, scale, q)
+	}
+	return c.convertJob(data, scale, q)
+}
+
+// encodeScaled scales img and encodes it with a fixed quality, or with the
+// adaptive target-size quality when q <= 0
+func (c *Converter) encodeScaled(img image.Image, scale float64, q int, format string) ([]byte, error) {
+	if err := ValidateImage(img); err != nil {
+		return nil, err
+	}
+	if scale > 0 && scale < 1.0 {
+		img = scaleImage(img, scale)
+	}
+	if err := c.jobContext().Err(); err != nil {
+		return nil, err
+	}
+	if q < 1 || q > 100 {
+		q = c.findQuality(img, c.targetSizeKB)
+	}
+	return encodeToBytes(img, q, format, c.jpegOpts, c.webpOpts)
+}
+
+// ConvertItem converts the image at the given ListImages index
+func (c *Converter) ConvertItem(data []byte, index int, scale float64, q int) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, ErrInvalidHEIF
+	}
+	img, err := decodeAt(c.jobContext(), data, index, c.toneMap)
+	if err != nil {
+		return nil, err
+	}
+	return c.encodeScaled(img, scale, q, c.outputFormat)
+}
+
+// ConvertAllToZip converts every image of a multi-image file and returns
+// them as a ZIP archive with one entry per ListImages index
+func (c *Converter) ConvertAllToZip(data []byte, scale float64, q int) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, ErrInvalidHEIF
+	}
+	f, err := parseContainer(data)
+	if err != nil {
+		return nil, err
+	}
+	refs := f.images()
+	if len(refs) == 0 {
+		return nil, ErrItemNotFound
+	}
+	if len(refs) > MaxArchiveImages {
+		return nil, ErrTooManyImages
+	}
+
+	ext := "jpg"
+	if c.outputFormat == "webp" {
+		ext = "webp"
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, ref := range refs {
+		img, err := f.decodeImageRef(c.jobContext(), ref, c.toneMap)
+		if err != nil {
+			return nil, err
+		}
+		encoded, err := c.encodeScaled(img, scale, q, c.outputFormat)
+		if err != nil {
+			return nil, err
+		}
+		// Images are already compressed; store them as-is
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:   fmt.Sprintf("image_%03d.%s", ref.info.Index, ext),
+			Method: zip.Store,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(encoded); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ConvertSequenceToWebP converts the frames of an image sequence into an
+// animated WebP that loops forever. Only intra-coded sequences are
+// supported: the decoder returns one picture per call, so inter-coded
+// samples can't be reconstructed and would leave only the keyframes.
+func (c *Converter) ConvertSequenceToWebP(data []byte, scale float64, q int) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, ErrInvalidHEIF
+	}
+	f, err := parseContainer(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var frames []imageRef
+	for _, ref := range f.images() {
+		if ref.info.Kind != ImageKindFrame {
+			continue
+		}
+		if len(ref.samples) > 1 {
+			return nil, fmt.Errorf("%w: inter-coded image sequence", ErrUnsupportedItem)
+		}
+		frames = append(frames, ref)
+	}
+	if len(frames) == 0 {
+		return nil, ErrNoSequence
+	}
+	if len(frames) > MaxAnimationFrames {
+		return nil, ErrTooManyImages
+	}
+
+	// Animations use one quality for all frames, derived from the first one
+	encoded := make([]webpFrame, 0, len(frames))
+	for _, ref := range frames {
+		img, err := f.decodeImageRef(c.jobContext(), ref, c.toneMap)
+		if err != nil {
+			return nil, err
+		}
+		if err := ValidateImage(img); err != nil {
+			return nil, err
+		}
+		scaled := image.Image(img)
+		if scale > 0 && scale < 1.0 {
+			scaled = scaleImage(img, scale)
+		}
+		if err := c.jobContext().Err(); err != nil {
+			return nil, err
+		}
+		if q < 1 || q > 100 {
+			q = c.findQuality(scaled, max(c.targetSizeKB/len(frames), 1))
+		}
+		frame, err := encodeToBytes(scaled, q, "webp", c.jpegOpts, c.webpOpts)
+		if err != nil {
+			return nil, err
+		}
+		b := scaled.Bounds()
+		encoded = append(encoded, webpFrame{
+			data:       frame,
+			width:      b.Dx(),
+			height:     b.Dy(),
+			durationMs: ref.info.DurationMs,
+		})
+	}
+	return muxAnimatedWebP(encoded, 0)
+}
@@ -0,0 +1,189 @@
+package converter
+
+import (
+	"image"
+	"runtime"
+	"sync"
+)
+
+// Image kernels split their output into horizontal bands that are processed
+// on separate goroutines. Each band runs tight loops over plane slices with
+// precomputed offsets, so the inner loops have no interface calls and the
+// compiler can drop most bounds checks.
+
+// minBandRows is the smallest band worth a goroutine
+const minBandRows = 32
+
+// maxBands caps the number of bands per kernel (0 uses GOMAXPROCS)
+var maxBands = 0
+
+// parallelRows calls fn on disjoint row ranges [y0, y1) covering [0, rows),
+// concurrently when the image is large enough, and waits for all of them
+func parallelRows(rows int, fn func(y0, y1 int)) {
+	n := maxBands
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	n = min(n, rows/minBandRows)
+	if n <= 1 {
+		fn(0, rows)
+		return
+	}
+	band := (rows + n - 1) / n
+	var wg sync.WaitGroup
+	for y0 := 0; y0 < rows; y0 += band {
+		wg.Add(1)
+		go func(y0, y1 int) {
+			defer wg.Done()
+			fn(y0, y1)
+		}(y0, min(y0+band, rows))
+	}
+	wg.Wait()
+}
+
+// nearestIndex maps each of n output positions to a source position in
+// [0, srcLen) with 16.16 fixed-point nearest-neighbor stepping
+func nearestIndex(n, srcLen int) []int {
+	idx := make([]int, n)
+	step := (srcLen << 16) / n
+	for i := range idx {
+		idx[i] = min((i*step)>>16, srcLen-1)
+	}
+	return idx
+}
+
+// scaleYCbCrNearest resamples src into dst (4:2:0) with nearest-neighbor
+// sampling. Any source subsampling and sub-image origin is handled through
+// precomputed plane offsets.
+func scaleYCbCrNearest(src, dst *image.YCbCr) {
+	r := src.Rect
+	dstW, dstH := dst.Rect.Dx(), dst.Rect.Dy()
+	xs := nearestIndex(dstW, r.Dx())
+	ys := nearestIndex(dstH, r.Dy())
+
+	parallelRows(dstH, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			srcRow := src.Y[src.YOffset(r.Min.X, r.Min.Y+ys[y]):]
+			dstRow := dst.Y[y*dst.YStride:][:dstW]
+			for x := range dstRow {
+				dstRow[x] = srcRow[xs[x]]
+			}
+		}
+	})
+
+	// Each output chroma sample takes the source chroma sample under the
+	// top-left luma pixel of its 2x2 block
+	cw, ch := (dstW+1)/2, (dstH+1)/2
+	base := src.COffset(r.Min.X, r.Min.Y)
+	cols := make([]int, cw)
+	for cx := range cols {
+		cols[cx] = src.COffset(r.Min.X+xs[2*cx], r.Min.Y) - base
+	}
+	parallelRows(ch, func(y0, y1 int) {
+		for cy := y0; cy < y1; cy++ {
+			off := src.COffset(r.Min.X, r.Min.Y+ys[2*cy])
+			cbRow, crRow := src.Cb[off:], src.Cr[off:]
+			dstCb := dst.Cb[cy*dst.CStride:][:cw]
+			dstCr := dst.Cr[cy*dst.CStride:][:cw]
+			for cx, c := range cols {
+				dstCb[cx] = cbRow[c]
+				dstCr[cx] = crRow[c]
+			}
+		}
+	})
+}
+
+// scaleGenericNearest resamples any image into dst (4:2:0), converting RGB
+// to YCbCr. RGBA images are read straight from their pixel buffer; other
+// types go through At.
+func scaleGenericNearest(src image.Image, dst *image.YCbCr) {
+	b := src.Bounds()
+	dstW, dstH := dst.Rect.Dx(), dst.Rect.Dy()
+	xs := nearestIndex(dstW, b.Dx())
+	ys := nearestIndex(dstH, b.Dy())
+
+	// rgb returns the 8-bit color of source pixel (x, y) relative to b.Min
+	rgb := func(x, y int) (uint8, uint8, uint8) {
+		r, g, bl, _ := src.At(b.Min.X+x, b.Min.Y+y).RGBA()
+		return uint8(r >> 8), uint8(g >> 8), uint8(bl >> 8)
+	}
+	if rgba, ok := src.(*image.RGBA); ok {
+		rgb = func(x, y int) (uint8, uint8, uint8) {
+			p := rgba.Pix[rgba.PixOffset(b.Min.X+x, b.Min.Y+y):]
+			return p[0], p[1], p[2]
+		}
+	}
+
+	// Rows are converted in pairs so each band owns whole chroma rows
+	parallelRows((dstH+1)/2, func(c0, c1 int) {
+		for cy := c0; cy < c1; cy++ {
+			for y := 2 * cy; y < min(2*cy+2, dstH); y++ {
+				dstRow := dst.Y[y*dst.YStride:][:dstW]
+				for x := range dstRow {
+					r, g, bl := rgb(xs[x], ys[y])
+					dstRow[x] = rgbToY(r, g, bl)
+				}
+			}
+			// Chroma from the top-left pixel of each 2x2 block
+			for cx := 0; 2*cx < dstW; cx++ {
+				r, g, bl := rgb(xs[2*cx], ys[2*cy])
+				off := cy*dst.CStride + cx
+				dst.Cb[off], dst.Cr[off] = rgbToCbCr(r, g, bl)
+			}
+		}
+	})
+}
+
+// rgbToY is the luma of color.RGBToYCbCr
+func rgbToY(r, g, b uint8) uint8 {
+	return uint8((19595*int32(r) + 38470*int32(g) + 7471*int32(b) + 1<<15) >> 16)
+}
+
+// rgbToCbCr is the chroma of color.RGBToYCbCr
+func rgbToCbCr(r, g, b uint8) (uint8, uint8) {
+	r1, g1, b1 := int32(r), int32(g), int32(b)
+	cb := -11056*r1 - 21712*g1 + 32768*b1 + 257<<15
+	cr := 32768*r1 - 27440*g1 - 5328*b1 + 257<<15
+	return clampFix(cb), clampFix(cr)
+}
+
+// clampFix converts a 16.16 fixed-point value to a clamped 8-bit sample
+func clampFix(v int32) uint8 {
+	if uint32(v)&0xff000000 == 0 {
+		return uint8(v >> 16)
+	}
+	return uint8(^(v >> 31))
+}
+
+// ycbcrToRGBA converts a YCbCr image to RGBA with the arithmetic of
+// color.YCbCrToRGB, so the result matches image/draw exactly
+func ycbcrToRGBA(src *image.YCbCr) *image.RGBA {
+	r := src.Rect
+	w, h := r.Dx(), r.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	cols := make([]int, w)
+	base := src.COffset(r.Min.X, r.Min.Y)
+	for x := range cols {
+		cols[x] = src.COffset(r.Min.X+x, r.Min.Y) - base
+	}
+
+	parallelRows(h, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			yRow := src.Y[src.YOffset(r.Min.X, r.Min.Y+y):][:w]
+			off := src.COffset(r.Min.X, r.Min.Y+y)
+			cbRow, crRow := src.Cb[off:], src.Cr[off:]
+			out := dst.Pix[y*dst.Stride:][:4*w]
+			for x, yv := range yRow {
+				yy := int32(yv) * 0x10101
+				cb := int32(cbRow[cols[x]]) - 128
+				cr := int32(crRow[cols[x]]) - 128
+				p := out[4*x : 4*x+4 : 4*x+4]
+				p[0] = clampFix(yy + 91881*cr)
+				p[1] = clampFix(yy - 22554*cb - 46802*cr)
+				p[2] = clampFix(yy + 116130*cb)
+				p[3] = 0xff
+			}
+		}
+	})
+	return dst
+}
@@ -0,0 +1,155 @@
+package converter
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"sync/atomic"
+	"testing"
+)
+
+// withBands forces kernels to split work into n bands, so the parallel code
+// paths run even with GOMAXPROCS=1
+func withBands(t testing.TB, n int) {
+	old := maxBands
+	maxBands = n
+	t.Cleanup(func() { maxBands = old })
+}
+
+// patternYCbCr fills every plane with position dependent values
+func patternYCbCr(r image.Rectangle, ratio image.YCbCrSubsampleRatio) *image.YCbCr {
+	img := image.NewYCbCr(r, ratio)
+	for i := range img.Y {
+		img.Y[i] = uint8(i*7 + i/img.YStride*3)
+	}
+	for i := range img.Cb {
+		img.Cb[i] = uint8(i*5 + 17)
+		img.Cr[i] = uint8(i*11 + i/img.CStride)
+	}
+	return img
+}
+
+func TestParallelRows(t *testing.T) {
+	for _, bands := range []int{0, 1, 3, 8} {
+		for _, rows := range []int{0, 1, 31, 100, 1001} {
+			withBands(t, bands)
+			hits := make([]int32, rows)
+			parallelRows(rows, func(y0, y1 int) {
+				for y := y0; y < y1; y++ {
+					atomic.AddInt32(&hits[y], 1)
+				}
+			})
+			for y, n := range hits {
+				if n != 1 {
+					t.Fatalf("bands=%d rows=%d: row %d processed %d times", bands, rows, y, n)
+				}
+			}
+		}
+	}
+}
+
+func TestScaleYCbCrNearest(t *testing.T) {
+	withBands(t, 4)
+	ratios := []image.YCbCrSubsampleRatio{
+		image.YCbCrSubsampleRatio420,
+		image.YCbCrSubsampleRatio422,
+		image.YCbCrSubsampleRatio444,
+		image.YCbCrSubsampleRatio440,
+	}
+	rects := []image.Rectangle{image.Rect(0, 0, 640, 480), image.Rect(13, 7, 500, 333)}
+	for _, ratio := range ratios {
+		for _, r := range rects {
+			t.Run(fmt.Sprintf("%v/%v", ratio, r), func(t *testing.T) {
+				src := patternYCbCr(image.Rect(0, 0, 640, 480), ratio).SubImage(r).(*image.YCbCr)
+				dst := image.NewYCbCr(image.Rect(0, 0, 201, 151), image.YCbCrSubsampleRatio420)
+				scaleYCbCrNearest(src, dst)
+
+				xs, ys := nearestIndex(201, r.Dx()), nearestIndex(151, r.Dy())
+				for y := range 151 {
+					for x := range 201 {
+						want := src.YCbCrAt(r.Min.X+xs[x], r.Min.Y+ys[y])
+						if got := dst.YCbCrAt(x, y); got.Y != want.Y {
+							t.Fatalf("luma at (%d,%d) = %d, want %d", x, y, got.Y, want.Y)
+						}
+						if x%2 == 0 && y%2 == 0 {
+							if got := dst.YCbCrAt(x, y); got.Cb != want.Cb || got.Cr != want.Cr {
+								t.Fatalf("chroma at (%d,%d) = %v, want %v", x, y, got, want)
+							}
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+// opaqueImage hides the concrete type of an image
+type opaqueImage struct{ image.Image }
+
+func TestScaleGenericNearest(t *testing.T) {
+	withBands(t, 4)
+	src := image.NewRGBA(image.Rect(5, 9, 405, 309))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i*13 + i/src.Stride)
+	}
+	fast := image.NewYCbCr(image.Rect(0, 0, 123, 77), image.YCbCrSubsampleRatio420)
+	slow := image.NewYCbCr(fast.Rect, image.YCbCrSubsampleRatio420)
+	scaleGenericNearest(src, fast)
+	scaleGenericNearest(opaqueImage{src}, slow)
+	if !bytes.Equal(fast.Y, slow.Y) || !bytes.Equal(fast.Cb, slow.Cb) || !bytes.Equal(fast.Cr, slow.Cr) {
+		t.Error("RGBA fast path differs from the generic path")
+	}
+
+	xs, ys := nearestIndex(123, 400), nearestIndex(77, 300)
+	for y := 0; y < 77; y += 2 {
+		for x := 0; x < 123; x += 2 {
+			c := src.RGBAAt(5+xs[x], 9+ys[y])
+			wy, wcb, wcr := color.RGBToYCbCr(c.R, c.G, c.B)
+			if got := fast.YCbCrAt(x, y); got != (color.YCbCr{wy, wcb, wcr}) {
+				t.Fatalf("(%d,%d) = %v, want %v", x, y, got, color.YCbCr{wy, wcb, wcr})
+			}
+		}
+	}
+}
+
+// TestYCbCrToRGBA checks the conversion against image/draw
+func TestYCbCrToRGBA(t *testing.T) {
+	withBands(t, 3)
+	for _, ratio := range []image.YCbCrSubsampleRatio{image.YCbCrSubsampleRatio420, image.YCbCrSubsampleRatio422, image.YCbCrSubsampleRatio444} {
+		src := patternYCbCr(image.Rect(0, 0, 320, 240), ratio).SubImage(image.Rect(3, 5, 301, 211)).(*image.YCbCr)
+		want := image.NewRGBA(image.Rect(0, 0, 298, 206))
+		draw.Draw(want, want.Rect, src, src.Rect.Min, draw.Src)
+		if got := ycbcrToRGBA(src); !bytes.Equal(got.Pix, want.Pix) {
+			t.Errorf("%v: ycbcrToRGBA differs from image/draw", ratio)
+		}
+	}
+}
+
+func BenchmarkScaleImage(b *testing.B) {
+	ycc := patternYCbCr(image.Rect(0, 0, 4000, 3000), image.YCbCrSubsampleRatio420)
+	rgba := ycbcrToRGBA(ycc)
+	for _, src := range []image.Image{ycc, rgba} {
+		b.Run(fmt.Sprintf("%T", src), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				scaleImage(src, 0.5)
+			}
+		})
+	}
+}
+
+func BenchmarkYCbCrToRGBA(b *testing.B) {
+	src := patternYCbCr(image.Rect(0, 0, 4000, 3000), image.YCbCrSubsampleRatio420)
+	b.Run("kernel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			ycbcrToRGBA(src)
+		}
+	})
+	b.Run("draw", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			dst := image.NewRGBA(src.Rect)
+			draw.Draw(dst, dst.Rect, src, image.Point{}, draw.Src)
+		}
+	})
+}
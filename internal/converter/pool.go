@@ -3,22 +3,54 @@ package converter
 import (
 	"context"
 	"errors"
-	"log"
+	"log/slog"
 	"sync"
 	"time"
+
+	"github.com/harliandi/go-heif/internal/logging"
+	"github.com/harliandi/go-heif/pkg/metrics"
 )
 
 var (
 	// ErrPoolBusy is returned when the worker pool is at capacity
 	ErrPoolBusy = errors.New("worker pool is busy, please retry later")
+	// ErrPoolStopped is returned for jobs submitted after Stop
+	ErrPoolStopped = errors.New("worker pool is stopped")
+	// ErrJobTimeout is returned when a conversion runs past the job timeout
+	ErrJobTimeout = errors.New("conversion timed out")
+	// ErrMemoryBudget is returned for images that need more memory than
+	// the whole pool's memory budget
+	ErrMemoryBudget = errors.New("image exceeds the conversion memory budget")
+)
+
+// Retry-After bounds for rejected jobs
+const (
+	minRetryAfter = time.Second
+	maxRetryAfter = time.Minute
 )
 
+// BusyError is returned when a job could not be queued. It wraps
+// ErrPoolBusy and estimates when the queue will have room, from the
+// queued jobs and the pool's observed throughput.
+type BusyError struct {
+	RetryAfter time.Duration
+}
+
+func (e *BusyError) Error() string { return ErrPoolBusy.Error() }
+
+func (e *BusyError) Unwrap() error { return ErrPoolBusy }
+
 // Job represents a conversion job
 type Job struct {
+	Ctx    context.Context // the submitter's context; the job is abandoned once it is done
 	Data   []byte
 	Scale  float64
 	Quality int
+	Options Options
+	Select Selection // images to convert, the primary one by default
 	Result chan<- Result
+
+	memory int64 // bytes reserved from the memory budget while running
 }
 
 // Result represents the outcome of a conversion job
@@ -27,88 +59,540 @@ type Result struct {
 	Err  error
 }
 
-// WorkerPool manages a pool of worker goroutines for conversion jobs
+// WorkerPool manages a pool of worker goroutines for conversion jobs.
+// Jobs wait in one queue per priority class; see Priority. The number of
+// workers can be changed at runtime with Resize or by Autoscale.
 type WorkerPool struct {
-	jobs    chan Job
-	workers int
+	conv    *Converter // converts jobs with their options applied
 	wg      sync.WaitGroup
 	once    sync.Once
+	flights flightGroup // identical in-flight jobs
+	memory  memoryBudget
+
+	mu       sync.Mutex
+	ready    *sync.Cond // signalled when a job is queued or the pool stops
+	workers  int        // wanted number of workers
+	running  int        // worker goroutines, above workers while shrinking
+	started  bool
+	spawned  int                 // worker ids handed out
+	limitSet [numPriorities]bool // queue limits set with SetQueueLimit
+	waitSum  time.Duration       // queue wait of jobs started since takeWaitStats
+	waitJobs int
+	avgJob   time.Duration // moving average of conversion times
+	maxWait  time.Duration // how long a job may wait for room in a full queue
+	room     chan struct{} // closed when a job leaves a queue, nil if nobody waits
+	classes  [numPriorities]*classQueue
+	weights map[string]int // tenant weights, 1 when unset
+	active  int            // jobs being converted
+	timeout time.Duration  // per-job conversion limit, 0 for none
+	stopped bool
+
+	// waiting is the job taken from the queues that waits for memory;
+	// no other job starts before it
+	waiting      *queuedJob
+	waitingClass Priority
+	stopWaiting  func() bool // stops waking workers when its context is done
+
+	abortCtx context.Context // done when Shutdown gives up on running jobs
+	abort    context.CancelFunc
 }
 
-// NewWorkerPool creates a new worker pool with the specified number of workers
+// NewWorkerPool creates a new worker pool with the specified number of
+// workers. Each priority class queues up to workers*2 jobs.
 func NewWorkerPool(workers int) *WorkerPool {
-	return &WorkerPool{
-		jobs:    make(chan Job, workers*2), // Buffered channel
+	p := &WorkerPool{
 		workers: workers,
+		conv:    New(defaultTargetSizeKB),
+		weights: make(map[string]int),
+	}
+	p.ready = sync.NewCond(&p.mu)
+	p.abortCtx, p.abort = context.WithCancel(context.Background())
+	for i := range p.classes {
+		p.classes[i] = newClassQueue(workers * 2)
+	}
+	return p
+}
+
+// SetQueueLimit sets the number of jobs a priority class may queue. It
+// no longer follows the number of workers.
+func (p *WorkerPool) SetQueueLimit(class Priority, limit int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.classes[class].limit = limit
+	p.limitSet[class] = true
+	p.wakeAdmitLocked()
+}
+
+// Resize changes the number of workers (at least 1). Queue limits not set
+// with SetQueueLimit follow it at workers*2. Extra workers exit once they
+// finish their current job.
+func (p *WorkerPool) Resize(workers int) {
+	workers = max(workers, 1)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return
+	}
+	p.workers = workers
+	for class, q := range p.classes {
+		if !p.limitSet[class] {
+			q.limit = workers * 2
+		}
+	}
+	p.wakeAdmitLocked()
+	if p.started {
+		for p.running < p.workers {
+			p.spawnLocked()
+		}
+		p.ready.Broadcast() // idle workers over the count exit
+	}
+}
+
+// Workers returns the wanted number of workers
+func (p *WorkerPool) Workers() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.workers
+}
+
+// spawnLocked starts a worker goroutine; p.mu must be held
+func (p *WorkerPool) spawnLocked() {
+	p.running++
+	p.spawned++
+	p.wg.Add(1)
+	go p.worker(p.spawned - 1)
+	metrics.UpdateWorkerCount(p.running)
+}
+
+// takeWaitStats returns the average queue wait of the jobs started since
+// the last call, and how many there were
+func (p *WorkerPool) takeWaitStats() (time.Duration, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := p.waitJobs
+	var avg time.Duration
+	if n > 0 {
+		avg = p.waitSum / time.Duration(n)
+	}
+	p.waitSum, p.waitJobs = 0, 0
+	return avg, n
+}
+
+// SetJobTimeout limits how long a job may run once a worker starts it;
+// 0 disables the limit
+func (p *WorkerPool) SetJobTimeout(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.timeout = d
+}
+
+// SetMemoryBudget limits the estimated memory of running jobs in bytes;
+// jobs wait in the queue, in order, until their memory is free. 0 disables
+// the limit.
+func (p *WorkerPool) SetMemoryBudget(bytes int64) {
+	p.memory.setLimit(bytes)
+	p.mu.Lock()
+	p.ready.Broadcast()
+	p.mu.Unlock()
+}
+
+// SetMaxQueueWait lets jobs wait up to d for room when their class queue
+// is full, instead of failing with ErrPoolBusy right away; 0 disables
+// waiting. Waiting jobs are not ordered among themselves.
+func (p *WorkerPool) SetMaxQueueWait(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maxWait = d
+}
+
+// SetTenantWeight sets a tenant's share of the workers relative to other
+// tenants of the same class (default 1)
+func (p *WorkerPool) SetTenantWeight(tenant string, weight int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.weights[tenant] = weight
+}
+
+// enqueue adds a job to its class queue
+func (p *WorkerPool) enqueue(job Job, class Priority, tenant string) error {
+	if _, err := p.tryEnqueue(job, class, tenant); err != nil {
+		if errors.Is(err, ErrPoolBusy) {
+			metrics.RecordQueueRejected(class.String())
+		}
+		return err
+	}
+	return nil
+}
+
+// admit adds a job to its class queue like enqueue, but when the queue is
+// full it waits up to the pool's max queue wait for room, or until ctx is
+// done
+func (p *WorkerPool) admit(ctx context.Context, job Job, class Priority, tenant string) error {
+	p.mu.Lock()
+	maxWait := p.maxWait
+	p.mu.Unlock()
+	if maxWait <= 0 {
+		return p.enqueue(job, class, tenant)
+	}
+
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	for {
+		room, err := p.tryEnqueue(job, class, tenant)
+		if !errors.Is(err, ErrPoolBusy) {
+			return err
+		}
+		select {
+		case <-room:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			metrics.RecordQueueRejected(class.String())
+			return err
+		}
+	}
+}
+
+// tryEnqueue adds a job to its class queue. If the queue is full it
+// returns a BusyError and a channel closed when a job leaves a queue.
+func (p *WorkerPool) tryEnqueue(job Job, class Priority, tenant string) (<-chan struct{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return nil, ErrPoolStopped
+	}
+	weight, ok := p.weights[tenant]
+	if !ok {
+		weight = 1
+	}
+	q := p.classes[class]
+	if !q.push(job, tenant, weight) {
+		if p.room == nil {
+			p.room = make(chan struct{})
+		}
+		return p.room, &BusyError{RetryAfter: p.retryAfterLocked()}
+	}
+	metrics.UpdateQueueDepth(class.String(), q.len)
+	p.updateMetrics()
+	p.ready.Signal()
+	return nil, nil
+}
+
+// wakeAdmitLocked wakes jobs waiting for room in a full queue; p.mu must
+// be held
+func (p *WorkerPool) wakeAdmitLocked() {
+	if p.room != nil {
+		close(p.room)
+		p.room = nil
+	}
+}
+
+// retryAfterLocked estimates when a rejected job would find room: the
+// queued jobs, plus the rejected one, divided among the workers at the
+// average conversion time. p.mu must be held.
+func (p *WorkerPool) retryAfterLocked() time.Duration {
+	d := p.avgJob * time.Duration(p.queuedLocked()+1) / time.Duration(max(p.workers, 1))
+	return min(max(d, minRetryAfter), maxRetryAfter)
+}
+
+// observeJob adds a conversion time to the moving average
+func (p *WorkerPool) observeJob(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.avgJob == 0 {
+		p.avgJob = d
+	} else {
+		p.avgJob += (d - p.avgJob) / 8
+	}
+}
+
+// next blocks until a job is available, taking the highest priority one,
+// and reserves its memory. A job whose memory is not free yet holds back
+// the jobs behind it, so large jobs are not starved by smaller ones. A job
+// whose submitter gave up while it waited is returned without memory, to
+// be skipped. next returns false once the pool is stopped and drained.
+func (p *WorkerPool) next() (Job, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		if p.running > p.workers {
+			// Shrinking: this worker exits
+			p.running--
+			metrics.UpdateWorkerCount(p.running)
+			return Job{}, false
+		}
+		if p.waiting == nil {
+			p.takeWaiting()
+		}
+		if qj := p.waiting; qj != nil {
+			job := qj.job
+			cancelled := job.Ctx != nil && job.Ctx.Err() != nil
+			if cancelled || p.memory.tryAcquire(job.memory) {
+				if cancelled {
+					job.memory = 0
+				}
+				p.clearWaiting()
+				wait := time.Since(qj.enqueued)
+				metrics.RecordQueueWait(p.waitingClass.String(), wait.Seconds())
+				if job.Ctx != nil {
+					logging.Add(job.Ctx, "queue_wait_ms", logging.Millis(wait))
+				}
+				p.waitSum += wait
+				p.waitJobs++
+				p.active++
+				p.updateMetrics()
+				return job, true
+			}
+		}
+		if p.stopped && p.waiting == nil {
+			if p.running > 0 {
+				p.running--
+				metrics.UpdateWorkerCount(p.running)
+			}
+			return Job{}, false
+		}
+		p.ready.Wait()
+	}
+}
+
+// takeWaiting moves the highest priority queued job to p.waiting; p.mu
+// must be held
+func (p *WorkerPool) takeWaiting() {
+	for class, q := range p.classes {
+		if qj, ok := q.pop(); ok {
+			metrics.UpdateQueueDepth(Priority(class).String(), q.len)
+			p.waiting, p.waitingClass = &qj, Priority(class)
+			p.wakeAdmitLocked()
+			if qj.job.Ctx != nil {
+				// Wake a worker to drop the job if its submitter gives up
+				p.stopWaiting = context.AfterFunc(qj.job.Ctx, func() {
+					p.mu.Lock()
+					p.ready.Broadcast()
+					p.mu.Unlock()
+				})
+			}
+			return
+		}
+	}
+}
+
+// clearWaiting empties p.waiting; p.mu must be held
+func (p *WorkerPool) clearWaiting() {
+	if p.stopWaiting != nil {
+		p.stopWaiting()
+		p.stopWaiting = nil
+	}
+	p.waiting = nil
+}
+
+// finish marks a job taken by next as done and releases its memory
+func (p *WorkerPool) finish(job Job) {
+	p.memory.release(job.memory)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active--
+	p.updateMetrics()
+	p.ready.Broadcast() // the waiting job may fit now
+}
+
+// queuedLocked returns the number of queued jobs, including the one
+// waiting for memory; p.mu must be held
+func (p *WorkerPool) queuedLocked() int {
+	n := 0
+	for _, q := range p.classes {
+		n += q.len
+	}
+	if p.waiting != nil {
+		n++
 	}
+	return n
+}
+
+// updateMetrics publishes the queue size and active jobs; p.mu must be held
+func (p *WorkerPool) updateMetrics() {
+	metrics.UpdateWorkerPoolMetrics(p.queuedLocked(), p.active)
 }
 
 // Start starts the worker pool goroutines
 func (p *WorkerPool) Start() {
 	p.once.Do(func() {
-		log.Printf("Starting worker pool with %d workers", p.workers)
-		for i := 0; i < p.workers; i++ {
-			p.wg.Add(1)
-			go p.worker(i)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		slog.Info("starting worker pool", "workers", p.workers)
+		p.started = true
+		for p.running < p.workers {
+			p.spawnLocked()
 		}
 	})
 }
 
-// worker processes jobs from the job channel
+// worker processes queued jobs until the pool is stopped
 func (p *WorkerPool) worker(id int) {
 	defer p.wg.Done()
-	for job := range p.jobs {
-		// Process the job
-		var result Result
-		if job.Quality > 0 && job.Scale > 0 && job.Scale < 1.0 {
-			result.Data, result.Err = defaultPool.ConvertBytesFastWithQuality(job.Data, job.Scale, job.Quality)
-		} else if job.Scale > 0 && job.Scale < 1.0 {
-			result.Data, result.Err = defaultPool.ConvertBytesFast(job.Data, job.Scale)
-		} else if job.Quality > 0 {
-			result.Data, result.Err = defaultPool.ConvertBytesWithQuality(job.Data, job.Quality)
-		} else {
-			result.Data, result.Err = defaultPool.ConvertBytes(job.Data)
+	for {
+		job, ok := p.next()
+		if !ok {
+			return
+		}
+		start := time.Now()
+		result, status := p.process(job)
+		p.finish(job)
+		elapsed := time.Since(start)
+		if status == "success" {
+			p.observeJob(elapsed)
 		}
+		mode := job.Select.Kind
+		if mode == "" {
+			mode = jobMode(job.Scale, job.Quality)
+		}
+		metrics.RecordConversion(status, mode, elapsed.Seconds(), len(job.Data), len(result.Data))
+
+		ctx := job.Ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		logging.Add(ctx, "convert_ms", logging.Millis(elapsed))
+		slog.DebugContext(ctx, "conversion job done", "worker", id, "status", status, "mode", mode,
+			"duration_ms", logging.Millis(elapsed), "result_bytes", len(result.Data))
 
 		// Send result (non-blocking in case receiver is gone)
 		select {
 		case job.Result <- result:
 		default:
-			log.Printf("Worker %d: result channel full or closed", id)
+			slog.DebugContext(ctx, "result channel full or closed", "worker", id)
 		}
 	}
 }
 
+// process runs a job within its timeout and returns the result with its
+// outcome for metrics
+func (p *WorkerPool) process(job Job) (Result, string) {
+	ctx := job.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// Skip the job if the submitter has already given up
+	if err := ctx.Err(); err != nil {
+		return Result{Err: err}, "cancelled"
+	}
+
+	p.mu.Lock()
+	timeout := p.timeout
+	p.mu.Unlock()
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(p.abortCtx, cancel)()
+	if timeout > 0 {
+		jobCtx, cancel = context.WithTimeout(jobCtx, timeout)
+		defer cancel()
+	}
+
+	var result Result
+	conv := p.conv.WithOptions(job.Options).WithContext(jobCtx)
+	result.Data, result.Err = conv.ConvertSelection(job.Data, job.Select, job.Scale, job.Quality)
+
+	switch {
+	case ctx.Err() != nil:
+		return result, "cancelled"
+	case result.Err == nil:
+		return result, "success"
+	case p.abortCtx.Err() != nil:
+		return Result{Err: ErrPoolStopped}, "cancelled"
+	case jobCtx.Err() != nil:
+		return Result{Err: ErrJobTimeout}, "timeout"
+	}
+	return result, "error"
+}
+
+// jobMode names the conversion convertJob picks, for metrics
+func jobMode(scale float64, quality int) string {
+	fast := scale > 0 && scale < 1.0
+	switch {
+	case fast && quality > 0:
+		return "fast_quality"
+	case fast:
+		return "fast"
+	case quality > 0:
+		return "fixed_quality"
+	}
+	return "adaptive"
+}
+
+// convertJob picks the conversion for a scale and quality (quality <= 0
+// means adaptive, scale outside (0, 1) means full resolution)
+func (c *Converter) convertJob(data []byte, scale float64, quality int) ([]byte, error) {
+	if quality > 0 && scale > 0 && scale < 1.0 {
+		return c.ConvertBytesFastWithQuality(data, scale, quality)
+	} else if scale > 0 && scale < 1.0 {
+		return c.ConvertBytesFast(data, scale)
+	} else if quality > 0 {
+		return c.ConvertBytesWithQuality(data, quality)
+	}
+	return c.ConvertBytes(data)
+}
+
 // Submit submits a job to the worker pool with context cancellation support
 // Returns ErrPoolBusy if the worker pool queue is full
 func (p *WorkerPool) Submit(ctx context.Context, data []byte, scale float64, quality int) ([]byte, error) {
+	return p.SubmitWithOptions(ctx, data, scale, quality, Options{})
+}
+
+// SubmitWithOptions submits a job with per-request converter options
+// (output format, tone mapping, JPEG encoder settings). Concurrent
+// submissions of the same file with the same settings share one job; the
+// returned data must not be modified.
+func (p *WorkerPool) SubmitWithOptions(ctx context.Context, data []byte, scale float64, quality int, opts Options) ([]byte, error) {
+	return p.SubmitSelection(ctx, data, Selection{}, scale, quality, opts)
+}
+
+// SubmitSelection submits a job converting the images sel picks, like
+// SubmitWithOptions
+func (p *WorkerPool) SubmitSelection(ctx context.Context, data []byte, sel Selection, scale float64, quality int, opts Options) ([]byte, error) {
+	key := jobKey(data, sel, scale, quality, opts)
+	result, err, shared := p.flights.do(ctx, key, func(ctx context.Context) ([]byte, error) {
+		return p.submit(ctx, data, sel, scale, quality, opts)
+	})
+	if shared {
+		metrics.RecordConversionDeduplicated()
+	}
+	return result, err
+}
+
+// submit queues a single job with the priority and tenant of ctx and
+// waits for its result
+func (p *WorkerPool) submit(ctx context.Context, data []byte, sel Selection, scale float64, quality int, opts Options) ([]byte, error) {
 	// Start the pool if not already started
 	p.Start()
 
 	resultChan := make(chan Result, 1)
 	job := Job{
+		Ctx:    ctx,
 		Data:   data,
 		Scale:  scale,
 		Quality: quality,
+		Options: opts,
+		Select: sel,
 		Result: resultChan,
+		memory: estimateMemory(data, opts, sel),
+	}
+	if !p.memory.fits(job.memory) {
+		return nil, ErrMemoryBudget
+	}
+
+	// If the class queue is full, wait for room up to the max queue wait
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := p.admit(ctx, job, priorityFrom(ctx), tenantFrom(ctx)); err != nil {
+		return nil, err
 	}
 
-	// Try to submit job with a timeout to avoid blocking indefinitely
-	// If the queue is full, return ErrPoolBusy immediately
+	// Job submitted, wait for result
 	select {
 	case <-ctx.Done():
 		return nil, ctx.Err()
-	case p.jobs <- job:
-		// Job submitted, wait for result
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case result := <-resultChan:
-			return result.Data, result.Err
-		}
-	default:
-		// Queue is full, return busy error
-		return nil, ErrPoolBusy
+	case result := <-resultChan:
+		return result.Data, result.Err
 	}
 }
 
@@ -136,18 +620,111 @@ func (p *WorkerPool) SubmitWithRetry(ctx context.Context, data []byte, scale flo
 	return nil, lastErr
 }
 
-// Stop gracefully shuts down the worker pool
+// Stop gracefully shuts down the worker pool: queued jobs still run, new
+// ones are rejected with ErrPoolStopped
 func (p *WorkerPool) Stop() {
-	close(p.jobs)
+	p.mu.Lock()
+	p.stopped = true
+	p.wakeAdmitLocked()
+	p.ready.Broadcast()
+	p.mu.Unlock()
 	p.wg.Wait()
-	log.Printf("Worker pool stopped")
+	slog.Info("worker pool stopped")
 }
 
-// Stats returns current pool statistics
+// Shutdown stops the worker pool like Stop, but bounded by ctx: if ctx is
+// done before the workers finish, the remaining queued jobs fail and
+// running ones are cancelled, both with ErrPoolStopped, and Shutdown
+// returns ctx's error once workers exit. Jobs queued on a pool that was
+// never started fail right away.
+func (p *WorkerPool) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.stopped = true
+	p.wakeAdmitLocked()
+	p.ready.Broadcast()
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		slog.Warn("worker pool drain timed out, cancelling remaining jobs")
+		p.failQueued()
+		p.abort()
+		<-done
+	}
+	// Jobs queued on a pool that was never started have no worker to run them
+	p.failQueued()
+	slog.Info("worker pool stopped")
+	return err
+}
+
+// failQueued empties the queues, failing each job with ErrPoolStopped
+func (p *WorkerPool) failQueued() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.waiting != nil {
+		select {
+		case p.waiting.job.Result <- Result{Err: ErrPoolStopped}:
+		default:
+		}
+		p.clearWaiting()
+	}
+	for class, q := range p.classes {
+		for {
+			qj, ok := q.pop()
+			if !ok {
+				break
+			}
+			select {
+			case qj.job.Result <- Result{Err: ErrPoolStopped}:
+			default:
+			}
+		}
+		metrics.UpdateQueueDepth(Priority(class).String(), 0)
+	}
+	p.wakeAdmitLocked()
+	p.updateMetrics()
+	p.ready.Broadcast() // workers waiting for memory for a dropped job
+}
+
+// QueueDelay returns how long the oldest queued job has been waiting, 0
+// when nothing is queued
+func (p *WorkerPool) QueueDelay() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var oldest time.Time
+	if p.waiting != nil {
+		oldest = p.waiting.enqueued
+	}
+	for _, q := range p.classes {
+		if t, ok := q.oldest(); ok && (oldest.IsZero() || t.Before(oldest)) {
+			oldest = t
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Since(oldest)
+}
+
+// Stats returns the number of jobs being converted and waiting in the
+// queues
 func (p *WorkerPool) Stats() (active, queued int) {
-	return len(p.jobs), cap(p.jobs) - len(p.jobs)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.active, p.queuedLocked()
 }
 
+// defaultTargetSizeKB is used when converting without an initialized pool
+const defaultTargetSizeKB = 500
+
 // Default global worker pool
 var (
 	defaultPool     *Converter
@@ -155,27 +732,43 @@ var (
 	poolInitOnce    sync.Once
 )
 
+// GlobalWorkerPool returns the global worker pool, or nil before
+// InitGlobalWorkerPool
+func GlobalWorkerPool() *WorkerPool {
+	return globalWorkerPool
+}
+
 // InitGlobalWorkerPool initializes the global worker pool
 func InitGlobalWorkerPool(workers int, targetSizeKB int) {
 	poolInitOnce.Do(func() {
 		defaultPool = New(targetSizeKB)
 		globalWorkerPool = NewWorkerPool(workers)
+		globalWorkerPool.conv = defaultPool
 		globalWorkerPool.Start()
 	})
 }
 
 // SubmitToGlobalPool submits a job to the global worker pool
 func SubmitToGlobalPool(ctx context.Context, data []byte, scale float64, quality int) ([]byte, error) {
+	return SubmitToGlobalPoolWithOptions(ctx, data, scale, quality, Options{})
+}
+
+// SubmitToGlobalPoolWithOptions submits a job with per-request converter
+// options to the global worker pool
+func SubmitToGlobalPoolWithOptions(ctx context.Context, data []byte, scale float64, quality int, opts Options) ([]byte, error) {
+	return SubmitSelectionToGlobalPool(ctx, data, Selection{}, scale, quality, opts)
+}
+
+// SubmitSelectionToGlobalPool submits a job converting the images sel
+// picks to the global worker pool
+func SubmitSelectionToGlobalPool(ctx context.Context, data []byte, sel Selection, scale float64, quality int, opts Options) ([]byte, error) {
 	if globalWorkerPool == nil {
 		// Fallback to direct conversion if pool not initialized
-		if quality > 0 && scale > 0 && scale < 1.0 {
-			return defaultPool.ConvertBytesFastWithQuality(data, scale, quality)
-		} else if scale > 0 && scale < 1.0 {
-			return defaultPool.ConvertBytesFast(data, scale)
-		} else if quality > 0 {
-			return defaultPool.ConvertBytesWithQuality(data, quality)
+		conv := defaultPool
+		if conv == nil {
+			conv = New(defaultTargetSizeKB)
 		}
-		return defaultPool.ConvertBytes(data)
+		return conv.WithOptions(opts).WithContext(ctx).ConvertSelection(data, sel, scale, quality)
 	}
-	return globalWorkerPool.Submit(ctx, data, scale, quality)
+	return globalWorkerPool.SubmitSelection(ctx, data, sel, scale, quality, opts)
 }
@@ -0,0 +1,161 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Priority is the scheduling class of a conversion job. Workers always
+// take the highest priority job available; within a class, tenants share
+// the workers in proportion to their weights.
+type Priority int
+
+const (
+	// PriorityInteractive is for requests a user is waiting on (the default)
+	PriorityInteractive Priority = iota
+	// PriorityBatch is for bulk conversions
+	PriorityBatch
+	// PriorityBackground only runs when nothing else is queued
+	PriorityBackground
+
+	numPriorities = 3
+)
+
+// String returns the name of the priority class
+func (p Priority) String() string {
+	switch p {
+	case PriorityBatch:
+		return "batch"
+	case PriorityBackground:
+		return "background"
+	}
+	return "interactive"
+}
+
+// ParsePriority parses "interactive", "batch" or "background"
+func ParsePriority(s string) (Priority, error) {
+	switch s {
+	case "", "interactive":
+		return PriorityInteractive, nil
+	case "batch":
+		return PriorityBatch, nil
+	case "background":
+		return PriorityBackground, nil
+	}
+	return PriorityInteractive, fmt.Errorf("unknown priority %q", s)
+}
+
+// Scheduling metadata travels with the request context
+type (
+	priorityKey struct{}
+	tenantKey   struct{}
+)
+
+// WithPriority returns a context that submits jobs with priority p
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// WithTenant returns a context that submits jobs on behalf of tenant, the
+// unit of fair sharing within a priority class
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+func priorityFrom(ctx context.Context) Priority {
+	p, _ := ctx.Value(priorityKey{}).(Priority)
+	if p < 0 || p >= numPriorities {
+		return PriorityInteractive
+	}
+	return p
+}
+
+func tenantFrom(ctx context.Context) string {
+	t, _ := ctx.Value(tenantKey{}).(string)
+	return t
+}
+
+// quantumBytes is the input size a tenant of weight 1 may submit per
+// round; jobs are charged their input size so one tenant's large images
+// don't crowd out another's small ones
+const quantumBytes = 1 << 20
+
+// queuedJob is a job waiting in a tenant queue
+type queuedJob struct {
+	job      Job
+	cost     int
+	enqueued time.Time
+}
+
+// tenantQueue holds one tenant's jobs within a class
+type tenantQueue struct {
+	name    string
+	jobs    []queuedJob
+	deficit int // deficit round robin credit in bytes
+	quantum int
+}
+
+// classQueue is one priority class: per-tenant queues served by deficit
+// round robin, bounded by a total depth limit
+type classQueue struct {
+	limit   int
+	len     int
+	tenants map[string]*tenantQueue
+	active  []*tenantQueue // tenants with queued jobs, in service order
+}
+
+func newClassQueue(limit int) *classQueue {
+	return &classQueue{limit: limit, tenants: make(map[string]*tenantQueue)}
+}
+
+// push queues a job, reporting false if the class is full
+func (c *classQueue) push(job Job, tenant string, weight int) bool {
+	if c.len >= c.limit {
+		return false
+	}
+	t, ok := c.tenants[tenant]
+	if !ok {
+		t = &tenantQueue{name: tenant, quantum: max(weight, 1) * quantumBytes}
+		c.tenants[tenant] = t
+		c.active = append(c.active, t)
+	}
+	t.jobs = append(t.jobs, queuedJob{job: job, cost: max(len(job.Data), 1), enqueued: time.Now()})
+	c.len++
+	return true
+}
+
+// pop takes the next job in deficit round robin order
+func (c *classQueue) pop() (queuedJob, bool) {
+	for len(c.active) > 0 {
+		t := c.active[0]
+		head := t.jobs[0]
+		if t.deficit >= head.cost {
+			t.deficit -= head.cost
+			t.jobs[0] = queuedJob{}
+			t.jobs = t.jobs[1:]
+			c.len--
+			if len(t.jobs) == 0 {
+				// Idle tenants don't keep credit
+				c.active = c.active[1:]
+				delete(c.tenants, t.name)
+			}
+			return head, true
+		}
+		// The tenant's turn is over: top up its credit for the next round
+		t.deficit += t.quantum
+		c.active = append(c.active[1:], t)
+	}
+	return queuedJob{}, false
+}
+
+// oldest returns when the longest waiting job of the class was queued
+func (c *classQueue) oldest() (time.Time, bool) {
+	var oldest time.Time
+	for _, t := range c.active {
+		if e := t.jobs[0].enqueued; oldest.IsZero() || e.Before(oldest) {
+			oldest = e
+		}
+	}
+	return oldest, !oldest.IsZero()
+}
@@ -0,0 +1,294 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// sizedJob returns a job whose input is n bytes, tagged with id as its scale
+func sizedJob(id float64, n int) Job {
+	return Job{Data: make([]byte, n), Scale: id}
+}
+
+func TestParsePriority(t *testing.T) {
+	for s, want := range map[string]Priority{
+		"":            PriorityInteractive,
+		"interactive": PriorityInteractive,
+		"batch":       PriorityBatch,
+		"background":  PriorityBackground,
+	} {
+		got, err := ParsePriority(s)
+		if err != nil || got != want {
+			t.Errorf("ParsePriority(%q) = %v, %v", s, got, err)
+		}
+		if s != "" && got.String() != s {
+			t.Errorf("%v.String() = %q", got, got.String())
+		}
+	}
+	if _, err := ParsePriority("urgent"); err == nil {
+		t.Error("unknown priority accepted")
+	}
+}
+
+func TestPriorityContext(t *testing.T) {
+	ctx := context.Background()
+	if priorityFrom(ctx) != PriorityInteractive || tenantFrom(ctx) != "" {
+		t.Error("unexpected defaults")
+	}
+	ctx = WithTenant(WithPriority(ctx, PriorityBatch), "10.0.0.1")
+	if priorityFrom(ctx) != PriorityBatch || tenantFrom(ctx) != "10.0.0.1" {
+		t.Errorf("got %v %q", priorityFrom(ctx), tenantFrom(ctx))
+	}
+	if priorityFrom(WithPriority(ctx, Priority(7))) != PriorityInteractive {
+		t.Error("invalid priority not clamped")
+	}
+}
+
+func TestClassQueue_FairShare(t *testing.T) {
+	q := newClassQueue(100)
+	// One tenant floods the queue with large images before another
+	// submits small ones
+	for range 10 {
+		q.push(sizedJob(1, 8<<20), "bulk", 1)
+	}
+	for range 10 {
+		q.push(sizedJob(2, 256<<10), "thumbs", 1)
+	}
+
+	// The small jobs are not stuck behind the large ones
+	thumbs := 0
+	for range 10 {
+		qj, ok := q.pop()
+		if !ok {
+			t.Fatal("queue empty")
+		}
+		if qj.job.Scale == 2 {
+			thumbs++
+		}
+	}
+	if thumbs < 9 {
+		t.Errorf("%d of the first 10 jobs were thumbnails, want at least 9", thumbs)
+	}
+
+	// Everything is eventually served
+	n := 10
+	for {
+		if _, ok := q.pop(); !ok {
+			break
+		}
+		n++
+	}
+	if n != 20 || q.len != 0 || len(q.tenants) != 0 {
+		t.Errorf("served %d jobs, len=%d tenants=%d", n, q.len, len(q.tenants))
+	}
+}
+
+func TestClassQueue_Weights(t *testing.T) {
+	q := newClassQueue(100)
+	for range 30 {
+		q.push(sizedJob(1, quantumBytes), "a", 2)
+		q.push(sizedJob(2, quantumBytes), "b", 1)
+	}
+	counts := map[float64]int{}
+	for range 30 {
+		qj, _ := q.pop()
+		counts[qj.job.Scale]++
+	}
+	if counts[1] != 20 || counts[2] != 10 {
+		t.Errorf("served a=%d b=%d, want 20 and 10", counts[1], counts[2])
+	}
+}
+
+func TestClassQueue_Limit(t *testing.T) {
+	q := newClassQueue(2)
+	if !q.push(sizedJob(1, 1), "a", 1) || !q.push(sizedJob(2, 1), "b", 1) {
+		t.Fatal("push below the limit failed")
+	}
+	if q.push(sizedJob(3, 1), "c", 1) {
+		t.Error("push over the limit accepted")
+	}
+	q.pop()
+	if !q.push(sizedJob(3, 1), "c", 1) {
+		t.Error("push after pop rejected")
+	}
+}
+
+func TestWorkerPool_PriorityOrder(t *testing.T) {
+	// Workers are not started, so jobs stay queued until next is called
+	p := NewWorkerPool(2)
+	p.enqueue(sizedJob(3, 1), PriorityBackground, "")
+	p.enqueue(sizedJob(2, 1), PriorityBatch, "")
+	p.enqueue(sizedJob(1, 1), PriorityInteractive, "")
+	for want := 1.0; want <= 3; want++ {
+		job, ok := p.next()
+		if !ok || job.Scale != want {
+			t.Errorf("next = %v, %v, want job %v", job.Scale, ok, want)
+		}
+	}
+
+	// Each class has its own depth limit
+	p.SetQueueLimit(PriorityBatch, 1)
+	if err := p.enqueue(sizedJob(1, 1), PriorityBatch, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.enqueue(sizedJob(2, 1), PriorityBatch, ""); !errors.Is(err, ErrPoolBusy) {
+		t.Errorf("full batch queue: got %v, want ErrPoolBusy", err)
+	}
+	if err := p.enqueue(sizedJob(3, 1), PriorityInteractive, ""); err != nil {
+		t.Errorf("interactive rejected by a full batch queue: %v", err)
+	}
+
+	// Stop lets workers drain the queue, then rejects new jobs
+	p.Stop()
+	for range 2 {
+		if _, ok := p.next(); !ok {
+			t.Error("queued job dropped by Stop")
+		}
+	}
+	if _, ok := p.next(); ok {
+		t.Error("next returned a job from an empty stopped pool")
+	}
+	if err := p.enqueue(sizedJob(1, 1), PriorityInteractive, ""); !errors.Is(err, ErrPoolStopped) {
+		t.Errorf("enqueue after Stop: got %v, want ErrPoolStopped", err)
+	}
+}
+
+func TestWorkerPool_QueueWait(t *testing.T) {
+	// Workers are not started, so the queue only drains when next is called
+	p := NewWorkerPool(2)
+	p.SetQueueLimit(PriorityInteractive, 1)
+	p.SetMaxQueueWait(time.Second)
+	ctx := context.Background()
+	if err := p.admit(ctx, sizedJob(1, 1), PriorityInteractive, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// A full queue holds the job until a worker takes one
+	admitted := make(chan error, 1)
+	go func() { admitted <- p.admit(ctx, sizedJob(2, 1), PriorityInteractive, "") }()
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case err := <-admitted:
+		t.Fatalf("admitted to a full queue: %v", err)
+	default:
+	}
+	job, _ := p.next()
+	p.finish(job)
+	if err := <-admitted; err != nil {
+		t.Fatalf("waiting job: %v", err)
+	}
+
+	// The wait ends with the context
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := p.admit(cctx, sizedJob(3, 1), PriorityInteractive, ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("cancelled wait: got %v, want DeadlineExceeded", err)
+	}
+
+	// Past the max wait the job is rejected, retried after the queued jobs
+	// and the rejected one run on the workers at the observed pace
+	p.SetMaxQueueWait(10 * time.Millisecond)
+	p.observeJob(3 * time.Second)
+	err := p.admit(ctx, sizedJob(4, 1), PriorityInteractive, "")
+	var busy *BusyError
+	if !errors.As(err, &busy) || !errors.Is(err, ErrPoolBusy) {
+		t.Fatalf("full queue: got %v, want BusyError", err)
+	}
+	if busy.RetryAfter != 3*time.Second {
+		t.Errorf("RetryAfter = %v, want 3s", busy.RetryAfter)
+	}
+
+	// Stop wakes waiting jobs
+	p.SetMaxQueueWait(time.Minute)
+	go func() { admitted <- p.admit(ctx, sizedJob(5, 1), PriorityInteractive, "") }()
+	time.Sleep(10 * time.Millisecond)
+	p.Shutdown(ctx)
+	if err := <-admitted; !errors.Is(err, ErrPoolStopped) {
+		t.Errorf("wait during Stop: got %v, want ErrPoolStopped", err)
+	}
+}
+
+func TestWorkerPool_QueueDelay(t *testing.T) {
+	// Workers are not started, so jobs stay queued until next is called
+	p := NewWorkerPool(2)
+	if d := p.QueueDelay(); d != 0 {
+		t.Errorf("empty queue: delay %v", d)
+	}
+	p.enqueue(sizedJob(1, 1), PriorityBatch, "a")
+	time.Sleep(20 * time.Millisecond)
+	p.enqueue(sizedJob(2, 1), PriorityInteractive, "b")
+	if d := p.QueueDelay(); d < 20*time.Millisecond {
+		t.Errorf("delay %v, want the oldest job's wait of at least 20ms", d)
+	}
+
+	// The job waiting for memory counts too
+	p.mu.Lock()
+	p.waiting = &queuedJob{job: sizedJob(3, 1), enqueued: time.Now().Add(-time.Minute)}
+	p.mu.Unlock()
+	if d := p.QueueDelay(); d < time.Minute {
+		t.Errorf("delay %v, want the waiting job's minute", d)
+	}
+}
+
+func TestWorkerPool_Shutdown(t *testing.T) {
+	// Queued jobs of a pool that was never started fail instead of hanging
+	p := NewWorkerPool(1)
+	result := make(chan Result, 1)
+	if err := p.enqueue(Job{Data: []byte("x"), Result: result}, PriorityBatch, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-result; !errors.Is(r.Err, ErrPoolStopped) {
+		t.Errorf("queued job: got %v, want ErrPoolStopped", r.Err)
+	}
+	if active, queued := p.Stats(); active != 0 || queued != 0 {
+		t.Errorf("Stats() = %d, %d after shutdown", active, queued)
+	}
+}
+
+func TestWorkerPool_ShutdownGracePeriod(t *testing.T) {
+	// The first job waits for memory that never frees up and holds back
+	// the one queued behind it
+	p := NewWorkerPool(1)
+	p.SetMemoryBudget(1)
+	running := make(chan Result, 1)
+	queued := make(chan Result, 1)
+	for _, job := range []Job{
+		{Data: []byte("a"), Result: running, memory: 2},
+		{Data: []byte("b"), Result: queued},
+	} {
+		if err := p.enqueue(job, PriorityInteractive, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.Start()
+	for {
+		p.mu.Lock()
+		waiting := p.waiting != nil
+		p.mu.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := p.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown = %v, want context.DeadlineExceeded", err)
+	}
+	for name, ch := range map[string]chan Result{"running": running, "queued": queued} {
+		select {
+		case r := <-ch:
+			if !errors.Is(r.Err, ErrPoolStopped) {
+				t.Errorf("%s job: got %v, want ErrPoolStopped", name, r.Err)
+			}
+		default:
+			t.Errorf("%s job got no result", name)
+		}
+	}
+}
@@ -3,7 +3,7 @@ package converter
 import (
 	"errors"
 	"image"
-	"log"
+	"log/slog"
 )
 
 var (
@@ -28,7 +28,7 @@ const (
 func ValidateFile(data []byte) error {
 	// Check file size
 	if len(data) > MaxFileSize {
-		log.Printf("File too large: %d bytes (max: %d)", len(data), MaxFileSize)
+		slog.Debug("file too large", "bytes", len(data), "max", MaxFileSize)
 		return ErrFileTooLarge
 	}
 
@@ -51,26 +51,26 @@ func ValidateImage(img image.Image) error {
 
 	// Check for zero or negative dimensions
 	if width <= 0 || height <= 0 {
-		log.Printf("Invalid dimensions: %dx%d", width, height)
+		slog.Debug("invalid dimensions", "width", width, "height", height)
 		return ErrInvalidImageDimensions
 	}
 
 	// Check minimum dimension
 	if width < MinImageDimension || height < MinImageDimension {
-		log.Printf("Dimensions too small: %dx%d (min: %d)", width, height, MinImageDimension)
+		slog.Debug("dimensions too small", "width", width, "height", height, "min", MinImageDimension)
 		return ErrInvalidImageDimensions
 	}
 
 	// Check maximum width/height
 	if width > MaxImageWidth || height > MaxImageHeight {
-		log.Printf("Dimensions too large: %dx%d (max: %dx%d)", width, height, MaxImageWidth, MaxImageHeight)
+		slog.Debug("dimensions too large", "width", width, "height", height, "max_width", MaxImageWidth, "max_height", MaxImageHeight)
 		return ErrImageTooLarge
 	}
 
 	// Check total pixel count (prevent decompression bomb attacks)
 	totalPixels := int64(width) * int64(height)
 	if totalPixels > MaxImagePixels {
-		log.Printf("Too many pixels: %d (max: %d)", totalPixels, MaxImagePixels)
+		slog.Debug("too many pixels", "pixels", totalPixels, "max", MaxImagePixels)
 		return ErrImageTooLarge
 	}
 
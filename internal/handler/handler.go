@@ -2,14 +2,25 @@ package handler
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"math"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/harliandi/go-heif/internal/cache"
 	"github.com/harliandi/go-heif/internal/converter"
+	"github.com/harliandi/go-heif/internal/logging"
+	"github.com/harliandi/go-heif/internal/middleware"
+	"github.com/harliandi/go-heif/pkg/jpeg"
+	"github.com/harliandi/go-heif/pkg/webp"
 	"github.com/harliandi/go-heif/internal/storage"
 )
 
@@ -25,8 +36,11 @@ const (
 type Handler struct {
 	converter   *converter.Converter
 	uploader    *storage.Uploader
+	cache       *cache.Cache
 	maxUploadMB int
+	targetSizeKB int
 	useWorkerPool bool
+	draining     atomic.Bool // set on shutdown, fails readiness checks
 }
 
 // New creates a new Handler
@@ -34,6 +48,7 @@ func New(targetSizeKB, maxUploadMB int) *Handler {
 	return &Handler{
 		converter:   converter.New(targetSizeKB),
 		maxUploadMB: maxUploadMB,
+		targetSizeKB: targetSizeKB,
 		useWorkerPool: true, // Enable worker pool by default for better performance
 	}
 }
@@ -44,6 +59,12 @@ func (h *Handler) WithUploader(uploader *storage.Uploader) *Handler {
 	return h
 }
 
+// WithCache sets the conversion result cache for the handler
+func (h *Handler) WithCache(c *cache.Cache) *Handler {
+	h.cache = c
+	return h
+}
+
 // Convert handles the /convert endpoint
 func (h *Handler) Convert(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -51,61 +72,8 @@ func (h *Handler) Convert(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check for client cancellation early
-	select {
-	case <-r.Context().Done():
-		log.Printf("Request cancelled by client")
-		return
-	default:
-	}
-
-	// Parse multipart form with size limit
-	if err := r.ParseMultipartForm(int64(h.maxUploadMB) << 20); err != nil {
-		if errors.Is(err, http.ErrNotMultipart) {
-			http.Error(w, "Content-Type must be multipart/form-data", http.StatusBadRequest)
-		} else {
-			http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
-		}
-		return
-	}
-
-	// Get file from form
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, "No file provided", http.StatusBadRequest)
-		return
-	}
-	defer file.Close()
-
-	// Validate file extension
-	if !isHEIFExtension(header.Filename) {
-		http.Error(w, "Not a HEIF/HEIC file (wrong extension)", http.StatusUnsupportedMediaType)
-		return
-	}
-
-	// Read entire file into memory to avoid seek/reader exhaustion issues
-	// This also allows us to validate magic bytes before conversion
-	fileData, err := io.ReadAll(file)
-	if err != nil {
-		log.Printf("Failed to read file: %v", err)
-		http.Error(w, "Failed to read file", http.StatusInternalServerError)
-		return
-	}
-
-	// Strict file size validation before processing
-	if err := converter.ValidateFile(fileData); err != nil {
-		log.Printf("File validation failed: %v", err)
-		if errors.Is(err, converter.ErrFileTooLarge) {
-			http.Error(w, "File too large (max 20MB)", http.StatusRequestEntityTooLarge)
-		} else {
-			http.Error(w, "Invalid file", http.StatusBadRequest)
-		}
-		return
-	}
-
-	// Validate file magic bytes (actual format check)
-	if !isValidHEIF(fileData) {
-		http.Error(w, "Invalid HEIF/HEIC file format", http.StatusUnsupportedMediaType)
+	fileData, ok := h.readUpload(w, r)
+	if !ok {
 		return
 	}
 
@@ -118,7 +86,18 @@ func (h *Handler) Convert(w http.ResponseWriter, r *http.Request) {
 	if outputFormat != "webp" {
 		outputFormat = "jpeg" // default
 	}
-	h.converter.SetOutputFormat(outputFormat)
+
+	// Per-request converter settings; the shared converter is never modified
+	opts, err := parseConvertOptions(query, outputFormat)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r, err = withScheduling(r, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Default scale is 0.5 (50% resolution) for speed
 	// Use scale=1 to get full resolution
@@ -139,54 +118,64 @@ func (h *Handler) Convert(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Check the caller's quotas and charge it for the images it asks to
+	// decode
+	sel, _ := parseSelection(query, outputFormat)
+	if !checkTier(w, r, fileData, sel, outputFormat, scale) {
+		return
+	}
+	if !chargeCost(w, r, fileData, sel) {
+		return
+	}
+
+	// Multi-image files (a specific item, all items as ZIP, or an animation)
+	if h.convertMulti(w, r, fileData, opts, scale, quality) {
+		return
+	}
+
+	// Serve repeated uploads from the cache
+	targetKB := h.targetSizeKB
+	if sizeKB, err := strconv.Atoi(query.Get("max_size")); err == nil && sizeKB > 0 && scale >= 1.0 {
+		targetKB = sizeKB
+		opts.TargetSizeKB = sizeKB
+	}
+	key := h.cacheKey(fileData, opts, scale, quality, targetKB)
+	if data, ok := h.cachedResult(w, key); ok {
+		h.sendJPEGResponse(w, r, data)
+		return
+	}
+
 	// Convert with scale and/or quality
 	if scale > 0 && scale < 1.0 {
 		if quality > 0 {
-			h.convertFastWithQuality(w, r, fileData, scale, quality)
+			h.convertFastWithQuality(w, r, fileData, opts, scale, quality, key)
 		} else {
-			h.convertFast(w, r, fileData, scale)
+			h.convertFast(w, r, fileData, opts, scale, key)
 		}
 		return
 	}
 
 	// scale >= 1.0 means full resolution
 	if quality > 0 {
-		h.convertWithQuality(w, r, fileData, quality)
+		h.convertWithQuality(w, r, fileData, opts, quality, key)
 		return
 	}
 
-	// Check for custom max_size parameter - worker pool doesn't support dynamic target size
-	// For custom max_size, fall back to direct conversion
+	// Adaptive quality, with the max_size target if given (see opts)
 	var jpegData []byte
-	if maxSizeStr := query.Get("max_size"); maxSizeStr != "" {
-		// Custom target size - use direct conversion (worker pool uses default target size)
-		sizeKB, parseErr := strconv.Atoi(maxSizeStr)
-		if parseErr == nil && sizeKB > 0 {
-			conv := converter.New(sizeKB)
-			jpegData, err = conv.ConvertBytes(fileData)
-		} else {
-			jpegData, err = h.converter.ConvertBytes(fileData)
-		}
-	} else if h.useWorkerPool {
+	if h.useWorkerPool {
 		// Use worker pool with context for cancellation support
-		jpegData, err = converter.SubmitToGlobalPool(r.Context(), fileData, 1.0, -1)
+		jpegData, err = converter.SubmitToGlobalPoolWithOptions(r.Context(), fileData, 1.0, -1, opts)
 	} else {
 		// Direct conversion fallback
-		jpegData, err = h.converter.ConvertBytes(fileData)
+		jpegData, err = h.converter.WithOptions(opts).WithContext(r.Context()).ConvertBytes(fileData)
 	}
 
 	if err != nil {
-		log.Printf("Conversion error: %v", err)
-		if errors.Is(err, converter.ErrPoolBusy) {
-			w.Header().Set("Content-Type", "application/json")
-			w.Header().Set("Retry-After", "1")
-			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte(`{"error":"Service busy, please retry"}`))
-			return
-		}
-		http.Error(w, "Conversion failed", http.StatusInternalServerError)
+		writeConversionError(w, r, err)
 		return
 	}
+	h.storeResult(key, jpegData)
 
 	// Check response format - default to binary for better performance
 	responseFormat := query.Get("format")
@@ -199,73 +188,126 @@ func (h *Handler) Convert(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h *Handler) convertWithQuality(w http.ResponseWriter, r *http.Request, fileData []byte, quality int) {
+func (h *Handler) convertWithQuality(w http.ResponseWriter, r *http.Request, fileData []byte, opts converter.Options, quality int, key string) {
 	var jpegData []byte
 	var err error
 	if h.useWorkerPool {
-		jpegData, err = converter.SubmitToGlobalPool(r.Context(), fileData, 1.0, quality)
+		jpegData, err = converter.SubmitToGlobalPoolWithOptions(r.Context(), fileData, 1.0, quality, opts)
 	} else {
-		jpegData, err = h.converter.ConvertBytesWithQuality(fileData, quality)
+		jpegData, err = h.converter.WithOptions(opts).WithContext(r.Context()).ConvertBytesWithQuality(fileData, quality)
 	}
 	if err != nil {
-		log.Printf("Conversion error: %v", err)
-		if errors.Is(err, converter.ErrPoolBusy) {
-			w.Header().Set("Content-Type", "application/json")
-			w.Header().Set("Retry-After", "1")
-			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte(`{"error":"Service busy, please retry"}`))
-			return
-		}
-		http.Error(w, "Conversion failed", http.StatusInternalServerError)
+		writeConversionError(w, r, err)
 		return
 	}
+	h.storeResult(key, jpegData)
 	h.sendJPEGResponse(w, r, jpegData)
 }
 
-func (h *Handler) convertFast(w http.ResponseWriter, r *http.Request, fileData []byte, scale float64) {
+func (h *Handler) convertFast(w http.ResponseWriter, r *http.Request, fileData []byte, opts converter.Options, scale float64, key string) {
 	var jpegData []byte
 	var err error
 	if h.useWorkerPool {
-		jpegData, err = converter.SubmitToGlobalPool(r.Context(), fileData, scale, -1)
+		jpegData, err = converter.SubmitToGlobalPoolWithOptions(r.Context(), fileData, scale, -1, opts)
 	} else {
-		jpegData, err = h.converter.ConvertBytesFast(fileData, scale)
+		jpegData, err = h.converter.WithOptions(opts).WithContext(r.Context()).ConvertBytesFast(fileData, scale)
 	}
 	if err != nil {
-		log.Printf("Conversion error: %v", err)
-		if errors.Is(err, converter.ErrPoolBusy) {
-			w.Header().Set("Content-Type", "application/json")
-			w.Header().Set("Retry-After", "1")
-			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte(`{"error":"Service busy, please retry"}`))
-			return
-		}
-		http.Error(w, "Conversion failed", http.StatusInternalServerError)
+		writeConversionError(w, r, err)
 		return
 	}
+	h.storeResult(key, jpegData)
 	h.sendJPEGResponse(w, r, jpegData)
 }
 
-func (h *Handler) convertFastWithQuality(w http.ResponseWriter, r *http.Request, fileData []byte, scale float64, quality int) {
+func (h *Handler) convertFastWithQuality(w http.ResponseWriter, r *http.Request, fileData []byte, opts converter.Options, scale float64, quality int, key string) {
 	var jpegData []byte
 	var err error
 	if h.useWorkerPool {
-		jpegData, err = converter.SubmitToGlobalPool(r.Context(), fileData, scale, quality)
+		jpegData, err = converter.SubmitToGlobalPoolWithOptions(r.Context(), fileData, scale, quality, opts)
 	} else {
-		jpegData, err = h.converter.ConvertBytesFastWithQuality(fileData, scale, quality)
+		jpegData, err = h.converter.WithOptions(opts).WithContext(r.Context()).ConvertBytesFastWithQuality(fileData, scale, quality)
 	}
 	if err != nil {
-		log.Printf("Conversion error: %v", err)
-		if errors.Is(err, converter.ErrPoolBusy) {
-			w.Header().Set("Content-Type", "application/json")
-			w.Header().Set("Retry-After", "1")
-			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte(`{"error":"Service busy, please retry"}`))
-			return
+		writeConversionError(w, r, err)
+		return
+	}
+	h.storeResult(key, jpegData)
+	h.sendJPEGResponse(w, r, jpegData)
+}
+
+// writeConversionError logs a failed conversion and writes its response
+func writeConversionError(w http.ResponseWriter, r *http.Request, err error) {
+	var status int
+	var body string
+	switch {
+	case errors.Is(err, converter.ErrPoolBusy):
+		retryAfter := time.Second
+		var busy *converter.BusyError
+		if errors.As(err, &busy) {
+			retryAfter = busy.RetryAfter
 		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		status, body = http.StatusServiceUnavailable, `{"error":"Service busy, please retry"}`
+	case errors.Is(err, converter.ErrMemoryBudget):
+		status, body = http.StatusRequestEntityTooLarge, `{"error":"Image too large to convert"}`
+	case errors.Is(err, converter.ErrJobTimeout):
+		status, body = http.StatusGatewayTimeout, `{"error":"Conversion timed out"}`
+	default:
+		slog.ErrorContext(r.Context(), "conversion failed", "error", err)
 		http.Error(w, "Conversion failed", http.StatusInternalServerError)
 		return
 	}
-	h.sendJPEGResponse(w, r, jpegData)
+	// Overload and oversized images are expected under load
+	slog.WarnContext(r.Context(), "conversion failed", "error", err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write([]byte(body))
+}
+
+// cacheKey identifies the result of a primary-image conversion by the input
+// and every setting that affects the output. It is empty without a cache.
+func (h *Handler) cacheKey(fileData []byte, opts converter.Options, scale float64, quality, targetKB int) string {
+	if h.cache == nil {
+		return ""
+	}
+	if scale <= 0 || scale >= 1.0 {
+		scale = 1.0
+	}
+	if quality > 0 {
+		targetKB = 0 // only used by adaptive quality
+	}
+	if opts.ToneMap == "" {
+		opts.ToneMap = converter.DefaultToneMap
+	}
+	if opts.Format == "webp" {
+		opts.JPEG = jpeg.Options{}
+	} else {
+		opts.WebP = webp.Options{}
+	}
+	params := fmt.Sprintf("%s|scale=%g|quality=%d|target=%d|%+v", converter.JPEGEncoder(), scale, quality, targetKB, opts)
+	return cache.Key(fileData, params)
+}
+
+// cachedResult looks key up in the cache and sets the X-Cache header
+func (h *Handler) cachedResult(w http.ResponseWriter, key string) ([]byte, bool) {
+	if key == "" {
+		return nil, false
+	}
+	data, ok := h.cache.Get(key)
+	if ok {
+		w.Header().Set("X-Cache", "HIT")
+	} else {
+		w.Header().Set("X-Cache", "MISS")
+	}
+	return data, ok
+}
+
+// storeResult caches a successful conversion
+func (h *Handler) storeResult(key string, data []byte) {
+	if key != "" {
+		h.cache.Set(key, data)
+	}
 }
 
 // sendJPEGResponse sends the image data using format from query parameter
@@ -299,7 +341,7 @@ func (h *Handler) sendBinaryImageResponse(w http.ResponseWriter, data []byte, ou
 	w.WriteHeader(http.StatusOK)
 	if _, err := w.Write(data); err != nil {
 		// Client may have disconnected, log but don't panic
-		log.Printf("Failed to write response: %v", err)
+		slog.Debug("response write failed", "error", err)
 	}
 }
 
@@ -322,7 +364,7 @@ func (h *Handler) sendJSONResponse(w http.ResponseWriter, data []byte, outputFor
 	w.WriteHeader(http.StatusOK)
 	if _, err := w.Write([]byte(response)); err != nil {
 		// Client may have disconnected, log but don't panic
-		log.Printf("Failed to write response: %v", err)
+		slog.Debug("response write failed", "error", err)
 	}
 }
 
@@ -331,10 +373,28 @@ func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	if _, err := w.Write([]byte(`{"status":"ok"}`)); err != nil {
-		log.Printf("Failed to write health response: %v", err)
+		slog.DebugContext(r.Context(), "response write failed", "error", err)
 	}
 }
 
+// SetDraining marks the server as shutting down: /ready starts failing so
+// load balancers stop sending new requests, while in-flight ones finish
+func (h *Handler) SetDraining() {
+	h.draining.Store(true)
+}
+
+// Ready handles the /ready endpoint (readiness probe)
+func (h *Handler) Ready(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if h.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"status":"draining"}`))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"ready"}`))
+}
+
 // ConvertAndStore handles the /convert/store endpoint
 // Converts HEIF to JPEG and uploads to Supabase Storage, returning the public URL
 func (h *Handler) ConvertAndStore(w http.ResponseWriter, r *http.Request) {
@@ -345,16 +405,130 @@ func (h *Handler) ConvertAndStore(w http.ResponseWriter, r *http.Request) {
 
 	// Check if uploader is configured
 	if h.uploader == nil {
-		log.Printf("Storage uploader not configured")
+		slog.ErrorContext(r.Context(), "storage uploader not configured")
 		http.Error(w, "Storage not configured", http.StatusInternalServerError)
 		return
 	}
 
+	fileData, ok := h.readUpload(w, r)
+	if !ok {
+		return
+	}
+
+	// Check query parameters
+	query := r.URL.Query()
+
+	// Get output format (default: jpeg, options: jpeg, webp)
+	outputFormat := query.Get("output")
+	if outputFormat != "webp" {
+		outputFormat = "jpeg"
+	}
+	opts, err := parseConvertOptions(query, outputFormat)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r, err = withScheduling(r, query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conv := h.converter.WithOptions(opts).WithContext(r.Context())
+
+	// Default scale is 0.5 (50% resolution) for speed
+	var scale float64 = 0.5
+	if scaleStr := query.Get("scale"); scaleStr != "" {
+		s, err := strconv.ParseFloat(scaleStr, 64)
+		if err == nil && s > 0 {
+			scale = s
+		}
+	}
+	if !checkTier(w, r, fileData, converter.Selection{}, outputFormat, scale) {
+		return
+	}
+	if !chargeCost(w, r, fileData, converter.Selection{}) {
+		return
+	}
+
+	// Get quality parameter (use adaptive quality by default)
+	var quality int = -1
+	if qualityStr := query.Get("quality"); qualityStr != "" {
+		q, err := strconv.Atoi(qualityStr)
+		if err == nil && q >= 1 && q <= 100 {
+			quality = q
+		}
+	}
+
+	// Convert the image, or reuse the result of an identical conversion
+	key := h.cacheKey(fileData, opts, scale, quality, h.targetSizeKB)
+	jpegData, cached := h.cachedResult(w, key)
+	switch {
+	case cached:
+		// Upload the earlier result
+	case scale > 0 && scale < 1.0:
+		// Fast conversion with scaling
+		if h.useWorkerPool {
+			jpegData, err = converter.SubmitToGlobalPoolWithOptions(r.Context(), fileData, scale, quality, opts)
+		} else {
+			if quality > 0 {
+				jpegData, err = conv.ConvertBytesFastWithQuality(fileData, scale, quality)
+			} else {
+				jpegData, err = conv.ConvertBytesFast(fileData, scale)
+			}
+		}
+	default:
+		// Full resolution conversion
+		if h.useWorkerPool {
+			jpegData, err = converter.SubmitToGlobalPoolWithOptions(r.Context(), fileData, 1.0, quality, opts)
+		} else {
+			if quality > 0 {
+				jpegData, err = conv.ConvertBytesWithQuality(fileData, quality)
+			} else {
+				jpegData, err = conv.ConvertBytes(fileData)
+			}
+		}
+	}
+
+	if err != nil {
+		writeConversionError(w, r, err)
+		return
+	}
+	if !cached {
+		h.storeResult(key, jpegData)
+	}
+
+	// Upload to storage with correct format
+	var contentType string
+	if outputFormat == "webp" {
+		contentType = "image/webp"
+	} else {
+		contentType = "image/jpeg"
+	}
+	result, err := h.uploader.UploadWithFormat(r.Context(), jpegData, outputFormat, contentType)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "upload failed", "error", err)
+		http.Error(w, "Upload failed", http.StatusInternalServerError)
+		return
+	}
+
+	// Return the public URL
+	response := `{"url":"` + result.URL + `"}`
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(response)))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write([]byte(response)); err != nil {
+		slog.DebugContext(r.Context(), "response write failed", "error", err)
+	}
+}
+
+// readUpload validates the request's multipart "file" field and returns its
+// contents. It writes the error response and returns false on failure.
+func (h *Handler) readUpload(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
 	// Check for client cancellation early
 	select {
 	case <-r.Context().Done():
-		log.Printf("Request cancelled by client")
-		return
+		slog.DebugContext(r.Context(), "request cancelled by client")
+		return nil, false
 	default:
 	}
 
@@ -365,139 +539,340 @@ func (h *Handler) ConvertAndStore(w http.ResponseWriter, r *http.Request) {
 		} else {
 			http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
 		}
-		return
+		return nil, false
 	}
 
 	// Get file from form
 	file, header, err := r.FormFile("file")
 	if err != nil {
 		http.Error(w, "No file provided", http.StatusBadRequest)
-		return
+		return nil, false
 	}
 	defer file.Close()
 
 	// Validate file extension
 	if !isHEIFExtension(header.Filename) {
 		http.Error(w, "Not a HEIF/HEIC file (wrong extension)", http.StatusUnsupportedMediaType)
-		return
+		return nil, false
 	}
 
-	// Read entire file into memory
+	// Read entire file into memory to avoid seek/reader exhaustion issues
+	// This also allows us to validate magic bytes before conversion
 	fileData, err := io.ReadAll(file)
 	if err != nil {
-		log.Printf("Failed to read file: %v", err)
+		slog.WarnContext(r.Context(), "upload read failed", "error", err)
 		http.Error(w, "Failed to read file", http.StatusInternalServerError)
-		return
+		return nil, false
+	}
+	logging.Add(r.Context(), "bytes_in", len(fileData))
+
+	// The caller's API key tier may allow smaller uploads than the server
+	if id, ok := middleware.IdentityFrom(r.Context()); ok && id.Tier.MaxUploadMB > 0 && len(fileData) > id.Tier.MaxUploadMB<<20 {
+		middleware.QuotaError(w, "max_upload_mb")
+		return nil, false
 	}
 
 	// Strict file size validation before processing
 	if err := converter.ValidateFile(fileData); err != nil {
-		log.Printf("File validation failed: %v", err)
+		slog.InfoContext(r.Context(), "file validation failed", "error", err)
 		if errors.Is(err, converter.ErrFileTooLarge) {
 			http.Error(w, "File too large (max 20MB)", http.StatusRequestEntityTooLarge)
 		} else {
 			http.Error(w, "Invalid file", http.StatusBadRequest)
 		}
-		return
+		return nil, false
 	}
 
-	// Validate file magic bytes
+	// Validate file magic bytes (actual format check)
 	if !isValidHEIF(fileData) {
 		http.Error(w, "Invalid HEIF/HEIC file format", http.StatusUnsupportedMediaType)
-		return
+		return nil, false
 	}
 
-	// Check query parameters
+	return fileData, true
+}
+
+// convertMulti handles the multi-image query parameters:
+//   - item=N converts the image at index N (see /info)
+//   - item=all converts every image into a ZIP archive
+//   - animate=true (with output=webp) converts an image sequence into an animated WebP
+//
+// It returns false when none of them is set and the request should take the
+// regular primary-image path.
+func (h *Handler) convertMulti(w http.ResponseWriter, r *http.Request, fileData []byte, opts converter.Options, scale float64, quality int) bool {
 	query := r.URL.Query()
+	outputFormat := opts.Format
+	sel, ok := parseSelection(query, outputFormat)
+	if !ok {
+		http.Error(w, "Invalid item parameter", http.StatusBadRequest)
+		return true
+	}
+	if sel.Kind == "" {
+		return false
+	}
 
-	// Get output format (default: jpeg, options: jpeg, webp)
-	outputFormat := query.Get("output")
-	if outputFormat != "webp" {
-		outputFormat = "jpeg"
+	contentType := "image/jpeg"
+	if outputFormat == "webp" {
+		contentType = "image/webp"
+	}
+	if sel.Kind == converter.SelectAll {
+		contentType = "application/zip"
 	}
-	h.converter.SetOutputFormat(outputFormat)
 
-	// Default scale is 0.5 (50% resolution) for speed
-	var scale float64 = 0.5
-	if scaleStr := query.Get("scale"); scaleStr != "" {
-		s, err := strconv.ParseFloat(scaleStr, 64)
-		if err == nil && s > 0 {
-			scale = s
+	var data []byte
+	var err error
+	if h.useWorkerPool {
+		data, err = converter.SubmitSelectionToGlobalPool(r.Context(), fileData, sel, scale, quality, opts)
+	} else {
+		data, err = h.converter.WithOptions(opts).WithContext(r.Context()).ConvertSelection(fileData, sel, scale, quality)
+	}
+
+	if err != nil {
+		slog.WarnContext(r.Context(), "multi-image conversion failed", "error", err)
+		switch {
+		case errors.Is(err, converter.ErrItemNotFound):
+			http.Error(w, "Image item not found", http.StatusNotFound)
+		case errors.Is(err, converter.ErrNoSequence):
+			http.Error(w, "File has no image sequence", http.StatusBadRequest)
+		case errors.Is(err, converter.ErrTooManyImages):
+			http.Error(w, "Too many images in file", http.StatusRequestEntityTooLarge)
+		case errors.Is(err, converter.ErrUnsupportedItem):
+			http.Error(w, "Unsupported image item", http.StatusUnsupportedMediaType)
+		default:
+			writeConversionError(w, r, err)
 		}
+		return true
 	}
 
-	// Get quality parameter (use adaptive quality by default)
-	var quality int = -1
-	if qualityStr := query.Get("quality"); qualityStr != "" {
-		q, err := strconv.Atoi(qualityStr)
-		if err == nil && q >= 1 && q <= 100 {
-			quality = q
+	if contentType == "application/zip" {
+		w.Header().Set("Content-Disposition", `attachment; filename="images.zip"`)
+	} else if query.Get("format") == "json" {
+		h.sendJSONResponse(w, data, outputFormat)
+		return true
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(data); err != nil {
+		slog.DebugContext(r.Context(), "response write failed", "error", err)
+	}
+	return true
+}
+
+// parseSelection reads the images to convert from the item and animate
+// parameters; the zero Selection is the primary image. ok is false for an
+// invalid item.
+func parseSelection(query url.Values, outputFormat string) (sel converter.Selection, ok bool) {
+	item := query.Get("item")
+	switch {
+	case outputFormat == "webp" && (query.Get("animate") == "true" || query.Get("animate") == "1"):
+		sel.Kind = converter.SelectAnimation
+	case item == "":
+	case item == "all":
+		sel.Kind = converter.SelectAll
+	default:
+		index, err := strconv.Atoi(item)
+		if err != nil || index < 0 {
+			return sel, false
 		}
+		sel = converter.Selection{Kind: converter.SelectItem, Index: index}
 	}
+	return sel, true
+}
 
-	// Convert the image
+// parseConvertOptions reads the per-request converter settings:
+//   - tonemap=none|reinhard|hable selects the HDR to SDR tone mapping operator
+//   - profile=max selects the smallest-output JPEG settings (tuned tables,
+//     trellis quantization, progressive); the parameters below override it
+//   - quant=annexk|robidoux selects the JPEG quantization tables
+//   - trellis=true enables trellis quantization
+//   - progressive=true writes a progressive JPEG
+//   - subsampling=444|422|420 sets the JPEG chroma subsampling
+//   - optimize=true computes optimized Huffman tables
+//   - dct=islow|ifast|float selects the DCT method
+//   - restart=N writes a restart marker every N MCUs
+//   - dpi=N sets the JFIF density in dots per inch
+//
+// The returned error message is suitable for a 400 response.
+func parseConvertOptions(query url.Values, outputFormat string) (converter.Options, error) {
+	opts := converter.Options{Format: outputFormat}
+
+	if toneMap := query.Get("tonemap"); toneMap != "" {
+		if !converter.IsValidToneMap(toneMap) {
+			return opts, errors.New("Invalid tonemap parameter (none, reinhard or hable)")
+		}
+		opts.ToneMap = toneMap
+	}
 
-	// Convert the image
-	var jpegData []byte
-	if scale > 0 && scale < 1.0 {
-		// Fast conversion with scaling
-		if h.useWorkerPool {
-			jpegData, err = converter.SubmitToGlobalPool(r.Context(), fileData, scale, quality)
-		} else {
-			if quality > 0 {
-				jpegData, err = h.converter.ConvertBytesFastWithQuality(fileData, scale, quality)
-			} else {
-				jpegData, err = h.converter.ConvertBytesFast(fileData, scale)
-			}
+	switch query.Get("profile") {
+	case "", "default":
+	case "max":
+		opts.JPEG = jpeg.MaxCompression(0) // quality is set per conversion
+	default:
+		return opts, errors.New("Invalid profile parameter (default or max)")
+	}
+
+	var err error
+	if v := query.Get("quant"); v != "" {
+		if opts.JPEG.QuantTable, err = jpeg.ParseQuantTable(v); err != nil {
+			return opts, errors.New("Invalid quant parameter (annexk or robidoux)")
 		}
-	} else {
-		// Full resolution conversion
-		if h.useWorkerPool {
-			jpegData, err = converter.SubmitToGlobalPool(r.Context(), fileData, 1.0, quality)
-		} else {
-			if quality > 0 {
-				jpegData, err = h.converter.ConvertBytesWithQuality(fileData, quality)
-			} else {
-				jpegData, err = h.converter.ConvertBytes(fileData)
-			}
+	}
+	if v := query.Get("trellis"); v != "" {
+		if opts.JPEG.Trellis, err = strconv.ParseBool(v); err != nil {
+			return opts, errors.New("Invalid trellis parameter (true or false)")
+		}
+	}
+	if v := query.Get("progressive"); v != "" {
+		if opts.JPEG.Progressive, err = strconv.ParseBool(v); err != nil {
+			return opts, errors.New("Invalid progressive parameter (true or false)")
 		}
 	}
+	if v := query.Get("optimize"); v != "" {
+		if opts.JPEG.OptimizeHuffman, err = strconv.ParseBool(v); err != nil {
+			return opts, errors.New("Invalid optimize parameter (true or false)")
+		}
+	}
+	if opts.JPEG.Subsampling, err = jpeg.ParseSubsampling(query.Get("subsampling")); err != nil {
+		return opts, errors.New("Invalid subsampling parameter (444, 422 or 420)")
+	}
+	if opts.JPEG.DCTMethod, err = jpeg.ParseDCTMethod(query.Get("dct")); err != nil {
+		return opts, errors.New("Invalid dct parameter (islow, ifast or float)")
+	}
+	if v := query.Get("restart"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > jpeg.MaxRestartInterval {
+			return opts, errors.New("Invalid restart parameter (0-65535 MCUs)")
+		}
+		opts.JPEG.RestartInterval = n
+	}
+	if v := query.Get("dpi"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 65535 {
+			return opts, errors.New("Invalid dpi parameter (1-65535)")
+		}
+		opts.JPEG.DensityUnit = jpeg.DensityInch
+		opts.JPEG.XDensity, opts.JPEG.YDensity = n, n
+	}
 
-	if err != nil {
-		log.Printf("Conversion error: %v", err)
-		if errors.Is(err, converter.ErrPoolBusy) {
-			w.Header().Set("Content-Type", "application/json")
-			w.Header().Set("Retry-After", "1")
-			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte(`{"error":"Service busy, please retry"}`))
-			return
+	opts.WebP = webp.Options{Method: webp.DefaultMethod}
+	if v := query.Get("method"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < webp.MinMethod || n > webp.MaxMethod {
+			return opts, errors.New("Invalid method parameter (0-6)")
 		}
-		http.Error(w, "Conversion failed", http.StatusInternalServerError)
+		opts.WebP.Method = n
+	}
+	if v := query.Get("sharp_yuv"); v != "" {
+		if opts.WebP.SharpYUV, err = strconv.ParseBool(v); err != nil {
+			return opts, errors.New("Invalid sharp_yuv parameter (true or false)")
+		}
+	}
+	if v := query.Get("lossless"); v != "" {
+		if opts.WebP.Lossless, err = strconv.ParseBool(v); err != nil {
+			return opts, errors.New("Invalid lossless parameter (true or false)")
+		}
+	}
+	if v := query.Get("near_lossless"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 100 {
+			return opts, errors.New("Invalid near_lossless parameter (0-100)")
+		}
+		opts.WebP.NearLossless = n
+	}
+	return opts, nil
+}
+
+// Info handles the /info endpoint
+// Lists the images (items and sequence frames) contained in an uploaded HEIF file
+func (h *Handler) Info(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Upload to storage with correct format
-	var contentType string
-	if outputFormat == "webp" {
-		contentType = "image/webp"
-	} else {
-		contentType = "image/jpeg"
+	fileData, ok := h.readUpload(w, r)
+	if !ok {
+		return
 	}
-	result, err := h.uploader.UploadWithFormat(r.Context(), jpegData, outputFormat, contentType)
+	// Listing images decodes nothing; only the upload is charged
+	if !middleware.ChargeCost(w, r, len(fileData), 0) {
+		return
+	}
+
+	images, err := converter.ListImages(fileData)
 	if err != nil {
-		log.Printf("Upload error: %v", err)
-		http.Error(w, "Upload failed", http.StatusInternalServerError)
+		slog.InfoContext(r.Context(), "image listing failed", "error", err)
+		http.Error(w, "Invalid HEIF/HEIC file format", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	response, err := json.Marshal(struct {
+		Count  int                   `json:"count"`
+		Images []converter.ImageInfo `json:"images"`
+	}{len(images), images})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	// Return the public URL
-	response := `{"url":"` + result.URL + `"}`
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Content-Length", strconv.Itoa(len(response)))
 	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write([]byte(response)); err != nil {
-		log.Printf("Failed to write response: %v", err)
+	if _, err := w.Write(response); err != nil {
+		slog.DebugContext(r.Context(), "response write failed", "error", err)
+	}
+}
+
+// checkTier enforces the output quotas of the caller's API key tier:
+// allowed formats and the largest output image. It writes a 403 response
+// naming the quota and returns false when the request exceeds one.
+func checkTier(w http.ResponseWriter, r *http.Request, fileData []byte, sel converter.Selection, format string, scale float64) bool {
+	id, ok := middleware.IdentityFrom(r.Context())
+	if !ok {
+		return true
+	}
+	if !id.Tier.AllowsFormat(format) {
+		middleware.QuotaError(w, "formats")
+		return false
 	}
+	if limit := id.Tier.MaxOutputMegapixels; limit > 0 {
+		pixels := float64(converter.MaxPixels(fileData, sel))
+		if scale > 0 && scale < 1.0 {
+			pixels *= scale * scale
+		}
+		if pixels > limit*1e6 {
+			middleware.QuotaError(w, "max_output_megapixels")
+			return false
+		}
+	}
+	return true
+}
+
+// withScheduling tags the request context with the worker pool priority
+// from the "priority" parameter and the client as the fair-share tenant:
+// the API key's tenant, or the client's address (its /64 for IPv6) as
+// resolved through trusted proxies
+func withScheduling(r *http.Request, query url.Values) (*http.Request, error) {
+	priority, err := converter.ParsePriority(query.Get("priority"))
+	if err != nil {
+		return r, errors.New("Invalid priority parameter (interactive, batch, background)")
+	}
+	tenant := middleware.ClientKey(r)
+	if id, ok := middleware.IdentityFrom(r.Context()); ok {
+		tenant = id.Tenant
+	}
+	logging.Add(r.Context(), "tenant", tenant, "priority", priority.String())
+	ctx := converter.WithTenant(converter.WithPriority(r.Context(), priority), tenant)
+	return r.WithContext(ctx), nil
+}
+
+// chargeCost charges the request for the upload and decoding sel's images
+// (see middleware.ChargeCost), logging their megapixels
+func chargeCost(w http.ResponseWriter, r *http.Request, fileData []byte, sel converter.Selection) bool {
+	pixels := converter.Pixels(fileData, sel)
+	logging.Add(r.Context(), "mp", math.Round(float64(pixels)/1e4)/100)
+	return middleware.ChargeCost(w, r, len(fileData), pixels)
 }
 
 // isHEIFExtension checks if the filename has a HEIF/HEIC extension
@@ -3,15 +3,22 @@ package handler
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/harliandi/go-heif/internal/cache"
 	"github.com/harliandi/go-heif/internal/converter"
+	"github.com/harliandi/go-heif/internal/middleware"
+	"github.com/harliandi/go-heif/pkg/jpeg"
+	"github.com/harliandi/go-heif/pkg/webp"
 )
 
 func TestNew(t *testing.T) {
@@ -291,6 +298,22 @@ func TestHandler_Health(t *testing.T) {
 	}
 }
 
+func TestHandler_Ready(t *testing.T) {
+	h := New(500, 10)
+	ready := func() int {
+		w := httptest.NewRecorder()
+		h.Ready(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		return w.Code
+	}
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", code)
+	}
+	h.SetDraining()
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 while draining, got %d", code)
+	}
+}
+
 func TestHandler_Convert_PoolBusyError(t *testing.T) {
 	// This test verifies ErrPoolBusy is handled correctly
 	// We can't easily simulate a full pool, but we can test the error handling path
@@ -303,6 +326,29 @@ func TestHandler_Convert_PoolBusyError(t *testing.T) {
 	}
 }
 
+func TestWriteConversionError(t *testing.T) {
+	tests := []struct {
+		err        error
+		wantStatus int
+		retryAfter bool
+	}{
+		{converter.ErrPoolBusy, http.StatusServiceUnavailable, true},
+		{fmt.Errorf("submit: %w", converter.ErrMemoryBudget), http.StatusRequestEntityTooLarge, false},
+		{converter.ErrJobTimeout, http.StatusGatewayTimeout, false},
+		{converter.ErrInvalidHEIF, http.StatusInternalServerError, false},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		writeConversionError(w, httptest.NewRequest(http.MethodPost, "/convert", nil), tt.err)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%v: status %d, want %d", tt.err, w.Code, tt.wantStatus)
+		}
+		if got := w.Header().Get("Retry-After") != ""; got != tt.retryAfter {
+			t.Errorf("%v: Retry-After set = %v", tt.err, got)
+		}
+	}
+}
+
 func TestHandler_Convert_ConcurrentRequests(t *testing.T) {
 	h := New(500, 10)
 
@@ -565,7 +611,7 @@ func TestHandler_convertWithQuality(t *testing.T) {
 			req := httptest.NewRequest(http.MethodPost, "/convert", nil)
 			w := httptest.NewRecorder()
 
-			h.convertWithQuality(w, req, []byte("fake"), tt.quality)
+			h.convertWithQuality(w, req, []byte("fake"), converter.Options{}, tt.quality, "")
 
 			// Should get an error for invalid data, but not panic
 			if w.Code != http.StatusInternalServerError && w.Code != http.StatusServiceUnavailable {
@@ -593,7 +639,7 @@ func TestHandler_convertFast(t *testing.T) {
 			req := httptest.NewRequest(http.MethodPost, "/convert", nil)
 			w := httptest.NewRecorder()
 
-			h.convertFast(w, req, []byte("fake"), tt.scale)
+			h.convertFast(w, req, []byte("fake"), converter.Options{}, tt.scale, "")
 
 			// Should get an error for invalid data, but not panic
 			if w.Code != http.StatusInternalServerError && w.Code != http.StatusServiceUnavailable {
@@ -622,7 +668,7 @@ func TestHandler_convertFastWithQuality(t *testing.T) {
 			req := httptest.NewRequest(http.MethodPost, "/convert", nil)
 			w := httptest.NewRecorder()
 
-			h.convertFastWithQuality(w, req, []byte("fake"), tt.scale, tt.quality)
+			h.convertFastWithQuality(w, req, []byte("fake"), converter.Options{}, tt.scale, tt.quality, "")
 
 			// Should get an error for invalid data, but not panic
 			if w.Code != http.StatusInternalServerError && w.Code != http.StatusServiceUnavailable {
@@ -855,3 +901,378 @@ func TestHandler_Convert_WithRealHEIF(t *testing.T) {
 		})
 	}
 }
+
+func TestHandler_Info(t *testing.T) {
+	testData, err := os.ReadFile("../../testdata/test.heic")
+	if err != nil {
+		t.Skip("No test HEIF file found")
+	}
+
+	h := New(500, 10)
+
+	body, contentType := createTestFileUpload("test.heic", string(testData))
+	req := httptest.NewRequest(http.MethodPost, "/info", body)
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+
+	h.Info(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected Content-Type application/json, got %s", ct)
+	}
+	if !strings.Contains(w.Body.String(), `"count":1`) || !strings.Contains(w.Body.String(), `"primary":true`) {
+		t.Errorf("Unexpected body: %s", w.Body.String())
+	}
+
+	// Method check
+	req = httptest.NewRequest(http.MethodGet, "/info", nil)
+	w = httptest.NewRecorder()
+	h.Info(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", w.Code)
+	}
+}
+
+func TestHandler_Convert_MultiImageParameters(t *testing.T) {
+	testData, err := os.ReadFile("../../testdata/test.heic")
+	if err != nil {
+		t.Skip("No test HEIF file found")
+	}
+
+	h := New(500, 10)
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantCT     string
+	}{
+		{"Primary item", "?item=0&scale=0.25", http.StatusOK, "image/jpeg"},
+		{"All items as ZIP", "?item=all&scale=0.25", http.StatusOK, "application/zip"},
+		{"Missing item", "?item=5", http.StatusNotFound, ""},
+		{"Invalid item", "?item=abc", http.StatusBadRequest, ""},
+		{"Animate still image", "?output=webp&animate=true", http.StatusBadRequest, ""},
+		{"Explicit tone mapping", "?tonemap=reinhard&scale=0.25", http.StatusOK, "image/jpeg"},
+		{"Invalid tone mapping", "?tonemap=aces", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, contentType := createTestFileUpload("test.heic", string(testData))
+			req := httptest.NewRequest(http.MethodPost, "/convert"+tt.query, body)
+			req.Header.Set("Content-Type", contentType)
+			w := httptest.NewRecorder()
+
+			h.Convert(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if tt.wantCT != "" && w.Header().Get("Content-Type") != tt.wantCT {
+				t.Errorf("Expected Content-Type %s, got %s", tt.wantCT, w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestHandler_Convert_StopsWhenClientGone(t *testing.T) {
+	testData, err := os.ReadFile("../../testdata/test.heic")
+	if err != nil {
+		t.Skip("No test HEIF file found")
+	}
+	h := New(500, 10)
+
+	// Multi-image and max_size conversions stop with the request context;
+	// the client goes away once the upload has been read
+	for _, query := range []string{"?item=0", "?item=all", "?scale=1&max_size=200"} {
+		ctx, cancel := context.WithCancel(context.Background())
+		body, contentType := createTestFileUpload("test.heic", string(testData))
+		req := httptest.NewRequest(http.MethodPost, "/convert"+query, &cancelAtEOF{body, cancel}).WithContext(ctx)
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+
+		h.Convert(w, req)
+		if w.Code == http.StatusOK {
+			t.Errorf("%s: converted after the client went away", query)
+		}
+	}
+}
+
+func TestHandler_Convert_PoolLimitsApplyToAllPaths(t *testing.T) {
+	testData, err := os.ReadFile("../../testdata/test.heic")
+	if err != nil {
+		t.Skip("No test HEIF file found")
+	}
+	converter.InitGlobalWorkerPool(2, 500)
+	pool := converter.GlobalWorkerPool()
+	pool.SetMemoryBudget(1 << 20)
+	defer pool.SetMemoryBudget(0)
+	h := New(500, 10)
+
+	// Multi-image and max_size conversions go through the pool too
+	for _, query := range []string{"?item=0", "?item=all", "?output=webp&animate=true", "?scale=1&max_size=200"} {
+		body, contentType := createTestFileUpload("test.heic", string(testData))
+		req := httptest.NewRequest(http.MethodPost, "/convert"+query, body)
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+
+		h.Convert(w, req)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: status %d, want %d", query, w.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+}
+
+func TestHandler_Convert_CostLimit(t *testing.T) {
+	testData, err := os.ReadFile("../../testdata/test.heic")
+	if err != nil {
+		t.Skip("No test HEIF file found")
+	}
+	// The budget covers one conversion of the file, and barely refills
+	cost := float64(len(testData))/(1<<20) + float64(converter.Pixels(testData, converter.Selection{}))/1e6
+	cl := middleware.NewCostLimiter(middleware.ClientBudget(middleware.CostBudget{Rate: 0.001, Burst: cost * 1.5}))
+	handler := middleware.CostLimit(cl)(http.HandlerFunc(New(500, 10).Convert))
+
+	convert := func() *httptest.ResponseRecorder {
+		body, contentType := createTestFileUpload("test.heic", string(testData))
+		req := httptest.NewRequest(http.MethodPost, "/convert?scale=0.25", body)
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	w := convert()
+	if w.Code != http.StatusOK {
+		t.Fatalf("first conversion: status %d", w.Code)
+	}
+	if got, want := w.Header().Get("X-Cost-Charged"), strconv.FormatFloat(cost, 'f', 1, 64); got != want {
+		t.Errorf("X-Cost-Charged = %q, want %q", got, want)
+	}
+	w = convert()
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("second conversion: status %d, want 429", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" || w.Header().Get("X-Cost-Limit") == "" {
+		t.Errorf("missing budget headers: %v", w.Header())
+	}
+}
+
+func TestHandler_Convert_TierQuotas(t *testing.T) {
+	testData, err := os.ReadFile("../../testdata/test.heic")
+	if err != nil {
+		t.Skip("No test HEIF file found")
+	}
+	h := New(500, 10)
+	megapixels := float64(converter.Pixels(testData, converter.Selection{})) / 1e6
+	tier := &middleware.Tier{
+		MaxUploadMB:         len(testData)>>20 + 1,
+		MaxOutputMegapixels: megapixels / 2,
+		Formats:             []string{"jpeg"},
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		uploadMB   int
+		wantStatus int
+		wantQuota  string
+	}{
+		{"Within quotas", "?scale=0.25", 0, http.StatusOK, ""},
+		{"Format not allowed", "?scale=0.25&output=webp", 0, http.StatusForbidden, "formats"},
+		{"Output too large", "?scale=1", 0, http.StatusForbidden, "max_output_megapixels"},
+		{"Upload too large", "?scale=0.25", len(testData) >> 20, http.StatusForbidden, "max_upload_mb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tier := *tier
+			if tt.uploadMB > 0 {
+				tier.MaxUploadMB = tt.uploadMB
+			}
+			body, contentType := createTestFileUpload("test.heic", string(testData))
+			req := httptest.NewRequest(http.MethodPost, "/convert"+tt.query, body)
+			req.Header.Set("Content-Type", contentType)
+			req = req.WithContext(middleware.WithIdentity(req.Context(), &middleware.Identity{Tenant: "acme", Tier: &tier}))
+			w := httptest.NewRecorder()
+
+			h.Convert(w, req)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantQuota != "" && !strings.Contains(w.Body.String(), `"quota":"`+tt.wantQuota+`"`) {
+				t.Errorf("body %s does not name quota %s", w.Body.String(), tt.wantQuota)
+			}
+		})
+	}
+}
+
+// cancelAtEOF cancels a request context once its body has been read
+type cancelAtEOF struct {
+	b      *bytes.Buffer
+	cancel context.CancelFunc
+}
+
+func (c *cancelAtEOF) Read(p []byte) (int, error) {
+	n, err := c.b.Read(p)
+	if c.b.Len() == 0 {
+		c.cancel()
+	}
+	return n, err
+}
+
+func TestParseConvertOptions(t *testing.T) {
+	tests := []struct {
+		query   string
+		wantErr bool
+		check   func(converter.Options) bool
+	}{
+		{"", false, func(o converter.Options) bool { return o.JPEG.Standard() && o.Format == "jpeg" }},
+		{"progressive=true&optimize=1", false, func(o converter.Options) bool { return o.JPEG.Progressive && o.JPEG.OptimizeHuffman }},
+		{"subsampling=444&dct=float", false, func(o converter.Options) bool {
+			return o.JPEG.Subsampling == jpeg.Subsampling444 && o.JPEG.DCTMethod == jpeg.DCTFloat
+		}},
+		{"restart=16&dpi=300", false, func(o converter.Options) bool {
+			return o.JPEG.RestartInterval == 16 && o.JPEG.DensityUnit == jpeg.DensityInch && o.JPEG.XDensity == 300
+		}},
+		{"tonemap=none", false, func(o converter.Options) bool { return o.ToneMap == converter.ToneMapNone }},
+		{"profile=max", false, func(o converter.Options) bool {
+			return o.JPEG.Trellis && o.JPEG.Progressive && o.JPEG.QuantTable == jpeg.QuantRobidoux
+		}},
+		{"profile=max&progressive=false&quant=annexk", false, func(o converter.Options) bool {
+			return o.JPEG.Trellis && !o.JPEG.Progressive && o.JPEG.QuantTable == jpeg.QuantAnnexK
+		}},
+		{"trellis=1", false, func(o converter.Options) bool { return o.JPEG.Trellis }},
+		{"profile=tiny", true, nil},
+		{"quant=flat", true, nil},
+		{"trellis=on", true, nil},
+		{"progressive=maybe", true, nil},
+		{"optimize=yes", true, nil},
+		{"subsampling=411", true, nil},
+		{"dct=fastest", true, nil},
+		{"restart=-1", true, nil},
+		{"restart=70000", true, nil},
+		{"dpi=0", true, nil},
+		{"tonemap=aces", true, nil},
+		{"", false, func(o converter.Options) bool { return o.WebP == webp.Options{Method: webp.DefaultMethod} }},
+		{"method=6&sharp_yuv=true", false, func(o converter.Options) bool { return o.WebP.Method == 6 && o.WebP.SharpYUV }},
+		{"lossless=1&near_lossless=60", false, func(o converter.Options) bool { return o.WebP.Lossless && o.WebP.NearLossless == 60 }},
+		{"method=7", true, nil},
+		{"sharp_yuv=maybe", true, nil},
+		{"lossless=yes", true, nil},
+		{"near_lossless=101", true, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, _ := url.ParseQuery(tt.query)
+			opts, err := parseConvertOptions(q, "jpeg")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseConvertOptions(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+			}
+			if !tt.wantErr && !tt.check(opts) {
+				t.Errorf("parseConvertOptions(%q) = %+v", tt.query, opts)
+			}
+		})
+	}
+}
+
+func TestHandler_Convert_JPEGOptions(t *testing.T) {
+	testData, err := os.ReadFile("../../testdata/test.heic")
+	if err != nil {
+		t.Skip("No test HEIF file found")
+	}
+
+	h := New(500, 10)
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		marker     []byte // expected in the output
+	}{
+		{"Progressive", "?scale=0.25&quality=80&progressive=true", http.StatusOK, []byte{0xFF, 0xC2}},
+		{"Restart and density", "?scale=0.25&restart=8&dpi=300", http.StatusOK, []byte{0xFF, 0xDD}},
+		{"Full resolution 444", "?scale=1&subsampling=444&optimize=true", http.StatusOK, []byte{0xFF, 0xC0}},
+		{"Max compression", "?scale=0.25&profile=max", http.StatusOK, []byte{0xFF, 0xC2}},
+		{"Invalid subsampling", "?subsampling=411", http.StatusBadRequest, nil},
+		{"Invalid restart", "?restart=x", http.StatusBadRequest, nil},
+		{"WebP options", "?output=webp&scale=0.25&method=6&sharp_yuv=true", http.StatusOK, []byte("WEBPVP8")},
+		{"Invalid method", "?output=webp&method=9", http.StatusBadRequest, nil},
+		{"Batch priority", "?scale=0.25&priority=batch", http.StatusOK, []byte{0xFF, 0xD8}},
+		{"Invalid priority", "?priority=urgent", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, contentType := createTestFileUpload("test.heic", string(testData))
+			req := httptest.NewRequest(http.MethodPost, "/convert"+tt.query, body)
+			req.Header.Set("Content-Type", contentType)
+			w := httptest.NewRecorder()
+
+			h.Convert(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.wantStatus, w.Code, w.Body.String())
+			}
+			if tt.marker != nil && !bytes.Contains(w.Body.Bytes(), tt.marker) {
+				t.Errorf("Expected marker % X in output", tt.marker)
+			}
+		})
+	}
+}
+
+func TestHandler_Convert_Cache(t *testing.T) {
+	testData, err := os.ReadFile("../../testdata/test.heic")
+	if err != nil {
+		t.Skip("No test HEIF file found")
+	}
+
+	mem := cache.NewMemory(64 << 20)
+	h := New(500, 10).WithCache(cache.New(mem))
+
+	convert := func(query string) *httptest.ResponseRecorder {
+		body, contentType := createTestFileUpload("test.heic", string(testData))
+		req := httptest.NewRequest(http.MethodPost, "/convert"+query, body)
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		h.Convert(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", query, w.Code, w.Body.String())
+		}
+		return w
+	}
+
+	first := convert("?scale=0.25&quality=80")
+	if got := first.Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("first request X-Cache = %q, want MISS", got)
+	}
+	second := convert("?scale=0.25&quality=80")
+	if got := second.Header().Get("X-Cache"); got != "HIT" {
+		t.Errorf("repeated request X-Cache = %q, want HIT", got)
+	}
+	if !bytes.Equal(first.Body.Bytes(), second.Body.Bytes()) {
+		t.Error("cached response differs from the original")
+	}
+
+	// Settings that change the output miss; the response format does not
+	if got := convert("?scale=0.25&quality=81").Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("different quality X-Cache = %q, want MISS", got)
+	}
+	if got := convert("?scale=0.25&quality=80&output=webp").Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("different format X-Cache = %q, want MISS", got)
+	}
+	if w := convert("?scale=0.25&quality=80&format=json"); w.Header().Get("X-Cache") != "HIT" || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("json response of a cached result: X-Cache=%q Content-Type=%q", w.Header().Get("X-Cache"), w.Header().Get("Content-Type"))
+	}
+	if mem.Len() != 3 {
+		t.Errorf("cache holds %d results, want 3", mem.Len())
+	}
+
+	// Without a cache no header is set
+	h.cache = nil
+	if got := convert("?scale=0.25&quality=80").Header().Get("X-Cache"); got != "" {
+		t.Errorf("X-Cache = %q without a cache", got)
+	}
+}
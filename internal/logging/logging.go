@@ -0,0 +1,134 @@
+// Package logging sets up structured logging with log/slog and carries
+// request-scoped attributes, such as the request ID, in contexts, so every
+// record logged for a request can be correlated.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestIDKey is the attribute holding the request ID
+const RequestIDKey = "request_id"
+
+type requestKey struct{}
+
+// request holds the attributes of a request, added to as it is handled
+type request struct {
+	id    string
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+// WithRequestID returns a context for the request with ID id. Records
+// logged with it carry request_id and the attributes added with Add.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestKey{}, &request{
+		id:    id,
+		attrs: []slog.Attr{slog.String(RequestIDKey, id)},
+	})
+}
+
+// RequestID returns the request ID of ctx, or "" if it has none
+func RequestID(ctx context.Context) string {
+	if req, ok := ctx.Value(requestKey{}).(*request); ok {
+		return req.id
+	}
+	return ""
+}
+
+// Add adds attributes, given as key-value pairs or slog.Attr like in
+// slog.Logger.Info, to the records of ctx's request, replacing attributes
+// with the same key. It does nothing if ctx has no request.
+func Add(ctx context.Context, args ...any) {
+	req, ok := ctx.Value(requestKey{}).(*request)
+	if !ok {
+		return
+	}
+	// A record converts the arguments the way the slog functions do
+	r := slog.NewRecord(time.Time{}, 0, "", 0)
+	r.Add(args...)
+	req.mu.Lock()
+	defer req.mu.Unlock()
+	r.Attrs(func(a slog.Attr) bool {
+		for i := range req.attrs {
+			if req.attrs[i].Key == a.Key {
+				req.attrs[i] = a
+				return true
+			}
+		}
+		req.attrs = append(req.attrs, a)
+		return true
+	})
+}
+
+// Attrs returns the attributes of ctx's request
+func Attrs(ctx context.Context) []slog.Attr {
+	req, ok := ctx.Value(requestKey{}).(*request)
+	if !ok {
+		return nil
+	}
+	req.mu.Lock()
+	defer req.mu.Unlock()
+	return append([]slog.Attr(nil), req.attrs...)
+}
+
+// Millis returns d in milliseconds, the unit of the duration attributes
+func Millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// contextHandler adds the request attributes of the context to records
+type contextHandler struct {
+	slog.Handler
+}
+
+// NewHandler returns a handler that adds the request attributes of the
+// context to records before passing them to h
+func NewHandler(h slog.Handler) slog.Handler {
+	return contextHandler{h}
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs := Attrs(ctx); len(attrs) > 0 {
+		r = r.Clone()
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// New returns a logger writing records at level and above to w, as JSON
+// or, for format "text", as key=value pairs
+func New(w io.Writer, format string, level slog.Level) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "", "json":
+		h = slog.NewJSONHandler(w, opts)
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+	return slog.New(NewHandler(h)), nil
+}
+
+// ParseLevel parses a level name: debug, info, warn or error
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
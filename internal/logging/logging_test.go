@@ -0,0 +1,78 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestHandler_RequestAttrs(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "json", slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := WithRequestID(context.Background(), "req-1")
+	Add(ctx, "tenant", "203.0.113.5", "bytes_in", 100)
+	Add(ctx, slog.Int("bytes_in", 200)) // replaces the earlier value
+	logger.With("component", "test").InfoContext(ctx, "converted", "mp", 12.5)
+	logger.DebugContext(ctx, "below the level")
+
+	var rec map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("%v: %s", err, buf.Bytes())
+	}
+	want := map[string]any{
+		"msg":        "converted",
+		"level":      "INFO",
+		"component":  "test",
+		"request_id": "req-1",
+		"tenant":     "203.0.113.5",
+		"bytes_in":   200.0,
+		"mp":         12.5,
+	}
+	for k, v := range want {
+		if rec[k] != v {
+			t.Errorf("%s = %v, want %v", k, rec[k], v)
+		}
+	}
+	if n := bytes.Count(buf.Bytes(), []byte("\n")); n != 1 {
+		t.Errorf("%d records, want 1", n)
+	}
+
+	// Contexts without a request log as usual
+	buf.Reset()
+	Add(context.Background(), "tenant", "x")
+	logger.InfoContext(context.Background(), "plain")
+	if bytes.Contains(buf.Bytes(), []byte(RequestIDKey)) {
+		t.Errorf("request ID without request: %s", buf.Bytes())
+	}
+	if id := RequestID(ctx); id != "req-1" {
+		t.Errorf("RequestID = %q", id)
+	}
+}
+
+func TestNew_Format(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "text", slog.LevelDebug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.DebugContext(WithRequestID(context.Background(), "req-2"), "hello")
+	if !bytes.Contains(buf.Bytes(), []byte("level=DEBUG msg=hello request_id=req-2")) {
+		t.Errorf("text record: %s", buf.Bytes())
+	}
+	if _, err := New(&buf, "xml", slog.LevelInfo); err == nil {
+		t.Error("expected error for an unknown format")
+	}
+	for name, want := range map[string]slog.Level{"debug": slog.LevelDebug, "INFO": slog.LevelInfo, "warn": slog.LevelWarn, "error": slog.LevelError} {
+		if level, err := ParseLevel(name); err != nil || level != want {
+			t.Errorf("ParseLevel(%q) = %v, %v", name, level, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("expected error for an unknown level")
+	}
+}
@@ -0,0 +1,417 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harliandi/go-heif/pkg/metrics"
+)
+
+// IPFilter returns middleware that rejects clients in deny and, unless
+// allow is empty, clients outside allow with a 403. Requests for the
+// public paths pass.
+func IPFilter(allow, deny []netip.Prefix, public ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !slices.Contains(public, r.URL.Path) {
+				addr := clientAddr(r)
+				reason := ""
+				switch {
+				case containsAddr(deny, addr):
+					reason = "denied"
+				case len(allow) > 0 && !containsAddr(allow, addr):
+					reason = "not_allowed"
+				}
+				if reason != "" {
+					slog.WarnContext(r.Context(), "request blocked", "client_ip", ClientIP(r), "reason", reason)
+					metrics.RecordIPBlocked(reason)
+					writeJSONError(w, http.StatusForbidden, "Forbidden", "")
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// BanStore keeps abuse strikes and bans by client key
+type BanStore interface {
+	// Strike counts an offence of key, returning the offences within the
+	// window that started with the first of them
+	Strike(key string, window time.Duration) int
+	// Ban bans key until then
+	Ban(key string, until time.Time)
+	// BannedUntil returns the end of key's ban, or the zero Time
+	BannedUntil(key string) time.Time
+	// Lift ends key's ban and forgets its strikes, reporting whether it
+	// was banned
+	Lift(key string) bool
+	// Bans returns the current bans by key
+	Bans() map[string]time.Time
+}
+
+// strikes counts offences within a window
+type strikes struct {
+	count   int
+	expires time.Time
+}
+
+// MemoryBanStore is a BanStore in process memory
+type MemoryBanStore struct {
+	mu      sync.Mutex
+	strikes map[string]*strikes
+	bans    map[string]time.Time
+}
+
+// NewMemoryBanStore creates an empty in-memory ban store
+func NewMemoryBanStore() *MemoryBanStore {
+	s := &MemoryBanStore{strikes: make(map[string]*strikes), bans: make(map[string]time.Time)}
+	go s.cleanup()
+	return s
+}
+
+// Strike counts an offence of key
+func (s *MemoryBanStore) Strike(key string, window time.Duration) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	st, ok := s.strikes[key]
+	if !ok || !now.Before(st.expires) {
+		st = &strikes{expires: now.Add(window)}
+		s.strikes[key] = st
+	}
+	st.count++
+	return st.count
+}
+
+// Ban bans key until then
+func (s *MemoryBanStore) Ban(key string, until time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bans[key] = until
+}
+
+// BannedUntil returns the end of key's ban, or the zero Time
+func (s *MemoryBanStore) BannedUntil(key string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until, ok := s.bans[key]
+	if !ok || !time.Now().Before(until) {
+		return time.Time{}
+	}
+	return until
+}
+
+// Lift ends key's ban and forgets its strikes
+func (s *MemoryBanStore) Lift(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until, ok := s.bans[key]
+	delete(s.bans, key)
+	delete(s.strikes, key)
+	return ok && time.Now().Before(until)
+}
+
+// Bans returns the current bans by key
+func (s *MemoryBanStore) Bans() map[string]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	bans := make(map[string]time.Time, len(s.bans))
+	for key, until := range s.bans {
+		if now.Before(until) {
+			bans[key] = until
+		}
+	}
+	return bans
+}
+
+// cleanup removes expired strikes and bans to prevent memory leaks
+func (s *MemoryBanStore) cleanup() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.mu.Lock()
+		now := time.Now()
+		for key, st := range s.strikes {
+			if !now.Before(st.expires) {
+				delete(s.strikes, key)
+			}
+		}
+		for key, until := range s.bans {
+			if !now.Before(until) {
+				delete(s.bans, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Redis keys of the ban store
+const (
+	redisStrikeKeyspace = "heif:strikes:"
+	redisBanKeyspace    = "heif:ban:"
+)
+
+// strikeScript counts an offence in KEYS[1], starting a window of ARGV[1]
+// milliseconds with the first one
+var strikeScript = newRedisScript(`
+local n = redis.call('INCR', KEYS[1])
+if n == 1 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return n
+`)
+
+// RedisBanStore is a BanStore shared by all replicas through Redis. While
+// Redis is unreachable, strikes and bans are kept in fallback.
+type RedisBanStore struct {
+	client   *redisClient
+	fallback BanStore
+	down     redisOutage
+}
+
+// NewRedisBanStore creates a ban store in the Redis server at rawURL
+// (redis://[:password@]host:port[/db])
+func NewRedisBanStore(rawURL string, fallback BanStore) (*RedisBanStore, error) {
+	client, err := newRedisClient(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisBanStore{client: client, fallback: fallback}, nil
+}
+
+// failed records err, if any, as a Redis outage and reports whether
+// there was one
+func (s *RedisBanStore) failed(err error) bool {
+	if err != nil {
+		s.down.failed("ban store", err)
+		return true
+	}
+	return false
+}
+
+// Strike counts an offence of key
+func (s *RedisBanStore) Strike(key string, window time.Duration) int {
+	if !s.down.skip() {
+		reply, err := s.client.eval(strikeScript, []string{redisStrikeKeyspace + key}, strconv.FormatInt(window.Milliseconds(), 10))
+		if err == nil {
+			if n, ok := reply.(int64); ok {
+				return int(n)
+			}
+			err = fmt.Errorf("unexpected script reply %v", reply)
+		}
+		s.failed(err)
+	}
+	return s.fallback.Strike(key, window)
+}
+
+// Ban bans key until then
+func (s *RedisBanStore) Ban(key string, until time.Time) {
+	ttl := time.Until(until).Milliseconds()
+	if ttl <= 0 {
+		return
+	}
+	if !s.down.skip() {
+		_, err := s.client.do("SET", redisBanKeyspace+key, strconv.FormatInt(until.UnixMilli(), 10), "PX", strconv.FormatInt(ttl, 10))
+		if !s.failed(err) {
+			return
+		}
+	}
+	s.fallback.Ban(key, until)
+}
+
+// BannedUntil returns the end of key's ban, or the zero Time
+func (s *RedisBanStore) BannedUntil(key string) time.Time {
+	if !s.down.skip() {
+		reply, err := s.client.do("GET", redisBanKeyspace+key)
+		if !s.failed(err) {
+			return parseBanUntil(reply)
+		}
+	}
+	return s.fallback.BannedUntil(key)
+}
+
+// Lift ends key's ban and forgets its strikes
+func (s *RedisBanStore) Lift(key string) bool {
+	lifted := s.fallback.Lift(key)
+	if !s.down.skip() {
+		reply, err := s.client.do("DEL", redisBanKeyspace+key)
+		if !s.failed(err) {
+			s.client.do("DEL", redisStrikeKeyspace+key)
+			n, _ := reply.(int64)
+			lifted = lifted || n > 0
+		}
+	}
+	return lifted
+}
+
+// Bans returns the current bans by key
+func (s *RedisBanStore) Bans() map[string]time.Time {
+	bans := s.fallback.Bans()
+	if s.down.skip() {
+		return bans
+	}
+	cursor := "0"
+	for {
+		reply, err := s.client.do("SCAN", cursor, "MATCH", redisBanKeyspace+"*", "COUNT", "100")
+		if s.failed(err) {
+			return bans
+		}
+		page, _ := reply.([]any)
+		if len(page) != 2 {
+			return bans
+		}
+		cursor, _ = page[0].(string)
+		keys, _ := page[1].([]any)
+		for _, k := range keys {
+			k, _ := k.(string)
+			reply, err := s.client.do("GET", k)
+			if s.failed(err) {
+				return bans
+			}
+			if until := parseBanUntil(reply); !until.IsZero() {
+				bans[strings.TrimPrefix(k, redisBanKeyspace)] = until
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			return bans
+		}
+	}
+}
+
+// Close closes the idle connections
+func (s *RedisBanStore) Close() {
+	s.client.Close()
+}
+
+// parseBanUntil parses a ban's end stored in Redis, in Unix milliseconds
+func parseBanUntil(reply any) time.Time {
+	v, _ := reply.(string)
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// AbuseGuard bans clients whose requests keep being rejected as invalid,
+// like scrapers posting garbage to /convert
+type AbuseGuard struct {
+	store     BanStore
+	threshold int           // invalid requests that get a client banned
+	window    time.Duration // time the invalid requests are counted over
+	banFor    time.Duration
+}
+
+// NewAbuseGuard creates a guard banning clients for banFor once threshold
+// of their requests get a 400 or 415 response within window
+func NewAbuseGuard(store BanStore, threshold int, window, banFor time.Duration) *AbuseGuard {
+	return &AbuseGuard{store: store, threshold: threshold, window: window, banFor: banFor}
+}
+
+// invalidRequest reports whether a response status counts as a strike
+func invalidRequest(status int) bool {
+	return status == http.StatusBadRequest || status == http.StatusUnsupportedMediaType
+}
+
+// AbuseBan returns middleware that rejects clients banned by g with a
+// 403, and counts invalid requests towards bans. Clients are identified
+// by ClientKey.
+func AbuseBan(g *AbuseGuard) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := ClientKey(r)
+			if until := g.store.BannedUntil(key); !until.IsZero() {
+				metrics.RecordIPBlocked("banned")
+				w.Header().Set("Retry-After", RetryAfterSeconds(time.Until(until)))
+				writeJSONError(w, http.StatusForbidden, "Forbidden", "")
+				return
+			}
+
+			wrapped := &responseWrapper{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(wrapped, r)
+			if !invalidRequest(wrapped.status) {
+				return
+			}
+			if n := g.store.Strike(key, g.window); n >= g.threshold {
+				g.store.Ban(key, time.Now().Add(g.banFor))
+				slog.WarnContext(r.Context(), "client banned", "client", key, "ban_sec", g.banFor.Seconds(), "strikes", n)
+				metrics.RecordAbuseBan()
+			}
+		})
+	}
+}
+
+// banEntry is a ban in admin responses
+type banEntry struct {
+	Client string    `json:"client"`
+	Until  time.Time `json:"until"`
+}
+
+// BanAdmin returns the admin handler of g's bans: GET lists them, DELETE
+// lifts the ban of the client parameter, an address or a listed client
+// key
+func BanAdmin(g *AbuseGuard) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			bans := g.store.Bans()
+			entries := make([]banEntry, 0, len(bans))
+			for key, until := range bans {
+				entries = append(entries, banEntry{Client: key, Until: until.UTC()})
+			}
+			sort.Slice(entries, func(i, j int) bool { return entries[i].Client < entries[j].Client })
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string][]banEntry{"bans": entries})
+		case http.MethodDelete:
+			key := strings.TrimSpace(r.URL.Query().Get("client"))
+			if addr, err := netip.ParseAddr(key); err == nil {
+				key = addrKey(addr.Unmap())
+			}
+			if key == "" {
+				writeJSONError(w, http.StatusBadRequest, "client parameter required", "")
+				return
+			}
+			if !g.store.Lift(key) {
+				writeJSONError(w, http.StatusNotFound, "Client not banned", "")
+				return
+			}
+			slog.InfoContext(r.Context(), "ban lifted", "client", key)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed", "")
+		}
+	})
+}
+
+// AdminAuth returns middleware that requires token as a bearer token
+func AdminAuth(token string) func(http.Handler) http.Handler {
+	want := sha256.Sum256([]byte(token))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Compare hashes, so the comparison time reveals nothing about
+			// the token's length
+			got := sha256.Sum256([]byte(bearerToken(r)))
+			if token == "" || subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				writeJSONError(w, http.StatusUnauthorized, "Admin token required", "")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
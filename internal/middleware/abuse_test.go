@@ -0,0 +1,214 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIPFilter(t *testing.T) {
+	allow, _ := ParseCIDRs("203.0.113.0/24,2001:db8::/32")
+	deny, _ := ParseCIDRs("203.0.113.66")
+	handler := IPFilter(allow, deny, "/health")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	tests := []struct {
+		remote string
+		path   string
+		want   int
+	}{
+		{"203.0.113.5:1234", "/convert", http.StatusOK},
+		{"[2001:db8::1]:1234", "/convert", http.StatusOK},
+		{"203.0.113.66:1234", "/convert", http.StatusForbidden},
+		{"198.51.100.1:1234", "/convert", http.StatusForbidden},
+		{"198.51.100.1:1234", "/health", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.path, nil)
+		req.RemoteAddr = tt.remote
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s %s: status %d, want %d", tt.remote, tt.path, w.Code, tt.want)
+		}
+	}
+
+	// Without an allowlist, only the denylist applies
+	handler = IPFilter(nil, deny)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/convert", nil)
+	req.RemoteAddr = "198.51.100.1:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("no allowlist: status %d", w.Code)
+	}
+}
+
+func TestAbuseBan(t *testing.T) {
+	g := NewAbuseGuard(NewMemoryBanStore(), 3, time.Minute, time.Hour)
+	handler := AbuseBan(g)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/garbage":
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+		case "/bad":
+			w.WriteHeader(http.StatusBadRequest)
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	serve := func(remote, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Other errors are no strikes
+	for i := 0; i < 5; i++ {
+		serve("203.0.113.5:1234", "/missing")
+	}
+	serve("203.0.113.5:1234", "/garbage")
+	serve("203.0.113.5:1234", "/bad")
+	if w := serve("203.0.113.5:1234", "/convert"); w.Code != http.StatusOK {
+		t.Fatalf("banned after 2 strikes: %d", w.Code)
+	}
+	serve("203.0.113.5:1234", "/garbage")
+	w := serve("203.0.113.5:1234", "/convert")
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("not banned after 3 strikes: %d", w.Code)
+	}
+	if ra := w.Header().Get("Retry-After"); ra != "3600" {
+		t.Errorf("Retry-After %q, want the ban's 3600", ra)
+	}
+	if w := serve("203.0.113.6:1234", "/convert"); w.Code != http.StatusOK {
+		t.Errorf("other client banned: %d", w.Code)
+	}
+
+	// IPv6 clients are banned per /64
+	for i := 0; i < 3; i++ {
+		serve("[2001:db8::1]:1234", "/garbage")
+	}
+	if w := serve("[2001:db8::2]:1234", "/convert"); w.Code != http.StatusForbidden {
+		t.Errorf("IPv6 /64 not banned: %d", w.Code)
+	}
+}
+
+func TestBanAdmin(t *testing.T) {
+	store := NewMemoryBanStore()
+	g := NewAbuseGuard(store, 1, time.Minute, time.Hour)
+	until := time.Now().Add(time.Hour).Truncate(time.Second)
+	store.Ban("203.0.113.5", until)
+	store.Ban("2001:db8::/64", until)
+	store.Ban("198.51.100.1", time.Now().Add(-time.Second)) // expired
+
+	handler := AdminAuth("s3cret")(BanAdmin(g))
+	serve := func(method, target, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, token := range []string{"", "wrong", "s3cret2"} {
+		if w := serve(http.MethodGet, "/admin/bans", token); w.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: status %d, want 401", token, w.Code)
+		}
+	}
+
+	w := serve(http.MethodGet, "/admin/bans", "s3cret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("list: status %d", w.Code)
+	}
+	var list struct {
+		Bans []banEntry `json:"bans"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Bans) != 2 || list.Bans[0].Client != "2001:db8::/64" || list.Bans[1].Client != "203.0.113.5" || !list.Bans[1].Until.Equal(until) {
+		t.Errorf("bans: %+v", list.Bans)
+	}
+
+	// Lift by address, also inside a banned /64
+	if w := serve(http.MethodDelete, "/admin/bans?client=203.0.113.5", "s3cret"); w.Code != http.StatusNoContent {
+		t.Errorf("lift: status %d", w.Code)
+	}
+	if w := serve(http.MethodDelete, "/admin/bans?client=2001:db8::42", "s3cret"); w.Code != http.StatusNoContent {
+		t.Errorf("lift by address in /64: status %d", w.Code)
+	}
+	if len(store.Bans()) != 0 {
+		t.Errorf("bans left: %v", store.Bans())
+	}
+	if w := serve(http.MethodDelete, "/admin/bans?client=203.0.113.5", "s3cret"); w.Code != http.StatusNotFound {
+		t.Errorf("lift unbanned: status %d, want 404", w.Code)
+	}
+	if w := serve(http.MethodDelete, "/admin/bans", "s3cret"); w.Code != http.StatusBadRequest {
+		t.Errorf("lift without client: status %d, want 400", w.Code)
+	}
+	if w := serve(http.MethodPost, "/admin/bans", "s3cret"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status %d, want 405", w.Code)
+	}
+
+	// Without a token the endpoint is closed
+	handler = AdminAuth("")(BanAdmin(g))
+	if w := serve(http.MethodGet, "/admin/bans", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("empty admin token: status %d, want 401", w.Code)
+	}
+}
+
+func TestRedisBanStore(t *testing.T) {
+	f := newFakeRedis(t, "")
+	// Two replicas share strikes and bans
+	a, err := NewRedisBanStore(f.url(), NewMemoryBanStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := NewRedisBanStore(f.url(), NewMemoryBanStore())
+	defer a.Close()
+	defer b.Close()
+
+	if n := a.Strike("203.0.113.5", time.Minute); n != 1 {
+		t.Errorf("first strike: %d", n)
+	}
+	if n := b.Strike("203.0.113.5", time.Minute); n != 2 {
+		t.Errorf("strike on the other replica: %d, want 2", n)
+	}
+	until := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	a.Ban("203.0.113.5", until)
+	if got := b.BannedUntil("203.0.113.5"); !got.Equal(until) {
+		t.Errorf("ban on the other replica until %v, want %v", got, until)
+	}
+	if got := b.BannedUntil("203.0.113.6"); !got.IsZero() {
+		t.Errorf("unbanned client banned until %v", got)
+	}
+	if bans := b.Bans(); len(bans) != 1 || !bans["203.0.113.5"].Equal(until) {
+		t.Errorf("bans: %v", bans)
+	}
+	if !b.Lift("203.0.113.5") || !a.BannedUntil("203.0.113.5").IsZero() {
+		t.Error("ban not lifted on both replicas")
+	}
+	if n := a.Strike("203.0.113.5", time.Minute); n != 1 {
+		t.Errorf("strikes kept after lifting: %d", n)
+	}
+
+	// Redis goes away: bans are kept locally
+	f.close()
+	a.Close()
+	a.Ban("198.51.100.1", until)
+	if got := a.BannedUntil("198.51.100.1"); !got.Equal(until) {
+		t.Errorf("ban while Redis is down until %v, want %v", got, until)
+	}
+	if n := a.Strike("198.51.100.1", time.Minute); n != 1 {
+		t.Errorf("strike while Redis is down: %d", n)
+	}
+}
@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/harliandi/go-heif/pkg/metrics"
+)
+
+// thumbnailScale is the largest scale converted as a cheap thumbnail
+const thumbnailScale = 0.5
+
+// Cost ranks requests for load shedding
+type Cost int
+
+const (
+	// CostCheap requests are admitted even while shedding: info, health
+	// and metrics, and thumbnails
+	CostCheap Cost = iota
+	// CostExpensive requests are full resolution, multi-image and
+	// animated conversions
+	CostExpensive
+)
+
+// String returns the name of the cost, for metrics
+func (c Cost) String() string {
+	if c == CostExpensive {
+		return "expensive"
+	}
+	return "cheap"
+}
+
+// RequestCost ranks a request by the work it asks the conversion pool for
+func RequestCost(r *http.Request) Cost {
+	switch r.URL.Path {
+	case "/convert", "/convert/store":
+	default:
+		return CostCheap
+	}
+	query := r.URL.Query()
+	if query.Get("item") == "all" || query.Get("animate") == "true" || query.Get("animate") == "1" {
+		return CostExpensive
+	}
+	if scale, err := strconv.ParseFloat(query.Get("scale"), 64); err == nil && scale > 0 && scale <= thumbnailScale {
+		return CostCheap
+	}
+	return CostExpensive
+}
+
+// AdmissionController decides when to shed load from the conversion
+// pool's queueing delay, like CoDel: a delay above target is tolerated
+// for one interval, so bursts that drain on their own are not shed; once
+// it stays above target for a whole interval the controller sheds until
+// the delay falls below target again.
+type AdmissionController struct {
+	delay    func() time.Duration // current queueing delay
+	target   time.Duration
+	interval time.Duration
+
+	mu         sync.Mutex
+	firstAbove time.Time // when a delay above target becomes overload
+	shedding   bool
+}
+
+// NewAdmissionController creates a controller reading the queueing delay
+// from delay
+func NewAdmissionController(delay func() time.Duration, target, interval time.Duration) *AdmissionController {
+	return &AdmissionController{delay: delay, target: target, interval: interval}
+}
+
+// Shedding reports whether requests should be shed at now, along with the
+// current queueing delay
+func (ac *AdmissionController) Shedding(now time.Time) (bool, time.Duration) {
+	d := ac.delay()
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	shedding := ac.shedding
+	switch {
+	case d < ac.target:
+		ac.firstAbove = time.Time{}
+		ac.shedding = false
+	case ac.firstAbove.IsZero():
+		ac.firstAbove = now.Add(ac.interval)
+	case !now.Before(ac.firstAbove):
+		ac.shedding = true
+	}
+	if ac.shedding != shedding {
+		slog.Warn("adaptive admission", "shedding", ac.shedding, "queue_delay_ms", d.Milliseconds())
+		metrics.UpdateAdmissionShedding(ac.shedding)
+	}
+	return ac.shedding, d
+}
+
+// AdaptiveAdmission returns middleware that rejects expensive requests,
+// ranked by cost (RequestCost if nil), while ac is shedding load. Cheap
+// requests are always admitted.
+func AdaptiveAdmission(ac *AdmissionController, cost func(*http.Request) Cost) func(http.Handler) http.Handler {
+	if cost == nil {
+		cost = RequestCost
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c := cost(r)
+			if c == CostExpensive {
+				if shedding, delay := ac.Shedding(time.Now()); shedding {
+					metrics.RecordLoadShed(c.String())
+					w.Header().Set("Content-Type", "application/json")
+					// The queue drains at about its current delay
+					w.Header().Set("Retry-After", RetryAfterSeconds(min(max(delay, minRetryAfter), maxRetryAfter)))
+					w.WriteHeader(http.StatusServiceUnavailable)
+					w.Write([]byte(`{"error":"Service overloaded, please try again"}`))
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
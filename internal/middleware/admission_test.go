@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestCost(t *testing.T) {
+	for target, want := range map[string]Cost{
+		"/info":                        CostCheap,
+		"/health":                      CostCheap,
+		"/convert?scale=0.25":          CostCheap,
+		"/convert/store?scale=0.5":     CostCheap,
+		"/convert":                     CostExpensive,
+		"/convert?scale=0.8":           CostExpensive,
+		"/convert?scale=0.25&item=all": CostExpensive,
+		"/convert?animate=true":        CostExpensive,
+	} {
+		if got := RequestCost(httptest.NewRequest(http.MethodPost, target, nil)); got != want {
+			t.Errorf("RequestCost(%s) = %v, want %v", target, got, want)
+		}
+	}
+}
+
+func TestAdmissionController(t *testing.T) {
+	delay := 50 * time.Millisecond
+	ac := NewAdmissionController(func() time.Duration { return delay }, 100*time.Millisecond, time.Second)
+	now := time.Now()
+	if shedding, _ := ac.Shedding(now); shedding {
+		t.Error("shedding below target")
+	}
+
+	// A delay above target is tolerated for one interval
+	delay = 300 * time.Millisecond
+	if shedding, _ := ac.Shedding(now); shedding {
+		t.Error("shedding as soon as the delay rose")
+	}
+	if shedding, _ := ac.Shedding(now.Add(500 * time.Millisecond)); shedding {
+		t.Error("shedding within the interval")
+	}
+	if shedding, d := ac.Shedding(now.Add(time.Second)); !shedding || d != delay {
+		t.Errorf("after the interval: shedding=%v delay=%v, want true and %v", shedding, d, delay)
+	}
+
+	// A burst that drains stops shedding and restarts the interval
+	delay = 0
+	if shedding, _ := ac.Shedding(now.Add(2 * time.Second)); shedding {
+		t.Error("still shedding after the queue drained")
+	}
+	delay = 300 * time.Millisecond
+	if shedding, _ := ac.Shedding(now.Add(3 * time.Second)); shedding {
+		t.Error("shedding without a full interval above target")
+	}
+}
+
+func TestAdaptiveAdmission(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	delay := 3 * time.Second
+	ac := NewAdmissionController(func() time.Duration { return delay }, 100*time.Millisecond, time.Nanosecond)
+	handler := AdaptiveAdmission(ac, nil)(next)
+
+	serve := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, target, nil))
+		return w
+	}
+	serve("/convert") // starts the interval
+	time.Sleep(time.Millisecond)
+	w := serve("/convert")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expensive request while overloaded: got %d, want 503", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "3" {
+		t.Errorf("Retry-After = %q, want the queue delay of 3", got)
+	}
+	if w := serve("/convert?scale=0.25"); w.Code != http.StatusOK {
+		t.Errorf("thumbnail while overloaded: got %d, want 200", w.Code)
+	}
+	if w := serve("/info"); w.Code != http.StatusOK {
+		t.Errorf("info while overloaded: got %d, want 200", w.Code)
+	}
+
+	delay = 0
+	if w := serve("/convert"); w.Code != http.StatusOK {
+		t.Errorf("expensive request after recovery: got %d, want 200", w.Code)
+	}
+}
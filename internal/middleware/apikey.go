@@ -0,0 +1,245 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Tier is a set of quotas shared by API keys and token holders. Zero
+// limits are unlimited.
+type Tier struct {
+	Name                string   `json:"-"`
+	RateLimit           int      `json:"rate_limit"` // requests per second per tenant
+	RateBurst           int      `json:"rate_burst"`
+	CostRate            float64  `json:"cost_rate"` // cost tokens per second per tenant; see CostLimiter
+	CostBurst           float64  `json:"cost_burst"`
+	MaxUploadMB         int      `json:"max_upload_mb"`
+	MaxOutputMegapixels float64  `json:"max_output_megapixels"` // largest image converted, after scaling
+	Formats             []string `json:"formats"`               // allowed output formats, all when empty
+
+	limiter *RateLimiter
+}
+
+// init names the tier and sets up its rate limiter
+func (t *Tier) init(name string) {
+	t.Name = name
+	if t.RateLimit > 0 {
+		t.limiter = NewRateLimiter(t.RateLimit, max(t.RateBurst, 1))
+	}
+}
+
+// AllowsFormat reports whether the tier may convert to format
+func (t *Tier) AllowsFormat(format string) bool {
+	return len(t.Formats) == 0 || slices.Contains(t.Formats, format)
+}
+
+// Identity is the tenant behind a request's API key or token, with its
+// quotas
+type Identity struct {
+	Tenant string
+	Tier   *Tier
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a context carrying the caller's identity
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// IdentityFrom returns the identity of an authenticated request
+func IdentityFrom(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+	return id, ok
+}
+
+// KeyStore maps API keys to identities. Keys are stored as the hex
+// SHA-256 of the key, so the file holds no usable secrets.
+type KeyStore struct {
+	keys  map[string]*Identity // by key hash
+	tiers map[string]*Tier
+}
+
+// keyFile is the JSON layout of a key store file
+type keyFile struct {
+	Tiers map[string]*Tier `json:"tiers"`
+	Keys  []struct {
+		Hash   string `json:"sha256"`
+		Tenant string `json:"tenant"`
+		Tier   string `json:"tier"`
+	} `json:"keys"`
+}
+
+// LoadKeyStore reads a key store from a JSON file of tiers and keys:
+//
+//	{
+//	  "tiers": {"free": {"rate_limit": 1, "rate_burst": 5, "max_upload_mb": 5,
+//	                     "max_output_megapixels": 4, "formats": ["jpeg"]}},
+//	  "keys": [{"sha256": "<hex of the key's SHA-256>", "tenant": "acme", "tier": "free"}]
+//	}
+func LoadKeyStore(path string) (*KeyStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f keyFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parse key store: %w", err)
+	}
+	ks := &KeyStore{keys: make(map[string]*Identity), tiers: f.Tiers}
+	for name, t := range f.Tiers {
+		t.init(name)
+	}
+	for _, k := range f.Keys {
+		t, ok := f.Tiers[k.Tier]
+		if !ok {
+			return nil, fmt.Errorf("key of tenant %q: unknown tier %q", k.Tenant, k.Tier)
+		}
+		hash := strings.ToLower(k.Hash)
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 {
+			return nil, fmt.Errorf("key of tenant %q: invalid sha256", k.Tenant)
+		}
+		ks.keys[hash] = &Identity{Tenant: k.Tenant, Tier: t}
+	}
+	return ks, nil
+}
+
+// Tiers returns the tiers of the store by name
+func (ks *KeyStore) Tiers() map[string]*Tier {
+	return ks.tiers
+}
+
+// Lookup returns the identity of an API key
+func (ks *KeyStore) Lookup(key string) (*Identity, bool) {
+	sum := sha256.Sum256([]byte(key))
+	id, ok := ks.keys[hex.EncodeToString(sum[:])]
+	return id, ok
+}
+
+// Len returns the number of keys
+func (ks *KeyStore) Len() int {
+	return len(ks.keys)
+}
+
+// bearerToken returns the token of an Authorization: Bearer header
+func bearerToken(r *http.Request) string {
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// Authenticator checks request credentials: JWTs from the identity
+// provider if JWT is set, API keys if Keys is set
+type Authenticator struct {
+	Keys *KeyStore
+	JWT  *JWTValidator
+}
+
+// authenticate returns the identity of r's credentials. The error message
+// is suitable for a 401 response.
+func (a Authenticator) authenticate(r *http.Request) (*Identity, error) {
+	token := bearerToken(r)
+	if a.JWT != nil && isJWT(token) {
+		return a.JWT.Validate(r.Context(), token)
+	}
+	if a.Keys != nil {
+		key := token
+		if key == "" {
+			key = r.Header.Get("X-API-Key")
+		}
+		if key == "" {
+			return nil, errMissingCredentials
+		}
+		if id, ok := a.Keys.Lookup(key); ok {
+			return id, nil
+		}
+		return nil, errors.New("Invalid API key")
+	}
+	if token == "" {
+		return nil, errMissingCredentials
+	}
+	return nil, errors.New("Invalid token")
+}
+
+var errMissingCredentials = errors.New("API key or token required")
+
+// APIKeyAuth returns middleware that requires a valid API key; see Auth
+func APIKeyAuth(ks *KeyStore, public ...string) func(http.Handler) http.Handler {
+	return Auth(Authenticator{Keys: ks}, public...)
+}
+
+// Auth returns middleware that requires valid credentials, attaches their
+// identity to the request context and applies its tier's rate limit.
+// Requests for the public paths pass without credentials.
+func Auth(a Authenticator, public ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if slices.Contains(public, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			id, err := a.authenticate(r)
+			if err != nil {
+				if errors.Is(err, errMissingCredentials) {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+				} else {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+				}
+				writeJSONError(w, http.StatusUnauthorized, err.Error(), "")
+				return
+			}
+			if id.Tier == nil {
+				writeJSONError(w, http.StatusForbidden, "Unknown tier", "tier")
+				return
+			}
+			if l := id.Tier.limiter; l != nil && !l.Allow(id.Tenant) {
+				slog.InfoContext(r.Context(), "rate limit exceeded", "tenant", id.Tenant, "tier", id.Tier.Name)
+				w.Header().Set("Retry-After", "1")
+				writeJSONError(w, http.StatusTooManyRequests, "Quota exceeded", "rate_limit")
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), id)))
+		})
+	}
+}
+
+// TierBudget returns a CostLimiter budget function charging authenticated
+// tenants by their tier's cost budget, and other clients by IP with
+// fallback
+func TierBudget(fallback CostBudget) func(*http.Request) (string, CostBudget) {
+	return func(r *http.Request) (string, CostBudget) {
+		if id, ok := IdentityFrom(r.Context()); ok && id.Tier.CostRate > 0 {
+			return "tenant:" + id.Tenant, CostBudget{Rate: id.Tier.CostRate, Burst: id.Tier.CostBurst}
+		}
+		return ClientKey(r), fallback
+	}
+}
+
+// QuotaError writes a 403 response naming the tier quota a request
+// violates
+func QuotaError(w http.ResponseWriter, quota string) {
+	writeJSONError(w, http.StatusForbidden, "Quota exceeded", quota)
+}
+
+// writeJSONError writes a JSON error response, naming the violated quota
+// if there is one
+func writeJSONError(w http.ResponseWriter, status int, msg, quota string) {
+	body := map[string]string{"error": msg}
+	if quota != "" {
+		body["quota"] = quota
+	}
+	data, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
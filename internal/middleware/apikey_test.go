@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeKeyStore writes a key store with a "free" tier for key "secret"
+// of tenant acme
+func writeKeyStore(t *testing.T, tiers string) *KeyStore {
+	t.Helper()
+	sum := sha256.Sum256([]byte("secret"))
+	path := filepath.Join(t.TempDir(), "keys.json")
+	data := `{"tiers": ` + tiers + `, "keys": [{"sha256": "` + hex.EncodeToString(sum[:]) + `", "tenant": "acme", "tier": "free"}]}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ks, err := LoadKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+func TestLoadKeyStore(t *testing.T) {
+	ks := writeKeyStore(t, `{"free": {"max_upload_mb": 5, "formats": ["jpeg"]}}`)
+	id, ok := ks.Lookup("secret")
+	if !ok || id.Tenant != "acme" || id.Tier.Name != "free" || id.Tier.MaxUploadMB != 5 {
+		t.Fatalf("Lookup = %+v, %v", id, ok)
+	}
+	if !id.Tier.AllowsFormat("jpeg") || id.Tier.AllowsFormat("webp") {
+		t.Error("format allowlist not applied")
+	}
+	if _, ok := ks.Lookup("other"); ok {
+		t.Error("unknown key found")
+	}
+
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"unknown tier": `{"tiers": {}, "keys": [{"sha256": "` + strings.Repeat("ab", 32) + `", "tier": "gold"}]}`,
+		"bad hash":     `{"tiers": {"free": {}}, "keys": [{"sha256": "secret", "tier": "free"}]}`,
+		"bad json":     `{`,
+	} {
+		path := filepath.Join(dir, "keys.json")
+		os.WriteFile(path, []byte(data), 0o600)
+		if _, err := LoadKeyStore(path); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	ks := writeKeyStore(t, `{"free": {"rate_limit": 1, "rate_burst": 2}}`)
+	var tenant string
+	handler := APIKeyAuth(ks, "/health")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant = ""
+		if id, ok := IdentityFrom(r.Context()); ok {
+			tenant = id.Tenant
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := serve("/health", nil); w.Code != http.StatusOK {
+		t.Errorf("public path: status %d", w.Code)
+	}
+	if w := serve("/convert", nil); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("no key: status %d", w.Code)
+	}
+	if w := serve("/convert", http.Header{"X-Api-Key": {"wrong"}}); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong key: status %d", w.Code)
+	}
+	if w := serve("/convert", http.Header{"Authorization": {"Bearer secret"}}); w.Code != http.StatusOK || tenant != "acme" {
+		t.Errorf("bearer key: status %d, tenant %q", w.Code, tenant)
+	}
+	if w := serve("/convert", http.Header{"X-Api-Key": {"secret"}}); w.Code != http.StatusOK || tenant != "acme" {
+		t.Errorf("X-API-Key: status %d, tenant %q", w.Code, tenant)
+	}
+
+	// The burst of 2 is spent
+	w := serve("/convert", http.Header{"X-Api-Key": {"secret"}})
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), `"quota":"rate_limit"`) {
+		t.Errorf("over the tier rate limit: status %d, body %s", w.Code, w.Body.String())
+	}
+}
+
+func TestTierBudget(t *testing.T) {
+	fallback := CostBudget{Rate: 1, Burst: 10}
+	budget := TierBudget(fallback)
+	req := httptest.NewRequest(http.MethodPost, "/convert", nil)
+	if key, b := budget(req); key != "192.0.2.1" || b != fallback {
+		t.Errorf("anonymous: %q, %+v", key, b)
+	}
+	id := &Identity{Tenant: "acme", Tier: &Tier{CostRate: 5, CostBurst: 50}}
+	req = req.WithContext(WithIdentity(req.Context(), id))
+	if key, b := budget(req); key != "tenant:acme" || b != (CostBudget{Rate: 5, Burst: 50}) {
+		t.Errorf("tenant: %q, %+v", key, b)
+	}
+}
@@ -0,0 +1,228 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ipv6LimitBits is the prefix IPv6 clients are limited by: hosts commonly
+// get a whole /64, so limiting single addresses would let a client rotate
+// through billions of them
+const ipv6LimitBits = 64
+
+// TrustedProxies resolves the client address of requests that reach the
+// server through reverse proxies. Forwarding headers are only believed
+// when the hop that sent them is a trusted proxy, so clients cannot spoof
+// their address.
+type TrustedProxies struct {
+	prefixes []netip.Prefix
+}
+
+// ParseTrustedProxies parses a comma-separated list of proxy CIDRs or
+// addresses, e.g. "10.0.0.0/8,fd00::/8,192.0.2.7"
+func ParseTrustedProxies(list string) (*TrustedProxies, error) {
+	prefixes, err := ParseCIDRs(list)
+	if err != nil {
+		return nil, err
+	}
+	return &TrustedProxies{prefixes: prefixes}, nil
+}
+
+// ParseCIDRs parses a comma-separated list of CIDRs or addresses;
+// addresses are single-address prefixes
+func ParseCIDRs(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address or CIDR %q", s)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or CIDR %q", s)
+		}
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// containsAddr reports whether one of prefixes contains addr
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of trusted proxy ranges
+func (tp *TrustedProxies) Len() int {
+	return len(tp.prefixes)
+}
+
+// trusted reports whether addr is a trusted proxy
+func (tp *TrustedProxies) trusted(addr netip.Addr) bool {
+	return tp != nil && containsAddr(tp.prefixes, addr)
+}
+
+// ClientIP returns the address of the client behind r. Starting from the
+// connection's peer, it walks the forwarding chain right to left while
+// the hops are trusted proxies, and returns the first untrusted one. The
+// chain is read from the RFC 7239 Forwarded header, else X-Forwarded-For,
+// else X-Real-IP. It returns the zero Addr if the peer address is invalid.
+func (tp *TrustedProxies) ClientIP(r *http.Request) netip.Addr {
+	addr := parseNode(r.RemoteAddr)
+	if !addr.IsValid() || !tp.trusted(addr) {
+		return addr
+	}
+	chain := forwardedFor(r.Header)
+	if len(chain) == 0 {
+		chain = splitList(r.Header.Values("X-Forwarded-For"))
+	}
+	if len(chain) == 0 {
+		if xri := strings.TrimSpace(r.Header.Get("X-Real-IP")); xri != "" {
+			chain = []string{xri}
+		}
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop := parseNode(chain[i])
+		if !hop.IsValid() {
+			// "unknown", an obfuscated identifier or garbage: the last
+			// trusted proxy is the best address there is
+			return addr
+		}
+		addr = hop
+		if !tp.trusted(addr) {
+			return addr
+		}
+	}
+	return addr
+}
+
+// forwardedFor returns the for= nodes of the Forwarded headers, in order
+func forwardedFor(h http.Header) []string {
+	var nodes []string
+	for _, element := range splitQuoted(strings.Join(h.Values("Forwarded"), ","), ',') {
+		for _, pair := range splitQuoted(element, ';') {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(key, "for") {
+				nodes = append(nodes, strings.Trim(value, `"`))
+			}
+		}
+	}
+	return nodes
+}
+
+// splitQuoted splits s at sep outside of quoted strings
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// splitList splits comma-separated header values into trimmed entries
+func splitList(values []string) []string {
+	var entries []string
+	for _, v := range values {
+		for _, e := range strings.Split(v, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				entries = append(entries, e)
+			}
+		}
+	}
+	return entries
+}
+
+// parseNode parses an address with an optional port: "192.0.2.1",
+// "192.0.2.1:80", "2001:db8::1" or "[2001:db8::1]:80"
+func parseNode(s string) netip.Addr {
+	s = strings.TrimSpace(s)
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr.Unmap().WithZone("")
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap().WithZone("")
+}
+
+type clientIPKey struct{}
+
+// RealIP returns middleware that resolves each request's client address
+// with tp for ClientIP and ClientKey
+func RealIP(tp *TrustedProxies) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), clientIPKey{}, tp.ClientIP(r))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// clientAddr returns the client address resolved by RealIP, or the peer
+// address of requests that did not pass through it
+func clientAddr(r *http.Request) netip.Addr {
+	if addr, ok := r.Context().Value(clientIPKey{}).(netip.Addr); ok {
+		return addr
+	}
+	return parseNode(r.RemoteAddr)
+}
+
+// ClientIP returns the client address of r, for logs
+func ClientIP(r *http.Request) string {
+	if addr := clientAddr(r); addr.IsValid() {
+		return addr.String()
+	}
+	return r.RemoteAddr
+}
+
+// ClientKey returns the key r's client is limited by: its IPv4 address
+// or its IPv6 /64
+func ClientKey(r *http.Request) string {
+	addr := clientAddr(r)
+	if !addr.IsValid() {
+		return r.RemoteAddr
+	}
+	return addrKey(addr)
+}
+
+// addrKey returns the client key of addr
+func addrKey(addr netip.Addr) string {
+	if addr.Is6() {
+		p, _ := addr.Prefix(ipv6LimitBits)
+		return p.String()
+	}
+	return addr.String()
+}
@@ -0,0 +1,138 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	tp, err := ParseTrustedProxies(" 10.0.0.0/8, 192.0.2.7,fd00::/8,::ffff:172.16.0.0/108,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tp.Len() != 4 {
+		t.Errorf("got %d ranges, want 4", tp.Len())
+	}
+	for _, addr := range []string{"10.1.2.3", "192.0.2.7", "fd00::1", "172.16.5.5"} {
+		if !tp.trusted(parseNode(addr)) {
+			t.Errorf("%s not trusted", addr)
+		}
+	}
+	for _, addr := range []string{"11.0.0.1", "192.0.2.8", "2001:db8::1", "172.32.0.1"} {
+		if tp.trusted(parseNode(addr)) {
+			t.Errorf("%s trusted", addr)
+		}
+	}
+	for _, bad := range []string{"10.0.0.0/33", "proxy.local", "10.0.0"} {
+		if _, err := ParseTrustedProxies(bad); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+}
+
+func TestTrustedProxies_ClientIP(t *testing.T) {
+	tp, _ := ParseTrustedProxies("10.0.0.0/8,fd00::/8")
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"port stripped", "203.0.113.5:4242", nil, "203.0.113.5"},
+		{"IPv6 peer", "[2001:db8::1]:4242", nil, "2001:db8::1"},
+		{"no port", "203.0.113.5", nil, "203.0.113.5"},
+		{"IPv4-mapped peer", "[::ffff:203.0.113.5]:4242", nil, "203.0.113.5"},
+		{"headers of untrusted peer ignored", "203.0.113.5:4242",
+			map[string]string{"X-Forwarded-For": "1.1.1.1", "X-Real-IP": "1.1.1.1", "Forwarded": "for=1.1.1.1"}, "203.0.113.5"},
+		{"XFF", "10.0.0.1:80", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "198.51.100.7"},
+		// A client can prepend anything; the rightmost untrusted hop is
+		// the one the trusted proxies saw
+		{"XFF spoofed prefix", "10.0.0.1:80",
+			map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"XFF all trusted", "10.0.0.1:80", map[string]string{"X-Forwarded-For": "10.9.9.9, 10.0.0.2"}, "10.9.9.9"},
+		{"XFF with port", "10.0.0.1:80", map[string]string{"X-Forwarded-For": "[2001:db8::9]:1234"}, "2001:db8::9"},
+		{"XFF garbage", "10.0.0.1:80", map[string]string{"X-Forwarded-For": "198.51.100.7, unknown"}, "10.0.0.1"},
+		{"X-Real-IP", "10.0.0.1:80", map[string]string{"X-Real-IP": "198.51.100.7"}, "198.51.100.7"},
+		{"Forwarded", "10.0.0.1:80",
+			map[string]string{"Forwarded": `for=192.0.2.60;proto=http;by=10.0.0.1, for="[2001:db8:cafe::17]:4711"`}, "2001:db8:cafe::17"},
+		{"Forwarded over XFF", "10.0.0.1:80",
+			map[string]string{"Forwarded": "For=192.0.2.60", "X-Forwarded-For": "198.51.100.7"}, "192.0.2.60"},
+		{"Forwarded quoted separators", "10.0.0.1:80",
+			map[string]string{"Forwarded": `for=192.0.2.60;ext="a,b;c", for=10.0.0.3`}, "192.0.2.60"},
+		{"Forwarded obfuscated", "10.0.0.1:80", map[string]string{"Forwarded": "for=_hidden"}, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/convert", nil)
+			req.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			if got := tp.ClientIP(req).String(); got != tt.want {
+				t.Errorf("ClientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	tests := []struct {
+		remote string
+		want   string
+	}{
+		{"203.0.113.5:4242", "203.0.113.5"},
+		{"[2001:db8:cafe:1:aaaa::1]:4242", "2001:db8:cafe:1::/64"},
+		{"[2001:db8:cafe:1:bbbb::2]:4242", "2001:db8:cafe:1::/64"},
+		{"invalid", "invalid"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/convert", nil)
+		req.RemoteAddr = tt.remote
+		if got := ClientKey(req); got != tt.want {
+			t.Errorf("ClientKey(%s) = %s, want %s", tt.remote, got, tt.want)
+		}
+	}
+}
+
+func TestRealIP_RateLimit(t *testing.T) {
+	tp, _ := ParseTrustedProxies("10.0.0.0/8")
+	handler := RealIP(tp)(RateLimit(1, 1)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+	serve := func(remote, xff string) int {
+		req := httptest.NewRequest(http.MethodGet, "/convert", nil)
+		req.RemoteAddr = remote
+		if xff != "" {
+			req.Header.Set("X-Forwarded-For", xff)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// New connections and spoofed headers do not get a fresh bucket
+	if code := serve("203.0.113.5:1000", ""); code != http.StatusOK {
+		t.Fatalf("first request: %d", code)
+	}
+	if code := serve("203.0.113.5:1001", "198.51.100.1"); code != http.StatusTooManyRequests {
+		t.Errorf("spoofed XFF from a new port: %d, want 429", code)
+	}
+	// Clients behind the trusted proxy are limited separately
+	if code := serve("10.0.0.1:80", "198.51.100.1"); code != http.StatusOK {
+		t.Errorf("first client behind proxy: %d", code)
+	}
+	if code := serve("10.0.0.1:80", "198.51.100.2"); code != http.StatusOK {
+		t.Errorf("second client behind proxy: %d", code)
+	}
+	if code := serve("10.0.0.1:80", "1.1.1.1, 198.51.100.1"); code != http.StatusTooManyRequests {
+		t.Errorf("first client again: %d, want 429", code)
+	}
+	// IPv6 clients are limited per /64
+	if code := serve("[2001:db8::1]:1000", ""); code != http.StatusOK {
+		t.Errorf("IPv6 client: %d", code)
+	}
+	if code := serve("[2001:db8::2]:1000", ""); code != http.StatusTooManyRequests {
+		t.Errorf("IPv6 client in the same /64: %d, want 429", code)
+	}
+}
@@ -1,9 +1,13 @@
 package middleware
 
 import (
-	"log"
+	"context"
+	"log/slog"
+	"math"
 	"net/http"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/harliandi/go-heif/pkg/metrics"
 )
@@ -14,8 +18,17 @@ type ConcurrencyLimiter struct {
 	mu        sync.RWMutex
 	active    int
 	max       int
+	waiting   int           // requests in AcquireWait
+	avgHold   time.Duration // moving average of how long a slot is held
+	route     string        // route of a per-route limiter, empty for the global one
 }
 
+// Retry-After bounds for rejected requests
+const (
+	minRetryAfter = time.Second
+	maxRetryAfter = time.Minute
+)
+
 // NewConcurrencyLimiter creates a new concurrency limiter
 func NewConcurrencyLimiter(max int) *ConcurrencyLimiter {
 	return &ConcurrencyLimiter{
@@ -28,47 +41,134 @@ func NewConcurrencyLimiter(max int) *ConcurrencyLimiter {
 func (cl *ConcurrencyLimiter) Acquire() bool {
 	select {
 	case cl.semaphore <- struct{}{}:
-		cl.mu.Lock()
-		cl.active++
-		active := cl.active
-		cl.mu.Unlock()
-		log.Printf("Concurrency: %d/%d active", active, cl.max)
-		metrics.UpdateConcurrency(active)
+		cl.add(1)
 		return true
 	default:
 		return false
 	}
 }
 
-// Release releases a slot
-func (cl *ConcurrencyLimiter) Release() {
-	<-cl.semaphore
+// AcquireWait acquires a slot, waiting up to maxWait for one to free up or
+// until ctx is done. Returns false if no slot was acquired.
+func (cl *ConcurrencyLimiter) AcquireWait(ctx context.Context, maxWait time.Duration) bool {
+	if cl.Acquire() {
+		return true
+	}
+	if maxWait <= 0 {
+		return false
+	}
 	cl.mu.Lock()
-	cl.active--
+	cl.waiting++
+	cl.mu.Unlock()
+	defer func() {
+		cl.mu.Lock()
+		cl.waiting--
+		cl.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	select {
+	case cl.semaphore <- struct{}{}:
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return false
+	}
+	cl.add(1)
+	return true
+}
+
+// add counts delta requests becoming active, reporting the global
+// limiter's count to the concurrency gauge
+func (cl *ConcurrencyLimiter) add(delta int) {
+	cl.mu.Lock()
+	cl.active += delta
 	active := cl.active
 	cl.mu.Unlock()
-	log.Printf("Concurrency: %d/%d active", active, cl.max)
+	if cl.route != "" {
+		slog.Debug("concurrency", "route", cl.route, "active", active, "max", cl.max)
+		return
+	}
+	slog.Debug("concurrency", "active", active, "max", cl.max)
 	metrics.UpdateConcurrency(active)
 }
 
+// RetryAfter estimates when a rejected request would get a slot: the
+// waiting requests, plus the rejected one, divided among the slots at the
+// average time a slot is held
+func (cl *ConcurrencyLimiter) RetryAfter() time.Duration {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	d := cl.avgHold * time.Duration(cl.waiting+1) / time.Duration(max(cl.max, 1))
+	return min(max(d, minRetryAfter), maxRetryAfter)
+}
+
+// observe adds the time a slot was held to the moving average
+func (cl *ConcurrencyLimiter) observe(d time.Duration) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if cl.avgHold == 0 {
+		cl.avgHold = d
+	} else {
+		cl.avgHold += (d - cl.avgHold) / 8
+	}
+}
+
+// Release releases a slot
+func (cl *ConcurrencyLimiter) Release() {
+	<-cl.semaphore
+	cl.add(-1)
+}
+
 // ConcurrencyLimit returns middleware that enforces concurrency limits
 func ConcurrencyLimit(max int) func(http.Handler) http.Handler {
+	return ConcurrencyLimitWait(max, 0)
+}
+
+// ConcurrencyLimitWait returns middleware that enforces concurrency
+// limits, letting requests wait up to maxWait for a slot before they are
+// rejected
+func ConcurrencyLimitWait(max int, maxWait time.Duration) func(http.Handler) http.Handler {
 	cl := NewConcurrencyLimiter(max)
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if !cl.Acquire() {
-				log.Printf("Concurrency limit reached: %d", max)
-				metrics.RecordConcurrencyLimitExceeded()
-				w.Header().Set("Content-Type", "application/json")
-				w.Header().Set("Retry-After", "1")
-				w.WriteHeader(http.StatusServiceUnavailable)
-				w.Write([]byte(`{"error":"Service busy, please try again"}`))
-				return
-			}
-
-			defer cl.Release()
-			next.ServeHTTP(w, r)
+			cl.serve(w, r, maxWait, next)
 		})
 	}
 }
+
+// serve runs next in a slot, waiting up to maxWait for one, or rejects
+// the request with a 503
+func (cl *ConcurrencyLimiter) serve(w http.ResponseWriter, r *http.Request, maxWait time.Duration, next http.Handler) {
+	if !cl.AcquireWait(r.Context(), maxWait) {
+		if r.Context().Err() != nil {
+			return // the client is gone
+		}
+		if cl.route != "" {
+			slog.WarnContext(r.Context(), "concurrency limit reached", "route", cl.route, "max", cl.max)
+		} else {
+			slog.WarnContext(r.Context(), "concurrency limit reached", "max", cl.max)
+		}
+		metrics.RecordConcurrencyLimitExceeded()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", RetryAfterSeconds(cl.RetryAfter()))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"error":"Service busy, please try again"}`))
+		return
+	}
+
+	start := time.Now()
+	defer func() {
+		cl.Release()
+		cl.observe(time.Since(start))
+	}()
+	next.ServeHTTP(w, r)
+}
+
+// RetryAfterSeconds formats d as a Retry-After value, in whole seconds
+// rounded up
+func RetryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,168 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/harliandi/go-heif/pkg/metrics"
+)
+
+// A request is charged one token per megabyte of input and one per
+// megapixel it decodes
+const (
+	bytesPerToken  = 1 << 20
+	pixelsPerToken = 1_000_000
+)
+
+// CostBudget is a client's token bucket: Rate tokens per second, up to
+// Burst
+type CostBudget struct {
+	Rate  float64
+	Burst float64
+}
+
+// CostLimiter implements token bucket limiting per client, charging each
+// request for the work it asks for instead of one token. Requests are
+// charged once the upload is read and its image headers parsed; see
+// ChargeCost.
+type CostLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	budget  func(*http.Request) (string, CostBudget)
+	ttl     time.Duration // cleanup interval for stale entries
+}
+
+// NewCostLimiter creates a cost limiter. budget returns the client a
+// request is charged to and that client's budget, so budgets can differ
+// per API key or tier.
+func NewCostLimiter(budget func(*http.Request) (key string, b CostBudget)) *CostLimiter {
+	cl := &CostLimiter{
+		buckets: make(map[string]*bucket),
+		budget:  budget,
+		ttl:     5 * time.Minute,
+	}
+	go cl.cleanup()
+	return cl
+}
+
+// ClientBudget returns a budget function giving every client IP budget b
+func ClientBudget(b CostBudget) func(*http.Request) (string, CostBudget) {
+	return func(r *http.Request) (string, CostBudget) {
+		return ClientKey(r), b
+	}
+}
+
+// refill returns key's bucket with the tokens earned since it was last
+// used; cl.mu must be held
+func (cl *CostLimiter) refill(key string, b CostBudget, now time.Time) *bucket {
+	bk, ok := cl.buckets[key]
+	if !ok {
+		bk = &bucket{tokens: b.Burst, lastRef: now}
+		cl.buckets[key] = bk
+	}
+	bk.tokens = min(bk.tokens+now.Sub(bk.lastRef).Seconds()*b.Rate, b.Burst)
+	bk.lastRef = now
+	return bk
+}
+
+// Remaining returns the tokens key has left
+func (cl *CostLimiter) Remaining(key string, b CostBudget) float64 {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.refill(key, b, time.Now()).tokens
+}
+
+// Take charges key cost tokens if it has them. Costs above the burst are
+// charged the burst, so large images pass once the bucket is full. If
+// the tokens are missing it returns how long until they are earned.
+func (cl *CostLimiter) Take(key string, b CostBudget, cost float64) (ok bool, remaining float64, wait time.Duration) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	bk := cl.refill(key, b, time.Now())
+	cost = min(cost, b.Burst)
+	if bk.tokens >= cost {
+		bk.tokens -= cost
+		return true, bk.tokens, 0
+	}
+	if b.Rate > 0 {
+		wait = time.Duration((cost - bk.tokens) / b.Rate * float64(time.Second))
+	}
+	return false, bk.tokens, wait
+}
+
+// cleanup removes stale entries to prevent memory leaks
+func (cl *CostLimiter) cleanup() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cl.mu.Lock()
+		now := time.Now()
+		for key, b := range cl.buckets {
+			if now.Sub(b.lastRef) > cl.ttl {
+				delete(cl.buckets, key)
+			}
+		}
+		cl.mu.Unlock()
+	}
+}
+
+// costCharge is the client a request's cost is charged to
+type costCharge struct {
+	cl     *CostLimiter
+	key    string
+	budget CostBudget
+}
+
+type costChargeKey struct{}
+
+// CostLimit returns middleware that makes requests chargeable with
+// ChargeCost and reports the client's budget in the X-Cost-Limit and
+// X-Cost-Remaining headers
+func CostLimit(cl *CostLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, b := cl.budget(r)
+			w.Header().Set("X-Cost-Limit", formatTokens(b.Burst))
+			w.Header().Set("X-Cost-Remaining", formatTokens(cl.Remaining(key, b)))
+			ctx := context.WithValue(r.Context(), costChargeKey{}, &costCharge{cl: cl, key: key, budget: b})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// ChargeCost charges the request's client for converting an upload of
+// size bytes decoding pixels pixels, and updates the budget headers. If
+// the client's budget is spent it writes a 429 response and returns
+// false. Requests that did not pass through CostLimit are not charged.
+func ChargeCost(w http.ResponseWriter, r *http.Request, size int, pixels int64) bool {
+	c, ok := r.Context().Value(costChargeKey{}).(*costCharge)
+	if !ok {
+		return true
+	}
+	cost := float64(size)/bytesPerToken + float64(pixels)/pixelsPerToken
+	ok, remaining, wait := c.cl.Take(c.key, c.budget, cost)
+	w.Header().Set("X-Cost-Remaining", formatTokens(remaining))
+	if !ok {
+		slog.InfoContext(r.Context(), "cost limit exceeded", "client", c.key, "cost", cost, "remaining", remaining)
+		metrics.RecordCostLimitExceeded()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", RetryAfterSeconds(max(wait, minRetryAfter)))
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error":"Cost limit exceeded"}`))
+		return false
+	}
+	charged := min(cost, c.budget.Burst)
+	w.Header().Set("X-Cost-Charged", formatTokens(charged))
+	metrics.RecordCostCharged(charged)
+	return true
+}
+
+// formatTokens formats a token count for the budget headers
+func formatTokens(tokens float64) string {
+	return strconv.FormatFloat(tokens, 'f', 1, 64)
+}
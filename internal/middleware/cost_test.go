@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCostLimiter_Take(t *testing.T) {
+	cl := NewCostLimiter(nil)
+	b := CostBudget{Rate: 10, Burst: 100}
+	if got := cl.Remaining("a", b); got != 100 {
+		t.Errorf("new client has %v tokens, want the burst", got)
+	}
+	if ok, remaining, _ := cl.Take("a", b, 60); !ok || remaining < 40 || remaining > 41 {
+		t.Errorf("Take(60) = %v, %v, want ok and 40 left", ok, remaining)
+	}
+	ok, _, wait := cl.Take("a", b, 60)
+	if ok {
+		t.Error("charged more tokens than left")
+	}
+	// 20 tokens are missing at 10 per second
+	if wait < 1900*time.Millisecond || wait > 2*time.Second {
+		t.Errorf("wait %v, want about 2s", wait)
+	}
+	if ok, _, _ := cl.Take("b", b, 60); !ok {
+		t.Error("clients share a bucket")
+	}
+
+	// Costs above the burst are charged the burst from a full bucket
+	if ok, remaining, _ := cl.Take("c", b, 500); !ok || remaining != 0 {
+		t.Errorf("Take(500) from a full bucket = %v, %v, want ok and 0 left", ok, remaining)
+	}
+}
+
+func TestCostLimit(t *testing.T) {
+	cl := NewCostLimiter(ClientBudget(CostBudget{Rate: 0.01, Burst: 10}))
+	var charged bool
+	handler := CostLimit(cl)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 4MB of input decoding 2 megapixels costs 6 tokens
+		if charged = ChargeCost(w, r, 4<<20, 2_000_000); charged {
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/convert", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !charged {
+		t.Fatalf("first request: status %d", w.Code)
+	}
+	for header, want := range map[string]string{"X-Cost-Limit": "10.0", "X-Cost-Charged": "6.0", "X-Cost-Remaining": "4.0"} {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests || charged {
+		t.Errorf("second request: status %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "200" {
+		t.Errorf("Retry-After = %q, want 200 (2 tokens at 0.01/s)", got)
+	}
+
+	// Requests outside CostLimit are not charged
+	if !ChargeCost(httptest.NewRecorder(), req, 1<<30, 1<<30) {
+		t.Error("uncharged request rejected")
+	}
+}
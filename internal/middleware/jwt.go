@@ -0,0 +1,407 @@
+package middleware
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWKS cache timing
+const (
+	defaultJWKSTTL = 10 * time.Minute
+	// jwksMinRefresh limits refetches for tokens signed with unknown keys
+	jwksMinRefresh = 30 * time.Second
+	jwksTimeout    = 10 * time.Second
+	maxJWKSBytes   = 1 << 20
+)
+
+// JWKS loads and caches the signing keys of an identity provider from a
+// JSON Web Key Set file or URL. Keys are reloaded after the TTL, or
+// earlier when a token names a key the set doesn't have, as providers
+// rotate keys. A set that fails to reload keeps its previous keys.
+type JWKS struct {
+	source string // file path or http(s) URL
+	ttl    time.Duration
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey // by key id
+	fetched time.Time                   // when keys were loaded
+	tried   time.Time                   // last load attempt
+}
+
+// NewJWKS creates a key set loaded from source, a file path or an http(s)
+// URL, and reloaded after ttl (0 for 10 minutes)
+func NewJWKS(source string, ttl time.Duration) *JWKS {
+	if ttl <= 0 {
+		ttl = defaultJWKSTTL
+	}
+	return &JWKS{source: source, ttl: ttl, client: &http.Client{Timeout: jwksTimeout}}
+}
+
+// Key returns the key with id kid, or every key if kid is empty
+func (s *JWKS) Key(ctx context.Context, kid string) ([]crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	_, known := s.keys[kid]
+	stale := now.Sub(s.fetched) > s.ttl
+	if (stale || kid != "" && !known) && now.Sub(s.tried) >= jwksMinRefresh {
+		s.tried = now
+		keys, err := s.load(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "JWKS load failed", "source", s.source, "error", err)
+			if s.keys == nil {
+				return nil, errors.New("signing keys unavailable")
+			}
+		} else {
+			s.keys, s.fetched = keys, now
+		}
+	}
+	if kid != "" {
+		if key, ok := s.keys[kid]; ok {
+			return []crypto.PublicKey{key}, nil
+		}
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	keys := make([]crypto.PublicKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// load reads and parses the key set
+func (s *JWKS) load(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(s.source, "http://") || strings.HasPrefix(s.source, "https://") {
+		data, err = s.fetch(ctx)
+	} else {
+		data, err = os.ReadFile(s.source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
+
+// fetch downloads the key set
+func (s *JWKS) fetch(ctx context.Context) ([]byte, error) {
+	// The key set is shared, so it is not fetched with the request's context
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), jwksTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxJWKSBytes))
+}
+
+// jwk is a JSON Web Key (RFC 7517); only the members of signing keys are
+// read
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS parses the signature keys of a key set, skipping keys of
+// other uses and types
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parse JWKS: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("JWKS key %q: %w", k.Kid, err)
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// publicKey returns the key, nil for unsupported key types
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		var ecdhCurve ecdh.Curve
+		switch k.Crv {
+		case "P-256":
+			curve, ecdhCurve = elliptic.P256(), ecdh.P256()
+		case "P-384":
+			curve, ecdhCurve = elliptic.P384(), ecdh.P384()
+		case "P-521":
+			curve, ecdhCurve = elliptic.P521(), ecdh.P521()
+		default:
+			return nil, nil
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+		y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+		if err1 != nil || err2 != nil || len(x) != size || len(y) != size {
+			return nil, errors.New("invalid EC key")
+		}
+		// Rejects points that are not on the curve
+		if _, err := ecdhCurve.NewPublicKey(slices.Concat([]byte{4}, x, y)); err != nil {
+			return nil, errors.New("invalid EC key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
+
+// JWTConfig sets what JWTValidator accepts and how claims map to an
+// identity
+type JWTConfig struct {
+	Issuer      string           // required "iss", empty to accept any
+	Audience    string           // required in "aud", empty to accept any
+	TenantClaim string           // claim naming the tenant, "sub" by default
+	TierClaim   string           // claim naming the tier, "tier" by default
+	DefaultTier string           // tier of tokens without a tier claim
+	Tiers       map[string]*Tier // quotas by tier name; nil gives every tier no quotas
+	Leeway      time.Duration    // allowed clock skew for "exp" and "nbf"
+}
+
+// JWTValidator validates JWTs signed by an identity provider's keys and
+// maps their claims to an identity
+type JWTValidator struct {
+	keys *JWKS
+	cfg  JWTConfig
+}
+
+// NewJWTValidator creates a validator checking signatures against keys
+func NewJWTValidator(keys *JWKS, cfg JWTConfig) *JWTValidator {
+	if cfg.TenantClaim == "" {
+		cfg.TenantClaim = "sub"
+	}
+	if cfg.TierClaim == "" {
+		cfg.TierClaim = "tier"
+	}
+	return &JWTValidator{keys: keys, cfg: cfg}
+}
+
+// isJWT reports whether a bearer token is a JWT rather than an API key
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Validate checks a JWT's signature, issuer, audience and validity period
+// and returns the identity its claims name. A tier the configuration
+// doesn't know gives an identity without a tier. The error message is
+// suitable for a 401 response.
+func (v *JWTValidator) Validate(ctx context.Context, token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	keys, err := v.keys.Key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	if !slices.ContainsFunc(keys, func(key crypto.PublicKey) bool { return verifyJWS(header.Alg, key, signed, sig) }) {
+		return nil, errors.New("invalid token signature")
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	if err := v.checkClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+
+	tenant, _ := claims[v.cfg.TenantClaim].(string)
+	if tenant == "" {
+		return nil, fmt.Errorf("token has no %q claim", v.cfg.TenantClaim)
+	}
+	tierName, _ := claims[v.cfg.TierClaim].(string)
+	if tierName == "" {
+		tierName = v.cfg.DefaultTier
+	}
+	id := &Identity{Tenant: tenant}
+	if v.cfg.Tiers == nil {
+		id.Tier = &Tier{Name: tierName}
+	} else {
+		id.Tier = v.cfg.Tiers[tierName]
+	}
+	return id, nil
+}
+
+// checkClaims checks the registered claims of a token at now
+func (v *JWTValidator) checkClaims(claims map[string]any, now time.Time) error {
+	if v.cfg.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.cfg.Issuer {
+			return errors.New("token has the wrong issuer")
+		}
+	}
+	if v.cfg.Audience != "" {
+		var aud []string
+		switch a := claims["aud"].(type) {
+		case string:
+			aud = []string{a}
+		case []any:
+			for _, s := range a {
+				if s, ok := s.(string); ok {
+					aud = append(aud, s)
+				}
+			}
+		}
+		if !slices.Contains(aud, v.cfg.Audience) {
+			return errors.New("token has the wrong audience")
+		}
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(v.cfg.Leeway)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.cfg.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token not valid yet")
+	}
+	return nil
+}
+
+// decodeSegment decodes a base64url JSON segment of a token
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifyJWS checks a JWS signature (RFC 7518) made with alg by key's
+// private half. Algorithms that don't match the key type fail, so a
+// token can't pick a weaker check than its key allows.
+func verifyJWS(alg string, key crypto.PublicKey, signed, sig []byte) bool {
+	var h crypto.Hash
+	switch alg[min(2, len(alg)):] {
+	case "256":
+		h = crypto.SHA256
+	case "384":
+		h = crypto.SHA384
+	case "512":
+		h = crypto.SHA512
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if h == 0 {
+			return false
+		}
+		digest := hashOf(h, signed)
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(key, h, digest, sig) == nil
+		case "PS":
+			return rsa.VerifyPSS(key, h, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		// ES512 uses P-521; each algorithm has one curve
+		curveAlg := map[int]string{32: "ES256", 48: "ES384", 66: "ES512"}[size]
+		if alg != curveAlg || len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(key, hashOf(h, signed), r, s)
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(key, signed, sig)
+	}
+	return false
+}
+
+// hashOf returns the digest of data with h
+func hashOf(h crypto.Hash, data []byte) []byte {
+	var hh hash.Hash
+	switch h {
+	case crypto.SHA384:
+		hh = sha512.New384()
+	case crypto.SHA512:
+		hh = sha512.New()
+	default:
+		hh = sha256.New()
+	}
+	hh.Write(data)
+	return hh.Sum(nil)
+}
+
+// JWTAuth returns middleware that requires a valid JWT; see Auth
+func JWTAuth(v *JWTValidator, public ...string) func(http.Handler) http.Handler {
+	return Auth(Authenticator{JWT: v}, public...)
+}
@@ -0,0 +1,272 @@
+package middleware
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding
+
+// testSigner signs JWTs with a key published in a test JWKS
+type testSigner struct {
+	kid string
+	alg string
+	key crypto.Signer
+	jwk map[string]string
+}
+
+func newRSASigner(t *testing.T, kid string) *testSigner {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigner{kid: kid, alg: "RS256", key: key, jwk: map[string]string{
+		"kty": "RSA", "kid": kid, "use": "sig",
+		"n": b64.EncodeToString(key.N.Bytes()),
+		"e": b64.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}
+}
+
+func newECSigner(t *testing.T, kid string) *testSigner {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigner{kid: kid, alg: "ES256", key: key, jwk: map[string]string{
+		"kty": "EC", "kid": kid, "crv": "P-256",
+		"x": b64.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y": b64.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}}
+}
+
+func newEdSigner(t *testing.T, kid string) *testSigner {
+	t.Helper()
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSigner{kid: kid, alg: "EdDSA", key: key, jwk: map[string]string{
+		"kty": "OKP", "kid": kid, "crv": "Ed25519", "x": b64.EncodeToString(pub),
+	}}
+}
+
+// sign returns a JWT of claims
+func (s *testSigner) sign(t *testing.T, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": s.alg, "kid": s.kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	var sig []byte
+	var err error
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest[:])
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64.EncodeToString(sig)
+}
+
+// jwksServer serves a JWKS of signers, counting the fetches
+func jwksServer(t *testing.T, fetches *atomic.Int32, signers ...*testSigner) *httptest.Server {
+	t.Helper()
+	var keys []map[string]string
+	for _, s := range signers {
+		keys = append(keys, s.jwk)
+	}
+	data, _ := json.Marshal(map[string]any{"keys": keys})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestJWTValidator(t *testing.T) {
+	rsaKey, ecKey, edKey := newRSASigner(t, "rsa"), newECSigner(t, "ec"), newEdSigner(t, "ed")
+	var fetches atomic.Int32
+	srv := jwksServer(t, &fetches, rsaKey, ecKey, edKey)
+	gold := &Tier{Name: "gold"}
+	v := NewJWTValidator(NewJWKS(srv.URL, 0), JWTConfig{
+		Issuer:      "https://idp.example",
+		Audience:    "heif",
+		DefaultTier: "gold",
+		Tiers:       map[string]*Tier{"gold": gold},
+	})
+
+	now := time.Now().Unix()
+	valid := func() map[string]any {
+		return map[string]any{"iss": "https://idp.example", "aud": []string{"other", "heif"}, "sub": "acme", "exp": now + 60}
+	}
+	for _, s := range []*testSigner{rsaKey, ecKey, edKey} {
+		id, err := v.Validate(context.Background(), s.sign(t, valid()))
+		if err != nil || id.Tenant != "acme" || id.Tier != gold {
+			t.Errorf("%s: Validate = %+v, %v", s.alg, id, err)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("JWKS fetched %d times, want once", n)
+	}
+
+	tests := []struct {
+		name   string
+		claims func(map[string]any)
+		token  func(string) string
+	}{
+		{"expired", func(c map[string]any) { c["exp"] = now - 60 }, nil},
+		{"no expiry", func(c map[string]any) { delete(c, "exp") }, nil},
+		{"not yet valid", func(c map[string]any) { c["nbf"] = now + 60 }, nil},
+		{"wrong issuer", func(c map[string]any) { c["iss"] = "https://evil.example" }, nil},
+		{"wrong audience", func(c map[string]any) { c["aud"] = "other" }, nil},
+		{"no tenant", func(c map[string]any) { delete(c, "sub") }, nil},
+		{"tampered claims", nil, func(tok string) string {
+			parts := strings.Split(tok, ".")
+			payload, _ := json.Marshal(map[string]any{"iss": "https://idp.example", "aud": "heif", "sub": "other", "exp": now + 60})
+			return parts[0] + "." + b64.EncodeToString(payload) + "." + parts[2]
+		}},
+		{"alg none", nil, func(tok string) string {
+			parts := strings.Split(tok, ".")
+			header, _ := json.Marshal(map[string]string{"alg": "none", "kid": "rsa"})
+			return b64.EncodeToString(header) + "." + parts[1] + "."
+		}},
+		{"HMAC with the RSA key", nil, func(tok string) string {
+			parts := strings.Split(tok, ".")
+			header, _ := json.Marshal(map[string]string{"alg": "HS256", "kid": "rsa"})
+			return b64.EncodeToString(header) + "." + parts[1] + "." + parts[2]
+		}},
+		{"unknown key", nil, func(tok string) string {
+			parts := strings.Split(tok, ".")
+			header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "rotated"})
+			return b64.EncodeToString(header) + "." + parts[1] + "." + parts[2]
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := valid()
+			if tt.claims != nil {
+				tt.claims(claims)
+			}
+			tok := rsaKey.sign(t, claims)
+			if tt.token != nil {
+				tok = tt.token(tok)
+			}
+			if id, err := v.Validate(context.Background(), tok); err == nil {
+				t.Errorf("accepted: %+v", id)
+			}
+		})
+	}
+
+	// An unknown tier gives no tier; Auth turns it into a 403
+	claims := valid()
+	claims["tier"] = "platinum"
+	if id, err := v.Validate(context.Background(), rsaKey.sign(t, claims)); err != nil || id.Tier != nil {
+		t.Errorf("unknown tier: %+v, %v", id, err)
+	}
+}
+
+func TestJWKS_Refresh(t *testing.T) {
+	old, rotated := newEdSigner(t, "old"), newEdSigner(t, "new")
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	write := func(signers ...*testSigner) {
+		var keys []map[string]string
+		for _, s := range signers {
+			keys = append(keys, s.jwk)
+		}
+		data, _ := json.Marshal(map[string]any{"keys": keys})
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(old)
+	jwks := NewJWKS(path, time.Hour)
+	if keys, err := jwks.Key(context.Background(), "old"); err != nil || len(keys) != 1 {
+		t.Fatalf("Key(old) = %v, %v", keys, err)
+	}
+
+	// A rotated key is picked up, but refetches are rate limited
+	write(old, rotated)
+	if _, err := jwks.Key(context.Background(), "new"); err == nil {
+		t.Error("refetched right after the last load")
+	}
+	jwks.mu.Lock()
+	jwks.tried = time.Now().Add(-jwksMinRefresh)
+	jwks.mu.Unlock()
+	if _, err := jwks.Key(context.Background(), "new"); err != nil {
+		t.Errorf("rotated key: %v", err)
+	}
+
+	// A failed reload keeps the keys
+	os.WriteFile(path, []byte("{"), 0o600)
+	jwks.mu.Lock()
+	jwks.fetched, jwks.tried = time.Time{}, time.Time{}
+	jwks.mu.Unlock()
+	if _, err := jwks.Key(context.Background(), "old"); err != nil {
+		t.Errorf("after a failed reload: %v", err)
+	}
+}
+
+func TestAuth_JWTAndAPIKeys(t *testing.T) {
+	ks := writeKeyStore(t, `{"free": {}}`)
+	signer := newEdSigner(t, "ed")
+	var fetches atomic.Int32
+	srv := jwksServer(t, &fetches, signer)
+	a := Authenticator{
+		Keys: ks,
+		JWT:  NewJWTValidator(NewJWKS(srv.URL, 0), JWTConfig{Tiers: ks.Tiers()}),
+	}
+	var tenant string
+	handler := Auth(a)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := IdentityFrom(r.Context())
+		tenant = id.Tenant
+	}))
+
+	serve := func(auth string) int {
+		req := httptest.NewRequest(http.MethodPost, "/convert", nil)
+		req.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	exp := time.Now().Add(time.Minute).Unix()
+	if code := serve("Bearer " + signer.sign(t, map[string]any{"sub": "svc", "tier": "free", "exp": exp})); code != http.StatusOK || tenant != "svc" {
+		t.Errorf("JWT: status %d, tenant %q", code, tenant)
+	}
+	if code := serve("Bearer secret"); code != http.StatusOK || tenant != "acme" {
+		t.Errorf("API key: status %d, tenant %q", code, tenant)
+	}
+	if code := serve("Bearer " + signer.sign(t, map[string]any{"sub": "svc", "tier": "gold", "exp": exp})); code != http.StatusForbidden {
+		t.Errorf("unknown tier: status %d, want 403", code)
+	}
+	if code := serve("Bearer " + signer.sign(t, map[string]any{"sub": "svc", "exp": exp - 3600})); code != http.StatusUnauthorized {
+		t.Errorf("expired JWT: status %d, want 401", code)
+	}
+}
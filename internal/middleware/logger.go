@@ -2,11 +2,12 @@ package middleware
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"runtime/debug"
 	"time"
 
+	"github.com/harliandi/go-heif/internal/logging"
 	"github.com/harliandi/go-heif/pkg/metrics"
 )
 
@@ -20,15 +21,23 @@ func Logger(next http.Handler) http.Handler {
 
 		next.ServeHTTP(wrapped, r)
 
-		duration := time.Since(start).Seconds()
+		elapsed := time.Since(start)
+		duration := elapsed.Seconds()
 		statusCode := fmt.Sprintf("%d", wrapped.status)
 
-		// Log the request
-		log.Printf("%s %s %d %v",
-			r.Method,
-			r.URL.Path,
-			wrapped.status,
-			time.Since(start),
+		// Log the request; the handler adds its own attributes, such as
+		// the tenant and bytes_in, through the request context
+		level := slog.LevelInfo
+		if wrapped.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		slog.Log(r.Context(), level, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", wrapped.status,
+			"duration_ms", logging.Millis(elapsed),
+			"bytes_out", wrapped.bytes,
+			"client_ip", ClientIP(r),
 		)
 
 		// Record metrics (excluding /metrics endpoint to avoid recursion)
@@ -43,8 +52,10 @@ func Recovery(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
-				stack := debug.Stack()
-				log.Printf("PANIC recovered: %v\n%s", err, stack)
+				slog.ErrorContext(r.Context(), "panic recovered",
+					"error", fmt.Sprint(err),
+					"stack", string(debug.Stack()),
+				)
 
 				// Try to send error response
 				w.Header().Set("Content-Type", "application/json")
@@ -57,12 +68,25 @@ func Recovery(next http.Handler) http.Handler {
 	})
 }
 
+// responseWrapper records the status and size of a response
 type responseWrapper struct {
 	http.ResponseWriter
 	status int
+	bytes  int64
 }
 
 func (w *responseWrapper) WriteHeader(status int) {
 	w.status = status
 	w.ResponseWriter.WriteHeader(status)
 }
+
+func (w *responseWrapper) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the wrapped writer
+func (w *responseWrapper) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
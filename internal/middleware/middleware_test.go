@@ -201,6 +201,87 @@ func TestConcurrencyLimit_Sequential(t *testing.T) {
 	}
 }
 
+// TestConcurrencyLimitWait tests requests wait for a slot instead of
+// being rejected right away
+func TestConcurrencyLimitWait(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := ConcurrencyLimitWait(1, time.Second)(next)
+
+	var successCount int32
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/test", nil))
+			if w.Code == http.StatusOK {
+				atomic.AddInt32(&successCount, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if successCount != 4 {
+		t.Errorf("Expected all 4 requests to succeed after waiting, got %d", successCount)
+	}
+}
+
+// TestConcurrencyLimitWait_Timeout tests requests are rejected with a
+// Retry-After from the observed request time once the wait runs out
+func TestConcurrencyLimitWait_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := ConcurrencyLimitWait(1, 20*time.Millisecond)(next)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test", nil))
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+	start := time.Now()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/test", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503, got %d", w.Code)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Rejected after %v, before the max wait", elapsed)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
+	close(release)
+	<-done
+}
+
+func TestConcurrencyLimiter_RetryAfter(t *testing.T) {
+	cl := NewConcurrencyLimiter(2)
+	if got := cl.RetryAfter(); got != minRetryAfter {
+		t.Errorf("without history: %v, want %v", got, minRetryAfter)
+	}
+	cl.observe(4 * time.Second)
+	cl.waiting = 3
+	// 4 requests ahead on 2 slots of 4s each
+	if got := cl.RetryAfter(); got != 8*time.Second {
+		t.Errorf("RetryAfter() = %v, want 8s", got)
+	}
+	cl.observe(time.Hour)
+	if got := cl.RetryAfter(); got != maxRetryAfter {
+		t.Errorf("RetryAfter() = %v, want the %v cap", got, maxRetryAfter)
+	}
+	if got := RetryAfterSeconds(1500 * time.Millisecond); got != "2" {
+		t.Errorf("RetryAfterSeconds(1.5s) = %q, want 2", got)
+	}
+}
+
 // TestRecovery tests panic recovery
 func TestRecovery(t *testing.T) {
 	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
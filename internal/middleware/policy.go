@@ -0,0 +1,157 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// RoutePolicy sets the rate and concurrency limits of the requests
+// matching Route, an http.ServeMux pattern such as "POST /convert" or
+// "/info". Zero limits leave the route to the global limits.
+type RoutePolicy struct {
+	Route         string `json:"route"`
+	Exempt        bool   `json:"exempt"`         // bypass the rate and concurrency limits
+	RateLimit     int    `json:"rate_limit"`     // requests per second per client, instead of the global rate limit
+	RateBurst     int    `json:"rate_burst"`     // rate limit burst, RateLimit when unset
+	MaxConcurrent int    `json:"max_concurrent"` // concurrent requests, instead of sharing the global limit
+}
+
+// DefaultRoutePolicies exempts the health probes and metrics, so they are
+// answered while conversions saturate the limits
+func DefaultRoutePolicies() []RoutePolicy {
+	return []RoutePolicy{
+		{Route: "/health", Exempt: true},
+		{Route: "/ready", Exempt: true},
+		{Route: "/metrics", Exempt: true},
+	}
+}
+
+// LoadRoutePolicies reads policies from a JSON file holding an array of
+// them:
+//
+//	[
+//	  {"route": "POST /convert", "rate_limit": 2, "rate_burst": 5, "max_concurrent": 20},
+//	  {"route": "GET /info", "rate_limit": 50}
+//	]
+func LoadRoutePolicies(path string) ([]RoutePolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policies []RoutePolicy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, fmt.Errorf("parse route policies: %w", err)
+	}
+	return policies, nil
+}
+
+// route is a policy with its own limiters
+type route struct {
+	RoutePolicy
+	limiter     Limiter
+	concurrency *ConcurrencyLimiter
+}
+
+// RoutePolicies applies per-route limits. Requests are matched to
+// policies like http.ServeMux matches handlers: by method, host and the
+// most specific path pattern.
+type RoutePolicies struct {
+	mux    *http.ServeMux
+	routes map[string]*route // by pattern
+}
+
+// NewRoutePolicies builds the routes of policies; a later policy for the
+// same route replaces an earlier one. newLimiter creates the rate limiter
+// of routes with their own rate limit.
+func NewRoutePolicies(policies []RoutePolicy, newLimiter func(rate, burst int) Limiter) (*RoutePolicies, error) {
+	byRoute := make(map[string]RoutePolicy)
+	for _, p := range policies {
+		if p.RateLimit < 0 || p.RateBurst < 0 || p.MaxConcurrent < 0 {
+			return nil, fmt.Errorf("route %q: negative limit", p.Route)
+		}
+		byRoute[p.Route] = p
+	}
+	rp := &RoutePolicies{mux: http.NewServeMux(), routes: make(map[string]*route)}
+	for pattern := range byRoute {
+		if err := handlePattern(rp.mux, pattern); err != nil {
+			return nil, err
+		}
+	}
+	for pattern, p := range byRoute {
+		rt := &route{RoutePolicy: p}
+		if p.RateLimit > 0 {
+			rt.limiter = newLimiter(p.RateLimit, max(p.RateBurst, p.RateLimit))
+		}
+		if p.MaxConcurrent > 0 {
+			rt.concurrency = NewConcurrencyLimiter(p.MaxConcurrent)
+			rt.concurrency.route = pattern
+		}
+		rp.routes[pattern] = rt
+	}
+	return rp, nil
+}
+
+// handlePattern registers pattern on mux, returning the error ServeMux
+// panics with for invalid or conflicting patterns
+func handlePattern(mux *http.ServeMux, pattern string) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("route policies: %v", v)
+		}
+	}()
+	mux.Handle(pattern, http.NotFoundHandler())
+	return nil
+}
+
+// match returns the route of r, or nil if no policy matches it
+func (rp *RoutePolicies) match(r *http.Request) *route {
+	_, pattern := rp.mux.Handler(r)
+	return rp.routes[pattern]
+}
+
+// RateLimit returns middleware that enforces each route's rate limit, or
+// global for routes without one. Exempt routes are not limited.
+func (rp *RoutePolicies) RateLimit(global Limiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rl, key := global, ClientKey(r)
+			if rt := rp.match(r); rt != nil {
+				switch {
+				case rt.Exempt:
+					rl = nil
+				case rt.limiter != nil:
+					// Route buckets are apart from the global ones, also
+					// in a shared store
+					rl, key = rt.limiter, rt.Route+"|"+key
+				}
+			}
+			if rl == nil || allowRate(w, r, rl, key) {
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// ConcurrencyLimit returns middleware that enforces each route's
+// concurrency limit, or global for routes without one, letting requests
+// wait up to maxWait for a slot. Exempt routes are not limited.
+func (rp *RoutePolicies) ConcurrencyLimit(global *ConcurrencyLimiter, maxWait time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cl := global
+			if rt := rp.match(r); rt != nil {
+				switch {
+				case rt.Exempt:
+					next.ServeHTTP(w, r)
+					return
+				case rt.concurrency != nil:
+					cl = rt.concurrency
+				}
+			}
+			cl.serve(w, r, maxWait, next)
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newLocalLimiter(rate, burst int) Limiter {
+	return NewRateLimiter(rate, burst)
+}
+
+func TestLoadRoutePolicies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.json")
+	data := `[{"route": "POST /convert", "rate_limit": 2, "rate_burst": 5, "max_concurrent": 20},
+		{"route": "/metrics", "exempt": true}]`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	policies, err := LoadRoutePolicies(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RoutePolicy{
+		{Route: "POST /convert", RateLimit: 2, RateBurst: 5, MaxConcurrent: 20},
+		{Route: "/metrics", Exempt: true},
+	}
+	if len(policies) != len(want) || policies[0] != want[0] || policies[1] != want[1] {
+		t.Errorf("got %+v, want %+v", policies, want)
+	}
+
+	os.WriteFile(path, []byte(`{"route": "/"}`), 0o600)
+	if _, err := LoadRoutePolicies(path); err == nil {
+		t.Error("expected error for a non-array file")
+	}
+}
+
+func TestNewRoutePolicies_Invalid(t *testing.T) {
+	for name, policies := range map[string][]RoutePolicy{
+		"invalid pattern":  {{Route: "GET"}},
+		"conflict":         {{Route: "GET /a/{x}"}, {Route: "GET /{y}/b"}},
+		"negative limit":   {{Route: "/info", RateLimit: -1}},
+		"negative maximum": {{Route: "/info", MaxConcurrent: -1}},
+	} {
+		if _, err := NewRoutePolicies(policies, newLocalLimiter); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestRoutePolicies_RateLimit(t *testing.T) {
+	rp, err := NewRoutePolicies(append(DefaultRoutePolicies(),
+		RoutePolicy{Route: "POST /convert", RateLimit: 1, RateBurst: 2},
+		RoutePolicy{Route: "/ready", RateLimit: 1}, // replaces the exemption
+	), newLocalLimiter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := rp.RateLimit(NewRateLimiter(1, 1))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(method, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = "203.0.113.5:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// The global burst of 1
+	if code := serve(http.MethodGet, "/info"); code != http.StatusOK {
+		t.Errorf("GET /info: %d", code)
+	}
+	if code := serve(http.MethodGet, "/convert"); code != http.StatusTooManyRequests {
+		t.Errorf("GET /convert shares the global limit: %d, want 429", code)
+	}
+	// POST /convert has its own burst of 2
+	for i := 0; i < 2; i++ {
+		if code := serve(http.MethodPost, "/convert"); code != http.StatusOK {
+			t.Errorf("POST /convert %d: %d", i+1, code)
+		}
+	}
+	if code := serve(http.MethodPost, "/convert"); code != http.StatusTooManyRequests {
+		t.Errorf("POST /convert over its limit: %d, want 429", code)
+	}
+	// Probes are exempt
+	for i := 0; i < 5; i++ {
+		if code := serve(http.MethodGet, "/health"); code != http.StatusOK {
+			t.Errorf("GET /health %d: %d", i+1, code)
+		}
+	}
+	if serve(http.MethodGet, "/ready") != http.StatusOK || serve(http.MethodGet, "/ready") != http.StatusTooManyRequests {
+		t.Error("policy for /ready did not replace the exemption")
+	}
+}
+
+func TestRoutePolicies_ConcurrencyLimit(t *testing.T) {
+	rp, err := NewRoutePolicies(append(DefaultRoutePolicies(),
+		RoutePolicy{Route: "/info", MaxConcurrent: 1},
+	), newLocalLimiter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	handler := rp.ConcurrencyLimit(NewConcurrencyLimiter(1), 0)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/convert" || r.URL.Path == "/info" {
+			started <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(path string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	// Fill the global slot and the /info slot
+	done := make(chan int, 2)
+	go func() { done <- serve("/convert") }()
+	go func() { done <- serve("/info") }()
+	<-started
+	<-started
+
+	if code := serve("/convert"); code != http.StatusServiceUnavailable {
+		t.Errorf("/convert over the global limit: %d, want 503", code)
+	}
+	if code := serve("/info"); code != http.StatusServiceUnavailable {
+		t.Errorf("/info over its own limit: %d, want 503", code)
+	}
+	for _, path := range []string{"/health", "/ready", "/metrics"} {
+		if code := serve(path); code != http.StatusOK {
+			t.Errorf("%s while the limits are full: %d, want 200", path, code)
+		}
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		select {
+		case code := <-done:
+			if code != http.StatusOK {
+				t.Errorf("held request: %d", code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("held requests did not finish")
+		}
+	}
+}
@@ -1,7 +1,7 @@
 package middleware
 
 import (
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
 	"sync"
@@ -10,7 +10,15 @@ import (
 	"github.com/harliandi/go-heif/pkg/metrics"
 )
 
-// RateLimiter implements token bucket rate limiting per IP address
+// Limiter decides whether a client, identified by key, may make another
+// request
+type Limiter interface {
+	Allow(key string) bool
+}
+
+// RateLimiter implements token bucket rate limiting per IP address in
+// process memory. With several replicas each keeps its own buckets; see
+// RedisLimiter for limits shared between them.
 type RateLimiter struct {
 	mu     sync.Mutex
 	limits map[string]*bucket
@@ -95,28 +103,6 @@ func (rl *RateLimiter) cleanup() {
 	}
 }
 
-// getIP extracts the client IP from the request
-func getIP(r *http.Request) string {
-	// Check X-Forwarded-For header (for proxies/load balancers)
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		// Take the first IP
-		for i, c := range xff {
-			if c == ' ' || c == ',' {
-				return xff[:i]
-			}
-		}
-		return xff
-	}
-
-	// Check X-Real-IP header
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return xri
-	}
-
-	// Fall back to RemoteAddr
-	return r.RemoteAddr
-}
-
 // getIPPrefix extracts the first octet of an IP for privacy-preserving metrics
 func getIPPrefix(ip string) string {
 	// Remove port if present
@@ -136,24 +122,34 @@ func getIPPrefix(ip string) string {
 
 // RateLimit returns middleware that enforces rate limiting
 func RateLimit(rate, burst int) func(http.Handler) http.Handler {
-	rl := NewRateLimiter(rate, burst)
+	return RateLimitWith(NewRateLimiter(rate, burst))
+}
 
+// RateLimitWith returns middleware that enforces rate limiting per client
+// with rl, keyed by ClientKey
+func RateLimitWith(rl Limiter) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ip := getIP(r)
-
-			if !rl.Allow(ip) {
-				log.Printf("Rate limit exceeded for IP: %s", ip)
-				// Record metric for rate limit exceeded
-				metrics.RecordRateLimitExceeded(getIPPrefix(ip))
-				w.Header().Set("Content-Type", "application/json")
-				w.Header().Set("Retry-After", "1")
-				w.WriteHeader(http.StatusTooManyRequests)
-				w.Write([]byte(`{"error":"Rate limit exceeded"}`))
-				return
+			if allowRate(w, r, rl, ClientKey(r)) {
+				next.ServeHTTP(w, r)
 			}
-
-			next.ServeHTTP(w, r)
 		})
 	}
 }
+
+// allowRate checks key against rl, writing a 429 response if it is over
+// the limit
+func allowRate(w http.ResponseWriter, r *http.Request, rl Limiter, key string) bool {
+	if rl.Allow(key) {
+		return true
+	}
+	ip := ClientIP(r)
+	slog.InfoContext(r.Context(), "rate limit exceeded", "client_ip", ip, "client", key)
+	// Record metric for rate limit exceeded
+	metrics.RecordRateLimitExceeded(getIPPrefix(ip))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", "1")
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte(`{"error":"Rate limit exceeded"}`))
+	return false
+}
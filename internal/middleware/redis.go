@@ -0,0 +1,324 @@
+package middleware
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Redis limiter defaults
+const (
+	redisTimeout = 200 * time.Millisecond // per command, dial included
+	// redisRetry is how long local state is used after Redis fails
+	redisRetry    = 5 * time.Second
+	redisMaxIdle  = 16
+	redisKeyspace = "heif:ratelimit:"
+)
+
+// tokenBucketScript takes one token from the bucket in KEYS[1], refilled
+// at ARGV[1] tokens per second up to ARGV[2], and returns 1 if there was
+// one. The Redis clock is used so replicas agree on the refill.
+const tokenBucketScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(b[1]) or burst
+local ts = tonumber(b[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('EXPIRE', KEYS[1], math.ceil(burst / rate) + 1)
+return allowed
+`
+
+// tokenBucket runs tokenBucketScript
+var tokenBucket = newRedisScript(tokenBucketScript)
+
+// RedisLimiter implements token bucket rate limiting shared by all
+// replicas through Redis. Each check runs one atomic Lua script. While
+// Redis is unreachable, requests are limited by fallback in each process.
+type RedisLimiter struct {
+	client   *redisClient
+	rate     int
+	burst    int
+	fallback Limiter
+	down     redisOutage
+}
+
+// NewRedisLimiter creates a limiter with rate tokens per second and burst
+// per key, stored in the Redis server at rawURL
+// (redis://[:password@]host:port[/db]). fallback limits requests while
+// Redis is unreachable.
+func NewRedisLimiter(rawURL string, rate, burst int, fallback Limiter) (*RedisLimiter, error) {
+	client, err := newRedisClient(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisLimiter{client: client, rate: rate, burst: burst, fallback: fallback}, nil
+}
+
+// Allow checks if a request for key should be allowed
+func (rl *RedisLimiter) Allow(key string) bool {
+	if !rl.down.skip() {
+		reply, err := rl.client.eval(tokenBucket, []string{redisKeyspace + key}, strconv.Itoa(rl.rate), strconv.Itoa(rl.burst))
+		if err == nil {
+			if n, ok := reply.(int64); ok {
+				return n == 1
+			}
+			err = fmt.Errorf("unexpected script reply %v", reply)
+		}
+		rl.down.failed("rate limiter", err)
+	}
+	return rl.fallback.Allow(key)
+}
+
+// Close closes the idle connections
+func (rl *RedisLimiter) Close() {
+	rl.client.Close()
+}
+
+// redisOutage tracks a Redis failure, so a store falls back to local
+// state for a while instead of retrying Redis on every request
+type redisOutage struct {
+	mu    sync.Mutex
+	until time.Time // Redis is skipped until then after a failure
+}
+
+// skip reports whether Redis failed recently
+func (o *redisOutage) skip() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return time.Now().Before(o.until)
+}
+
+// failed records a failure of the Redis-backed what
+func (o *redisOutage) failed(what string, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if time.Now().After(o.until) {
+		slog.Warn("Redis unavailable, using local state", "store", what, "retry_sec", redisRetry.Seconds(), "error", err)
+	}
+	o.until = time.Now().Add(redisRetry)
+}
+
+// redisScript is a Lua script with its SHA-1, for EVALSHA
+type redisScript struct {
+	src string
+	sha string
+}
+
+func newRedisScript(src string) redisScript {
+	sum := sha1.Sum([]byte(src))
+	return redisScript{src: src, sha: hex.EncodeToString(sum[:])}
+}
+
+// redisClient is a minimal Redis client keeping a pool of connections
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+// newRedisClient creates a client for the server at rawURL
+// (redis://[:password@]host:port[/db])
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("invalid Redis URL %q", rawURL)
+	}
+	rc := &redisClient{addr: u.Host}
+	if _, _, err := net.SplitHostPort(rc.addr); err != nil {
+		rc.addr = net.JoinHostPort(rc.addr, "6379")
+	}
+	if u.User != nil {
+		rc.password, _ = u.User.Password()
+		if rc.password == "" {
+			rc.password = u.User.Username()
+		}
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if rc.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid Redis database %q", db)
+		}
+	}
+	return rc, nil
+}
+
+// do sends a command on a pooled connection and returns its reply
+func (rc *redisClient) do(args ...string) (any, error) {
+	c, err := rc.conn()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(args...)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		c.close() // the connection is in an unknown state
+		return nil, err
+	}
+	rc.put(c)
+	return reply, err
+}
+
+// eval runs script, sending its source only if the server has not cached
+// it yet
+func (rc *redisClient) eval(script redisScript, keys []string, args ...string) (any, error) {
+	cmd := append([]string{"EVALSHA", script.sha, strconv.Itoa(len(keys))}, keys...)
+	cmd = append(cmd, args...)
+	reply, err := rc.do(cmd...)
+	var rerr redisError
+	if errors.As(err, &rerr) && strings.HasPrefix(string(rerr), "NOSCRIPT") {
+		// First use on this server: send the script, which caches it
+		cmd[0], cmd[1] = "EVAL", script.src
+		reply, err = rc.do(cmd...)
+	}
+	return reply, err
+}
+
+// conn returns an idle connection or dials a new one
+func (rc *redisClient) conn() (*redisConn, error) {
+	rc.mu.Lock()
+	if n := len(rc.idle); n > 0 {
+		c := rc.idle[n-1]
+		rc.idle = rc.idle[:n-1]
+		rc.mu.Unlock()
+		return c, nil
+	}
+	rc.mu.Unlock()
+
+	nc, err := net.DialTimeout("tcp", rc.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: nc, r: bufio.NewReader(nc)}
+	if rc.password != "" {
+		if _, err := c.do("AUTH", rc.password); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	if rc.db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(rc.db)); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// put returns a connection to the idle pool
+func (rc *redisClient) put(c *redisConn) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if len(rc.idle) >= redisMaxIdle {
+		c.close()
+		return
+	}
+	rc.idle = append(rc.idle, c)
+}
+
+// Close closes the idle connections
+func (rc *redisClient) Close() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for _, c := range rc.idle {
+		c.close()
+	}
+	rc.idle = nil
+}
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// redisConn speaks RESP, the Redis protocol, over one connection
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// do sends a command and reads its reply: a string, int64, []any, nil,
+// or a redisError
+func (c *redisConn) do(args ...string) (any, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+	return readRESP(c.r)
+}
+
+func (c *redisConn) close() {
+	c.conn.Close()
+}
+
+// readRESP reads one RESP value
+func readRESP(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty RESP line")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err // nil bulk string
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err // nil array
+		}
+		values := make([]any, n)
+		for i := range values {
+			if values[i], err = readRESP(r); err != nil {
+				var rerr redisError
+				if !errors.As(err, &rerr) {
+					return nil, err
+				}
+				values[i] = rerr
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("invalid RESP type %q", line[0])
+}
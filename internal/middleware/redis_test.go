@@ -0,0 +1,376 @@
+package middleware
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process Redis stand-in speaking RESP. It runs the
+// semantics of the limiter's and ban store's scripts in Go, keyed by the
+// script's SHA-1 like Redis' script cache, and the string commands they
+// use.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu       sync.Mutex
+	scripts  map[string]bool
+	buckets  map[string]*bucket
+	values   map[string]*fakeValue
+	commands []string
+}
+
+// fakeValue is a string value with an optional expiry
+type fakeValue struct {
+	value   string
+	expires time.Time
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, password: password, scripts: make(map[string]bool),
+		buckets: make(map[string]*bucket), values: make(map[string]*fakeValue)}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	t.Cleanup(f.close)
+	return f
+}
+
+func (f *fakeRedis) url() string {
+	if f.password != "" {
+		return "redis://:" + f.password + "@" + f.ln.Addr().String() + "/2"
+	}
+	return "redis://" + f.ln.Addr().String()
+}
+
+func (f *fakeRedis) close() {
+	f.ln.Close()
+}
+
+func (f *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	authed := f.password == ""
+	for {
+		v, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		items, _ := v.([]any)
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+		if len(args) == 0 {
+			return
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, strings.ToUpper(args[0]))
+		f.mu.Unlock()
+		var reply string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			authed = args[1] == f.password
+			reply = "+OK\r\n"
+			if !authed {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case cmd == "SELECT":
+			reply = "+OK\r\n"
+		case cmd == "EVAL" || cmd == "EVALSHA":
+			reply = f.eval(cmd, args[1:])
+		case cmd == "SET" || cmd == "GET" || cmd == "DEL" || cmd == "SCAN":
+			reply = f.strings(cmd, args[1:])
+		default:
+			reply = "-ERR unknown command '" + args[0] + "'\r\n"
+		}
+		if _, err := c.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+// eval runs a script: EVAL script 1 key args...
+func (f *fakeRedis) eval(cmd string, args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sha := args[0]
+	if cmd == "EVAL" {
+		switch args[0] {
+		case tokenBucket.src:
+			sha = tokenBucket.sha
+		case strikeScript.src:
+			sha = strikeScript.sha
+		default:
+			return "-ERR unexpected script\r\n"
+		}
+		f.scripts[sha] = true
+	} else if !f.scripts[sha] {
+		return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+	}
+	key := args[2]
+	now := time.Now()
+	if sha == strikeScript.sha {
+		v := f.get(key)
+		n, _ := strconv.Atoi(v)
+		n++
+		ms, _ := strconv.Atoi(args[3])
+		if n == 1 {
+			f.values[key] = &fakeValue{value: "1", expires: now.Add(time.Duration(ms) * time.Millisecond)}
+		} else {
+			f.values[key].value = strconv.Itoa(n)
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	}
+	rate, _ := strconv.ParseFloat(args[3], 64)
+	burst, _ := strconv.ParseFloat(args[4], 64)
+	b, ok := f.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, lastRef: now}
+		f.buckets[key] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.lastRef).Seconds()*rate)
+	b.lastRef = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return ":1\r\n"
+	}
+	return ":0\r\n"
+}
+
+// get returns the value of key, or "" if it is missing or expired; f.mu
+// must be held
+func (f *fakeRedis) get(key string) string {
+	v, ok := f.values[key]
+	if !ok {
+		return ""
+	}
+	if !v.expires.IsZero() && !time.Now().Before(v.expires) {
+		delete(f.values, key)
+		return ""
+	}
+	return v.value
+}
+
+// strings runs SET key value PX ms, GET key, DEL key and
+// SCAN cursor MATCH prefix* COUNT n, returning every key in one page
+func (f *fakeRedis) strings(cmd string, args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch cmd {
+	case "SET":
+		v := &fakeValue{value: args[1]}
+		if len(args) == 4 && strings.EqualFold(args[2], "PX") {
+			ms, _ := strconv.Atoi(args[3])
+			v.expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		f.values[args[0]] = v
+		return "+OK\r\n"
+	case "GET":
+		v := f.get(args[0])
+		if v == "" {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "DEL":
+		n := 0
+		for _, key := range args {
+			if f.get(key) != "" {
+				delete(f.values, key)
+				n++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	}
+	prefix := strings.TrimSuffix(args[2], "*")
+	var b strings.Builder
+	var keys []string
+	for key := range f.values {
+		if strings.HasPrefix(key, prefix) && f.get(key) != "" {
+			keys = append(keys, key)
+		}
+	}
+	fmt.Fprintf(&b, "*2\r\n$1\r\n0\r\n*%d\r\n", len(keys))
+	for _, key := range keys {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(key), key)
+	}
+	return b.String()
+}
+
+func (f *fakeRedis) count(cmd string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, c := range f.commands {
+		if c == cmd {
+			n++
+		}
+	}
+	return n
+}
+
+// countingLimiter records the keys it is asked about
+type countingLimiter struct {
+	mu   sync.Mutex
+	keys []string
+}
+
+func (l *countingLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.keys = append(l.keys, key)
+	return true
+}
+
+func (l *countingLimiter) calls() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.keys)
+}
+
+func TestNewRedisLimiter(t *testing.T) {
+	tests := []struct {
+		url      string
+		addr     string
+		password string
+		db       int
+	}{
+		{"redis://cache", "cache:6379", "", 0},
+		{"redis://:secret@cache:6380/3", "cache:6380", "secret", 3},
+		{"redis://secret@cache", "cache:6379", "secret", 0},
+	}
+	for _, tt := range tests {
+		rl, err := NewRedisLimiter(tt.url, 1, 1, nil)
+		if err != nil {
+			t.Errorf("%s: %v", tt.url, err)
+			continue
+		}
+		if c := rl.client; c.addr != tt.addr || c.password != tt.password || c.db != tt.db {
+			t.Errorf("%s: got %s %q %d, want %s %q %d", tt.url, c.addr, c.password, c.db, tt.addr, tt.password, tt.db)
+		}
+	}
+	for _, bad := range []string{"cache:6379", "http://cache", "redis://cache/x"} {
+		if _, err := NewRedisLimiter(bad, 1, 1, nil); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
+
+func TestRedisLimiter_SharedBuckets(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	fallback := &countingLimiter{}
+	// Two replicas share the bucket of each client
+	a, err := NewRedisLimiter(f.url(), 1, 3, fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := NewRedisLimiter(f.url(), 1, 3, fallback)
+	defer a.Close()
+	defer b.Close()
+
+	for i, l := range []*RedisLimiter{a, b, a} {
+		if !l.Allow("1.2.3.4") {
+			t.Errorf("request %d denied within the burst", i+1)
+		}
+	}
+	if a.Allow("1.2.3.4") || b.Allow("1.2.3.4") {
+		t.Error("replicas allowed more than the shared burst")
+	}
+	if !b.Allow("5.6.7.8") {
+		t.Error("clients share a bucket")
+	}
+	if fallback.calls() != 0 {
+		t.Errorf("fallback used %d times while Redis is up", fallback.calls())
+	}
+	// The server caches the script once sent, then runs it by its SHA-1
+	if n := f.count("EVAL"); n != 1 {
+		t.Errorf("EVAL sent %d times, want 1", n)
+	}
+	// Connections are reused
+	if n := f.count("AUTH"); n != 2 {
+		t.Errorf("AUTH sent %d times, want one per replica connection", n)
+	}
+}
+
+func TestRedisLimiter_Fallback(t *testing.T) {
+	f := newFakeRedis(t, "")
+	fallback := &countingLimiter{}
+	rl, err := NewRedisLimiter(f.url(), 1, 1, fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+	if !rl.Allow("a") || rl.Allow("a") {
+		t.Fatal("Redis bucket not applied")
+	}
+
+	// Redis goes away: requests are limited locally, without retrying
+	// Redis on every request
+	f.close()
+	rl.Close()
+	if !rl.Allow("a") {
+		t.Error("fallback limiter not used while Redis is unreachable")
+	}
+	rl.Allow("a")
+	if fallback.calls() != 2 {
+		t.Errorf("fallback used %d times, want 2", fallback.calls())
+	}
+	rl.down.mu.Lock()
+	down := time.Until(rl.down.until)
+	rl.down.mu.Unlock()
+	if down <= 0 || down > redisRetry {
+		t.Errorf("Redis retried in %v, want within %v", down, redisRetry)
+	}
+}
+
+func TestRedisLimiter_Unreachable(t *testing.T) {
+	// Nothing listens on the address
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	fallback := &countingLimiter{}
+	rl, err := NewRedisLimiter(fmt.Sprintf("redis://%s", addr), 1, 1, fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := RateLimitWith(rl)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/convert", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("request %d: status %d, want the fallback's decision", i+1, w.Code)
+		}
+	}
+	if fallback.calls() != 3 {
+		t.Errorf("fallback used %d times, want 3", fallback.calls())
+	}
+}
@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/harliandi/go-heif/internal/logging"
+)
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = logging.RequestID(r.Context())
+	}))
+	serve := func(incoming string) string {
+		req := httptest.NewRequest(http.MethodPost, "/convert", nil)
+		if incoming != "" {
+			req.Header.Set(RequestIDHeader, incoming)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if got := w.Header().Get(RequestIDHeader); got != seen {
+			t.Errorf("response ID %q, context ID %q", got, seen)
+		}
+		return seen
+	}
+
+	if id := serve("edge-1234:abcd"); id != "edge-1234:abcd" {
+		t.Errorf("incoming ID replaced with %q", id)
+	}
+	first := serve("")
+	if len(first) != 36 {
+		t.Errorf("generated ID %q, want a UUID", first)
+	}
+	if second := serve(""); second == first {
+		t.Error("generated IDs repeat")
+	}
+	for _, bad := range []string{"has space", "new\nline", `quote"`, strings.Repeat("a", maxRequestIDLen+1)} {
+		if id := serve(bad); id == bad {
+			t.Errorf("invalid incoming ID %q kept", bad)
+		}
+	}
+}
+
+func TestLogger_RequestAttrs(t *testing.T) {
+	var buf bytes.Buffer
+	logger, _ := logging.New(&buf, "json", slog.LevelInfo)
+	// SetDefault also redirects the log package, which restoring the
+	// default logger does not undo
+	defer log.SetOutput(log.Writer())
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(logger)
+
+	handler := RequestID(Logger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Attributes added deeper in the chain reach the access log
+		logging.Add(r.Context(), "tenant", "acme")
+		w.Write([]byte("hello"))
+	})))
+	req := httptest.NewRequest(http.MethodPost, "/convert", nil)
+	req.Header.Set(RequestIDHeader, "req-42")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	var rec map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("%v: %s", err, buf.Bytes())
+	}
+	want := map[string]any{
+		"msg":        "request",
+		"request_id": "req-42",
+		"tenant":     "acme",
+		"method":     "POST",
+		"path":       "/convert",
+		"status":     200.0,
+		"bytes_out":  5.0,
+	}
+	for k, v := range want {
+		if rec[k] != v {
+			t.Errorf("%s = %v, want %v", k, rec[k], v)
+		}
+	}
+	if _, ok := rec["duration_ms"].(float64); !ok {
+		t.Errorf("duration_ms missing: %s", buf.Bytes())
+	}
+}
@@ -0,0 +1,206 @@
+//go:build cgo && !purego
+
+package jpeg
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+// TestEncodeYCbCr_MatchesStdlib checks that libjpeg-turbo output decodes to
+// the same picture as the standard library encoder for every subsampling
+func TestEncodeYCbCr_MatchesStdlib(t *testing.T) {
+	ratios := []image.YCbCrSubsampleRatio{
+		image.YCbCrSubsampleRatio444,
+		image.YCbCrSubsampleRatio422,
+		image.YCbCrSubsampleRatio420,
+		image.YCbCrSubsampleRatio440,
+	}
+	sizes := []struct{ w, h int }{{256, 128}, {333, 257}, {17, 9}}
+
+	for _, ratio := range ratios {
+		for _, size := range sizes {
+			t.Run(fmt.Sprintf("%v/%dx%d", ratio, size.w, size.h), func(t *testing.T) {
+				src := testPattern(size.w, size.h, ratio)
+
+				turboData, err := EncodeYCbCr(src, 90)
+				if err != nil {
+					t.Fatalf("EncodeYCbCr failed: %v", err)
+				}
+				turboImg, err := jpeg.Decode(bytes.NewReader(turboData))
+				if err != nil {
+					t.Fatalf("turbo output is not valid JPEG: %v", err)
+				}
+
+				var stdBuf bytes.Buffer
+				if err := jpeg.Encode(&stdBuf, src, &jpeg.Options{Quality: 90}); err != nil {
+					t.Fatalf("std encode failed: %v", err)
+				}
+				stdImg, err := jpeg.Decode(&stdBuf)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				turboPSNR, stdPSNR := psnr(t, src, turboImg), psnr(t, src, stdImg)
+				t.Logf("PSNR turbo=%.1fdB std=%.1fdB", turboPSNR, stdPSNR)
+				if turboPSNR < 30 || turboPSNR < stdPSNR-2 {
+					t.Errorf("turbo PSNR %.1fdB too low (std %.1fdB)", turboPSNR, stdPSNR)
+				}
+			})
+		}
+	}
+}
+
+// TestEncodeYCbCr_SubImage checks that cropped images are encoded from
+// their own origin
+func TestEncodeYCbCr_SubImage(t *testing.T) {
+	src := testPattern(320, 240, image.YCbCrSubsampleRatio420)
+	sub := src.SubImage(image.Rect(64, 32, 256, 160)).(*image.YCbCr)
+
+	data, err := EncodeYCbCr(sub, 90)
+	if err != nil {
+		t.Fatalf("EncodeYCbCr failed: %v", err)
+	}
+	decoded, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := psnr(t, sub, decoded); p < 30 {
+		t.Errorf("PSNR %.1fdB too low for cropped image", p)
+	}
+}
+
+func TestEncodeYCbCr_Errors(t *testing.T) {
+	if _, err := EncodeYCbCr(image.NewYCbCr(image.Rect(0, 0, 0, 0), image.YCbCrSubsampleRatio420), 85); err == nil {
+		t.Error("expected error for empty image")
+	}
+	bad := image.NewYCbCr(image.Rect(0, 0, 16, 16), image.YCbCrSubsampleRatio420)
+	bad.SubsampleRatio = image.YCbCrSubsampleRatio(99)
+	if _, err := EncodeYCbCr(bad, 85); err == nil {
+		t.Error("expected error for unknown subsample ratio")
+	}
+}
+
+// TestEncodeYCbCrWithOptions checks that each option reaches libjpeg
+func TestEncodeYCbCrWithOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    Options
+		samp    byte
+		sofType byte
+	}{
+		{"progressive", Options{Quality: 85, Progressive: true}, 0x22, 0xC2},
+		{"444", Options{Quality: 85, Subsampling: Subsampling444}, 0x11, 0xC0},
+		{"422", Options{Quality: 85, Subsampling: Subsampling422}, 0x21, 0xC0},
+		{"optimized ifast", Options{Quality: 85, OptimizeHuffman: true, DCTMethod: DCTIFast}, 0x22, 0xC0},
+		{"float restart", Options{Quality: 85, DCTMethod: DCTFloat, RestartInterval: 2}, 0x22, 0xC0},
+		{"density", Options{Quality: 85, DensityUnit: DensityCm, XDensity: 118, YDensity: 118}, 0x22, 0xC0},
+		{"robidoux", Options{Quality: 85, QuantTable: QuantRobidoux}, 0x22, 0xC0},
+		{"max compression", MaxCompression(85), 0x22, 0xC2},
+	}
+
+	src := testPattern(203, 141, image.YCbCrSubsampleRatio420)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := EncodeYCbCrWithOptions(src, &tt.opts)
+			if err != nil {
+				t.Fatalf("EncodeYCbCrWithOptions failed: %v", err)
+			}
+			decoded, err := jpeg.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("output is not valid JPEG: %v", err)
+			}
+			if p := psnr(t, src, decoded); p < 30 {
+				t.Errorf("PSNR %.1fdB too low", p)
+			}
+			if sof := segment(t, data, tt.sofType); sof[7] != tt.samp {
+				t.Errorf("luma sampling %#x, want %#x", sof[7], tt.samp)
+			}
+			if tt.opts.RestartInterval > 0 && !bytes.Contains(markers(data), []byte{0xD0}) {
+				t.Error("no restart markers written")
+			}
+			if tt.opts.DensityUnit != DensityNone {
+				if app0 := segment(t, data, 0xE0); int(app0[7]) != tt.opts.DensityUnit || int(app0[8])<<8|int(app0[9]) != tt.opts.XDensity {
+					t.Errorf("density not written: %v", app0[7:12])
+				}
+			}
+		})
+	}
+
+	if _, err := EncodeYCbCrWithOptions(src, &Options{Quality: 85, RestartInterval: -1}); err == nil {
+		t.Error("expected error for invalid options")
+	}
+}
+
+// TestEncodeYCbCr_Trellis checks that libjpeg-turbo writes the trellis
+// quantized coefficients unchanged: the result decodes to exactly the same
+// pixels as the pure Go encoder's output
+func TestEncodeYCbCr_Trellis(t *testing.T) {
+	for _, ratio := range []image.YCbCrSubsampleRatio{image.YCbCrSubsampleRatio420, image.YCbCrSubsampleRatio444} {
+		for _, size := range []struct{ w, h int }{{320, 240}, {203, 141}} {
+			t.Run(fmt.Sprintf("%v/%dx%d", ratio, size.w, size.h), func(t *testing.T) {
+				src := texturedPattern(size.w, size.h)
+				opts := MaxCompression(80)
+				opts.Subsampling = Subsampling420
+				if ratio == image.YCbCrSubsampleRatio444 {
+					// image/jpeg miscounts restart intervals in progressive
+					// scans of subsampled components, so only test them here
+					opts.Subsampling = Subsampling444
+					opts.RestartInterval = 7
+				}
+
+				turboData, err := EncodeYCbCrWithOptions(src, &opts)
+				if err != nil {
+					t.Fatalf("EncodeYCbCrWithOptions failed: %v", err)
+				}
+				var goBuf bytes.Buffer
+				if err := EncodeGo(&goBuf, src, &opts); err != nil {
+					t.Fatal(err)
+				}
+				turboImg, err := jpeg.Decode(bytes.NewReader(turboData))
+				if err != nil {
+					t.Fatalf("turbo output is not valid JPEG: %v", err)
+				}
+				goImg, err := jpeg.Decode(&goBuf)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				a, b := turboImg.(*image.YCbCr), goImg.(*image.YCbCr)
+				if !bytes.Equal(a.Y, b.Y) || !bytes.Equal(a.Cb, b.Cb) || !bytes.Equal(a.Cr, b.Cr) {
+					t.Error("turbo and Go outputs decode to different pixels")
+				}
+				segment(t, turboData, 0xC2) // progressive
+				t.Logf("turbo %d bytes, Go %d bytes", len(turboData), goBuf.Len())
+			})
+		}
+	}
+}
+
+// BenchmarkEncode compares both backends on a synthetic 12MP image
+func BenchmarkEncode(b *testing.B) {
+	for _, ratio := range []image.YCbCrSubsampleRatio{image.YCbCrSubsampleRatio420, image.YCbCrSubsampleRatio444} {
+		img := testPattern(4000, 3000, ratio)
+		b.Run(fmt.Sprintf("turbo/%v", ratio), func(b *testing.B) {
+			b.SetBytes(int64(len(img.Y)))
+			for i := 0; i < b.N; i++ {
+				if _, err := EncodeYCbCr(img, 85); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("std/%v", ratio), func(b *testing.B) {
+			b.SetBytes(int64(len(img.Y)))
+			var buf bytes.Buffer
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package jpeg
+
+// Forward DCTs used by the pure Go encoder, following libjpeg's jfdctint.c
+// (accurate integer, Loeffler-Ligtenberg-Moschytz) and jfdctflt.c
+// (Arai-Agui-Nakajima floating point).
+
+const (
+	constBits = 13
+	pass1Bits = 2
+
+	fix0298631336 = 2446
+	fix0390180644 = 3196
+	fix0541196100 = 4433
+	fix0765366865 = 6270
+	fix0899976223 = 7373
+	fix1175875602 = 9633
+	fix1501321110 = 12299
+	fix1847759065 = 15137
+	fix1961570560 = 16069
+	fix2053119869 = 16819
+	fix2562915447 = 20995
+	fix3072711026 = 25172
+)
+
+func descale(x, n int) int {
+	return (x + 1<<(n-1)) >> n
+}
+
+// fdctInt transforms a block of level-shifted samples in place. The output
+// is scaled up by 8 relative to a true DCT.
+func fdctInt(b *[64]int) {
+	// Pass 1: rows, results scaled up by 2^pass1Bits
+	for y := 0; y < 8; y++ {
+		r := b[y*8 : y*8+8 : y*8+8]
+		tmp0, tmp7 := r[0]+r[7], r[0]-r[7]
+		tmp1, tmp6 := r[1]+r[6], r[1]-r[6]
+		tmp2, tmp5 := r[2]+r[5], r[2]-r[5]
+		tmp3, tmp4 := r[3]+r[4], r[3]-r[4]
+
+		tmp10, tmp13 := tmp0+tmp3, tmp0-tmp3
+		tmp11, tmp12 := tmp1+tmp2, tmp1-tmp2
+
+		r[0] = (tmp10 + tmp11) << pass1Bits
+		r[4] = (tmp10 - tmp11) << pass1Bits
+		z1 := (tmp12 + tmp13) * fix0541196100
+		r[2] = descale(z1+tmp13*fix0765366865, constBits-pass1Bits)
+		r[6] = descale(z1-tmp12*fix1847759065, constBits-pass1Bits)
+
+		r[7], r[5], r[3], r[1] = oddPart(tmp4, tmp5, tmp6, tmp7, constBits-pass1Bits)
+	}
+
+	// Pass 2: columns, removing the pass 1 scaling
+	for x := 0; x < 8; x++ {
+		tmp0, tmp7 := b[x]+b[56+x], b[x]-b[56+x]
+		tmp1, tmp6 := b[8+x]+b[48+x], b[8+x]-b[48+x]
+		tmp2, tmp5 := b[16+x]+b[40+x], b[16+x]-b[40+x]
+		tmp3, tmp4 := b[24+x]+b[32+x], b[24+x]-b[32+x]
+
+		tmp10, tmp13 := tmp0+tmp3, tmp0-tmp3
+		tmp11, tmp12 := tmp1+tmp2, tmp1-tmp2
+
+		b[x] = descale(tmp10+tmp11, pass1Bits)
+		b[32+x] = descale(tmp10-tmp11, pass1Bits)
+		z1 := (tmp12 + tmp13) * fix0541196100
+		b[16+x] = descale(z1+tmp13*fix0765366865, constBits+pass1Bits)
+		b[48+x] = descale(z1-tmp12*fix1847759065, constBits+pass1Bits)
+
+		b[56+x], b[40+x], b[24+x], b[8+x] = oddPart(tmp4, tmp5, tmp6, tmp7, constBits+pass1Bits)
+	}
+}
+
+// oddPart computes outputs 7, 5, 3 and 1 of the integer DCT
+func oddPart(tmp4, tmp5, tmp6, tmp7, shift int) (o7, o5, o3, o1 int) {
+	z1 := tmp4 + tmp7
+	z2 := tmp5 + tmp6
+	z3 := tmp4 + tmp6
+	z4 := tmp5 + tmp7
+	z5 := (z3 + z4) * fix1175875602
+
+	tmp4 *= fix0298631336
+	tmp5 *= fix2053119869
+	tmp6 *= fix3072711026
+	tmp7 *= fix1501321110
+	z1 *= -fix0899976223
+	z2 *= -fix2562915447
+	z3 = z3*-fix1961570560 + z5
+	z4 = z4*-fix0390180644 + z5
+
+	return descale(tmp4+z1+z3, shift), descale(tmp5+z2+z4, shift),
+		descale(tmp6+z2+z3, shift), descale(tmp7+z1+z4, shift)
+}
+
+// aanScale are the AAN output scale factors cos(k*pi/16)*sqrt(2), k>0
+var aanScale = [8]float64{
+	1.0, 1.387039845, 1.306562965, 1.175875602,
+	1.0, 0.785694958, 0.541196100, 0.275899379,
+}
+
+// fdctFloat transforms a block in place with the AAN algorithm. Output k
+// (row i, column j) is scaled by 8*aanScale[i]*aanScale[j].
+func fdctFloat(b *[64]float64) {
+	pass := func(get func(int) float64, set func(int, float64)) {
+		tmp0, tmp7 := get(0)+get(7), get(0)-get(7)
+		tmp1, tmp6 := get(1)+get(6), get(1)-get(6)
+		tmp2, tmp5 := get(2)+get(5), get(2)-get(5)
+		tmp3, tmp4 := get(3)+get(4), get(3)-get(4)
+
+		// Even part
+		tmp10, tmp13 := tmp0+tmp3, tmp0-tmp3
+		tmp11, tmp12 := tmp1+tmp2, tmp1-tmp2
+		set(0, tmp10+tmp11)
+		set(4, tmp10-tmp11)
+		z1 := (tmp12 + tmp13) * 0.707106781
+		set(2, tmp13+z1)
+		set(6, tmp13-z1)
+
+		// Odd part
+		tmp10 = tmp4 + tmp5
+		tmp11 = tmp5 + tmp6
+		tmp12 = tmp6 + tmp7
+		z5 := (tmp10 - tmp12) * 0.382683433
+		z2 := 0.541196100*tmp10 + z5
+		z4 := 1.306562965*tmp12 + z5
+		z3 := tmp11 * 0.707106781
+		z11, z13 := tmp7+z3, tmp7-z3
+		set(5, z13+z2)
+		set(3, z13-z2)
+		set(1, z11+z4)
+		set(7, z11-z4)
+	}
+	for y := 0; y < 8; y++ {
+		row := b[y*8 : y*8+8]
+		var out [8]float64
+		pass(func(i int) float64 { return row[i] }, func(i int, v float64) { out[i] = v })
+		copy(row, out[:])
+	}
+	for x := 0; x < 8; x++ {
+		var out [8]float64
+		pass(func(i int) float64 { return b[i*8+x] }, func(i int, v float64) { out[i] = v })
+		for i, v := range out {
+			b[i*8+x] = v
+		}
+	}
+}
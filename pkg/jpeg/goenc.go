@@ -0,0 +1,734 @@
+package jpeg
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"math"
+)
+
+// The pure Go encoder supports every Options setting, for builds without
+// libjpeg-turbo and for options image/jpeg lacks. Progressive output uses
+// spectral selection only (no successive approximation).
+
+// zigzag maps zigzag scan position to natural (row-major) coefficient index
+var zigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// baseQuant are the ITU T.81 Annex K quantization tables in natural order
+var baseQuant = [2][64]int{
+	{
+		16, 11, 10, 16, 24, 40, 51, 61,
+		12, 12, 14, 19, 26, 58, 60, 55,
+		14, 13, 16, 24, 40, 57, 69, 56,
+		14, 17, 22, 29, 51, 87, 80, 62,
+		18, 22, 37, 56, 68, 109, 103, 77,
+		24, 35, 55, 64, 81, 104, 113, 92,
+		49, 64, 78, 87, 103, 121, 120, 101,
+		72, 92, 95, 98, 112, 100, 103, 99,
+	},
+	{
+		17, 18, 24, 47, 99, 99, 99, 99,
+		18, 21, 26, 66, 99, 99, 99, 99,
+		24, 26, 56, 99, 99, 99, 99, 99,
+		47, 66, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// robidouxQuant is N. Robidoux's table from ImageMagick, used for both luma
+// and chroma as mozjpeg does
+var robidouxQuant = [64]int{
+	16, 16, 16, 18, 25, 37, 56, 85,
+	16, 17, 20, 27, 34, 40, 53, 75,
+	16, 20, 24, 31, 43, 62, 91, 135,
+	18, 27, 31, 40, 53, 74, 106, 156,
+	25, 34, 43, 53, 69, 94, 131, 189,
+	37, 40, 62, 74, 94, 124, 169, 238,
+	56, 53, 91, 106, 131, 169, 226, 311,
+	85, 75, 135, 156, 189, 238, 311, 418,
+}
+
+// quantTables scales the base tables like libjpeg's jpeg_set_quality
+// (baseline compatible: values are limited to 255)
+func quantTables(quality int, table QuantTable) [2][64]int {
+	quality = clampQuality(quality)
+	scale := 200 - 2*quality
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	base := baseQuant
+	if table == QuantRobidoux {
+		base = [2][64]int{robidouxQuant, robidouxQuant}
+	}
+	var q [2][64]int
+	for t := range q {
+		for i, v := range base[t] {
+			q[t][i] = min(max((v*scale+50)/100, 1), 255)
+		}
+	}
+	return q
+}
+
+// huffSpec is a Huffman table as stored in a DHT segment
+type huffSpec struct {
+	bits [16]uint8 // number of codes of each length 1..16
+	vals []uint8
+}
+
+// Standard Huffman tables (ITU T.81 Annex K.3)
+var (
+	stdDCLuma = huffSpec{
+		bits: [16]uint8{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		vals: []uint8{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	}
+	stdDCChroma = huffSpec{
+		bits: [16]uint8{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		vals: []uint8{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	}
+	stdACLuma = huffSpec{
+		bits: [16]uint8{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 0x7d},
+		vals: []uint8{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12, 0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08, 0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	}
+	stdACChroma = huffSpec{
+		bits: [16]uint8{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 0x77},
+		vals: []uint8{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21, 0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91, 0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34, 0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	}
+)
+
+// huffCode is the code table derived from a huffSpec
+type huffCode struct {
+	code [256]uint16
+	size [256]uint8
+}
+
+func (s *huffSpec) codes() *huffCode {
+	var h huffCode
+	code, k := uint16(0), 0
+	for length := 1; length <= 16; length++ {
+		for i := 0; i < int(s.bits[length-1]); i++ {
+			h.code[s.vals[k]] = code
+			h.size[s.vals[k]] = uint8(length)
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return &h
+}
+
+// optimalHuffman builds a length-limited Huffman table for the symbol
+// frequencies, following ITU T.81 Annex K.2 (as libjpeg does)
+func optimalHuffman(counts *[256]int) huffSpec {
+	var freq [257]int
+	copy(freq[:], counts[:])
+	freq[256] = 1 // reserved so that no code is all ones
+	var codesize [257]int
+	var others [257]int
+	for i := range others {
+		others[i] = -1
+	}
+
+	for {
+		// Find the two smallest nonzero frequencies (largest index on ties)
+		c1, c2 := -1, -1
+		for i, v := 0, int(^uint(0)>>1); i <= 256; i++ {
+			if freq[i] != 0 && freq[i] <= v {
+				v, c1 = freq[i], i
+			}
+		}
+		for i, v := 0, int(^uint(0)>>1); i <= 256; i++ {
+			if freq[i] != 0 && freq[i] <= v && i != c1 {
+				v, c2 = freq[i], i
+			}
+		}
+		if c2 < 0 {
+			break
+		}
+		freq[c1] += freq[c2]
+		freq[c2] = 0
+		codesize[c1]++
+		for others[c1] >= 0 {
+			c1 = others[c1]
+			codesize[c1]++
+		}
+		others[c1] = c2
+		codesize[c2]++
+		for others[c2] >= 0 {
+			c2 = others[c2]
+			codesize[c2]++
+		}
+	}
+
+	var bits [33]int
+	for i := 0; i <= 256; i++ {
+		if codesize[i] > 0 {
+			bits[codesize[i]]++
+		}
+	}
+	// Limit code lengths to 16 bits
+	for i := 32; i > 16; i-- {
+		for bits[i] > 0 {
+			j := i - 2
+			for bits[j] == 0 {
+				j--
+			}
+			bits[i] -= 2
+			bits[i-1]++
+			bits[j+1] += 2
+			bits[j]--
+		}
+	}
+	// Remove the reserved code
+	i := 16
+	for bits[i] == 0 {
+		i--
+	}
+	bits[i]--
+
+	var spec huffSpec
+	for l := 1; l <= 16; l++ {
+		spec.bits[l-1] = uint8(bits[l])
+	}
+	for l := 1; l <= 32; l++ {
+		for sym := 0; sym < 256; sym++ {
+			if codesize[sym] == l {
+				spec.vals = append(spec.vals, uint8(sym))
+			}
+		}
+	}
+	return spec
+}
+
+// component is one colour plane prepared for encoding
+type component struct {
+	id           uint8
+	h, v         int         // sampling factors
+	table        int         // 0 luma, 1 chroma (quantization and Huffman)
+	blocksW      int         // blocks per row in the MCU grid
+	blocksH      int         // block rows in the MCU grid
+	scanW, scanH int         // blocks covering the component itself (non-interleaved scans)
+	coef         [][64]int16 // quantized coefficients in zigzag order
+}
+
+// bitWriter writes entropy-coded data with 0xFF byte stuffing
+type bitWriter struct {
+	w   *bufio.Writer
+	acc uint32
+	n   uint
+}
+
+func (b *bitWriter) emit(code uint32, size uint8) {
+	b.acc = b.acc<<size | code&(1<<size-1)
+	b.n += uint(size)
+	for b.n >= 8 {
+		c := byte(b.acc >> (b.n - 8))
+		b.w.WriteByte(c)
+		if c == 0xFF {
+			b.w.WriteByte(0)
+		}
+		b.n -= 8
+	}
+}
+
+// flush pads the last byte with one bits
+func (b *bitWriter) flush() {
+	if b.n > 0 {
+		b.emit(1<<(8-b.n)-1, uint8(8-b.n))
+	}
+	b.acc = 0
+}
+
+// scanEncoder entropy codes one scan. With stats set it only counts symbols.
+type scanEncoder struct {
+	bw      *bitWriter
+	dc, ac  [2]*huffCode
+	stats   *[4][256]int // DC luma, DC chroma, AC luma, AC chroma
+	pred    [3]int
+	eobrun  int
+	restart int
+}
+
+func (e *scanEncoder) symbol(ac bool, table int, sym uint8) {
+	if e.stats != nil {
+		idx := table
+		if ac {
+			idx += 2
+		}
+		e.stats[idx][sym]++
+		return
+	}
+	h := e.dc[table]
+	if ac {
+		h = e.ac[table]
+	}
+	e.bw.emit(uint32(h.code[sym]), h.size[sym])
+}
+
+func (e *scanEncoder) bits(v uint32, n int) {
+	if e.stats == nil && n > 0 {
+		e.bw.emit(v, uint8(n))
+	}
+}
+
+// category returns the magnitude category of v and its JPEG bit pattern
+func category(v int) (int, uint32) {
+	a := v
+	if a < 0 {
+		a = -a
+		v--
+	}
+	n := 0
+	for a > 0 {
+		n++
+		a >>= 1
+	}
+	return n, uint32(v)
+}
+
+func (e *scanEncoder) encodeDC(c *component, ci int, blk *[64]int16) {
+	diff := int(blk[0]) - e.pred[ci]
+	e.pred[ci] = int(blk[0])
+	n, bits := category(diff)
+	e.symbol(false, c.table, uint8(n))
+	e.bits(bits, n)
+}
+
+// encodeAC codes coefficients ss..se of a block. Progressive scans pass
+// progressive=true so that runs of empty blocks become EOB runs.
+func (e *scanEncoder) encodeAC(c *component, blk *[64]int16, ss, se int, progressive bool) {
+	run := 0
+	for k := ss; k <= se; k++ {
+		v := int(blk[k])
+		if v == 0 {
+			run++
+			continue
+		}
+		if progressive {
+			e.flushEOBRun(c)
+		}
+		for run > 15 {
+			e.symbol(true, c.table, 0xF0)
+			run -= 16
+		}
+		n, bits := category(v)
+		e.symbol(true, c.table, uint8(run<<4|n))
+		e.bits(bits, n)
+		run = 0
+	}
+	if run > 0 {
+		if !progressive {
+			e.symbol(true, c.table, 0x00)
+			return
+		}
+		e.eobrun++
+		if e.eobrun == 0x7FFF {
+			e.flushEOBRun(c)
+		}
+	}
+}
+
+func (e *scanEncoder) flushEOBRun(c *component) {
+	if e.eobrun == 0 {
+		return
+	}
+	n := 0
+	for r := e.eobrun >> 1; r > 0; r >>= 1 {
+		n++
+	}
+	e.symbol(true, c.table, uint8(n<<4))
+	e.bits(uint32(e.eobrun), n)
+	e.eobrun = 0
+}
+
+// checkRestart emits a restart marker before MCU number mcu when due
+func (e *scanEncoder) checkRestart(mcu int, c *component) {
+	if e.restart == 0 || mcu == 0 || mcu%e.restart != 0 {
+		return
+	}
+	if c != nil {
+		e.flushEOBRun(c)
+	}
+	e.pred = [3]int{}
+	if e.stats != nil {
+		return
+	}
+	e.bw.flush()
+	e.bw.w.WriteByte(0xFF)
+	e.bw.w.WriteByte(0xD0 + byte((mcu/e.restart-1)&7))
+}
+
+// scan describes one SOS segment
+type scan struct {
+	comps  []int // component indexes
+	ss, se int
+}
+
+// frame is an image transformed into quantized DCT coefficients
+type frame struct {
+	width, height int
+	mcusX, mcusY  int
+	comps         []*component
+	quant         [2][64]int // natural order
+}
+
+// newFrame converts img to the component layout of opts and runs the DCT
+// and quantization (trellis quantization when enabled)
+func newFrame(img image.Image, opts *Options) (*frame, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	if b.Empty() {
+		return nil, errors.New("jpeg: empty image")
+	}
+	if b.Dx() > 65535 || b.Dy() > 65535 {
+		return nil, errors.New("jpeg: image is too large to encode")
+	}
+
+	ycc, ok := img.(*image.YCbCr)
+	if !ok {
+		ycc = toYCbCr(img)
+	}
+	ratio := opts.Subsampling.ratio(ycc.SubsampleRatio)
+	hmax, vmax := 1, 1
+	switch ratio {
+	case image.YCbCrSubsampleRatio444:
+	case image.YCbCrSubsampleRatio422:
+		hmax = 2
+	default:
+		// 4:2:0, and layouts the pure Go encoder doesn't write directly
+		ratio, hmax, vmax = image.YCbCrSubsampleRatio420, 2, 2
+	}
+	ycc = Resample(ycc, ratio)
+
+	f := &frame{
+		width:  b.Dx(),
+		height: b.Dy(),
+		quant:  quantTables(opts.Quality, opts.QuantTable),
+	}
+	f.mcusX = (f.width + 8*hmax - 1) / (8 * hmax)
+	f.mcusY = (f.height + 8*vmax - 1) / (8 * vmax)
+	f.comps = []*component{
+		{id: 1, h: hmax, v: vmax, table: 0},
+		{id: 2, h: 1, v: 1, table: 1},
+		{id: 3, h: 1, v: 1, table: 1},
+	}
+	cw, ch := (f.width+hmax-1)/hmax, (f.height+vmax-1)/vmax
+	planes := []plane{
+		{ycc.Y, ycc.YStride, f.width, f.height},
+		{ycc.Cb, ycc.CStride, cw, ch},
+		{ycc.Cr, ycc.CStride, cw, ch},
+	}
+	for i, c := range f.comps {
+		c.blocksW, c.blocksH = f.mcusX*c.h, f.mcusY*c.v
+		pw, ph := (f.width*c.h+hmax-1)/hmax, (f.height*c.v+vmax-1)/vmax
+		c.scanW, c.scanH = (pw+7)/8, (ph+7)/8
+		c.coef = make([][64]int16, c.blocksW*c.blocksH)
+		if !opts.Trellis {
+			quant := &f.quant[c.table]
+			planes[i].transform(c, opts.DCTMethod, func(raw *[64]int, out *[64]int16) {
+				quantize(raw, quant, out)
+			})
+		}
+	}
+	if opts.Trellis {
+		trellisQuantize(f, planes, opts.DCTMethod)
+	}
+	return f, nil
+}
+
+// EncodeGo encodes img as JPEG with the pure Go encoder.
+func EncodeGo(w io.Writer, img image.Image, opts *Options) error {
+	if opts == nil {
+		opts = &Options{Quality: DefaultQuality}
+	}
+	f, err := newFrame(img, opts)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriterSize(w, 64*1024)
+	writeHeaders(bw, f.width, f.height, f.comps, &f.quant, opts)
+
+	enc := &scanEncoder{bw: &bitWriter{w: bw}, restart: opts.RestartInterval}
+	if opts.Progressive {
+		// Spectral selection: DC first, then low and high AC bands
+		scans := []scan{
+			{comps: []int{0, 1, 2}, ss: 0, se: 0},
+			{comps: []int{0}, ss: 1, se: 5},
+			{comps: []int{2}, ss: 1, se: 63},
+			{comps: []int{1}, ss: 1, se: 63},
+			{comps: []int{0}, ss: 6, se: 63},
+		}
+		for _, s := range scans {
+			encodeScan(enc, bw, f.comps, s, f.mcusX, f.mcusY, true, true)
+		}
+	} else {
+		encodeScan(enc, bw, f.comps, scan{comps: []int{0, 1, 2}, ss: 0, se: 63}, f.mcusX, f.mcusY, false, opts.OptimizeHuffman)
+	}
+
+	bw.Write([]byte{0xFF, 0xD9})
+	return bw.Flush()
+}
+
+// encodeScan writes the Huffman tables and SOS segment of one scan followed
+// by its entropy-coded data
+func encodeScan(enc *scanEncoder, bw *bufio.Writer, comps []*component, s scan, mcusX, mcusY int, progressive, optimize bool) {
+	run := func() {
+		enc.pred = [3]int{}
+		enc.eobrun = 0
+		if len(s.comps) > 1 {
+			// Interleaved: MCUs of all components
+			for my := 0; my < mcusY; my++ {
+				for mx := 0; mx < mcusX; mx++ {
+					enc.checkRestart(my*mcusX+mx, nil)
+					for _, ci := range s.comps {
+						c := comps[ci]
+						for v := 0; v < c.v; v++ {
+							for h := 0; h < c.h; h++ {
+								blk := &c.coef[(my*c.v+v)*c.blocksW+mx*c.h+h]
+								enc.encodeDC(c, ci, blk)
+								if s.se > 0 {
+									enc.encodeAC(c, blk, 1, s.se, false)
+								}
+							}
+						}
+					}
+				}
+			}
+			return
+		}
+		// Non-interleaved: one block per MCU over the component's own area
+		ci := s.comps[0]
+		c := comps[ci]
+		for by := 0; by < c.scanH; by++ {
+			for bx := 0; bx < c.scanW; bx++ {
+				enc.checkRestart(by*c.scanW+bx, c)
+				blk := &c.coef[by*c.blocksW+bx]
+				if s.ss == 0 {
+					enc.encodeDC(c, ci, blk)
+				} else {
+					enc.encodeAC(c, blk, s.ss, s.se, progressive)
+				}
+			}
+		}
+		enc.flushEOBRun(c)
+	}
+
+	// Huffman tables: standard ones, or optimal ones from a counting pass
+	var specs [4]*huffSpec // DC luma, DC chroma, AC luma, AC chroma
+	if optimize {
+		var stats [4][256]int
+		enc.stats = &stats
+		run()
+		enc.stats = nil
+		for i := range specs {
+			if used(&stats[i]) {
+				spec := optimalHuffman(&stats[i])
+				specs[i] = &spec
+			}
+		}
+	} else {
+		specs = [4]*huffSpec{&stdDCLuma, &stdDCChroma, &stdACLuma, &stdACChroma}
+	}
+
+	// Only tables the scan uses are written and installed
+	needDC, needAC := s.ss == 0, s.se > 0
+	for i, spec := range specs {
+		ac, table := i >= 2, i%2
+		if spec == nil || (ac && !needAC) || (!ac && !needDC) || !scanUsesTable(comps, s, table) {
+			continue
+		}
+		writeDHT(bw, ac, table, spec)
+		if ac {
+			enc.ac[table] = spec.codes()
+		} else {
+			enc.dc[table] = spec.codes()
+		}
+	}
+	writeSOS(bw, comps, s)
+	run()
+	enc.bw.flush()
+}
+
+func used(counts *[256]int) bool {
+	for _, n := range counts {
+		if n > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func scanUsesTable(comps []*component, s scan, table int) bool {
+	for _, ci := range s.comps {
+		if comps[ci].table == table {
+			return true
+		}
+	}
+	return false
+}
+
+// plane is one source sample plane
+type plane struct {
+	pix          []byte
+	stride, w, h int
+}
+
+// transform runs the forward DCT over every block of the component's MCU
+// grid, replicating edge samples into the padding. quantize receives the
+// coefficients in natural order, scaled up by 8, and the block to fill.
+func (p plane) transform(c *component, method DCTMethod, quantize func(raw *[64]int, out *[64]int16)) {
+	var block, raw [64]int
+	var fblock [64]float64
+	for by := 0; by < c.blocksH; by++ {
+		for bx := 0; bx < c.blocksW; bx++ {
+			for y := 0; y < 8; y++ {
+				row := min(by*8+y, p.h-1) * p.stride
+				for x := 0; x < 8; x++ {
+					v := int(p.pix[row+min(bx*8+x, p.w-1)]) - 128
+					block[y*8+x] = v
+					fblock[y*8+x] = float64(v)
+				}
+			}
+			if method == DCTFloat {
+				fdctFloat(&fblock)
+				for k, v := range fblock {
+					// Remove the AAN scaling, leaving the same scale as fdctInt
+					raw[k] = int(math.Round(v / (aanScale[k/8] * aanScale[k%8])))
+				}
+			} else {
+				fdctInt(&block)
+				raw = block
+			}
+			quantize(&raw, &c.coef[by*c.blocksW+bx])
+		}
+	}
+}
+
+// quantize divides DCT coefficients (natural order, scaled up by 8) by the
+// quantization table, rounding to nearest, into zigzag order
+func quantize(raw *[64]int, quant *[64]int, out *[64]int16) {
+	for z, k := range zigzag {
+		q := quant[k] << 3
+		v := raw[k]
+		if v < 0 {
+			out[z] = int16(-((-v + q>>1) / q))
+		} else {
+			out[z] = int16((v + q>>1) / q)
+		}
+	}
+}
+
+// toYCbCr converts any image to full-resolution YCbCr
+func toYCbCr(img image.Image) *image.YCbCr {
+	b := img.Bounds()
+	dst := image.NewYCbCr(image.Rect(0, 0, b.Dx(), b.Dy()), image.YCbCrSubsampleRatio444)
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			yy, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(bl>>8))
+			dst.Y[y*dst.YStride+x] = yy
+			dst.Cb[y*dst.CStride+x] = cb
+			dst.Cr[y*dst.CStride+x] = cr
+		}
+	}
+	return dst
+}
+
+func writeMarker(w *bufio.Writer, marker byte, payload []byte) {
+	n := len(payload) + 2
+	w.Write([]byte{0xFF, marker, byte(n >> 8), byte(n)})
+	w.Write(payload)
+}
+
+func writeHeaders(w *bufio.Writer, width, height int, comps []*component, quant *[2][64]int, opts *Options) {
+	w.Write([]byte{0xFF, 0xD8})
+
+	// JFIF APP0
+	unit, xd, yd := opts.density()
+	writeMarker(w, 0xE0, []byte{'J', 'F', 'I', 'F', 0, 1, 1, byte(unit),
+		byte(xd >> 8), byte(xd), byte(yd >> 8), byte(yd), 0, 0})
+
+	// DQT, in zigzag order
+	dqt := make([]byte, 0, 2*65)
+	for t := range quant {
+		dqt = append(dqt, byte(t))
+		for _, k := range zigzag {
+			dqt = append(dqt, byte(quant[t][k]))
+		}
+	}
+	writeMarker(w, 0xDB, dqt)
+
+	// SOF0 (baseline) or SOF2 (progressive)
+	sof := []byte{8, byte(height >> 8), byte(height), byte(width >> 8), byte(width), byte(len(comps))}
+	for _, c := range comps {
+		sof = append(sof, c.id, byte(c.h<<4|c.v), byte(c.table))
+	}
+	marker := byte(0xC0)
+	if opts.Progressive {
+		marker = 0xC2
+	}
+	writeMarker(w, marker, sof)
+
+	if opts.RestartInterval > 0 {
+		writeMarker(w, 0xDD, []byte{byte(opts.RestartInterval >> 8), byte(opts.RestartInterval)})
+	}
+}
+
+func writeDHT(w *bufio.Writer, ac bool, table int, spec *huffSpec) {
+	class := byte(0)
+	if ac {
+		class = 1
+	}
+	payload := append([]byte{class<<4 | byte(table)}, spec.bits[:]...)
+	writeMarker(w, 0xC4, append(payload, spec.vals...))
+}
+
+func writeSOS(w *bufio.Writer, comps []*component, s scan) {
+	payload := []byte{byte(len(s.comps))}
+	for _, ci := range s.comps {
+		c := comps[ci]
+		payload = append(payload, c.id, byte(c.table<<4|c.table))
+	}
+	payload = append(payload, byte(s.ss), byte(s.se), 0)
+	writeMarker(w, 0xDA, payload)
+}
@@ -0,0 +1,53 @@
+// Package jpeg provides fast JPEG encoding using libjpeg-turbo via CGO.
+// This can be 2-4x faster than the standard library's pure Go encoder.
+//
+// Build with the purego tag (or CGO_ENABLED=0) to drop the libjpeg
+// dependency; Available is then false and EncodeYCbCr returns ErrUnavailable.
+package jpeg
+
+import (
+	"errors"
+	"image"
+	"image/jpeg"
+)
+
+const (
+	// DefaultQuality is the default JPEG quality
+	DefaultQuality = 85
+	// MinQuality is the minimum quality
+	MinQuality = 1
+	// MaxQuality is the maximum quality
+	MaxQuality = 100
+)
+
+// ErrUnavailable is returned by EncodeYCbCr in builds without libjpeg-turbo
+var ErrUnavailable = errors.New("libjpeg-turbo encoder not available in this build")
+
+// clampQuality limits quality to [MinQuality, MaxQuality]
+func clampQuality(quality int) int {
+	return min(max(quality, MinQuality), MaxQuality)
+}
+
+// Encode encodes any image.Image to JPEG.
+// For non-YCbCr images, or when libjpeg-turbo is not available, it falls
+// back to standard library encoding.
+func Encode(img image.Image, quality int) ([]byte, error) {
+	if ycbcr, ok := img.(*image.YCbCr); ok && Available {
+		return EncodeYCbCr(ycbcr, quality)
+	}
+
+	// Fallback for other image types
+	buf := make([]byte, 0, 512*1024)
+	w := &bufferWriter{buf: &buf}
+	err := jpeg.Encode(w, img, &jpeg.Options{Quality: clampQuality(quality)})
+	return buf, err
+}
+
+type bufferWriter struct {
+	buf *[]byte
+}
+
+func (w *bufferWriter) Write(p []byte) (int, error) {
+	*w.buf = append(*w.buf, p...)
+	return len(p), nil
+}
@@ -0,0 +1,363 @@
+package jpeg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"math"
+	"testing"
+)
+
+// testPattern builds a YCbCr image with smooth gradients and some detail,
+// so that a misplaced or mis-subsampled plane shows up as a large error
+func testPattern(w, h int, ratio image.YCbCrSubsampleRatio) *image.YCbCr {
+	img := image.NewYCbCr(image.Rect(0, 0, w, h), ratio)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := 40 + 170*x/max(w-1, 1)
+			if (x/16+y/16)%2 == 0 {
+				v += 20
+			}
+			img.Y[img.YOffset(x, y)] = uint8(v)
+		}
+	}
+	cw := img.Rect.Dx()
+	if ratio != image.YCbCrSubsampleRatio444 && ratio != image.YCbCrSubsampleRatio440 {
+		cw = (cw + 1) / 2
+	}
+	for i := range img.Cb {
+		x, y := i%img.CStride, i/img.CStride
+		img.Cb[i] = uint8(64 + 128*x/max(cw, 1))
+		img.Cr[i] = uint8(200 - y%128)
+	}
+	return img
+}
+
+// psnr compares the RGB values of two images of the same size
+func psnr(t *testing.T, a, b image.Image) float64 {
+	t.Helper()
+	if a.Bounds().Size() != b.Bounds().Size() {
+		t.Fatalf("size mismatch: %v vs %v", a.Bounds(), b.Bounds())
+	}
+	ab, bb := a.Bounds(), b.Bounds()
+	var sum float64
+	for y := 0; y < ab.Dy(); y++ {
+		for x := 0; x < ab.Dx(); x++ {
+			r1, g1, b1, _ := a.At(ab.Min.X+x, ab.Min.Y+y).RGBA()
+			r2, g2, b2, _ := b.At(bb.Min.X+x, bb.Min.Y+y).RGBA()
+			for _, d := range []float64{
+				float64(r1>>8) - float64(r2>>8),
+				float64(g1>>8) - float64(g2>>8),
+				float64(b1>>8) - float64(b2>>8),
+			} {
+				sum += d * d
+			}
+		}
+	}
+	mse := sum / float64(3*ab.Dx()*ab.Dy())
+	if mse == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255/mse)
+}
+
+// markers returns the marker codes of a JPEG stream (entropy-coded data
+// skipped, restart markers included)
+func markers(data []byte) []byte {
+	var out []byte
+	for i := 0; i+1 < len(data); i++ {
+		if data[i] == 0xFF && data[i+1] != 0 && data[i+1] != 0xFF {
+			out = append(out, data[i+1])
+			i++
+		}
+	}
+	return out
+}
+
+// segment returns the payload of the first segment with the given marker
+func segment(t *testing.T, data []byte, marker byte) []byte {
+	t.Helper()
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			break
+		}
+		m, n := data[i+1], int(data[i+2])<<8|int(data[i+3])
+		if m == marker {
+			return data[i+4 : i+2+n]
+		}
+		if m == 0xDA {
+			break
+		}
+		i += 2 + n
+	}
+	t.Fatalf("marker %#x not found", marker)
+	return nil
+}
+
+// TestEncode_AnyBackend checks Encode works whether or not libjpeg-turbo is
+// compiled in (go test -tags purego)
+func TestEncode_AnyBackend(t *testing.T) {
+	img := image.NewYCbCr(image.Rect(0, 0, 64, 48), image.YCbCrSubsampleRatio420)
+	data, err := Encode(img, 85)
+	if err != nil {
+		t.Fatalf("Encode failed (Available=%v): %v", Available, err)
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Encoded data is not valid JPEG: %v", err)
+	}
+	if cfg.Width != 64 || cfg.Height != 48 {
+		t.Errorf("Wrong dimensions: %dx%d", cfg.Width, cfg.Height)
+	}
+
+	if !Available {
+		if _, err := EncodeYCbCr(img, 85); !errors.Is(err, ErrUnavailable) {
+			t.Errorf("EncodeYCbCr error = %v, want ErrUnavailable", err)
+		}
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	for in, want := range map[string]Subsampling{"": SubsamplingAuto, "auto": SubsamplingAuto, "444": Subsampling444, "4:2:2": Subsampling422, "420": Subsampling420} {
+		if got, err := ParseSubsampling(in); err != nil || got != want {
+			t.Errorf("ParseSubsampling(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	if _, err := ParseSubsampling("411"); err == nil {
+		t.Error("ParseSubsampling(411) should fail")
+	}
+	for in, want := range map[string]DCTMethod{"": DCTISlow, "islow": DCTISlow, "ifast": DCTIFast, "float": DCTFloat} {
+		if got, err := ParseDCTMethod(in); err != nil || got != want {
+			t.Errorf("ParseDCTMethod(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	if _, err := ParseDCTMethod("fastest"); err == nil {
+		t.Error("ParseDCTMethod(fastest) should fail")
+	}
+
+	if !(&Options{Quality: 85}).Standard() {
+		t.Error("quality-only options should be standard")
+	}
+	if (&Options{Quality: 85, Progressive: true}).Standard() {
+		t.Error("progressive options should not be standard")
+	}
+	invalid := []Options{
+		{RestartInterval: -1},
+		{RestartInterval: MaxRestartInterval + 1},
+		{DensityUnit: 3},
+		{XDensity: 70000},
+		{Subsampling: 9},
+	}
+	for _, o := range invalid {
+		if err := o.Validate(); err == nil {
+			t.Errorf("Validate(%+v) should fail", o)
+		}
+	}
+}
+
+func TestResample(t *testing.T) {
+	src := testPattern(33, 17, image.YCbCrSubsampleRatio444)
+	for _, ratio := range []image.YCbCrSubsampleRatio{
+		image.YCbCrSubsampleRatio422,
+		image.YCbCrSubsampleRatio420,
+		image.YCbCrSubsampleRatio440,
+	} {
+		dst := Resample(src, ratio)
+		if dst.SubsampleRatio != ratio || dst.Rect.Dx() != 33 || dst.Rect.Dy() != 17 {
+			t.Fatalf("Resample(%v): got %v %v", ratio, dst.SubsampleRatio, dst.Rect)
+		}
+		// Round trip back to 4:4:4 stays close to the original
+		back := Resample(dst, image.YCbCrSubsampleRatio444)
+		if p := psnr(t, src, back); p < 30 {
+			t.Errorf("Resample(%v) round trip PSNR %.1fdB", ratio, p)
+		}
+	}
+	if Resample(src, src.SubsampleRatio) != src {
+		t.Error("Resample to the same ratio should return the source")
+	}
+
+	// Downsampling averages the covered samples
+	img := image.NewYCbCr(image.Rect(0, 0, 2, 2), image.YCbCrSubsampleRatio444)
+	copy(img.Cb, []byte{10, 20, 30, 40})
+	if got := Resample(img, image.YCbCrSubsampleRatio420).Cb[0]; got != 25 {
+		t.Errorf("averaged Cb = %d, want 25", got)
+	}
+}
+
+func TestOptimalHuffman(t *testing.T) {
+	var counts [256]int
+	for i := range counts {
+		counts[i] = 1 + i*i%997 // skewed but all present
+	}
+	counts[7] = 1 << 30
+	spec := optimalHuffman(&counts)
+
+	if len(spec.vals) != 256 {
+		t.Fatalf("got %d symbols, want 256", len(spec.vals))
+	}
+	// Kraft sum must be below 1 (the all-ones code is reserved)
+	var kraft float64
+	total := 0
+	for l, n := range spec.bits {
+		kraft += float64(n) / float64(uint(1)<<(l+1))
+		total += int(n)
+	}
+	if total != 256 || kraft >= 1 {
+		t.Errorf("invalid code lengths: total=%d kraft=%v", total, kraft)
+	}
+	if spec.vals[0] != 7 {
+		t.Errorf("most frequent symbol should get the shortest code, got %#x", spec.vals[0])
+	}
+
+	// Standard tables are consistent
+	for _, s := range []*huffSpec{&stdDCLuma, &stdDCChroma, &stdACLuma, &stdACChroma} {
+		n := 0
+		for _, b := range s.bits {
+			n += int(b)
+		}
+		if n != len(s.vals) {
+			t.Errorf("standard table declares %d codes, has %d values", n, len(s.vals))
+		}
+	}
+}
+
+// TestEncodeGo checks every option of the pure Go encoder by decoding the
+// result with image/jpeg and inspecting the markers
+func TestEncodeGo(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    Options
+		samp    byte // expected luma sampling factors
+		sofType byte
+	}{
+		{"baseline", Options{Quality: 85}, 0x22, 0xC0},
+		{"optimized", Options{Quality: 85, OptimizeHuffman: true}, 0x22, 0xC0},
+		{"progressive", Options{Quality: 85, Progressive: true}, 0x22, 0xC2},
+		{"444", Options{Quality: 85, Subsampling: Subsampling444}, 0x11, 0xC0},
+		{"422", Options{Quality: 85, Subsampling: Subsampling422}, 0x21, 0xC0},
+		{"float DCT", Options{Quality: 85, DCTMethod: DCTFloat}, 0x22, 0xC0},
+		{"restart", Options{Quality: 85, RestartInterval: 3}, 0x22, 0xC0},
+		{"progressive restart 444", Options{Quality: 60, Progressive: true, RestartInterval: 5, Subsampling: Subsampling444}, 0x11, 0xC2},
+		{"density", Options{Quality: 85, DensityUnit: DensityInch, XDensity: 300, YDensity: 150}, 0x22, 0xC0},
+	}
+
+	src := testPattern(203, 141, image.YCbCrSubsampleRatio420)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := EncodeGo(&buf, src, &tt.opts); err != nil {
+				t.Fatalf("EncodeGo failed: %v", err)
+			}
+			data := buf.Bytes()
+			decoded, err := jpeg.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("output is not valid JPEG: %v", err)
+			}
+			if p := psnr(t, src, decoded); p < 30 {
+				t.Errorf("PSNR %.1fdB too low", p)
+			}
+
+			sof := segment(t, data, tt.sofType)
+			if sof[7] != tt.samp {
+				t.Errorf("luma sampling %#x, want %#x", sof[7], tt.samp)
+			}
+			if tt.opts.RestartInterval > 0 && !bytes.Contains(markers(data), []byte{0xD0}) {
+				t.Error("no restart markers written")
+			}
+			if app0 := segment(t, data, 0xE0); tt.opts.DensityUnit != DensityNone {
+				unit, x, y := app0[7], int(app0[8])<<8|int(app0[9]), int(app0[10])<<8|int(app0[11])
+				if int(unit) != tt.opts.DensityUnit || x != tt.opts.XDensity || y != tt.opts.YDensity {
+					t.Errorf("density %d %dx%d, want %d %dx%d", unit, x, y, tt.opts.DensityUnit, tt.opts.XDensity, tt.opts.YDensity)
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeGo_MatchesStdlib(t *testing.T) {
+	for _, size := range []struct{ w, h int }{{256, 256}, {333, 257}, {9, 5}} {
+		t.Run(fmt.Sprintf("%dx%d", size.w, size.h), func(t *testing.T) {
+			src := testPattern(size.w, size.h, image.YCbCrSubsampleRatio420)
+
+			var goBuf, stdBuf bytes.Buffer
+			if err := EncodeGo(&goBuf, src, &Options{Quality: 75}); err != nil {
+				t.Fatal(err)
+			}
+			if err := jpeg.Encode(&stdBuf, src, &jpeg.Options{Quality: 75}); err != nil {
+				t.Fatal(err)
+			}
+			goImg, err := jpeg.Decode(&goBuf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stdImg, err := jpeg.Decode(&stdBuf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			goPSNR, stdPSNR := psnr(t, src, goImg), psnr(t, src, stdImg)
+			if goPSNR < stdPSNR-1 {
+				t.Errorf("Go encoder PSNR %.1fdB below image/jpeg %.1fdB", goPSNR, stdPSNR)
+			}
+		})
+	}
+}
+
+func TestEncodeGo_OptimizedIsSmaller(t *testing.T) {
+	src := testPattern(512, 384, image.YCbCrSubsampleRatio420)
+	size := func(o Options) int {
+		var buf bytes.Buffer
+		if err := EncodeGo(&buf, src, &o); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Len()
+	}
+	std, opt := size(Options{Quality: 85}), size(Options{Quality: 85, OptimizeHuffman: true})
+	if opt >= std {
+		t.Errorf("optimized Huffman output %d bytes, standard %d", opt, std)
+	}
+}
+
+func TestEncodeGo_NonYCbCr(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 30))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	var buf bytes.Buffer
+	if err := EncodeGo(&buf, img, &Options{Quality: 90, Subsampling: Subsampling444}); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Bounds().Dx() != 40 || decoded.Bounds().Dy() != 30 {
+		t.Errorf("wrong size %v", decoded.Bounds())
+	}
+	if err := EncodeGo(&buf, image.NewRGBA(image.Rect(0, 0, 0, 0)), nil); err == nil {
+		t.Error("expected error for empty image")
+	}
+}
+
+func BenchmarkEncodeGo(b *testing.B) {
+	img := testPattern(4000, 3000, image.YCbCrSubsampleRatio420)
+	for _, o := range []Options{{Quality: 85}, {Quality: 85, OptimizeHuffman: true}, {Quality: 85, Progressive: true}} {
+		name := "baseline"
+		if o.Progressive {
+			name = "progressive"
+		} else if o.OptimizeHuffman {
+			name = "optimized"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(img.Y)))
+			var buf bytes.Buffer
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				if err := EncodeGo(&buf, img, &o); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
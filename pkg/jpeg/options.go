@@ -0,0 +1,270 @@
+package jpeg
+
+import (
+	"fmt"
+	"image"
+	"strings"
+)
+
+// Subsampling is the chroma subsampling of the encoded JPEG
+type Subsampling int
+
+const (
+	// SubsamplingAuto keeps the subsampling of the source image
+	// (4:2:0 for images that are not YCbCr)
+	SubsamplingAuto Subsampling = iota
+	Subsampling444
+	Subsampling422
+	Subsampling420
+)
+
+// String returns the J:a:b notation of the subsampling
+func (s Subsampling) String() string {
+	switch s {
+	case Subsampling444:
+		return "4:4:4"
+	case Subsampling422:
+		return "4:2:2"
+	case Subsampling420:
+		return "4:2:0"
+	}
+	return "auto"
+}
+
+// ParseSubsampling parses "444", "422", "420" (or "4:4:4", ...) and "auto"
+func ParseSubsampling(s string) (Subsampling, error) {
+	switch strings.ReplaceAll(s, ":", "") {
+	case "", "auto":
+		return SubsamplingAuto, nil
+	case "444":
+		return Subsampling444, nil
+	case "422":
+		return Subsampling422, nil
+	case "420":
+		return Subsampling420, nil
+	}
+	return SubsamplingAuto, fmt.Errorf("unknown chroma subsampling %q", s)
+}
+
+// ratio returns the YCbCr layout to encode an image with the given source ratio
+func (s Subsampling) ratio(src image.YCbCrSubsampleRatio) image.YCbCrSubsampleRatio {
+	switch s {
+	case Subsampling444:
+		return image.YCbCrSubsampleRatio444
+	case Subsampling422:
+		return image.YCbCrSubsampleRatio422
+	case Subsampling420:
+		return image.YCbCrSubsampleRatio420
+	}
+	return src
+}
+
+// DCTMethod selects the forward DCT implementation
+type DCTMethod int
+
+const (
+	// DCTISlow is the accurate integer DCT (libjpeg's default)
+	DCTISlow DCTMethod = iota
+	// DCTIFast is a faster, less accurate integer DCT. The pure Go encoder
+	// uses the accurate integer DCT instead.
+	DCTIFast
+	// DCTFloat is the floating point DCT
+	DCTFloat
+)
+
+// String returns the libjpeg name of the DCT method
+func (m DCTMethod) String() string {
+	switch m {
+	case DCTIFast:
+		return "ifast"
+	case DCTFloat:
+		return "float"
+	}
+	return "islow"
+}
+
+// ParseDCTMethod parses "islow", "ifast" or "float"
+func ParseDCTMethod(s string) (DCTMethod, error) {
+	switch s {
+	case "", "islow":
+		return DCTISlow, nil
+	case "ifast":
+		return DCTIFast, nil
+	case "float":
+		return DCTFloat, nil
+	}
+	return DCTISlow, fmt.Errorf("unknown DCT method %q", s)
+}
+
+// QuantTable selects the base quantization tables, scaled by quality
+type QuantTable int
+
+const (
+	// QuantAnnexK are the example tables of ITU T.81 Annex K (libjpeg's default)
+	QuantAnnexK QuantTable = iota
+	// QuantRobidoux is N. Robidoux's perceptually tuned table (ImageMagick,
+	// mozjpeg's default). It keeps more low-frequency detail and quantizes
+	// high frequencies harder than Annex K.
+	QuantRobidoux
+)
+
+// String returns the name of the quantization table
+func (t QuantTable) String() string {
+	if t == QuantRobidoux {
+		return "robidoux"
+	}
+	return "annexk"
+}
+
+// ParseQuantTable parses "annexk" or "robidoux"
+func ParseQuantTable(s string) (QuantTable, error) {
+	switch s {
+	case "", "annexk":
+		return QuantAnnexK, nil
+	case "robidoux":
+		return QuantRobidoux, nil
+	}
+	return QuantAnnexK, fmt.Errorf("unknown quantization table %q", s)
+}
+
+// JFIF density units
+const (
+	DensityNone = 0 // aspect ratio only
+	DensityInch = 1 // dots per inch
+	DensityCm   = 2 // dots per centimeter
+)
+
+// MaxRestartInterval is the largest restart interval (in MCUs) a JPEG can signal
+const MaxRestartInterval = 65535
+
+// Options are the JPEG encoder settings. The zero value (apart from
+// Quality) is a baseline JPEG with the source subsampling, standard Huffman
+// tables, the accurate integer DCT and no restart markers.
+type Options struct {
+	Quality         int
+	Progressive     bool        // progressive scans; implies optimized Huffman tables
+	Subsampling     Subsampling // chroma subsampling of the output
+	OptimizeHuffman bool        // compute image-specific Huffman tables (two passes)
+	DCTMethod       DCTMethod
+	QuantTable      QuantTable
+	Trellis         bool // rate-distortion optimized (trellis) quantization
+	RestartInterval int  // restart marker every N MCUs, 0 disables
+	DensityUnit     int  // DensityNone, DensityInch or DensityCm
+	XDensity        int  // 0 means 1
+	YDensity        int  // 0 means 1
+}
+
+// Validate checks that the options can be encoded
+func (o *Options) Validate() error {
+	if o.Subsampling < SubsamplingAuto || o.Subsampling > Subsampling420 {
+		return fmt.Errorf("invalid subsampling %d", o.Subsampling)
+	}
+	if o.DCTMethod < DCTISlow || o.DCTMethod > DCTFloat {
+		return fmt.Errorf("invalid DCT method %d", o.DCTMethod)
+	}
+	if o.QuantTable < QuantAnnexK || o.QuantTable > QuantRobidoux {
+		return fmt.Errorf("invalid quantization table %d", o.QuantTable)
+	}
+	if o.RestartInterval < 0 || o.RestartInterval > MaxRestartInterval {
+		return fmt.Errorf("restart interval %d out of range", o.RestartInterval)
+	}
+	if o.DensityUnit < DensityNone || o.DensityUnit > DensityCm {
+		return fmt.Errorf("invalid density unit %d", o.DensityUnit)
+	}
+	if o.XDensity < 0 || o.XDensity > 65535 || o.YDensity < 0 || o.YDensity > 65535 {
+		return fmt.Errorf("density %dx%d out of range", o.XDensity, o.YDensity)
+	}
+	return nil
+}
+
+// Standard reports whether the options only use what image/jpeg supports:
+// baseline scans, standard Huffman and quantization tables, no restart
+// markers, no density and no explicit subsampling.
+func (o *Options) Standard() bool {
+	return !o.Progressive && !o.OptimizeHuffman && o.Subsampling == SubsamplingAuto &&
+		o.DCTMethod == DCTISlow && o.QuantTable == QuantAnnexK && !o.Trellis &&
+		o.RestartInterval == 0 && o.DensityUnit == DensityNone &&
+		o.XDensity <= 1 && o.YDensity <= 1
+}
+
+// SizeRatio estimates the output size relative to a baseline JPEG with
+// standard tables at the same quality, measured on photographs. It lets
+// target-size logic pick a higher quality for the more efficient settings.
+func (o *Options) SizeRatio() float64 {
+	r := 1.0
+	if o.Progressive || o.OptimizeHuffman {
+		r *= 0.96
+	}
+	if o.QuantTable == QuantRobidoux {
+		r *= 0.9
+	}
+	if o.Trellis {
+		r *= 0.88
+	}
+	return r
+}
+
+// MaxCompression returns the smallest-output profile: tuned quantization
+// tables, trellis quantization, progressive scans and optimized Huffman
+// tables (the mozjpeg recipe). Encoding is several times slower.
+func MaxCompression(quality int) Options {
+	return Options{
+		Quality:         quality,
+		Progressive:     true,
+		OptimizeHuffman: true,
+		QuantTable:      QuantRobidoux,
+		Trellis:         true,
+	}
+}
+
+// density returns the JFIF density fields with defaults applied
+func (o *Options) density() (unit, x, y int) {
+	x, y = max(o.XDensity, 1), max(o.YDensity, 1)
+	return o.DensityUnit, x, y
+}
+
+// Resample converts img to the given chroma subsampling. Each output chroma
+// sample is the average of the source chroma covering the same luma area,
+// so downsampling averages and upsampling replicates.
+func Resample(img *image.YCbCr, ratio image.YCbCrSubsampleRatio) *image.YCbCr {
+	r := img.Rect
+	if img.SubsampleRatio == ratio {
+		return img
+	}
+	dst := image.NewYCbCr(image.Rect(0, 0, r.Dx(), r.Dy()), ratio)
+	for y := 0; y < r.Dy(); y++ {
+		copy(dst.Y[y*dst.YStride:], img.Y[img.YOffset(r.Min.X, r.Min.Y+y):][:r.Dx()])
+	}
+
+	// Luma pixels covered by one output chroma sample
+	cw, ch := 1, 1
+	switch ratio {
+	case image.YCbCrSubsampleRatio422:
+		cw = 2
+	case image.YCbCrSubsampleRatio420:
+		cw, ch = 2, 2
+	case image.YCbCrSubsampleRatio440:
+		ch = 2
+	case image.YCbCrSubsampleRatio411:
+		cw = 4
+	case image.YCbCrSubsampleRatio410:
+		cw, ch = 4, 2
+	}
+	for cy := 0; cy*ch < r.Dy(); cy++ {
+		for cx := 0; cx*cw < r.Dx(); cx++ {
+			var cb, cr, n int
+			for y := cy * ch; y < min((cy+1)*ch, r.Dy()); y++ {
+				for x := cx * cw; x < min((cx+1)*cw, r.Dx()); x++ {
+					off := img.COffset(r.Min.X+x, r.Min.Y+y)
+					cb += int(img.Cb[off])
+					cr += int(img.Cr[off])
+					n++
+				}
+			}
+			off := cy*dst.CStride + cx
+			dst.Cb[off] = uint8((cb + n/2) / n)
+			dst.Cr[off] = uint8((cr + n/2) / n)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,19 @@
+//go:build !cgo || purego
+
+package jpeg
+
+import "image"
+
+// Available reports whether the libjpeg-turbo encoder is compiled in
+const Available = false
+
+// EncodeYCbCr always fails with ErrUnavailable in pure-Go builds.
+func EncodeYCbCr(img *image.YCbCr, quality int) ([]byte, error) {
+	return nil, ErrUnavailable
+}
+
+// EncodeYCbCrWithOptions always fails with ErrUnavailable in pure-Go builds;
+// use EncodeGo instead.
+func EncodeYCbCrWithOptions(img *image.YCbCr, opts *Options) ([]byte, error) {
+	return nil, ErrUnavailable
+}
@@ -0,0 +1,195 @@
+package jpeg
+
+import "math"
+
+// Trellis quantization chooses each block's AC coefficients to minimize
+// bits + lambda * distortion instead of rounding them independently,
+// following mozjpeg's quantize_trellis. Small coefficients that cost more
+// bits than they are worth are dropped or shortened, and lambda adapts to
+// the block's energy so that busy blocks (where errors are masked) are
+// quantized harder than flat ones.
+
+const (
+	// mozjpeg's default lambda = 2^14.75 / (2^16.5 + block energy)
+	trellisLambdaNum = 27554.7 // 2^14.75
+	trellisLambdaDen = 92681.9 // 2^16.5
+
+	maxACCoef = 1023 // largest AC magnitude of 8-bit JPEG (category 10)
+)
+
+// trellisQuantize quantizes every component of f. The first pass rates
+// symbols with the standard Huffman tables and gathers statistics; the
+// second rates them with code lengths derived from those statistics, which
+// is closer to the optimized tables the image is finally written with.
+func trellisQuantize(f *frame, planes []plane, method DCTMethod) {
+	lengths := [2]*[256]uint8{&stdACLuma.codes().size, &stdACChroma.codes().size}
+	var stats [2][256]int
+	for pass := 0; pass < 2; pass++ {
+		for i, c := range f.comps {
+			t := newTrellis(&f.quant[c.table], lengths[c.table])
+			counts := &stats[c.table]
+			planes[i].transform(c, method, func(raw *[64]int, out *[64]int16) {
+				t.quantize(raw, out)
+				if pass == 0 {
+					countAC(out, counts)
+				}
+			})
+		}
+		if pass == 0 {
+			for t := range stats {
+				// Every valid symbol keeps a code so any candidate can be rated
+				counts := stats[t]
+				counts[0x00]++
+				counts[0xF0]++
+				for run := 0; run < 16; run++ {
+					for size := 1; size <= 10; size++ {
+						counts[run<<4|size]++
+					}
+				}
+				spec := optimalHuffman(&counts)
+				lengths[t] = &spec.codes().size
+			}
+		}
+	}
+}
+
+// trellis quantizes blocks against one quantization table
+type trellis struct {
+	quant  *[64]int    // natural order
+	bits   *[256]uint8 // AC Huffman code lengths
+	weight [64]float64 // distortion weight 1/q² by zigzag position
+}
+
+func newTrellis(quant *[64]int, bits *[256]uint8) *trellis {
+	t := &trellis{quant: quant, bits: bits}
+	for z, k := range zigzag {
+		t.weight[z] = 1 / float64(quant[k]*quant[k])
+	}
+	return t
+}
+
+// quantize quantizes raw (natural order, scaled up by 8) into out (zigzag)
+func (t *trellis) quantize(raw *[64]int, out *[64]int16) {
+	// DC is predicted from the previous block and rounded as usual
+	q := t.quant[0] << 3
+	if dc := raw[0]; dc < 0 {
+		out[0] = int16(-((-dc + q>>1) / q))
+	} else {
+		out[0] = int16((dc + q>>1) / q)
+	}
+
+	norm := 0.0
+	for _, k := range zigzag[1:] {
+		norm += float64(raw[k] * raw[k])
+	}
+	lambda := trellisLambdaNum / (trellisLambdaDen + norm/63)
+
+	// zeroDist[i]: distortion of zeroing coefficients 1..i
+	// cost[i]: best cost of coding 1..i with coefficient i nonzero
+	// runStart[i]: the previous nonzero coefficient on that path
+	var zeroDist, cost [64]float64 // cost[0] = 0: the path start
+	var runStart [64]int
+	for i := 1; i < 64; i++ {
+		k := zigzag[i]
+		x, neg := raw[k], false
+		if x < 0 {
+			x, neg = -x, true
+		}
+		q := t.quant[k] << 3
+		w := lambda * t.weight[i]
+		zeroDist[i] = zeroDist[i-1] + float64(x*x)*w
+		out[i] = 0
+		cost[i] = math.Inf(1)
+
+		qx := min((x+q>>1)/q, maxACCoef)
+		if qx == 0 {
+			continue
+		}
+		// Candidates: the rounded value and the largest value of each
+		// smaller magnitude category
+		var cands [10]int
+		var dists [10]float64
+		n, _ := category(qx)
+		for s := 0; s < n; s++ {
+			cands[s] = 2<<s - 1
+			if s == n-1 {
+				cands[s] = qx
+			}
+			d := float64(cands[s]*q - x)
+			dists[s] = d * d * w
+		}
+
+		for j := 0; j < i; j++ {
+			if j != 0 && out[j] == 0 {
+				continue
+			}
+			run := i - 1 - j
+			runBits := float64((run >> 4) * int(t.bits[0xF0]))
+			run &= 15
+			base := cost[j] + runBits + zeroDist[i-1] - zeroDist[j]
+			for s := 0; s < n; s++ {
+				codeBits := t.bits[run<<4|(s+1)]
+				if codeBits == 0 {
+					continue
+				}
+				c := base + float64(int(codeBits)+s+1) + dists[s]
+				if c < cost[i] {
+					v := cands[s]
+					if neg {
+						v = -v
+					}
+					out[i] = int16(v)
+					cost[i] = c
+					runStart[i] = j
+				}
+			}
+		}
+	}
+
+	// Pick the last nonzero coefficient (everything after it is an EOB)
+	last := 0
+	best := zeroDist[63] + float64(t.bits[0x00])
+	for i := 1; i < 64; i++ {
+		if out[i] == 0 {
+			continue
+		}
+		c := cost[i] + zeroDist[63] - zeroDist[i]
+		if i < 63 {
+			c += float64(t.bits[0x00])
+		}
+		if c < best {
+			best, last = c, i
+		}
+	}
+
+	// Zero every coefficient that is not on the chosen path
+	for i := 63; i > 0; {
+		for ; i > last; i-- {
+			out[i] = 0
+		}
+		if i > 0 {
+			last = runStart[i]
+			i--
+		}
+	}
+}
+
+// countAC counts the sequential-mode AC symbols of a block
+func countAC(blk *[64]int16, counts *[256]int) {
+	run := 0
+	for _, v := range blk[1:] {
+		if v == 0 {
+			run++
+			continue
+		}
+		for ; run > 15; run -= 16 {
+			counts[0xF0]++
+		}
+		n, _ := category(int(v))
+		counts[run<<4|n]++
+		run = 0
+	}
+	if run > 0 {
+		counts[0x00]++
+	}
+}
@@ -0,0 +1,156 @@
+package jpeg
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+// texturedPattern is testPattern with deterministic noise, giving the
+// trellis quantizer small coefficients to trade off
+func texturedPattern(w, h int) *image.YCbCr {
+	img := testPattern(w, h, image.YCbCrSubsampleRatio420)
+	seed := uint32(1)
+	for i := range img.Y {
+		seed = seed*1664525 + 1013904223
+		img.Y[i] = uint8(min(max(int(img.Y[i])+int(seed>>28)-8, 0), 255))
+	}
+	return img
+}
+
+func TestQuantTables(t *testing.T) {
+	if q := quantTables(50, QuantAnnexK); q != baseQuant {
+		t.Error("Annex K tables at quality 50 should be unscaled")
+	}
+	q := quantTables(50, QuantRobidoux)
+	for i, v := range robidouxQuant {
+		if want := min(v, 255); q[0][i] != want || q[1][i] != want {
+			t.Fatalf("Robidoux table[%d] = %d/%d, want %d", i, q[0][i], q[1][i], want)
+		}
+	}
+	if q := quantTables(90, QuantRobidoux); q[0][63] != 84 {
+		t.Errorf("quality 90 should scale by 1/5: got %d", q[0][63])
+	}
+	if _, err := ParseQuantTable("robidoux"); err != nil {
+		t.Error(err)
+	}
+	if _, err := ParseQuantTable("flat"); err == nil {
+		t.Error("ParseQuantTable(flat) should fail")
+	}
+}
+
+func TestTrellis_Block(t *testing.T) {
+	quant := quantTables(75, QuantAnnexK)
+	tr := newTrellis(&quant[0], &stdACLuma.codes().size)
+
+	// A flat block stays flat
+	var raw [64]int
+	var out [64]int16
+	raw[0] = 800
+	tr.quantize(&raw, &out)
+	if out[0] != int16((800+quant[0][0]*4)/(quant[0][0]*8)) {
+		t.Errorf("DC = %d", out[0])
+	}
+	for i, v := range out[1:] {
+		if v != 0 {
+			t.Fatalf("AC[%d] = %d, want 0", i+1, v)
+		}
+	}
+
+	// A strong coefficient is kept, an isolated barely-rounding-up one far
+	// down the block is dropped
+	raw[1] = 8 * quant[0][1] * 12
+	raw[63] = 8 * quant[0][63] * 6 / 10
+	var plain [64]int16
+	quantize(&raw, &quant[0], &plain)
+	tr.quantize(&raw, &out)
+	if plain[63] != 1 {
+		t.Fatalf("setup: rounding should keep the last coefficient, got %d", plain[63])
+	}
+	if out[1] != 12 {
+		t.Errorf("strong coefficient = %d, want 12", out[1])
+	}
+	if out[63] != 0 {
+		t.Errorf("expensive isolated coefficient kept: %d", out[63])
+	}
+
+	// Trellis never increases a coefficient's magnitude
+	for i := range raw {
+		raw[i] = (i*7919)%600 - 300
+	}
+	quantize(&raw, &quant[0], &plain)
+	tr.quantize(&raw, &out)
+	for i := range out {
+		if abs16(out[i]) > abs16(plain[i]) {
+			t.Errorf("coefficient %d: trellis %d, rounding %d", i, out[i], plain[i])
+		}
+	}
+}
+
+func abs16(v int16) int16 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// TestEncodeGo_MaxCompression checks that the max compression profile
+// produces a valid, smaller JPEG at a small quality cost
+func TestEncodeGo_MaxCompression(t *testing.T) {
+	src := texturedPattern(320, 240)
+	encode := func(o Options) ([]byte, float64) {
+		var buf bytes.Buffer
+		if err := EncodeGo(&buf, src, &o); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := jpeg.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("output is not valid JPEG: %v", err)
+		}
+		return buf.Bytes(), psnr(t, src, decoded)
+	}
+
+	base, basePSNR := encode(Options{Quality: 80, Progressive: true})
+	trellis, trellisPSNR := encode(Options{Quality: 80, Progressive: true, Trellis: true})
+	maxData, maxPSNR := encode(MaxCompression(80))
+	t.Logf("baseline %d bytes %.1fdB, trellis %d bytes %.1fdB, max %d bytes %.1fdB",
+		len(base), basePSNR, len(trellis), trellisPSNR, len(maxData), maxPSNR)
+
+	if len(trellis) >= len(base) {
+		t.Errorf("trellis output %d bytes, not smaller than %d", len(trellis), len(base))
+	}
+	if len(maxData) >= len(trellis) {
+		t.Errorf("max compression output %d bytes, not smaller than trellis %d", len(maxData), len(trellis))
+	}
+	if trellisPSNR < basePSNR-1.5 {
+		t.Errorf("trellis PSNR %.1fdB dropped too far from %.1fdB", trellisPSNR, basePSNR)
+	}
+
+	// The DQT segment holds the Robidoux table
+	want := quantTables(80, QuantRobidoux)
+	dqt := segment(t, maxData, 0xDB)
+	for z, k := range zigzag {
+		if int(dqt[1+z]) != want[0][k] {
+			t.Fatalf("DQT[%d] = %d, want %d", z, dqt[1+z], want[0][k])
+		}
+	}
+
+	p := MaxCompression(80)
+	if p.Standard() || p.Validate() != nil {
+		t.Errorf("MaxCompression options: standard=%v validate=%v", p.Standard(), p.Validate())
+	}
+}
+
+func BenchmarkEncodeGo_Trellis(b *testing.B) {
+	img := texturedPattern(2000, 1500)
+	opts := MaxCompression(80)
+	b.SetBytes(int64(len(img.Y)))
+	var buf bytes.Buffer
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := EncodeGo(&buf, img, &opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
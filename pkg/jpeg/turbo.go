@@ -1,5 +1,5 @@
-// Package jpeg provides fast JPEG encoding using libjpeg-turbo via CGO.
-// This can be 2-4x faster than the standard library's pure Go encoder.
+//go:build cgo && !purego
+
 package jpeg
 
 /*
@@ -37,20 +37,66 @@ static void init_mem_dest(struct jpeg_compress_struct *cinfo,
     jpeg_mem_dest(cinfo, out_buffer, out_size);
 }
 
-// Encode YCbCr to JPEG
+// Copy a plane row into a block-aligned buffer, replicating the last sample
+static void copy_row(unsigned char *dst, const unsigned char *src, int width, int padded) {
+    memcpy(dst, src, width);
+    memset(dst + width, src[width - 1], padded - width);
+}
+
+// Encoder settings shared by both entry points
+typedef struct {
+    int width, height, h_samp, v_samp;
+    int progressive, optimize, dct_method, restart_interval;
+    int density_unit, x_density, y_density;
+} encode_params;
+
+// Configure a compressor for 3-component YCbCr output. quant holds the luma
+// and chroma quantization tables in natural order.
+static void setup_compress(struct jpeg_compress_struct *cinfo, const encode_params *p,
+                           const unsigned int *quant) {
+    cinfo->image_width = p->width;
+    cinfo->image_height = p->height;
+    cinfo->input_components = 3;
+    cinfo->in_color_space = JCS_YCbCr;
+
+    jpeg_set_defaults(cinfo);
+    jpeg_add_quant_table(cinfo, 0, quant, 100, TRUE);
+    jpeg_add_quant_table(cinfo, 1, quant + DCTSIZE2, 100, TRUE);
+    cinfo->dct_method = p->dct_method == 1 ? JDCT_IFAST : p->dct_method == 2 ? JDCT_FLOAT : JDCT_ISLOW;
+    cinfo->optimize_coding = p->optimize ? TRUE : FALSE;
+    cinfo->restart_interval = p->restart_interval;
+    cinfo->write_JFIF_header = TRUE;
+    cinfo->density_unit = p->density_unit;
+    cinfo->X_density = p->x_density;
+    cinfo->Y_density = p->y_density;
+
+    cinfo->comp_info[0].h_samp_factor = p->h_samp;
+    cinfo->comp_info[0].v_samp_factor = p->v_samp;
+    cinfo->comp_info[1].h_samp_factor = 1;
+    cinfo->comp_info[1].v_samp_factor = 1;
+    cinfo->comp_info[2].h_samp_factor = 1;
+    cinfo->comp_info[2].v_samp_factor = 1;
+
+    if (p->progressive) {
+        jpeg_simple_progression(cinfo);
+    }
+}
+
+// Encode planar YCbCr to JPEG using raw (already subsampled) data input.
+// h_samp/v_samp are the luma sampling factors relative to chroma.
 static int encode_ycc(
     const unsigned char *y, int y_stride,
     const unsigned char *cb, int cb_stride,
     const unsigned char *cr, int cr_stride,
-    int width, int height, int quality,
+    const encode_params *p, const unsigned int *quant,
     unsigned char **out_buffer, unsigned long *out_size,
     char **error_msg) {
 
     struct jpeg_compress_struct cinfo;
     my_error_mgr *jerr = NULL;
-    JSAMPROW row[1];
-    unsigned char *row_buffer = NULL;
+    unsigned char * volatile buffer = NULL; // volatile: read after longjmp
     int result = 0;
+    int width = p->width, height = p->height, h_samp = p->h_samp, v_samp = p->v_samp;
 
     *out_buffer = NULL;
     *out_size = 0;
@@ -65,56 +111,139 @@ static int encode_ycc(
 
     jpeg_create_compress(&cinfo);
     init_mem_dest(&cinfo, out_buffer, out_size);
+    setup_compress(&cinfo, p, quant);
+    cinfo.raw_data_in = TRUE;
+
+    // Raw data rows must cover whole MCUs; rows are copied into padded buffers
+    int c_width = (width + h_samp - 1) / h_samp;
+    int c_height = (height + v_samp - 1) / v_samp;
+    int mcu_width = DCTSIZE * h_samp;
+    int y_padded = (width + mcu_width - 1) / mcu_width * mcu_width;
+    int c_padded = y_padded / h_samp;
+    int y_rows = DCTSIZE * v_samp;
+
+    buffer = (unsigned char *)malloc((size_t)y_padded * y_rows + (size_t)c_padded * DCTSIZE * 2);
+    if (buffer == NULL) {
+        *error_msg = strdup("out of memory");
+        result = -1;
+        goto cleanup;
+    }
 
-    cinfo.image_width = width;
-    cinfo.image_height = height;
-    cinfo.input_components = 3;
-    cinfo.in_color_space = JCS_YCbCr;
+    JSAMPROW y_ptrs[4 * DCTSIZE], cb_ptrs[DCTSIZE], cr_ptrs[DCTSIZE];
+    JSAMPARRAY planes[3] = { y_ptrs, cb_ptrs, cr_ptrs };
+    for (int i = 0; i < y_rows; i++) {
+        y_ptrs[i] = buffer + (size_t)i * y_padded;
+    }
+    for (int i = 0; i < DCTSIZE; i++) {
+        cb_ptrs[i] = buffer + (size_t)y_padded * y_rows + (size_t)i * c_padded;
+        cr_ptrs[i] = buffer + (size_t)y_padded * y_rows + (size_t)(DCTSIZE + i) * c_padded;
+    }
 
-    jpeg_set_defaults(&cinfo);
-    jpeg_set_quality(&cinfo, quality, TRUE);
-    cinfo.dct_method = JDCT_FASTEST;
+    jpeg_start_compress(&cinfo, TRUE);
 
-    // 4:2:0 subsampling
-    cinfo.comp_info[0].h_samp_factor = 2;
-    cinfo.comp_info[0].v_samp_factor = 2;
-    cinfo.comp_info[1].h_samp_factor = 1;
-    cinfo.comp_info[1].v_samp_factor = 1;
-    cinfo.comp_info[2].h_samp_factor = 1;
-    cinfo.comp_info[2].v_samp_factor = 1;
+    while (cinfo.next_scanline < cinfo.image_height) {
+        int row = cinfo.next_scanline;
+        // Rows past the bottom edge repeat the last row
+        for (int i = 0; i < y_rows; i++) {
+            int r = row + i < height ? row + i : height - 1;
+            copy_row(y_ptrs[i], y + (size_t)r * y_stride, width, y_padded);
+        }
+        for (int i = 0; i < DCTSIZE; i++) {
+            int r = row / v_samp + i < c_height ? row / v_samp + i : c_height - 1;
+            copy_row(cb_ptrs[i], cb + (size_t)r * cb_stride, c_width, c_padded);
+            copy_row(cr_ptrs[i], cr + (size_t)r * cr_stride, c_width, c_padded);
+        }
+        jpeg_write_raw_data(&cinfo, planes, y_rows);
+    }
 
-    jpeg_start_compress(&cinfo, TRUE);
+    jpeg_finish_compress(&cinfo);
 
-    // Allocate interleaved row buffer: Y + Cb/2 + Cr/2
-    int row_size = width + width;  // Y + Cb/2 + Cr/2
-    row_buffer = (unsigned char *)malloc(row_size);
+cleanup:
+    if (buffer) free(buffer);
+    jpeg_destroy_compress(&cinfo);
+    if (jerr) free(jerr);
+    return result;
+}
 
-    while (cinfo.next_scanline < cinfo.image_height) {
-        int y_row = cinfo.next_scanline;
-        int c_row = y_row / 2;
-        int c_width = width / 2;
+static const int zigzag_to_natural[DCTSIZE2] = {
+    0, 1, 8, 16, 9, 2, 3, 10,
+    17, 24, 32, 25, 18, 11, 4, 5,
+    12, 19, 26, 33, 40, 48, 41, 34,
+    27, 20, 13, 6, 7, 14, 21, 28,
+    35, 42, 49, 56, 57, 50, 43, 36,
+    29, 22, 15, 23, 30, 37, 44, 51,
+    58, 59, 52, 45, 38, 31, 39, 46,
+    53, 60, 61, 54, 47, 55, 62, 63,
+};
+
+// Entropy code already quantized DCT coefficients. coefs[ci] holds the
+// blocks of component ci in zigzag order, row-major with stride[ci] blocks
+// per row, covering at least the component's MCU rows.
+static int encode_coefficients(
+    const short *coef_y, const short *coef_cb, const short *coef_cr,
+    int stride_y, int stride_c,
+    const encode_params *p, const unsigned int *quant,
+    unsigned char **out_buffer, unsigned long *out_size,
+    char **error_msg) {
 
-        // Copy Y
-        memcpy(row_buffer, y + y_row * y_stride, width);
+    struct jpeg_compress_struct cinfo;
+    my_error_mgr *jerr = NULL;
+    jvirt_barray_ptr arrays[3];
+    const short *coefs[3] = { coef_y, coef_cb, coef_cr };
+    int strides[3] = { stride_y, stride_c, stride_c };
+    int result = 0;
 
-        // Copy Cb and Cr (interleaved for libjpeg)
-        unsigned char *dst = row_buffer + width;
-        const unsigned char *cb_src = cb + c_row * cb_stride;
-        const unsigned char *cr_src = cr + c_row * cr_stride;
+    *out_buffer = NULL;
+    *out_size = 0;
+    *error_msg = NULL;
 
-        for (int i = 0; i < c_width; i++) {
-            *dst++ = cb_src[i];
-            *dst++ = cr_src[i];
-        }
+    jerr = setup_error_mgr(&cinfo);
+    if (setjmp(jerr->setjmp_buffer)) {
+        *error_msg = strdup(jerr->msg);
+        result = -1;
+        goto cleanup;
+    }
 
-        row[0] = row_buffer;
-        jpeg_write_scanlines(&cinfo, row, 1);
+    jpeg_create_compress(&cinfo);
+    init_mem_dest(&cinfo, out_buffer, out_size);
+    setup_compress(&cinfo, p, quant);
+
+    // Block arrays sized like jpeg_write_coefficients expects: the
+    // component's blocks, with rows rounded up to whole MCU rows
+    for (int ci = 0; ci < 3; ci++) {
+        jpeg_component_info *comp = &cinfo.comp_info[ci];
+        int w = (p->width * comp->h_samp_factor + p->h_samp - 1) / p->h_samp;
+        int h = (p->height * comp->v_samp_factor + p->v_samp - 1) / p->v_samp;
+        int blocks_w = (w + DCTSIZE - 1) / DCTSIZE;
+        int blocks_h = (h + DCTSIZE - 1) / DCTSIZE;
+        blocks_h = (blocks_h + comp->v_samp_factor - 1) / comp->v_samp_factor * comp->v_samp_factor;
+        arrays[ci] = (*cinfo.mem->request_virt_barray)((j_common_ptr)&cinfo, JPOOL_IMAGE, FALSE,
+            blocks_w, blocks_h, comp->v_samp_factor);
+    }
+    (*cinfo.mem->realize_virt_arrays)((j_common_ptr)&cinfo);
+
+    for (int ci = 0; ci < 3; ci++) {
+        jpeg_component_info *comp = &cinfo.comp_info[ci];
+        int w = (p->width * comp->h_samp_factor + p->h_samp - 1) / p->h_samp;
+        int h = (p->height * comp->v_samp_factor + p->v_samp - 1) / p->v_samp;
+        int blocks_w = (w + DCTSIZE - 1) / DCTSIZE;
+        int blocks_h = (h + DCTSIZE - 1) / DCTSIZE;
+        blocks_h = (blocks_h + comp->v_samp_factor - 1) / comp->v_samp_factor * comp->v_samp_factor;
+        for (int by = 0; by < blocks_h; by++) {
+            JBLOCKARRAY row = (*cinfo.mem->access_virt_barray)((j_common_ptr)&cinfo, arrays[ci], by, 1, TRUE);
+            for (int bx = 0; bx < blocks_w; bx++) {
+                const short *src = coefs[ci] + ((size_t)by * strides[ci] + bx) * DCTSIZE2;
+                for (int k = 0; k < DCTSIZE2; k++) {
+                    row[0][bx][zigzag_to_natural[k]] = src[k];
+                }
+            }
+        }
     }
 
+    jpeg_write_coefficients(&cinfo, arrays);
     jpeg_finish_compress(&cinfo);
 
 cleanup:
-    if (row_buffer) free(row_buffer);
     jpeg_destroy_compress(&cinfo);
     if (jerr) free(jerr);
     return result;
@@ -122,57 +251,159 @@ cleanup:
 */
 import "C"
 import (
+	"errors"
 	"fmt"
 	"image"
-	"image/jpeg"
 	"unsafe"
 )
 
-const (
-	// DefaultQuality is the default JPEG quality
-	DefaultQuality = 85
-	// MinQuality is the minimum quality
-	MinQuality = 1
-	// MaxQuality is the maximum quality
-	MaxQuality = 100
-)
+// Available reports whether the libjpeg-turbo encoder is compiled in
+const Available = true
+
+// samplingFactors returns the luma sampling factors for a chroma subsampling ratio
+func samplingFactors(r image.YCbCrSubsampleRatio) (h, v int, ok bool) {
+	switch r {
+	case image.YCbCrSubsampleRatio444:
+		return 1, 1, true
+	case image.YCbCrSubsampleRatio422:
+		return 2, 1, true
+	case image.YCbCrSubsampleRatio420:
+		return 2, 2, true
+	case image.YCbCrSubsampleRatio440:
+		return 1, 2, true
+	case image.YCbCrSubsampleRatio411:
+		return 4, 1, true
+	case image.YCbCrSubsampleRatio410:
+		return 4, 2, true
+	}
+	return 0, 0, false
+}
 
 // EncodeYCbCr encodes an image.YCbCr to JPEG using libjpeg-turbo.
+// The planes are passed to libjpeg as-is, keeping the image's chroma
+// subsampling, so no color conversion or resampling takes place.
 func EncodeYCbCr(img *image.YCbCr, quality int) ([]byte, error) {
-	if quality < MinQuality {
-		quality = MinQuality
+	return EncodeYCbCrWithOptions(img, &Options{Quality: quality})
+}
+
+// EncodeYCbCrWithOptions encodes an image.YCbCr to JPEG using libjpeg-turbo
+// with the given options. The chroma planes are resampled first when
+// opts.Subsampling differs from the image's. libjpeg-turbo has no trellis
+// quantization, so with opts.Trellis the coefficients are computed by the
+// Go encoder and only entropy coded by libjpeg-turbo.
+func EncodeYCbCrWithOptions(img *image.YCbCr, opts *Options) ([]byte, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("jpeg encode failed: %w", err)
 	}
-	if quality > MaxQuality {
-		quality = MaxQuality
+	if img.Rect.Empty() {
+		return nil, errors.New("jpeg encode failed: empty image")
+	}
+	if opts.Trellis {
+		return encodeCoefficients(img, opts)
+	}
+
+	img = Resample(img, opts.Subsampling.ratio(img.SubsampleRatio))
+	hSamp, vSamp, ok := samplingFactors(img.SubsampleRatio)
+	if !ok {
+		return nil, fmt.Errorf("jpeg encode failed: unsupported subsample ratio %v", img.SubsampleRatio)
 	}
 
+	quant := cQuantTables(opts)
+	params := newParams(img.Rect.Dx(), img.Rect.Dy(), hSamp, vSamp, opts)
 	var (
-		outBuffer  *C.uchar
-		outSize    C.ulong
-		errorMsg   *C.char
+		outBuffer *C.uchar
+		outSize   C.ulong
+		errorMsg  *C.char
 	)
-
+	yOff := img.YOffset(img.Rect.Min.X, img.Rect.Min.Y)
+	cOff := img.COffset(img.Rect.Min.X, img.Rect.Min.Y)
 	result := C.encode_ycc(
-		(*C.uchar)(&img.Y[0]),
+		(*C.uchar)(&img.Y[yOff]),
 		C.int(img.YStride),
-		(*C.uchar)(&img.Cb[0]),
+		(*C.uchar)(&img.Cb[cOff]),
 		C.int(img.CStride),
-		(*C.uchar)(&img.Cr[0]),
+		(*C.uchar)(&img.Cr[cOff]),
 		C.int(img.CStride),
-		C.int(img.Rect.Dx()),
-		C.int(img.Rect.Dy()),
-		C.int(quality),
+		params,
+		&quant[0],
+		&outBuffer,
+		&outSize,
+		&errorMsg,
+	)
+	return encodeResult(result, outBuffer, outSize, errorMsg)
+}
+
+// encodeCoefficients quantizes img with the Go encoder (see newFrame) and
+// has libjpeg-turbo write the coefficients
+func encodeCoefficients(img *image.YCbCr, opts *Options) ([]byte, error) {
+	f, err := newFrame(img, opts)
+	if err != nil {
+		return nil, fmt.Errorf("jpeg encode failed: %w", err)
+	}
+	y, cb, cr := f.comps[0], f.comps[1], f.comps[2]
+
+	quant := cQuantTables(opts)
+	params := newParams(f.width, f.height, y.h, y.v, opts)
+	var (
+		outBuffer *C.uchar
+		outSize   C.ulong
+		errorMsg  *C.char
+	)
+	result := C.encode_coefficients(
+		(*C.short)(&y.coef[0][0]),
+		(*C.short)(&cb.coef[0][0]),
+		(*C.short)(&cr.coef[0][0]),
+		C.int(y.blocksW),
+		C.int(cb.blocksW),
+		params,
+		&quant[0],
 		&outBuffer,
 		&outSize,
 		&errorMsg,
 	)
+	return encodeResult(result, outBuffer, outSize, errorMsg)
+}
+
+// cQuantTables returns the scaled quantization tables of opts for libjpeg
+func cQuantTables(opts *Options) [2 * 64]C.uint {
+	var quant [2 * 64]C.uint
+	tables := quantTables(opts.Quality, opts.QuantTable)
+	for t := range tables {
+		for i, v := range tables[t] {
+			quant[t*64+i] = C.uint(v)
+		}
+	}
+	return quant
+}
 
+func newParams(width, height, hSamp, vSamp int, opts *Options) *C.encode_params {
+	densityUnit, xDensity, yDensity := opts.density()
+	return &C.encode_params{
+		width:            C.int(width),
+		height:           C.int(height),
+		h_samp:           C.int(hSamp),
+		v_samp:           C.int(vSamp),
+		progressive:      cBool(opts.Progressive),
+		optimize:         cBool(opts.OptimizeHuffman),
+		dct_method:       C.int(opts.DCTMethod),
+		restart_interval: C.int(opts.RestartInterval),
+		density_unit:     C.int(densityUnit),
+		x_density:        C.int(xDensity),
+		y_density:        C.int(yDensity),
+	}
+}
+
+// encodeResult copies the libjpeg output buffer into Go memory and frees it
+func encodeResult(result C.int, outBuffer *C.uchar, outSize C.ulong, errorMsg *C.char) ([]byte, error) {
 	if result != 0 || outBuffer == nil {
 		err := fmt.Errorf("jpeg encode failed")
 		if errorMsg != nil {
 			err = fmt.Errorf("jpeg encode failed: %s", C.GoString(errorMsg))
 			C.free(unsafe.Pointer(errorMsg))
 		}
+		if outBuffer != nil {
+			C.free(unsafe.Pointer(outBuffer))
+		}
 		return nil, err
 	}
 
@@ -183,25 +414,9 @@ func EncodeYCbCr(img *image.YCbCr, quality int) ([]byte, error) {
 	return data, nil
 }
 
-// Encode encodes any image.Image to JPEG.
-// For non-YCbCr images, it falls back to standard library encoding.
-func Encode(img image.Image, quality int) ([]byte, error) {
-	if ycbcr, ok := img.(*image.YCbCr); ok {
-		return EncodeYCbCr(ycbcr, quality)
+func cBool(b bool) C.int {
+	if b {
+		return 1
 	}
-
-	// Fallback for other image types
-	buf := make([]byte, 0, 512*1024)
-	w := &bufferWriter{buf: &buf}
-	err := jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
-	return buf, err
-}
-
-type bufferWriter struct {
-	buf *[]byte
-}
-
-func (w *bufferWriter) Write(p []byte) (int, error) {
-	*w.buf = append(*w.buf, p...)
-	return len(p), nil
+	return 0
 }
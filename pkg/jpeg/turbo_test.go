@@ -1,3 +1,5 @@
+//go:build cgo && !purego
+
 package jpeg
 
 import (
@@ -48,7 +50,7 @@ func TestEncodeYCbCr(t *testing.T) {
 
 func TestEncodeRoundtrip(t *testing.T) {
 	// Read a HEIF file to get a real image
-	data, err := os.ReadFile("/home/harliandi/go-heif/testdata/test.heic")
+	data, err := os.ReadFile("../../testdata/test.heic")
 	if err != nil {
 		t.Skip("no test file available")
 	}
@@ -96,7 +98,7 @@ func TestEncodeRoundtrip(t *testing.T) {
 }
 
 func BenchmarkEncodeYCbCrTurbo(b *testing.B) {
-	data, err := os.ReadFile("/home/harliandi/go-heif/testdata/test.heic")
+	data, err := os.ReadFile("../../testdata/test.heic")
 	if err != nil {
 		b.Skip("no test file")
 	}
@@ -118,7 +120,7 @@ func BenchmarkEncodeYCbCrTurbo(b *testing.B) {
 }
 
 func BenchmarkEncodeYCbCrStdlib(b *testing.B) {
-	data, err := os.ReadFile("/home/harliandi/go-heif/testdata/test.heic")
+	data, err := os.ReadFile("../../testdata/test.heic")
 	if err != nil {
 		b.Skip("no test file")
 	}
@@ -30,7 +30,7 @@ var (
 			Name: "heif_conversions_total",
 			Help: "Total number of image conversions",
 		},
-		[]string{"status"}, // success, error, cancelled
+		[]string{"status"}, // success, error, cancelled, timeout
 	)
 
 	ConversionDuration = promauto.NewHistogramVec(
@@ -42,6 +42,22 @@ var (
 		[]string{"mode"}, // adaptive, fixed_quality, fast, fast_quality
 	)
 
+	ConversionStageDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "heif_conversion_stage_duration_seconds",
+			Help:    "Duration of each conversion stage in seconds",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+		},
+		[]string{"stage"}, // decode, scale, encode
+	)
+
+	ConversionsDeduplicated = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "heif_conversions_deduplicated_total",
+			Help: "Total number of requests that shared an identical in-flight conversion",
+		},
+	)
+
 	ConversionBytes = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "heif_conversion_bytes",
@@ -66,6 +82,45 @@ var (
 		},
 	)
 
+	WorkerPoolQueueDepth = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "heif_worker_pool_queue_depth",
+			Help: "Current number of queued jobs per priority class",
+		},
+		[]string{"class"}, // interactive, batch, background
+	)
+
+	WorkerPoolQueueWait = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "heif_worker_pool_queue_wait_seconds",
+			Help:    "Time jobs spend queued before a worker picks them up",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		},
+		[]string{"class"},
+	)
+
+	WorkerPoolRejected = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "heif_worker_pool_rejected_total",
+			Help: "Total number of jobs rejected because their class queue was full",
+		},
+		[]string{"class"},
+	)
+
+	WorkerPoolMemoryReserved = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "heif_worker_pool_memory_reserved_bytes",
+			Help: "Estimated memory reserved by running conversion jobs",
+		},
+	)
+
+	WorkerPoolWorkers = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "heif_worker_pool_workers",
+			Help: "Current number of worker pool goroutines",
+		},
+	)
+
 	// Rate limiting metrics
 	RateLimitExceeded = promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -90,6 +145,52 @@ var (
 		},
 	)
 
+	// Cost limit metrics
+	CostLimitExceeded = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "heif_cost_limit_exceeded_total",
+			Help: "Total number of requests rejected due to the cost limit",
+		},
+	)
+
+	CostCharged = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "heif_cost_charged_total",
+			Help: "Total cost tokens charged (megabytes of input plus decoded megapixels)",
+		},
+	)
+
+	// Adaptive admission metrics
+	LoadShed = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "heif_load_shed_total",
+			Help: "Total number of requests rejected by adaptive load shedding",
+		},
+		[]string{"cost"},
+	)
+
+	AdmissionShedding = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "heif_admission_shedding",
+			Help: "1 while adaptive admission is shedding expensive requests",
+		},
+	)
+
+	IPBlocked = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "heif_ip_blocked_total",
+			Help: "Total number of requests rejected by the IP filter or a ban",
+		},
+		[]string{"reason"}, // denied, not_allowed, banned
+	)
+
+	AbuseBans = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "heif_abuse_bans_total",
+			Help: "Total number of clients banned for repeated invalid requests",
+		},
+	)
+
 	// Memory metrics
 	MemoryPoolHits = promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -106,6 +207,23 @@ var (
 		},
 		[]string{"size"}, // small, medium, large, xlarge
 	)
+
+	// Result cache metrics
+	CacheLookups = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "heif_cache_lookups_total",
+			Help: "Total number of conversion cache lookups",
+		},
+		[]string{"result"}, // hit, miss
+	)
+
+	CacheSize = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "heif_cache_bytes",
+			Help: "Bytes held by the conversion cache",
+		},
+		[]string{"backend"}, // memory
+	)
 )
 
 // RecordRequest records an HTTP request
@@ -122,12 +240,48 @@ func RecordConversion(status, mode string, duration float64, inputBytes, outputB
 	ConversionBytes.WithLabelValues("output").Observe(float64(outputBytes))
 }
 
+// RecordConversionStage records the duration of one conversion stage
+func RecordConversionStage(stage string, duration float64) {
+	ConversionStageDuration.WithLabelValues(stage).Observe(duration)
+}
+
+// RecordConversionDeduplicated records a request served by an identical
+// in-flight conversion
+func RecordConversionDeduplicated() {
+	ConversionsDeduplicated.Inc()
+}
+
 // UpdateWorkerPoolMetrics updates worker pool metrics
 func UpdateWorkerPoolMetrics(queueSize, activeJobs int) {
 	WorkerPoolQueueSize.Set(float64(queueSize))
 	WorkerPoolActiveJobs.Set(float64(activeJobs))
 }
 
+// UpdateQueueDepth updates the queue depth of a priority class
+func UpdateQueueDepth(class string, depth int) {
+	WorkerPoolQueueDepth.WithLabelValues(class).Set(float64(depth))
+}
+
+// RecordQueueWait records how long a job of a priority class was queued
+func RecordQueueWait(class string, seconds float64) {
+	WorkerPoolQueueWait.WithLabelValues(class).Observe(seconds)
+}
+
+// RecordQueueRejected records a job rejected by a full class queue
+func RecordQueueRejected(class string) {
+	WorkerPoolRejected.WithLabelValues(class).Inc()
+}
+
+// UpdateWorkerCount updates the number of worker pool goroutines
+func UpdateWorkerCount(n int) {
+	WorkerPoolWorkers.Set(float64(n))
+}
+
+// UpdateMemoryReserved updates the memory reserved by running jobs
+func UpdateMemoryReserved(bytes int64) {
+	WorkerPoolMemoryReserved.Set(float64(bytes))
+}
+
 // RecordRateLimitExceeded records a rate limit rejection
 func RecordRateLimitExceeded(ipPrefix string) {
 	RateLimitExceeded.WithLabelValues(ipPrefix).Inc()
@@ -143,6 +297,40 @@ func RecordConcurrencyLimitExceeded() {
 	ConcurrencyLimitExceeded.Inc()
 }
 
+// RecordCostCharged records tokens charged by the cost limiter
+func RecordCostCharged(tokens float64) {
+	CostCharged.Add(tokens)
+}
+
+// RecordCostLimitExceeded records a cost limit rejection
+func RecordCostLimitExceeded() {
+	CostLimitExceeded.Inc()
+}
+
+// RecordLoadShed records a request rejected by adaptive load shedding
+func RecordLoadShed(cost string) {
+	LoadShed.WithLabelValues(cost).Inc()
+}
+
+// RecordIPBlocked records a request rejected by the IP filter or a ban
+func RecordIPBlocked(reason string) {
+	IPBlocked.WithLabelValues(reason).Inc()
+}
+
+// RecordAbuseBan records a client banned for abuse
+func RecordAbuseBan() {
+	AbuseBans.Inc()
+}
+
+// UpdateAdmissionShedding records whether adaptive admission is shedding
+func UpdateAdmissionShedding(shedding bool) {
+	if shedding {
+		AdmissionShedding.Set(1)
+	} else {
+		AdmissionShedding.Set(0)
+	}
+}
+
 // RecordPoolHit records a buffer pool hit
 func RecordPoolHit(size string) {
 	MemoryPoolHits.WithLabelValues(size).Inc()
@@ -152,3 +340,17 @@ func RecordPoolHit(size string) {
 func RecordPoolMiss(size string) {
 	MemoryPoolMisses.WithLabelValues(size).Inc()
 }
+
+// RecordCacheLookup records a conversion cache hit or miss
+func RecordCacheLookup(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	CacheLookups.WithLabelValues(result).Inc()
+}
+
+// UpdateCacheSize updates the size of a cache backend
+func UpdateCacheSize(backend string, bytes int64) {
+	CacheSize.WithLabelValues(backend).Set(float64(bytes))
+}
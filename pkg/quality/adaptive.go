@@ -14,13 +14,23 @@ const (
 // ZERO iterations - uses pure mathematical estimation for maximum speed.
 func FindOptimalQuality(img image.Image, targetSizeKB int) (int, error) {
 	// Pure mathematical estimation - no encoding iterations
-	return estimateQualitySinglePass(img, targetSizeKB), nil
+	return estimateQualitySinglePass(img, targetSizeKB, 1), nil
+}
+
+// FindOptimalQualityWithRatio is FindOptimalQuality for encoder settings
+// whose output is sizeRatio times the size of a baseline JPEG at the same
+// quality (see jpeg.Options.SizeRatio). Smaller outputs allow a higher quality.
+func FindOptimalQualityWithRatio(img image.Image, targetSizeKB int, sizeRatio float64) (int, error) {
+	if sizeRatio <= 0 {
+		sizeRatio = 1
+	}
+	return estimateQualitySinglePass(img, targetSizeKB, sizeRatio), nil
 }
 
 // estimateQualitySinglePass calculates quality in a single pass
 // using image dimensions and target size without any encoding.
 // This is the fastest possible approach for quality estimation.
-func estimateQualitySinglePass(img image.Image, targetSizeKB int) int {
+func estimateQualitySinglePass(img image.Image, targetSizeKB int, sizeRatio float64) int {
 	bounds := img.Bounds()
 	width := bounds.Dx()
 	height := bounds.Dy()
@@ -36,7 +46,7 @@ func estimateQualitySinglePass(img image.Image, targetSizeKB int) int {
 	// Compression factor varies by content type
 	// 0.15 = typical for photos, 0.25 = simple graphics
 	// Use conservative 0.18 for mixed content
-	compressionFactor := 0.18
+	compressionFactor := 0.18 * sizeRatio
 
 	// Calculate quality using inverse square law
 	// This accounts for JPEG's non-linear quality-to-size relationship
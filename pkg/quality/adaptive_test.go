@@ -140,3 +140,20 @@ func BenchmarkEncodeSize(b *testing.B) {
 		encodeSize(img, 85)
 	}
 }
+
+func TestFindOptimalQualityWithRatio(t *testing.T) {
+	img := createTestImage(1920, 1080)
+
+	base, _ := FindOptimalQuality(img, 300)
+	same, _ := FindOptimalQualityWithRatio(img, 300, 1)
+	if same != base {
+		t.Errorf("ratio 1 gave quality %d, want %d", same, base)
+	}
+	smaller, _ := FindOptimalQualityWithRatio(img, 300, 0.75)
+	if smaller <= base {
+		t.Errorf("smaller output ratio should allow higher quality: %d <= %d", smaller, base)
+	}
+	if q, _ := FindOptimalQualityWithRatio(img, 300, 0); q != base {
+		t.Errorf("invalid ratio should be ignored: got %d, want %d", q, base)
+	}
+}
@@ -0,0 +1,56 @@
+// Package webp encodes WebP images with libwebp. YCbCr images are handed to
+// the encoder as YUV 4:2:0 planes, skipping the RGBA conversion that
+// dominates encoding time with RGBA-only bindings.
+package webp
+
+import "fmt"
+
+// Encoder effort, libwebp's "method"
+const (
+	MinMethod     = 0 // fastest
+	DefaultMethod = 4 // libwebp's default
+	MaxMethod     = 6 // slowest, smallest output
+)
+
+// Options are the WebP encoder settings
+type Options struct {
+	// Quality is the lossy quality, or the compression effort of lossless
+	// encoding, from 0 to 100
+	Quality float32
+	// Method trades encoding speed for output size, from MinMethod to MaxMethod
+	Method int
+	// SharpYUV uses libwebp's iterative RGB to YUV conversion, which keeps
+	// sharper color edges. It needs RGB input, so YCbCr images are
+	// converted to RGBA first.
+	SharpYUV bool
+	// Lossless encodes the image losslessly
+	Lossless bool
+	// NearLossless enables lossless encoding with pixel preprocessing for a
+	// smaller file, from 1 (strongest) to 100 (none). 0 disables it.
+	NearLossless int
+}
+
+// Validate reports whether the options are in range
+func (o *Options) Validate() error {
+	if o.Quality < 0 || o.Quality > 100 {
+		return fmt.Errorf("webp: quality %v out of range 0-100", o.Quality)
+	}
+	if o.Method < MinMethod || o.Method > MaxMethod {
+		return fmt.Errorf("webp: method %d out of range %d-%d", o.Method, MinMethod, MaxMethod)
+	}
+	if o.NearLossless < 0 || o.NearLossless > 100 {
+		return fmt.Errorf("webp: near-lossless level %d out of range 0-100", o.NearLossless)
+	}
+	return nil
+}
+
+// lossless reports whether the options select lossless encoding
+func (o *Options) lossless() bool {
+	return o.Lossless || o.NearLossless > 0
+}
+
+// NeedsRGB reports whether the options need RGB samples (sharp YUV and
+// lossless encoding), so YCbCr planes cannot be encoded directly
+func (o *Options) NeedsRGB() bool {
+	return o.SharpYUV || o.lossless()
+}
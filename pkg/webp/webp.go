@@ -0,0 +1,291 @@
+package webp
+
+/*
+#cgo CFLAGS: -I${SRCDIR}/internal/libwebp
+#include <stdlib.h>
+#include <webp/encode.h>
+
+// Fill in an encoder configuration; returns 0 if it is invalid
+static int setup_config(WebPConfig *config, float quality, int method,
+                        int sharp_yuv, int lossless, int near_lossless) {
+    if (!WebPConfigInit(config)) {
+        return 0;
+    }
+    config->quality = quality;
+    config->method = method;
+    config->use_sharp_yuv = sharp_yuv;
+    if (lossless) {
+        config->lossless = 1;
+        config->near_lossless = near_lossless;
+    }
+    return WebPValidateConfig(config);
+}
+
+// Encode a prepared picture into memory and release it. On success *out
+// must be freed with WebPFree; on failure the encoder error code is returned.
+static int encode_picture(const WebPConfig *config, WebPPicture *pic,
+                          uint8_t **out, size_t *out_size) {
+    WebPMemoryWriter wr;
+    WebPMemoryWriterInit(&wr);
+    pic->writer = WebPMemoryWrite;
+    pic->custom_ptr = &wr;
+
+    int ok = WebPEncode(config, pic);
+    int err = pic->error_code;
+    WebPPictureFree(pic);
+    if (!ok) {
+        WebPMemoryWriterClear(&wr);
+        return err != VP8_ENC_OK ? err : VP8_ENC_ERROR_BAD_WRITE;
+    }
+    *out = wr.mem;
+    *out_size = wr.size;
+    return VP8_ENC_OK;
+}
+
+// Encode limited range YUV 4:2:0 planes without any color conversion
+static int encode_yuv(const uint8_t *y, const uint8_t *u, const uint8_t *v,
+                      int width, int height, int y_stride, int uv_stride,
+                      float quality, int method, uint8_t **out, size_t *out_size) {
+    WebPConfig config;
+    WebPPicture pic;
+    if (!setup_config(&config, quality, method, 0, 0, 0)) {
+        return VP8_ENC_ERROR_INVALID_CONFIGURATION;
+    }
+    if (!WebPPictureInit(&pic)) {
+        return VP8_ENC_ERROR_INVALID_CONFIGURATION;
+    }
+    pic.use_argb = 0;
+    pic.colorspace = WEBP_YUV420;
+    pic.width = width;
+    pic.height = height;
+    // The planes stay owned by the caller; WebPPictureFree leaves them alone
+    pic.y = (uint8_t *)y;
+    pic.u = (uint8_t *)u;
+    pic.v = (uint8_t *)v;
+    pic.y_stride = y_stride;
+    pic.uv_stride = uv_stride;
+    return encode_picture(&config, &pic, out, out_size);
+}
+
+// Encode non-premultiplied RGBA pixels. The picture is imported as ARGB so
+// that WebPEncode picks the RGB to YUV conversion (sharp or not) itself.
+static int encode_rgba(const uint8_t *rgba, int width, int height, int stride,
+                       float quality, int method, int sharp_yuv, int lossless,
+                       int near_lossless, uint8_t **out, size_t *out_size) {
+    WebPConfig config;
+    WebPPicture pic;
+    if (!setup_config(&config, quality, method, sharp_yuv, lossless, near_lossless)) {
+        return VP8_ENC_ERROR_INVALID_CONFIGURATION;
+    }
+    if (!WebPPictureInit(&pic)) {
+        return VP8_ENC_ERROR_INVALID_CONFIGURATION;
+    }
+    pic.use_argb = 1;
+    pic.width = width;
+    pic.height = height;
+    if (!WebPPictureImportRGBA(&pic, rgba, stride)) {
+        WebPPictureFree(&pic);
+        return VP8_ENC_ERROR_OUT_OF_MEMORY;
+    }
+    return encode_picture(&config, &pic, out, out_size);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"math"
+	"unsafe"
+
+	turbojpeg "github.com/harliandi/go-heif/pkg/jpeg"
+
+	// libwebp itself is compiled into chai2010/webp; only the headers are
+	// vendored in internal/libwebp
+	_ "github.com/chai2010/webp"
+)
+
+var errEmptyImage = errors.New("webp: empty image")
+
+// encodingErrors are the messages of libwebp's WebPEncodingError codes
+var encodingErrors = [...]string{
+	C.VP8_ENC_ERROR_OUT_OF_MEMORY:           "out of memory",
+	C.VP8_ENC_ERROR_BITSTREAM_OUT_OF_MEMORY: "out of memory flushing bits",
+	C.VP8_ENC_ERROR_NULL_PARAMETER:          "missing parameter",
+	C.VP8_ENC_ERROR_INVALID_CONFIGURATION:   "invalid configuration",
+	C.VP8_ENC_ERROR_BAD_DIMENSION:           "bad picture dimension",
+	C.VP8_ENC_ERROR_PARTITION0_OVERFLOW:     "partition 0 overflow",
+	C.VP8_ENC_ERROR_PARTITION_OVERFLOW:      "partition overflow",
+	C.VP8_ENC_ERROR_BAD_WRITE:               "write error",
+	C.VP8_ENC_ERROR_FILE_TOO_BIG:            "file too big",
+	C.VP8_ENC_ERROR_USER_ABORT:              "aborted",
+}
+
+// defaultOptions are used when Encode is called without options
+var defaultOptions = Options{Quality: 75, Method: DefaultMethod}
+
+// Go's image.YCbCr is full range (JFIF) while WebP stores BT.601 limited
+// range samples, so plane samples are mapped through these tables
+var lumaRange, chromaRange [256]uint8
+
+func init() {
+	for i := range 256 {
+		lumaRange[i] = uint8(16 + math.Round(float64(i)*219/255))
+		chromaRange[i] = uint8(128 + math.Round(float64(i-128)*224/255))
+	}
+}
+
+// Encode writes img to w as WebP. YCbCr images are encoded straight from
+// their planes unless opts asks for sharp YUV or lossless encoding.
+func Encode(w io.Writer, img image.Image, opts *Options) error {
+	if opts == nil {
+		opts = &defaultOptions
+	}
+	var data []byte
+	var err error
+	if ycc, ok := img.(*image.YCbCr); ok && !opts.NeedsRGB() {
+		data, err = EncodeYCbCr(ycc, opts)
+	} else {
+		data, err = EncodeRGBA(img, opts)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// EncodeYCbCr encodes a YCbCr image lossily from its planes. Chroma that is
+// not 4:2:0 is resampled first; sharp YUV and lossless options are rejected.
+func EncodeYCbCr(img *image.YCbCr, opts *Options) ([]byte, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.NeedsRGB() {
+		return nil, errors.New("webp: sharp YUV and lossless encoding need RGBA input")
+	}
+	r := img.Rect
+	w, h := r.Dx(), r.Dy()
+	if w <= 0 || h <= 0 {
+		return nil, errEmptyImage
+	}
+
+	src := turbojpeg.Resample(img, image.YCbCrSubsampleRatio420)
+	if src != img {
+		r = src.Rect
+	}
+	cw, ch := (w+1)/2, (h+1)/2
+	y := make([]byte, w*h)
+	cb := make([]byte, cw*ch)
+	cr := make([]byte, cw*ch)
+	for row := 0; row < h; row++ {
+		mapRange(y[row*w:][:w], src.Y[src.YOffset(r.Min.X, r.Min.Y+row):], &lumaRange)
+	}
+	for row := 0; row < ch; row++ {
+		off := src.COffset(r.Min.X, r.Min.Y+2*row)
+		mapRange(cb[row*cw:][:cw], src.Cb[off:], &chromaRange)
+		mapRange(cr[row*cw:][:cw], src.Cr[off:], &chromaRange)
+	}
+
+	var out *C.uint8_t
+	var size C.size_t
+	code := C.encode_yuv(
+		(*C.uint8_t)(unsafe.Pointer(&y[0])), (*C.uint8_t)(unsafe.Pointer(&cb[0])), (*C.uint8_t)(unsafe.Pointer(&cr[0])),
+		C.int(w), C.int(h), C.int(w), C.int(cw),
+		C.float(opts.Quality), C.int(opts.Method), &out, &size)
+	return encodeResult(code, out, size)
+}
+
+// EncodeRGBA encodes any image through libwebp's RGBA import, converting
+// it to non-premultiplied RGBA if needed
+func EncodeRGBA(img image.Image, opts *Options) ([]byte, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	if b.Empty() {
+		return nil, errEmptyImage
+	}
+	pix, stride := rgbaPixels(img)
+
+	var out *C.uint8_t
+	var size C.size_t
+	code := C.encode_rgba(
+		(*C.uint8_t)(unsafe.Pointer(&pix[0])), C.int(b.Dx()), C.int(b.Dy()), C.int(stride),
+		C.float(opts.Quality), C.int(opts.Method), cBool(opts.SharpYUV), cBool(opts.lossless()),
+		C.int(nearLosslessLevel(opts.NearLossless)), &out, &size)
+	return encodeResult(code, out, size)
+}
+
+// ToRGBA converts an image to RGBA, using image/draw's fast paths for the
+// common source types
+func ToRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Rect, img, b.Min, draw.Src)
+	return rgba
+}
+
+// rgbaPixels returns the non-premultiplied RGBA pixels of img, starting at
+// its top-left corner
+func rgbaPixels(img image.Image) (pix []byte, stride int) {
+	b := img.Bounds()
+	switch src := img.(type) {
+	case *image.NRGBA:
+		return src.Pix[src.PixOffset(b.Min.X, b.Min.Y):], src.Stride
+	case *image.RGBA:
+		// Premultiplied and straight alpha only agree for opaque images
+		if src.Opaque() {
+			return src.Pix[src.PixOffset(b.Min.X, b.Min.Y):], src.Stride
+		}
+	case *image.YCbCr:
+		rgba := ToRGBA(img)
+		return rgba.Pix, rgba.Stride
+	}
+	nrgba := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(nrgba, nrgba.Rect, img, b.Min, draw.Src)
+	return nrgba.Pix, nrgba.Stride
+}
+
+// mapRange maps len(dst) samples of src through table
+func mapRange(dst, src []byte, table *[256]uint8) {
+	src = src[:len(dst)]
+	for i, v := range src {
+		dst[i] = table[v]
+	}
+}
+
+// nearLosslessLevel converts NearLossless to libwebp's setting, where 100
+// means no preprocessing
+func nearLosslessLevel(level int) int {
+	if level == 0 {
+		return 100
+	}
+	return level
+}
+
+func cBool(b bool) C.int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// encodeResult copies libwebp's output into Go memory and frees it
+func encodeResult(code C.int, out *C.uint8_t, size C.size_t) ([]byte, error) {
+	if code != C.VP8_ENC_OK {
+		msg := "unknown error"
+		if int(code) < len(encodingErrors) && encodingErrors[code] != "" {
+			msg = encodingErrors[code]
+		}
+		return nil, fmt.Errorf("webp: encoding failed: %s", msg)
+	}
+	defer C.WebPFree(unsafe.Pointer(out))
+	return C.GoBytes(unsafe.Pointer(out), C.int(size)), nil
+}
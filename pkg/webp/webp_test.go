@@ -0,0 +1,260 @@
+package webp
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	chaiwebp "github.com/chai2010/webp"
+)
+
+// testPattern builds a photo-like YCbCr image: gradients, a checkerboard and
+// colored edges
+func testPattern(w, h int, ratio image.YCbCrSubsampleRatio) *image.YCbCr {
+	img := image.NewYCbCr(image.Rect(0, 0, w, h), ratio)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := 40 + 170*x/max(w-1, 1)
+			if (x/16+y/16)%2 == 0 {
+				v += 20
+			}
+			img.Y[img.YOffset(x, y)] = uint8(v)
+			off := img.COffset(x, y)
+			img.Cb[off] = uint8(64 + 128*x/max(w, 1))
+			img.Cr[off] = uint8(200 - y%128)
+		}
+	}
+	return img
+}
+
+// psnr compares the RGB values of two images of the same size
+func psnr(t testing.TB, a, b image.Image) float64 {
+	t.Helper()
+	ab, bb := a.Bounds(), b.Bounds()
+	if ab.Size() != bb.Size() {
+		t.Fatalf("size mismatch: %v vs %v", ab, bb)
+	}
+	var sum float64
+	for y := 0; y < ab.Dy(); y++ {
+		for x := 0; x < ab.Dx(); x++ {
+			r1, g1, b1, _ := a.At(ab.Min.X+x, ab.Min.Y+y).RGBA()
+			r2, g2, b2, _ := b.At(bb.Min.X+x, bb.Min.Y+y).RGBA()
+			for _, d := range []float64{
+				float64(r1>>8) - float64(r2>>8),
+				float64(g1>>8) - float64(g2>>8),
+				float64(b1>>8) - float64(b2>>8),
+			} {
+				sum += d * d
+			}
+		}
+	}
+	mse := sum / float64(3*ab.Dx()*ab.Dy())
+	if mse == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255/mse)
+}
+
+func encode(t testing.TB, img image.Image, opts *Options) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, opts); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func decode(t testing.TB, data []byte) image.Image {
+	t.Helper()
+	img, err := chaiwebp.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("output is not valid WebP: %v", err)
+	}
+	return img
+}
+
+func TestOptionsValidate(t *testing.T) {
+	valid := []Options{
+		{},
+		{Quality: 100, Method: MaxMethod, SharpYUV: true},
+		{Quality: 80, Method: DefaultMethod, NearLossless: 60},
+	}
+	for _, o := range valid {
+		if err := o.Validate(); err != nil {
+			t.Errorf("%+v: unexpected error %v", o, err)
+		}
+	}
+	invalid := []Options{
+		{Quality: -1},
+		{Quality: 101},
+		{Method: -1},
+		{Method: MaxMethod + 1},
+		{NearLossless: 101},
+	}
+	for _, o := range invalid {
+		if err := o.Validate(); err == nil {
+			t.Errorf("%+v: expected error", o)
+		}
+	}
+}
+
+// TestEncodeYCbCr checks that the plane path decodes to the same picture as
+// libwebp's own RGBA conversion for every subsampling and odd sizes
+func TestEncodeYCbCr(t *testing.T) {
+	ratios := []image.YCbCrSubsampleRatio{
+		image.YCbCrSubsampleRatio420,
+		image.YCbCrSubsampleRatio444,
+		image.YCbCrSubsampleRatio422,
+		image.YCbCrSubsampleRatio440,
+	}
+	opts := &Options{Quality: 90, Method: DefaultMethod}
+	for _, ratio := range ratios {
+		for _, size := range []struct{ w, h int }{{256, 128}, {333, 257}, {17, 9}} {
+			t.Run(fmt.Sprintf("%v/%dx%d", ratio, size.w, size.h), func(t *testing.T) {
+				src := testPattern(size.w, size.h, ratio)
+				direct, err := EncodeYCbCr(src, opts)
+				if err != nil {
+					t.Fatalf("EncodeYCbCr failed: %v", err)
+				}
+				viaRGBA, err := EncodeRGBA(src, opts)
+				if err != nil {
+					t.Fatalf("EncodeRGBA failed: %v", err)
+				}
+				directPSNR := psnr(t, src, decode(t, direct))
+				rgbaPSNR := psnr(t, src, decode(t, viaRGBA))
+				t.Logf("PSNR direct=%.1fdB rgba=%.1fdB, %d vs %d bytes", directPSNR, rgbaPSNR, len(direct), len(viaRGBA))
+				if directPSNR < 30 || directPSNR < rgbaPSNR-1.5 {
+					t.Errorf("direct PSNR %.1fdB too low (rgba %.1fdB)", directPSNR, rgbaPSNR)
+				}
+			})
+		}
+	}
+}
+
+// TestEncodeYCbCr_SubImage checks that cropped images are encoded from
+// their own origin
+func TestEncodeYCbCr_SubImage(t *testing.T) {
+	src := testPattern(320, 240, image.YCbCrSubsampleRatio420)
+	for _, r := range []image.Rectangle{image.Rect(64, 32, 256, 160), image.Rect(33, 17, 150, 99)} {
+		sub := src.SubImage(r).(*image.YCbCr)
+		got := decode(t, encode(t, sub, &Options{Quality: 90, Method: DefaultMethod}))
+		if p := psnr(t, sub, got); p < 30 {
+			t.Errorf("%v: PSNR %.1fdB too low for cropped image", r, p)
+		}
+	}
+}
+
+func TestEncode_Options(t *testing.T) {
+	src := testPattern(160, 120, image.YCbCrSubsampleRatio420)
+	lossy := encode(t, src, &Options{Quality: 80, Method: DefaultMethod})
+
+	t.Run("method", func(t *testing.T) {
+		fast := encode(t, src, &Options{Quality: 80, Method: MinMethod})
+		slow := encode(t, src, &Options{Quality: 80, Method: MaxMethod})
+		if bytes.Equal(fast, slow) {
+			t.Error("method has no effect")
+		}
+		decode(t, fast)
+		decode(t, slow)
+	})
+	t.Run("sharp yuv", func(t *testing.T) {
+		sharp := encode(t, src, &Options{Quality: 80, Method: DefaultMethod, SharpYUV: true})
+		if bytes.Equal(sharp, lossy) {
+			t.Error("sharp YUV has no effect")
+		}
+		if p := psnr(t, src, decode(t, sharp)); p < 30 {
+			t.Errorf("PSNR %.1fdB too low", p)
+		}
+	})
+	t.Run("lossless", func(t *testing.T) {
+		rgba := ToRGBA(src)
+		got := decode(t, encode(t, rgba, &Options{Quality: 50, Method: DefaultMethod, Lossless: true}))
+		if p := psnr(t, rgba, got); !math.IsInf(p, 1) {
+			t.Errorf("lossless output differs from the input (PSNR %.1fdB)", p)
+		}
+	})
+	t.Run("near lossless", func(t *testing.T) {
+		got := decode(t, encode(t, src, &Options{Quality: 50, Method: DefaultMethod, NearLossless: 40}))
+		if p := psnr(t, ToRGBA(src), got); p < 40 {
+			t.Errorf("PSNR %.1fdB too low for near-lossless", p)
+		}
+	})
+	t.Run("alpha", func(t *testing.T) {
+		img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+		for i := range 32 {
+			img.SetNRGBA(i, i, color.NRGBA{200, 100, 50, uint8(i * 8)})
+		}
+		got, err := chaiwebp.DecodeRGBA(encode(t, img, &Options{Quality: 90, Method: DefaultMethod, Lossless: true}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// DecodeRGBA returns straight alpha despite the image type, and
+		// libwebp may drop the color of fully transparent pixels
+		for i := 1; i < 32; i++ {
+			p := got.Pix[got.PixOffset(i, i):]
+			if c := (color.NRGBA{p[0], p[1], p[2], p[3]}); c != img.NRGBAAt(i, i) {
+				t.Fatalf("pixel %d: got %v, want %v", i, c, img.NRGBAAt(i, i))
+			}
+		}
+	})
+}
+
+func TestEncode_Errors(t *testing.T) {
+	src := testPattern(16, 16, image.YCbCrSubsampleRatio420)
+	if err := Encode(&bytes.Buffer{}, src, &Options{Quality: 200}); err == nil {
+		t.Error("expected error for invalid options")
+	}
+	if err := Encode(&bytes.Buffer{}, image.NewYCbCr(image.Rect(0, 0, 0, 0), image.YCbCrSubsampleRatio420), nil); err == nil {
+		t.Error("expected error for empty image")
+	}
+	if _, err := EncodeYCbCr(src, &Options{Lossless: true}); err == nil {
+		t.Error("expected EncodeYCbCr to reject lossless encoding")
+	}
+}
+
+// BenchmarkEncode compares the per-pixel RGBA copy the converter used to
+// do, image/draw's RGBA conversion and direct plane encoding on a 12MP image
+func BenchmarkEncode(b *testing.B) {
+	img := testPattern(4000, 3000, image.YCbCrSubsampleRatio420)
+	opts := &Options{Quality: 80, Method: DefaultMethod}
+
+	b.Run("per-pixel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			rgba := image.NewRGBA(img.Bounds())
+			for y := rgba.Rect.Min.Y; y < rgba.Rect.Max.Y; y++ {
+				for x := rgba.Rect.Min.X; x < rgba.Rect.Max.X; x++ {
+					rgba.Set(x, y, img.At(x, y))
+				}
+			}
+			if err := chaiwebp.Encode(&bytes.Buffer{}, rgba, &chaiwebp.Options{Quality: opts.Quality}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("rgba", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := EncodeRGBA(img, opts); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("ycbcr", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := EncodeYCbCr(img, opts); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkToRGBA measures the YCbCr to RGBA conversion alone
+func BenchmarkToRGBA(b *testing.B) {
+	img := testPattern(4000, 3000, image.YCbCrSubsampleRatio420)
+	b.SetBytes(int64(len(img.Y)))
+	for i := 0; i < b.N; i++ {
+		ToRGBA(img)
+	}
+}